@@ -0,0 +1,636 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// 外部工具调用接口使用的密钥，只读密钥不能修改数据
+type APIKey struct {
+	Name     string `json:"name"` // 调用方名称，写入审计日志
+	Key      string `json:"key"`
+	ReadOnly bool   `json:"read_only"`
+}
+
+const (
+	apiDefaultPageSize = 20
+	apiMaxPageSize     = 100
+)
+
+// 分页结果
+type apiPage struct {
+	Items    interface{} `json:"items"`
+	Page     int         `json:"page"`
+	PageSize int         `json:"page_size"`
+	Total    int         `json:"total"`
+}
+
+type apiTradeItem struct {
+	ID          int     `json:"id"`
+	Seller      string  `json:"seller"`
+	ItemName    string  `json:"item_name"`
+	Description string  `json:"description"`
+	Price       float64 `json:"price"`
+	Quantity    int     `json:"quantity"`
+	Category    string  `json:"category"`
+	Tags        string  `json:"tags"`
+	MarketGroup string  `json:"market_group"`
+	Status      string  `json:"status"`
+	UpdatedAt   string  `json:"updated_at"`
+}
+
+type apiRechargeCode struct {
+	Code       string  `json:"code"`
+	Amount     float64 `json:"amount"`
+	Status     string  `json:"status"`
+	Payer      string  `json:"payer"`
+	TransferID string  `json:"transfer_id"`
+	CreatedAt  string  `json:"created_at"`
+	UsedAt     string  `json:"used_at"`
+}
+
+type apiWallet struct {
+	Account   string  `json:"account"`
+	Balance   float64 `json:"balance"`
+	UpdatedAt string  `json:"updated_at"`
+}
+
+type apiWalletEntry struct {
+	ID           int     `json:"id"`
+	Account      string  `json:"account"`
+	Amount       float64 `json:"amount"`
+	BalanceAfter float64 `json:"balance_after"`
+	EntryType    string  `json:"entry_type"`
+	RefType      string  `json:"ref_type"`
+	RefID        int     `json:"ref_id"`
+	Memo         string  `json:"memo"`
+	CreatedAt    string  `json:"created_at"`
+}
+
+type apiHistoryEntry struct {
+	CreatedAt string `json:"created_at"`
+	OrderType string `json:"order_type"`
+	GameID    string `json:"game_id"`
+	StarCost  int    `json:"star_cost"`
+	Stars     int    `json:"stars"`
+	FinalRank string `json:"final_rank"`
+	IsActive  bool   `json:"is_active"`
+}
+
+// 在后台网页服务上注册 /api/ 接口，没有配置密钥时不开放
+func registerAPIRoutes(mux *http.ServeMux, db *sql.DB) bool {
+	if len(config.APIKeys) == 0 {
+		return false
+	}
+	mux.HandleFunc("/api/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "openapi.yaml")
+	})
+	mux.HandleFunc("/api/", func(w http.ResponseWriter, r *http.Request) {
+		key := authenticateAPIKey(r)
+		if key == nil {
+			writeJSONError(w, http.StatusUnauthorized, "缺少或无效的 API 密钥")
+			return
+		}
+		if r.Method != http.MethodGet && key.ReadOnly {
+			writeJSONError(w, http.StatusForbidden, "只读密钥不能修改数据")
+			return
+		}
+		routeAPIRequest(w, r, db, key)
+	})
+	return true
+}
+
+// 密钥通过 Authorization: Bearer <key> 传入
+func authenticateAPIKey(r *http.Request) *APIKey {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if token == "" {
+		return nil
+	}
+	for i := range config.APIKeys {
+		if config.APIKeys[i].Key != "" && subtle.ConstantTimeCompare([]byte(token), []byte(config.APIKeys[i].Key)) == 1 {
+			return &config.APIKeys[i]
+		}
+	}
+	return nil
+}
+
+func routeAPIRequest(w http.ResponseWriter, r *http.Request, db *sql.DB, key *APIKey) {
+	parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/api/"), "/"), "/")
+	route := fmt.Sprintf("%s %s", r.Method, parts[0])
+	if len(parts) > 1 {
+		route += " :id"
+	}
+	if len(parts) > 2 {
+		route += " " + parts[2]
+	}
+
+	switch route {
+	case "GET trade-items":
+		apiListTradeItems(w, r, db)
+	case "GET trade-items :id":
+		apiGetTradeItem(w, db, parts[1])
+	case "PATCH trade-items :id":
+		apiUpdateTradeItem(w, r, db, key, parts[1])
+	case "GET orders":
+		apiListOrders(w, r, db)
+	case "GET orders :id":
+		apiGetOrder(w, db, parts[1])
+	case "POST orders :id cancel":
+		apiCancelOrder(w, r, db, key, parts[1])
+	case "POST orders :id complete":
+		apiCompleteOrder(w, r, db, key, parts[1])
+	case "GET recharge-codes":
+		apiListRechargeCodes(w, r, db)
+	case "GET recharge-codes :id":
+		apiGetRechargeCode(w, db, parts[1])
+	case "POST recharge-codes :id void":
+		apiVoidRechargeCode(w, r, db, key, parts[1])
+	case "GET wallets":
+		apiListWallets(w, r, db)
+	case "GET wallets :id":
+		apiGetWallet(w, db, parts[1])
+	case "GET wallets :id entries":
+		apiListWalletEntries(w, r, db, parts[1])
+	case "POST wallets :id adjust":
+		apiAdjustWallet(w, r, db, key, parts[1])
+	case "GET history":
+		apiListHistory(w, r, db)
+	default:
+		writeJSONError(w, http.StatusNotFound, "接口不存在")
+	}
+}
+
+// 列表查询条件，只拼接固定的列名，取值都用占位符
+type apiFilter struct {
+	where []string
+	args  []interface{}
+}
+
+func (f *apiFilter) add(clause string, value string) {
+	if value == "" {
+		return
+	}
+	f.where = append(f.where, clause)
+	f.args = append(f.args, value)
+}
+
+func (f *apiFilter) sql() string {
+	if len(f.where) == 0 {
+		return ""
+	}
+	return " WHERE " + strings.Join(f.where, " AND ")
+}
+
+func apiPagination(r *http.Request) (int, int) {
+	page, _ := strconv.Atoi(r.URL.Query().Get("page"))
+	if page < 1 {
+		page = 1
+	}
+	size, _ := strconv.Atoi(r.URL.Query().Get("page_size"))
+	if size < 1 {
+		size = apiDefaultPageSize
+	}
+	if size > apiMaxPageSize {
+		size = apiMaxPageSize
+	}
+	return page, size
+}
+
+// 执行分页查询，scan 把每一行转换为返回的对象
+func apiQueryPage(w http.ResponseWriter, r *http.Request, db *sql.DB, selectSQL, fromSQL, orderBy string, f *apiFilter,
+	scan func(*sql.Rows) (interface{}, error)) {
+	page, size := apiPagination(r)
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) "+fromSQL+f.sql(), f.args...).Scan(&total); err != nil {
+		log.Printf("接口查询失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+
+	args := append(append([]interface{}{}, f.args...), size, (page-1)*size)
+	rows, err := db.Query(selectSQL+" "+fromSQL+f.sql()+" ORDER BY "+orderBy+" LIMIT ? OFFSET ?", args...)
+	if err != nil {
+		log.Printf("接口查询失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	defer rows.Close()
+
+	items := []interface{}{}
+	for rows.Next() {
+		item, err := scan(rows)
+		if err != nil {
+			log.Printf("接口读取数据失败: %v\n", err)
+			continue
+		}
+		items = append(items, item)
+	}
+	writeJSON(w, http.StatusOK, apiPage{Items: items, Page: page, PageSize: size, Total: total})
+}
+
+const apiTradeItemSelect = `SELECT id, seller, item_name, IFNULL(description, ''), price, quantity, category, tags, market_group, status, updated_at`
+
+func scanAPITradeItem(row interface{ Scan(...interface{}) error }) (interface{}, error) {
+	var item apiTradeItem
+	err := row.Scan(&item.ID, &item.Seller, &item.ItemName, &item.Description, &item.Price, &item.Quantity,
+		&item.Category, &item.Tags, &item.MarketGroup, &item.Status, &item.UpdatedAt)
+	return item, err
+}
+
+func apiListTradeItems(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	q := r.URL.Query()
+	f := &apiFilter{}
+	f.add("status = ?", q.Get("status"))
+	f.add("seller = ?", q.Get("seller"))
+	f.add("category = ?", q.Get("category"))
+	f.add("market_group = ?", q.Get("market_group"))
+	if keyword := q.Get("keyword"); keyword != "" {
+		f.add("(item_name LIKE ? OR tags LIKE ?)", "%"+keyword+"%")
+		f.args = append(f.args, "%"+keyword+"%")
+	}
+	apiQueryPage(w, r, db, apiTradeItemSelect, "FROM trade_items", "id DESC", f, func(rows *sql.Rows) (interface{}, error) {
+		return scanAPITradeItem(rows)
+	})
+}
+
+func apiGetTradeItem(w http.ResponseWriter, db *sql.DB, id string) {
+	item, err := scanAPITradeItem(db.QueryRow(apiTradeItemSelect+` FROM trade_items WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "交易品不存在")
+		return
+	}
+	if err != nil {
+		log.Printf("接口查询交易品失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	writeJSON(w, http.StatusOK, item)
+}
+
+// 修改交易品的价格、数量、描述或状态，修改前后的值写入审计日志
+func apiUpdateTradeItem(w http.ResponseWriter, r *http.Request, db *sql.DB, key *APIKey, id string) {
+	var req struct {
+		Price       *float64 `json:"price"`
+		Quantity    *int     `json:"quantity"`
+		Description *string  `json:"description"`
+		Status      *string  `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "请求格式错误")
+		return
+	}
+
+	var sets []string
+	var args []interface{}
+	if req.Price != nil {
+		if *req.Price <= 0 {
+			writeJSONError(w, http.StatusBadRequest, "价格必须大于 0")
+			return
+		}
+		sets, args = append(sets, "price = ?"), append(args, *req.Price)
+	}
+	if req.Quantity != nil {
+		if *req.Quantity < 0 {
+			writeJSONError(w, http.StatusBadRequest, "数量不能为负数")
+			return
+		}
+		sets, args = append(sets, "quantity = ?"), append(args, *req.Quantity)
+	}
+	if req.Description != nil {
+		sets, args = append(sets, "description = ?"), append(args, *req.Description)
+	}
+	if req.Status != nil {
+		switch *req.Status {
+		case tradeItemOnSale, tradeItemDelisted, tradeItemExpired:
+		default:
+			writeJSONError(w, http.StatusBadRequest, "状态只能是在售、已下架或已过期")
+			return
+		}
+		sets, args = append(sets, "status = ?", "expiry_reminded = 0"), append(args, *req.Status)
+	}
+	if len(sets) == 0 {
+		writeJSONError(w, http.StatusBadRequest, "没有需要修改的字段")
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "修改失败")
+		return
+	}
+	defer tx.Rollback()
+
+	before, err := scanAPITradeItem(tx.QueryRow(apiTradeItemSelect+` FROM trade_items WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "交易品不存在")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "修改失败")
+		return
+	}
+	sets = append(sets, "updated_at = datetime('now')")
+	if _, err := tx.Exec(`UPDATE trade_items SET `+strings.Join(sets, ", ")+` WHERE id = ?`, append(args, id)...); err != nil {
+		log.Printf("接口修改交易品失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "修改失败")
+		return
+	}
+	after, err := scanAPITradeItem(tx.QueryRow(apiTradeItemSelect+` FROM trade_items WHERE id = ?`, id))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "修改失败")
+		return
+	}
+	beforeJSON, _ := json.Marshal(before)
+	afterJSON, _ := json.Marshal(after)
+	if err := writeAuditLog(tx, "api:"+key.Name, "修改交易品", "交易品"+id+"号", string(beforeJSON), string(afterJSON), ""); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "修改失败")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "修改失败")
+		return
+	}
+	writeJSON(w, http.StatusOK, after)
+}
+
+func apiListOrders(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	q := r.URL.Query()
+	f := &apiFilter{}
+	f.add("status = ?", q.Get("status"))
+	f.add("seller = ?", q.Get("seller"))
+	f.add("buyer = ?", q.Get("buyer"))
+	f.add("item_id = ?", q.Get("item_id"))
+	f.add("created_at >= ?", q.Get("since"))
+	f.add("created_at < ?", q.Get("until"))
+	apiQueryPage(w, r, db, "SELECT "+tradeOrderColumns, "FROM trade_orders", "id DESC", f, func(rows *sql.Rows) (interface{}, error) {
+		return scanTradeOrder(rows)
+	})
+}
+
+func apiGetOrder(w http.ResponseWriter, db *sql.DB, id string) {
+	order, err := scanTradeOrder(db.QueryRow(`SELECT `+tradeOrderColumns+` FROM trade_orders WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "订单不存在")
+		return
+	}
+	if err != nil {
+		log.Printf("接口查询订单失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// 取消待付款的订单，已使用的优惠码一并作废
+func apiCancelOrder(w http.ResponseWriter, r *http.Request, db *sql.DB, key *APIKey, id string) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+	orderID, _ := strconv.Atoi(id)
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE trade_orders SET status = ?, updated_at = datetime('now') WHERE id = ? AND status = ?`,
+		orderCancelled, orderID, orderPending)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusConflict, "订单不存在或不是待付款状态")
+		return
+	}
+	if err := voidCouponRedemption(tx, "trade_order", orderID); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	if err := writeAuditLog(tx, "api:"+key.Name, "取消订单", fmt.Sprintf("交易单%d号", orderID), orderPending, orderCancelled, req.Reason); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	order, err := scanTradeOrder(tx.QueryRow(`SELECT `+tradeOrderColumns+` FROM trade_orders WHERE id = ?`, orderID))
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	if err := emitOrderStatusChanged(tx, order, orderPending); err != nil {
+		log.Printf("接口取消订单失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "取消失败")
+		return
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+// 代买家确认收货：已付款的订单完成并结算给卖家
+func apiCompleteOrder(w http.ResponseWriter, r *http.Request, db *sql.DB, key *APIKey, id string) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	order, err := scanTradeOrder(db.QueryRow(`SELECT `+tradeOrderColumns+` FROM trade_orders WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "订单不存在")
+		return
+	}
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "完成订单失败")
+		return
+	}
+	if order.Status != orderPaid {
+		writeJSONError(w, http.StatusConflict, "只有已付款的订单可以完成")
+		return
+	}
+	if err := completeTradeOrder(db, order); err != nil {
+		log.Printf("接口完成订单失败: %v\n", err)
+		writeJSONError(w, http.StatusConflict, "完成订单失败："+err.Error())
+		return
+	}
+	if err := writeAuditLog(db, "api:"+key.Name, "完成订单", fmt.Sprintf("交易单%d号", order.ID), orderPaid, orderCompleted, req.Reason); err != nil {
+		log.Printf("写入审计日志失败: %v\n", err)
+	}
+	writeJSON(w, http.StatusOK, order)
+}
+
+const apiRechargeCodeSelect = `SELECT recharge_code, amount, used, payer, transfer_id, created_at, used_at`
+
+func scanAPIRechargeCode(row interface{ Scan(...interface{}) error }) (interface{}, error) {
+	var c apiRechargeCode
+	var used int
+	if err := row.Scan(&c.Code, &c.Amount, &used, &c.Payer, &c.TransferID, &c.CreatedAt, &c.UsedAt); err != nil {
+		return nil, err
+	}
+	c.Status = rechargeCodeStatusText(used)
+	return c, nil
+}
+
+// 兑换码状态按中文名称过滤：未使用、已使用、已作废、退款审核中
+func apiListRechargeCodes(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	q := r.URL.Query()
+	f := &apiFilter{}
+	if status := q.Get("status"); status != "" {
+		used := -1
+		for _, s := range []int{codeUnused, codeUsed, codeVoided, codeRefunding} {
+			if rechargeCodeStatusText(s) == status {
+				used = s
+			}
+		}
+		f.add("used = ?", strconv.Itoa(used))
+	}
+	f.add("payer = ?", q.Get("payer"))
+	f.add("created_at >= ?", q.Get("since"))
+	f.add("created_at < ?", q.Get("until"))
+	apiQueryPage(w, r, db, apiRechargeCodeSelect, "FROM recharge_records", "id DESC", f, func(rows *sql.Rows) (interface{}, error) {
+		return scanAPIRechargeCode(rows)
+	})
+}
+
+func apiGetRechargeCode(w http.ResponseWriter, db *sql.DB, code string) {
+	c, err := scanAPIRechargeCode(db.QueryRow(apiRechargeCodeSelect+` FROM recharge_records WHERE recharge_code = ?`, code))
+	if err == sql.ErrNoRows {
+		writeJSONError(w, http.StatusNotFound, "兑换码不存在")
+		return
+	}
+	if err != nil {
+		log.Printf("接口查询兑换码失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	writeJSON(w, http.StatusOK, c)
+}
+
+// 作废未使用的兑换码，和管理员的“作废码”命令一样记审计日志
+func apiVoidRechargeCode(w http.ResponseWriter, r *http.Request, db *sql.DB, key *APIKey, code string) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	json.NewDecoder(r.Body).Decode(&req)
+
+	tx, err := db.Begin()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "作废失败")
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE recharge_records SET used = ? WHERE recharge_code = ? AND used = ?`, codeVoided, code, codeUnused)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "作废失败")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		writeJSONError(w, http.StatusConflict, "兑换码不存在或不是未使用状态")
+		return
+	}
+	if err := writeAuditLog(tx, "api:"+key.Name, "作废码", code, rechargeCodeStatusText(codeUnused), rechargeCodeStatusText(codeVoided), req.Reason); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "作废失败")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		writeJSONError(w, http.StatusInternalServerError, "作废失败")
+		return
+	}
+	apiGetRechargeCode(w, db, code)
+}
+
+func apiListWallets(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	f := &apiFilter{}
+	f.add("account = ?", r.URL.Query().Get("account"))
+	apiQueryPage(w, r, db, "SELECT account, balance, updated_at", "FROM wallets", "balance DESC", f, func(rows *sql.Rows) (interface{}, error) {
+		var wallet apiWallet
+		err := rows.Scan(&wallet.Account, &wallet.Balance, &wallet.UpdatedAt)
+		return wallet, err
+	})
+}
+
+func apiGetWallet(w http.ResponseWriter, db *sql.DB, account string) {
+	wallet := apiWallet{Account: account}
+	err := db.QueryRow(`SELECT balance, updated_at FROM wallets WHERE account = ?`, account).Scan(&wallet.Balance, &wallet.UpdatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("接口查询钱包失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	writeJSON(w, http.StatusOK, wallet)
+}
+
+// 调整用户钱包余额，正数补星、负数扣星，和管理员命令一样记在流水里，对方是平台账户
+func apiAdjustWallet(w http.ResponseWriter, r *http.Request, db *sql.DB, key *APIKey, account string) {
+	var req struct {
+		Amount float64 `json:"amount"`
+		Reason string  `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "请求格式错误")
+		return
+	}
+	amount := roundCents(req.Amount)
+	if amount == 0 {
+		writeJSONError(w, http.StatusBadRequest, "调整金额不能为 0")
+		return
+	}
+	if account == platformAccount {
+		writeJSONError(w, http.StatusBadRequest, "不能直接调整平台账户")
+		return
+	}
+	action := "补星"
+	if amount < 0 {
+		action = "扣星"
+	}
+	if _, _, err := adjustWalletByAdmin(db, "api:"+key.Name, action, account, amount, req.Reason); err != nil {
+		log.Printf("接口调整钱包失败: %v\n", err)
+		writeJSONError(w, http.StatusConflict, err.Error())
+		return
+	}
+	apiGetWallet(w, db, account)
+}
+
+func apiListWalletEntries(w http.ResponseWriter, r *http.Request, db *sql.DB, account string) {
+	q := r.URL.Query()
+	f := &apiFilter{}
+	f.add("account = ?", account)
+	f.add("entry_type = ?", q.Get("entry_type"))
+	f.add("created_at >= ?", q.Get("since"))
+	f.add("created_at < ?", q.Get("until"))
+	apiQueryPage(w, r, db, "SELECT id, account, amount, balance_after, entry_type, ref_type, ref_id, memo, created_at", "FROM wallet_entries", "id DESC", f,
+		func(rows *sql.Rows) (interface{}, error) {
+			var e apiWalletEntry
+			err := rows.Scan(&e.ID, &e.Account, &e.Amount, &e.BalanceAfter, &e.EntryType, &e.RefType, &e.RefID, &e.Memo, &e.CreatedAt)
+			return e, err
+		})
+}
+
+// 上分订单历史，和私聊“我的历史”读取同一张表
+func apiListHistory(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	q := r.URL.Query()
+	if q.Get("nick") == "" {
+		writeJSONError(w, http.StatusBadRequest, "缺少 nick 参数")
+		return
+	}
+	f := &apiFilter{}
+	f.add("GroupUserNickName = ?", q.Get("nick"))
+	f.add("OrderType = ?", q.Get("order_type"))
+	apiQueryPage(w, r, db, "SELECT CreatedAt, OrderType, GameID, StarCost, Stars, FinalRank, IsActive", "FROM Bridges", "CreatedAt DESC", f,
+		func(rows *sql.Rows) (interface{}, error) {
+			var h apiHistoryEntry
+			err := rows.Scan(&h.CreatedAt, &h.OrderType, &h.GameID, &h.StarCost, &h.Stars, &h.FinalRank, &h.IsActive)
+			return h, err
+		})
+}
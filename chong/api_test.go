@@ -0,0 +1,94 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// 用测试数据库和一把可写密钥启动 /api/ 接口
+func newTestAPIServer(t *testing.T) (*httptest.Server, *sql.DB) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.APIKeys = []APIKey{{Name: "测试", Key: "secret"}}
+
+	db := newTestDB(t)
+	mux := http.NewServeMux()
+	if !registerAPIRoutes(mux, db) {
+		t.Fatal("配置了密钥时应开放接口")
+	}
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	return server, db
+}
+
+func apiRequest(t *testing.T, server *httptest.Server, method, path, body string) (int, map[string]interface{}) {
+	t.Helper()
+	req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	req.Header.Set("Authorization", "Bearer secret")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("请求%s失败: %v", path, err)
+	}
+	defer resp.Body.Close()
+	var result map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&result)
+	return resp.StatusCode, result
+}
+
+func TestAPIHistoryOnFreshDatabase(t *testing.T) {
+	server, _ := newTestAPIServer(t)
+	status, result := apiRequest(t, server, http.MethodGet, "/api/history?nick=%E5%B0%8F%E6%98%8E", "")
+	if status != http.StatusOK || result["total"] != float64(0) {
+		t.Fatalf("新数据库查询历史应返回空列表，得到 %d %v", status, result)
+	}
+}
+
+func TestAPIOrderAndWalletActions(t *testing.T) {
+	server, db := newTestAPIServer(t)
+	item := addTestTradeItem(t, db, "卖家", 50, 2)
+	pending, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	paid, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	addTestRechargeCode(t, db, "3001", 50)
+	if err := payTradeOrder(db, paid, "3001", "买家"); err != nil {
+		t.Fatalf("付款失败: %v", err)
+	}
+
+	if status, result := apiRequest(t, server, http.MethodPost, "/api/orders/"+strconv.Itoa(pending.ID)+"/cancel", `{"reason":"买家放弃"}`); status != http.StatusOK || result["status"] != orderCancelled {
+		t.Fatalf("取消待付款订单失败: %d %v", status, result)
+	}
+	if status, _ := apiRequest(t, server, http.MethodPost, "/api/orders/"+strconv.Itoa(paid.ID)+"/cancel", `{}`); status != http.StatusConflict {
+		t.Fatalf("已付款订单不能取消，得到 %d", status)
+	}
+	if status, result := apiRequest(t, server, http.MethodPost, "/api/orders/"+strconv.Itoa(paid.ID)+"/complete", `{}`); status != http.StatusOK || result["status"] != orderCompleted {
+		t.Fatalf("完成订单失败: %d %v", status, result)
+	}
+	income, _ := getWalletBalance(db, "卖家")
+	if income <= 0 {
+		t.Fatal("完成订单后卖家应有交易收入")
+	}
+
+	if status, result := apiRequest(t, server, http.MethodPost, "/api/wallets/%E5%8D%96%E5%AE%B6/adjust", `{"amount":-1000}`); status != http.StatusConflict {
+		t.Fatalf("扣成负数应失败，得到 %d %v", status, result)
+	}
+	status, result := apiRequest(t, server, http.MethodPost, "/api/wallets/%E5%8D%96%E5%AE%B6/adjust", `{"amount":10,"reason":"补偿"}`)
+	if status != http.StatusOK || result["balance"] != roundCents(income+10) {
+		t.Fatalf("补星后余额应为%.2f，得到 %d %v", income+10, status, result)
+	}
+	var logs int
+	db.QueryRow(`SELECT COUNT(*) FROM admin_audit_logs WHERE admin = 'api:测试'`).Scan(&logs)
+	if logs != 3 {
+		t.Fatalf("应记录3条审计日志，实际为%d", logs)
+	}
+}
@@ -0,0 +1,441 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 打手登记表，max_orders 为 0 时使用 config.json 的 booster_max_orders
+func initBoosterTables(db *sql.DB) {
+	createBoostersTableSQL := `
+	CREATE TABLE IF NOT EXISTS boosters (
+		nick TEXT PRIMARY KEY,
+		max_orders INTEGER NOT NULL DEFAULT 0,
+		active BOOLEAN NOT NULL DEFAULT 1,
+		added_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createBoostersTableSQL); err != nil {
+		log.Fatalf("创建 boosters 表失败: %s\n", err)
+	}
+	// 机器人给打手设置的备注名，昵称谁都能改，打手命令按备注名认人
+	addColumnIfMissing(db, "boosters", "remark", "TEXT NOT NULL DEFAULT ''")
+	// 接单的打手和接单时间，超时没有进度时清空重新派单
+	addColumnIfMissing(db, "Bridges", "Booster", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "Bridges", "ClaimedAt", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "Bridges", "LastProgressAt", "TEXT NOT NULL DEFAULT ''")
+}
+
+// 按备注名找到登记的打手，返回登记时的昵称；没有备注名或没登记时返回空字符串
+func boosterByRemark(db *sql.DB, remark string) string {
+	if remark == "" {
+		return ""
+	}
+	var nick string
+	if err := db.QueryRow(`SELECT nick FROM boosters WHERE remark = ? AND active = 1`, remark).Scan(&nick); err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("查询打手失败: %v\n", err)
+		}
+		return ""
+	}
+	return nick
+}
+
+// 机器人给用户设置的备注名。群消息里的发送者没有备注名，按 UserName 到好友列表里找
+func friendRemark(self *openwechat.Self, user *openwechat.User) string {
+	if user.RemarkName != "" {
+		return user.RemarkName
+	}
+	friends, err := self.Friends()
+	if err != nil {
+		log.Printf("获取好友列表失败: %v\n", err)
+		return ""
+	}
+	if friend := friends.SearchByUserName(1, user.UserName).First(); friend != nil {
+		return friend.RemarkName
+	}
+	return ""
+}
+
+// 发送者是已登记的打手时返回登记的昵称
+func verifiedBooster(db *sql.DB, self *openwechat.Self, user *openwechat.User) string {
+	return boosterByRemark(db, friendRemark(self, user))
+}
+
+// 管理员可以更新任何订单，打手只能更新自己接的单
+func canUpdateBridge(db *sql.DB, operator string, id int) bool {
+	if isAdmin(operator) {
+		return true
+	}
+	var booster string
+	if err := db.QueryRow(`SELECT Booster FROM Bridges WHERE rowid = ?`, id).Scan(&booster); err != nil {
+		return false
+	}
+	return booster != "" && booster == operator
+}
+
+// 在打手群里发布待接的订单，没有配置打手群时只通知管理员
+func announceBridge(self *openwechat.Self, bridge *Bridge, title string) {
+	text := fmt.Sprintf("%s%d号：%s %s %d星，发送“接单%d号”接单。", title, bridge.ID, bridge.OrderType, bridge.GameID, bridge.TargetStars, bridge.ID)
+	if config.BoosterGroup == "" {
+		notifyAdmins(self, text)
+		return
+	}
+	groups, err := self.Groups()
+	if err != nil {
+		log.Printf("获取群组列表失败: %v\n", err)
+		return
+	}
+	group := groups.SearchByNickName(1, config.BoosterGroup).First()
+	if group == nil {
+		log.Printf("未找到打手群 [%s]\n", config.BoosterGroup)
+		notifyAdmins(self, text)
+		return
+	}
+	if _, err := group.SendText(text); err != nil {
+		log.Printf("发布上星订单%d号到打手群失败: %v\n", bridge.ID, err)
+	}
+}
+
+var (
+	addBoosterRe    = regexp.MustCompile(`^添加打手\s*([^，]+?)(?:，(\d+))?$`)
+	removeBoosterRe = regexp.MustCompile(`^移除打手\s*(.+)$`)
+	claimBridgeRe   = regexp.MustCompile(`^接单(\d+)号$`)
+)
+
+func isBoosterAdminCommand(content string) bool {
+	return content == "打手列表" || addBoosterRe.MatchString(content) || removeBoosterRe.MatchString(content)
+}
+
+// 管理员打手命令：添加打手 昵称[，同时接单上限]、移除打手 昵称、打手列表
+func handleBoosterAdmin(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	switch {
+	case msg.Content == "打手列表":
+		listBoosters(msg, db)
+
+	case addBoosterRe.MatchString(msg.Content):
+		matches := addBoosterRe.FindStringSubmatch(msg.Content)
+		nick := strings.TrimSpace(matches[1])
+		maxOrders, _ := strconv.Atoi(matches[2])
+		friends, err := self.Friends()
+		if err != nil {
+			msg.ReplyText("获取好友列表时发生错误，请稍后重试。")
+			return
+		}
+		matched := friends.SearchByNickName(2, nick)
+		if matched.Count() != 1 {
+			msg.ReplyText(fmt.Sprintf("找到%d个昵称为%s的好友，打手需要是机器人唯一的同名好友。", matched.Count(), nick))
+			return
+		}
+		remark := matched.First().RemarkName
+		if remark == "" {
+			msg.ReplyText(fmt.Sprintf("请先在机器人微信里给%s设置备注名，再添加为打手。", nick))
+			return
+		}
+		if err := addBooster(db, admin, nick, remark, maxOrders); err != nil {
+			msg.ReplyText(fmt.Sprintf("添加打手失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("已添加打手%s（备注名%s），同时最多接%d单。", nick, remark, boosterLimit(maxOrders)))
+
+	case removeBoosterRe.MatchString(msg.Content):
+		nick := strings.TrimSpace(removeBoosterRe.FindStringSubmatch(msg.Content)[1])
+		requeued, err := removeBooster(db, admin, nick)
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("移除打手失败：%v", err))
+			return
+		}
+		if len(requeued) == 0 {
+			msg.ReplyText(fmt.Sprintf("已移除打手%s。", nick))
+			return
+		}
+		ids := make([]string, len(requeued))
+		for i, id := range requeued {
+			ids[i] = fmt.Sprintf("%d号", id)
+			if bridge, err := getBridge(db, id); err == nil {
+				announceBridge(self, bridge, "重新派单：上星订单")
+			}
+		}
+		msg.ReplyText(fmt.Sprintf("已移除打手%s，其进行中的上星订单%s已退回待接队列重新派单，已上的星数保留。", nick, strings.Join(ids, "、")))
+	}
+}
+
+// 登记打手并记下备注名，同一个备注名只能对应一个打手
+func addBooster(db *sql.DB, admin, nick, remark string, maxOrders int) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var other string
+	err = tx.QueryRow(`SELECT nick FROM boosters WHERE remark = ? AND nick != ? AND active = 1`, remark, nick).Scan(&other)
+	if err == nil {
+		return fmt.Errorf("备注名%s已经登记给打手%s", remark, other)
+	}
+	if err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO boosters (nick, max_orders, active, added_by, remark) VALUES (?, ?, 1, ?, ?)
+	ON CONFLICT(nick) DO UPDATE SET max_orders = excluded.max_orders, active = 1, remark = excluded.remark`, nick, maxOrders, admin, remark); err != nil {
+		return err
+	}
+	if err := writeAuditLog(tx, admin, "添加打手", nick, "", fmt.Sprintf("%s，上限%d单", remark, boosterLimit(maxOrders)), ""); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 移除打手后其不能再更新进度，进行中的订单在同一个事务里退回待接队列
+func removeBooster(db *sql.DB, admin, nick string) ([]int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE boosters SET active = 0 WHERE nick = ? AND active = 1`, nick)
+	if err != nil {
+		log.Printf("移除打手失败: %v\n", err)
+		return nil, fmt.Errorf("请稍后重试")
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("%s不是打手", nick)
+	}
+
+	rows, err := tx.Query(`SELECT rowid FROM Bridges WHERE Booster = ? AND IsActive = 1 ORDER BY rowid`, nick)
+	if err != nil {
+		return nil, err
+	}
+	var requeued []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		requeued = append(requeued, id)
+	}
+	rows.Close()
+
+	if _, err := tx.Exec(`UPDATE Bridges SET Booster = '', ClaimedAt = '', UpdatedAt = datetime('now')
+	WHERE Booster = ? AND IsActive = 1`, nick); err != nil {
+		return nil, err
+	}
+	for _, id := range requeued {
+		if err := writeAuditLog(tx, admin, "移除打手重新派单", fmt.Sprintf("上星订单%d号", id), nick, "", ""); err != nil {
+			return nil, err
+		}
+	}
+	if err := writeAuditLog(tx, admin, "移除打手", nick, "", "", ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return requeued, nil
+}
+
+func boosterLimit(maxOrders int) int {
+	if maxOrders > 0 {
+		return maxOrders
+	}
+	return config.BoosterMaxOrders
+}
+
+func listBoosters(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT b.nick, b.max_orders,
+	(SELECT COUNT(*) FROM Bridges WHERE Booster = b.nick AND IsActive = 1)
+	FROM boosters b WHERE b.active = 1 ORDER BY b.nick`)
+	if err != nil {
+		msg.ReplyText("获取打手列表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var nick string
+		var maxOrders, working int
+		if err := rows.Scan(&nick, &maxOrders, &working); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("%s：进行中%d/%d单\n", nick, working, boosterLimit(maxOrders)))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("还没有登记打手，发送“添加打手 [昵称]”添加。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+func isBoosterCommand(content string) bool {
+	return content == "待接单" || content == "我的接单" || claimBridgeRe.MatchString(content) ||
+		bridgeProgressRe.MatchString(content) || closeBridgeRe.MatchString(content)
+}
+
+// 打手命令：待接单、接单N号、我的接单，以及自己所接订单的进度和结单
+func handleBoosterCommand(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, booster string) {
+	switch {
+	case msg.Content == "待接单":
+		listBridgeQueue(msg, db)
+
+	case msg.Content == "我的接单":
+		listBoosterBridges(msg, db, booster)
+
+	case claimBridgeRe.MatchString(msg.Content):
+		id, _ := strconv.Atoi(claimBridgeRe.FindStringSubmatch(msg.Content)[1])
+		bridge, err := claimBridge(db, id, booster)
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("接单失败：%v", err))
+			return
+		}
+		reply := fmt.Sprintf("%s已接上星订单%d号：%s %s %d星。", booster, id, bridge.OrderType, bridge.GameID, bridge.TargetStars)
+		if config.BridgeClaimTimeoutHours > 0 {
+			reply += fmt.Sprintf("请在%d小时内发送“进度%d号，[已上星数][，段位]”更新进度，否则会重新派单。", config.BridgeClaimTimeoutHours, id)
+		}
+		msg.ReplyText(reply)
+		sendTextToNickName(self, bridge.User, fmt.Sprintf("您的上星订单%d号已有打手接单，开始上星。", id))
+
+	case bridgeProgressRe.MatchString(msg.Content):
+		handleBridgeProgress(msg, db, self, booster)
+
+	case closeBridgeRe.MatchString(msg.Content):
+		handleCloseBridge(msg, db, self, booster)
+	}
+}
+
+// 接单时检查同时进行的单数，订单只能被一个打手接走
+func claimBridge(db *sql.DB, id int, booster string) (*Bridge, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var maxOrders, working int
+	if err := tx.QueryRow(`SELECT max_orders FROM boosters WHERE nick = ? AND active = 1`, booster).Scan(&maxOrders); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("您不是打手")
+		}
+		return nil, err
+	}
+	if err := tx.QueryRow(`SELECT COUNT(*) FROM Bridges WHERE Booster = ? AND IsActive = 1`, booster).Scan(&working); err != nil {
+		return nil, err
+	}
+	if limit := boosterLimit(maxOrders); working >= limit {
+		return nil, fmt.Errorf("您已有%d个进行中的订单，达到上限%d单", working, limit)
+	}
+
+	result, err := tx.Exec(`UPDATE Bridges SET Booster = ?, ClaimedAt = datetime('now'), LastProgressAt = '', UpdatedAt = datetime('now')
+	WHERE rowid = ? AND IsActive = 1 AND Booster = ''`, booster, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("上星订单%d号不存在、已结束或已被接走", id)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return getBridge(db, id)
+}
+
+func listBridgeQueue(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT rowid, OrderType, GameID, TargetStars FROM Bridges WHERE IsActive = 1 AND Booster = '' ORDER BY rowid`)
+	if err != nil {
+		msg.ReplyText("获取待接订单时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var b Bridge
+		if err := rows.Scan(&b.ID, &b.OrderType, &b.GameID, &b.TargetStars); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("上星订单%d号：%s %s %d星\n", b.ID, b.OrderType, b.GameID, b.TargetStars))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("当前没有待接的上星订单。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n") + "\n发送“接单N号”接单。")
+}
+
+func listBoosterBridges(msg *openwechat.Message, db *sql.DB, booster string) {
+	rows, err := db.Query(`SELECT rowid FROM Bridges WHERE Booster = ? AND IsActive = 1 ORDER BY rowid`, booster)
+	if err != nil {
+		msg.ReplyText("获取接单列表时发生错误，请稍后重试。")
+		return
+	}
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	rows.Close()
+
+	var response strings.Builder
+	for _, id := range ids {
+		if bridge, err := getBridge(db, id); err == nil {
+			response.WriteString(bridge.progressText() + "\n")
+		}
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("您当前没有进行中的订单。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+// 接单或上次更新进度后超过 bridge_claim_timeout_hours 没有进度的订单退回待接队列
+func requeueStaleBridges(db *sql.DB, self *openwechat.Self) {
+	rows, err := db.Query(`SELECT rowid, Booster FROM Bridges
+	WHERE IsActive = 1 AND Booster != '' AND MAX(ClaimedAt, LastProgressAt) < datetime('now', ?)`,
+		fmt.Sprintf("-%d hours", config.BridgeClaimTimeoutHours))
+	if err != nil {
+		log.Printf("查询超时的上星订单失败: %v\n", err)
+		return
+	}
+	type staleBridge struct {
+		id      int
+		booster string
+	}
+	var stale []staleBridge
+	for rows.Next() {
+		var s staleBridge
+		if err := rows.Scan(&s.id, &s.booster); err == nil {
+			stale = append(stale, s)
+		}
+	}
+	rows.Close()
+
+	for _, s := range stale {
+		result, err := db.Exec(`UPDATE Bridges SET Booster = '', ClaimedAt = '', UpdatedAt = datetime('now')
+		WHERE rowid = ? AND Booster = ? AND IsActive = 1`, s.id, s.booster)
+		if err != nil {
+			log.Printf("上星订单%d号重新派单失败: %v\n", s.id, err)
+			continue
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		writeAuditLog(db, "[系统]", "超时重新派单", fmt.Sprintf("上星订单%d号", s.id), s.booster, "", "")
+		if err := sendTextToNickName(self, s.booster, fmt.Sprintf("上星订单%d号超过%d小时没有更新进度，已重新派单。", s.id, config.BridgeClaimTimeoutHours)); err != nil {
+			log.Printf("通知打手 [%s] 失败: %v\n", s.booster, err)
+		}
+		if bridge, err := getBridge(db, s.id); err == nil {
+			announceBridge(self, bridge, "重新派单：上星订单")
+		}
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import "testing"
+
+func TestRemoveBoosterRequeuesClaimedBridges(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	if err := addBooster(db, "管理员", "打手", "打手-阿强", 0); err != nil {
+		t.Fatalf("添加打手失败: %v", err)
+	}
+	if _, err := claimBridge(db, bridge.ID, "打手"); err != nil {
+		t.Fatalf("接单失败: %v", err)
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 3, "", "打手"); err != nil {
+		t.Fatalf("更新进度失败: %v", err)
+	}
+
+	requeued, err := removeBooster(db, "管理员", "打手")
+	if err != nil {
+		t.Fatalf("移除打手失败: %v", err)
+	}
+	if len(requeued) != 1 || requeued[0] != bridge.ID {
+		t.Fatalf("应退回订单%d号，实际为%v", bridge.ID, requeued)
+	}
+	if boosterByRemark(db, "打手-阿强") != "" || canUpdateBridge(db, "打手", bridge.ID) {
+		t.Fatal("移除后的打手不应再能更新订单")
+	}
+	got, err := getBridge(db, bridge.ID)
+	if err != nil || got.Stars != 3 || !got.IsActive {
+		t.Fatalf("重新派单应保留进度: %+v %v", got, err)
+	}
+	if _, err := removeBooster(db, "管理员", "打手"); err == nil {
+		t.Fatal("重复移除应失败")
+	}
+}
+
+// 打手按机器人设置的备注名认人，改成打手的昵称不能冒充
+func TestBoosterIdentifiedByRemark(t *testing.T) {
+	db := newTestDB(t)
+	if err := addBooster(db, "管理员", "打手", "打手-阿强", 2); err != nil {
+		t.Fatalf("添加打手失败: %v", err)
+	}
+	if nick := boosterByRemark(db, "打手-阿强"); nick != "打手" {
+		t.Fatalf("应按备注名找到打手，得到%q", nick)
+	}
+	for _, remark := range []string{"", "打手", "别人"} {
+		if nick := boosterByRemark(db, remark); nick != "" {
+			t.Fatalf("备注名%q不应认成打手%s", remark, nick)
+		}
+	}
+	// 同一个备注名不能登记给两个打手
+	if err := addBooster(db, "管理员", "冒充者", "打手-阿强", 0); err == nil {
+		t.Fatal("备注名已被占用时应添加失败")
+	}
+	var logs int
+	db.QueryRow(`SELECT COUNT(*) FROM admin_audit_logs WHERE action = '添加打手'`).Scan(&logs)
+	if logs != 1 {
+		t.Fatalf("应记录1条添加打手的审计日志，实际为%d", logs)
+	}
+}
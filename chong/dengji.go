@@ -0,0 +1,190 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 会员等级，按累计兑换的充值码金额划分
+type VIPTier struct {
+	Name           string  `json:"name"`
+	MinSpent       float64 `json:"min_spent"`       // 累计兑换达到多少元升到该等级
+	BonusRate      float64 `json:"bonus_rate"`      // 兑换充值码时额外赠送的星卷比例
+	BridgeDiscount float64 `json:"bridge_discount"` // 上星订单的星卷折扣比例
+}
+
+// 没有达到任何等级时的默认等级
+var baseTier = VIPTier{Name: "普通会员"}
+
+// redeemed_by 记录兑换人；早期的充值码没有兑换人，按付款人计算
+func initTierTables(db *sql.DB) {
+	addColumnIfMissing(db, "recharge_records", "redeemed_by", "TEXT NOT NULL DEFAULT ''")
+	// 上次通知用户时的等级，用来判断等级是否变化
+	createMemberTiersTableSQL := `
+	CREATE TABLE IF NOT EXISTS member_tiers (
+		nick TEXT PRIMARY KEY,
+		tier TEXT NOT NULL,
+		updated_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createMemberTiersTableSQL); err != nil {
+		log.Fatalf("创建 member_tiers 表失败: %s\n", err)
+	}
+	seedMemberTiers(db)
+}
+
+// 按当前累计兑换金额补齐还没有记录的会员等级。上线等级功能或调整 vip_tiers 后，
+// 老用户下次兑换时不会收到“从普通会员变为…”的通知
+func seedMemberTiers(db *sql.DB) {
+	rows, err := db.Query(`SELECT COALESCE(NULLIF(redeemed_by, ''), payer) AS nick, SUM(amount) FROM recharge_records
+	WHERE used = ? GROUP BY nick`, codeUsed)
+	if err != nil {
+		log.Fatalf("统计会员累计兑换金额失败: %s\n", err)
+	}
+	spent := make(map[string]float64)
+	for rows.Next() {
+		var nick sql.NullString
+		var amount float64
+		if err := rows.Scan(&nick, &amount); err != nil {
+			log.Fatalf("统计会员累计兑换金额失败: %s\n", err)
+		}
+		if nick.String != "" {
+			spent[nick.String] = roundCents(amount)
+		}
+	}
+	rows.Close()
+
+	for nick, amount := range spent {
+		if _, err := db.Exec(`INSERT OR IGNORE INTO member_tiers (nick, tier) VALUES (?, ?)`, nick, tierForSpent(amount).Name); err != nil {
+			log.Fatalf("初始化 member_tiers 失败: %s\n", err)
+		}
+	}
+}
+
+// 累计兑换金额，退款作废的充值码不计入
+func memberSpent(db sqlQueryRower, nick string) (float64, error) {
+	var spent float64
+	err := db.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM recharge_records
+	WHERE used = ? AND COALESCE(NULLIF(redeemed_by, ''), payer) = ?`, codeUsed, nick).Scan(&spent)
+	return roundCents(spent), err
+}
+
+// 按门槛从高到低排好的等级
+func sortedTiers() []VIPTier {
+	tiers := append([]VIPTier(nil), config.VIPTiers...)
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].MinSpent > tiers[j].MinSpent })
+	return tiers
+}
+
+func tierForSpent(spent float64) VIPTier {
+	for _, tier := range sortedTiers() {
+		if spent >= tier.MinSpent {
+			return tier
+		}
+	}
+	return baseTier
+}
+
+// 下一个等级，已是最高等级时返回 false
+func nextTier(spent float64) (VIPTier, bool) {
+	tiers := sortedTiers()
+	for i := len(tiers) - 1; i >= 0; i-- {
+		if tiers[i].MinSpent > spent {
+			return tiers[i], true
+		}
+	}
+	return VIPTier{}, false
+}
+
+func memberTier(db sqlQueryRower, nick string) VIPTier {
+	spent, err := memberSpent(db, nick)
+	if err != nil {
+		log.Printf("查询 [%s] 累计兑换金额失败: %v\n", nick, err)
+		return baseTier
+	}
+	return tierForSpent(spent)
+}
+
+// 兑换充值码时按兑换前的等级赠送星卷，由平台账户支出
+func postTierBonus(tx *sql.Tx, account string, amount, spentBefore float64, code string) (float64, error) {
+	tier := tierForSpent(spentBefore)
+	bonus := roundCents(amount * tier.BonusRate)
+	if bonus <= 0 {
+		return 0, nil
+	}
+	memo := fmt.Sprintf("%s兑换码%s奖励%.0f%%", tier.Name, code, tier.BonusRate*100)
+	if _, err := postWalletEntry(tx, account, bonus, "等级奖励", "recharge_code", 0, memo); err != nil {
+		return 0, err
+	}
+	if _, err := postWalletEntry(tx, platformAccount, -bonus, "等级奖励支出", "recharge_code", 0, account+" "+memo); err != nil {
+		return 0, err
+	}
+	return bonus, nil
+}
+
+// 兑换后检查等级是否变化，变化时私聊通知用户
+func checkTierChange(db *sql.DB, self *openwechat.Self, nick string) {
+	current := memberTier(db, nick)
+	var previous string
+	err := db.QueryRow(`SELECT tier FROM member_tiers WHERE nick = ?`, nick).Scan(&previous)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("查询 [%s] 会员等级失败: %v\n", nick, err)
+		return
+	}
+	if err == sql.ErrNoRows {
+		previous = baseTier.Name
+	}
+	if previous == current.Name {
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO member_tiers (nick, tier, updated_at) VALUES (?, ?, datetime('now'))
+	ON CONFLICT(nick) DO UPDATE SET tier = excluded.tier, updated_at = excluded.updated_at`, nick, current.Name); err != nil {
+		log.Printf("保存 [%s] 会员等级失败: %v\n", nick, err)
+		return
+	}
+	text := fmt.Sprintf("您的会员等级已从%s变为%s。", previous, current.Name)
+	if benefits := tierBenefits(current); benefits != "" {
+		text += "当前权益：" + benefits + "。"
+	}
+	if err := sendTextToNickName(self, nick, text); err != nil {
+		log.Printf("通知 [%s] 等级变化失败: %v\n", nick, err)
+	}
+}
+
+// 等级权益的文字说明，没有权益时返回空字符串
+func tierBenefits(tier VIPTier) string {
+	var benefits []string
+	if tier.BonusRate > 0 {
+		benefits = append(benefits, fmt.Sprintf("兑换充值码额外赠送%.0f%%星卷", tier.BonusRate*100))
+	}
+	if tier.BridgeDiscount > 0 {
+		benefits = append(benefits, fmt.Sprintf("上星订单优惠%.0f%%", tier.BridgeDiscount*100))
+	}
+	return strings.Join(benefits, "，")
+}
+
+// 处理 "我的等级" 命令
+func handleMyTier(msg *openwechat.Message, db *sql.DB, nick string) {
+	spent, err := memberSpent(db, nick)
+	if err != nil {
+		msg.ReplyText("获取会员等级时发生错误，请稍后重试。")
+		return
+	}
+	tier := tierForSpent(spent)
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("会员等级：%s\n累计兑换：%.2f元", tier.Name, spent))
+	if benefits := tierBenefits(tier); benefits != "" {
+		response.WriteString("\n当前权益：" + benefits)
+	}
+	if next, ok := nextTier(spent); ok {
+		response.WriteString(fmt.Sprintf("\n再兑换%.2f元升级为%s", next.MinSpent-spent, next.Name))
+		if benefits := tierBenefits(next); benefits != "" {
+			response.WriteString("，可享" + benefits)
+		}
+	}
+	msg.ReplyText(response.String())
+}
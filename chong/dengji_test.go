@@ -0,0 +1,27 @@
+package main
+
+import "testing"
+
+func TestSeedMemberTiersForExistingUsers(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.VIPTiers = []VIPTier{{Name: "白银会员", MinSpent: 500, BonusRate: 0.02}}
+
+	db := newTestDB(t)
+	addTestRechargeCode(t, db, "111111", 600)
+	addTestRechargeCode(t, db, "222222", 100)
+	if _, err := db.Exec(`UPDATE recharge_records SET used = 1, payer = '老用户' WHERE recharge_code = '111111'`); err != nil {
+		t.Fatalf("标记兑换码失败: %v", err)
+	}
+	if _, err := db.Exec(`UPDATE recharge_records SET used = 1, redeemed_by = '新用户' WHERE recharge_code = '222222'`); err != nil {
+		t.Fatalf("标记兑换码失败: %v", err)
+	}
+
+	seedMemberTiers(db)
+	for nick, want := range map[string]string{"老用户": "白银会员", "新用户": "普通会员"} {
+		var tier string
+		if err := db.QueryRow(`SELECT tier FROM member_tiers WHERE nick = ?`, nick).Scan(&tier); err != nil || tier != want {
+			t.Fatalf("%s的等级应为%s，实际为%q %v", nick, want, tier, err)
+		}
+	}
+}
@@ -0,0 +1,416 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 交易订单状态
+const (
+	orderPending   = "待付款"
+	orderPaid      = "已付款"
+	orderCompleted = "已完成"
+	orderCancelled = "已取消"
+)
+
+// 一次购买对应一个订单，订单绑定机器人创建的交易群
+type TradeOrder struct {
+	ID          int     `json:"id"`
+	ItemID      int     `json:"item_id"`
+	ItemName    string  `json:"item_name"`
+	Seller      string  `json:"seller"`
+	Buyer       string  `json:"buyer"`
+	GroupID     string  `json:"-"`          // 交易群的 UserName，重新登录后会变化
+	GroupName   string  `json:"group_name"` // 交易群的群名，用于重新登录后找回订单
+	Price       float64 `json:"price"`
+	Status      string  `json:"status"`
+	CreatedAt   string  `json:"created_at"`
+	UpdatedAt   string  `json:"updated_at"`
+	CompletedAt string  `json:"completed_at"`
+
+	Commission   float64 `json:"commission"`    // 平台佣金，订单结算时写入
+	SellerIncome float64 `json:"seller_income"` // 卖家扣除佣金后的实得金额
+	CouponCode   string  `json:"coupon_code"`   // 下单时使用的优惠码
+	Discount     float64 `json:"discount"`      // 优惠金额，由平台承担
+}
+
+// 买家实际需要支付的金额
+func (o *TradeOrder) amountDue() float64 {
+	return roundCents(o.Price - o.Discount)
+}
+
+func initTradeOrderTables(db *sql.DB) {
+	createTradeOrdersTableSQL := `
+	CREATE TABLE IF NOT EXISTS trade_orders (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		item_id INTEGER NOT NULL,
+		item_name TEXT NOT NULL,
+		seller TEXT NOT NULL,
+		buyer TEXT NOT NULL,
+		group_id TEXT NOT NULL DEFAULT '',
+		group_name TEXT NOT NULL DEFAULT '',
+		price REAL NOT NULL,
+		recharge_code TEXT NOT NULL DEFAULT '',  -- 买家付款使用的兑换码
+		status TEXT NOT NULL DEFAULT '待付款',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+		completed_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createTradeOrdersTableSQL); err != nil {
+		log.Fatalf("创建 trade_orders 表失败: %s\n", err)
+	}
+	// 标记订单是否绑定了机器人自己建的交易群，只有这类群里的消息才按订单处理
+	addColumnIfMissing(db, "trade_orders", "bot_group", "INTEGER NOT NULL DEFAULT 0")
+	// 旧订单按机器人建群时的群名识别
+	if _, err := db.Exec(`UPDATE trade_orders SET bot_group = 1
+	WHERE bot_group = 0 AND group_name = '交易单' || id || '号-' || item_name`); err != nil {
+		log.Fatalf("标记机器人交易群失败: %s\n", err)
+	}
+}
+
+// 为买家创建订单并自动拉交易群，返回创建的订单，coupon.Code 为空表示不使用优惠码
+func openTradeOrder(db *sql.DB, self *openwechat.Self, item *TradeItem, buyer string, coupon couponUse) (*TradeOrder, error) {
+	if item.Seller == buyer {
+		return nil, fmt.Errorf("不能购买自己发布的交易品")
+	}
+	sellerFriend, err := findFriendByNickName(self, item.Seller)
+	if err != nil {
+		return nil, fmt.Errorf("卖家不是机器人的好友: %v", err)
+	}
+	buyerFriend, err := findFriendByNickName(self, buyer)
+	if err != nil {
+		return nil, fmt.Errorf("请先添加机器人为好友: %v", err)
+	}
+
+	order, err := createTradeOrder(db, item, buyer, "", "", coupon)
+	if err != nil {
+		return nil, err
+	}
+
+	topic := fmt.Sprintf("交易单%d号-%s", order.ID, item.ItemName)
+	group, err := self.CreateGroup(topic, sellerFriend, buyerFriend)
+	if err != nil {
+		if err := setTradeOrderStatus(db, order.ID, orderPending, orderCancelled); err != nil {
+			log.Printf("取消交易单%d号失败: %v\n", order.ID, err)
+		}
+		return nil, fmt.Errorf("创建交易群失败: %v", err)
+	}
+	if err := bindTradeOrderToGroup(db, order.ID, group.UserName, topic); err != nil {
+		// 群已经建好但订单没绑上，群里的消息不会按订单处理，取消订单并告知群成员
+		if err := setTradeOrderStatus(db, order.ID, orderPending, orderCancelled); err != nil {
+			log.Printf("取消交易单%d号失败: %v\n", order.ID, err)
+		}
+		if _, err := group.SendText(fmt.Sprintf("交易单%d号创建失败，本群作废，请重新下单。", order.ID)); err != nil {
+			log.Printf("发送交易群作废通知失败: %v\n", err)
+		}
+		return nil, fmt.Errorf("绑定交易群失败: %v", err)
+	}
+	order.GroupID, order.GroupName = group.UserName, topic
+
+	priceText := fmt.Sprintf("%.2f", item.Price)
+	if order.Discount > 0 {
+		priceText += fmt.Sprintf("（优惠码%s优惠%.2f，买家实付%.2f）", order.CouponCode, order.Discount, order.amountDue())
+	}
+	details := fmt.Sprintf("交易单%d号\n交易品：%d号 %s\n价格：%s\n描述：%s\n卖家：%s\n买家：%s\n\n"+
+		"买家请私聊机器人转账%.2f元，把收到的“兑换码：xxx”发到本群完成付款；卖家交付后买家发送“确认收货”完成交易，付款前双方均可发送“取消交易”。",
+		order.ID, item.ID, item.ItemName, priceText, item.Description, item.Seller, buyer, order.amountDue())
+	if _, err := group.SendText(details); err != nil {
+		log.Printf("发送交易群订单信息失败: %v\n", err)
+	}
+	if card, err := renderTradeItemCard(*item); err == nil {
+		if _, err := group.SendImage(card); err != nil {
+			log.Printf("发送交易群交易品卡片失败: %v\n", err)
+		}
+	}
+	return order, nil
+}
+
+// 建单和记录优惠码使用在同一个事务里，优惠码次数用完时整单失败
+func createTradeOrder(db *sql.DB, item *TradeItem, buyer, groupID, groupName string, coupon couponUse) (*TradeOrder, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var discount float64
+	if coupon.Code != "" {
+		if _, discount, err = checkCoupon(tx, coupon, couponTrade, item.Category, item.Price); err != nil {
+			return nil, err
+		}
+	}
+	result, err := tx.Exec(`INSERT INTO trade_orders (item_id, item_name, seller, buyer, group_id, group_name, price, coupon_code, discount)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)`, item.ID, item.ItemName, item.Seller, buyer, groupID, groupName, item.Price, coupon.Code, discount)
+	if err != nil {
+		log.Printf("创建订单失败: %v\n", err)
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	if coupon.Code != "" {
+		if err := recordCouponRedemption(tx, coupon, buyer, "trade_order", int(id), item.Price, discount); err != nil {
+			return nil, err
+		}
+	}
+	order := &TradeOrder{
+		ID:         int(id),
+		ItemID:     item.ID,
+		ItemName:   item.ItemName,
+		Seller:     item.Seller,
+		Buyer:      buyer,
+		GroupID:    groupID,
+		GroupName:  groupName,
+		Price:      item.Price,
+		Status:     orderPending,
+		CouponCode: coupon.Code,
+		Discount:   discount,
+	}
+	if err := emitOrderStatusChanged(tx, order, ""); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return order, nil
+}
+
+// 订单绑定机器人创建的交易群，手动交易的普通群不能走这里
+func bindTradeOrderToGroup(db *sql.DB, orderID int, groupID, groupName string) error {
+	_, err := db.Exec(`UPDATE trade_orders SET group_id = ?, group_name = ?, bot_group = 1, updated_at = datetime('now') WHERE id = ?`, groupID, groupName, orderID)
+	return err
+}
+
+// 只有订单仍是 from 状态时才修改，避免并发的两次操作都成功
+func setTradeOrderStatus(db *sql.DB, orderID int, from, status string) error {
+	order, err := getTradeOrderByID(db, orderID)
+	if err != nil || order == nil {
+		return err
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE trade_orders SET status = ?, updated_at = datetime('now') WHERE id = ? AND status = ?`, status, orderID, from)
+	if err != nil {
+		return err
+	}
+	if n, err := result.RowsAffected(); err != nil {
+		return err
+	} else if n == 0 {
+		return fmt.Errorf("交易单%d号当前状态不是%s", orderID, from)
+	}
+	if status == orderCancelled {
+		if err := voidCouponRedemption(tx, "trade_order", orderID); err != nil {
+			return fmt.Errorf("作废交易单%d号的优惠码记录失败: %v", orderID, err)
+		}
+	}
+	order.Status = status
+	if err := emitOrderStatusChanged(tx, order, from); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+const tradeOrderColumns = `id, item_id, item_name, seller, buyer, group_id, group_name, price, status, created_at, updated_at, completed_at, commission, seller_income, coupon_code, discount`
+
+func scanTradeOrder(row interface{ Scan(...interface{}) error }) (*TradeOrder, error) {
+	var order TradeOrder
+	err := row.Scan(&order.ID, &order.ItemID, &order.ItemName, &order.Seller, &order.Buyer, &order.GroupID, &order.GroupName,
+		&order.Price, &order.Status, &order.CreatedAt, &order.UpdatedAt, &order.CompletedAt, &order.Commission, &order.SellerIncome,
+		&order.CouponCode, &order.Discount)
+	if err != nil {
+		return nil, err
+	}
+	return &order, nil
+}
+
+func getTradeOrderByID(db *sql.DB, orderID int) (*TradeOrder, error) {
+	order, err := scanTradeOrder(db.QueryRow(`SELECT `+tradeOrderColumns+` FROM trade_orders WHERE id = ?`, orderID))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return order, err
+}
+
+// 查找机器人交易群绑定的进行中订单，群 UserName 变化后按群名匹配。
+// 已完成、已取消的订单和普通群都不匹配，群里的消息按普通群处理
+func getTradeOrderByGroup(db *sql.DB, group *openwechat.User) (*TradeOrder, error) {
+	order, err := scanTradeOrder(db.QueryRow(`SELECT `+tradeOrderColumns+` FROM trade_orders
+	WHERE bot_group = 1 AND status IN (?, ?, ?) AND (group_id = ? OR (group_name != '' AND group_name = ?))
+	ORDER BY id DESC LIMIT 1`, orderPending, orderPaid, orderDisputed, group.UserName, group.NickName))
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err == nil && order.GroupID != group.UserName {
+		bindTradeOrderToGroup(db, order.ID, group.UserName, order.GroupName)
+	}
+	return order, err
+}
+
+// 买家在交易群中发送兑换码付款
+func payTradeOrder(db *sql.DB, order *TradeOrder, rechargeCode, buyer string) error {
+	if order.Status != orderPending {
+		return fmt.Errorf("订单当前状态为%s，无需付款", order.Status)
+	}
+	if buyer != order.Buyer {
+		return fmt.Errorf("只有买家%s可以付款", order.Buyer)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var amount float64
+	var used int
+	err = tx.QueryRow("SELECT amount, used FROM recharge_records WHERE recharge_code = ?", rechargeCode).Scan(&amount, &used)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("充值码不存在")
+	}
+	if err != nil {
+		return fmt.Errorf("查询充值码出错: %s", err)
+	}
+	if err := rechargeCodeStatusError(used); err != nil {
+		return err
+	}
+	// 多付的部分没有地方退，金额必须和应付一致
+	if roundCents(amount) != order.amountDue() {
+		return fmt.Errorf("兑换码金额 %.2f 元与订单应付 %.2f 元不一致，请按应付金额转账", amount, order.amountDue())
+	}
+
+	result, err := tx.Exec("UPDATE recharge_records SET used = 1, used_at = datetime('now'), redeemed_by = ? WHERE recharge_code = ? AND used = 0", buyer, rechargeCode)
+	if err != nil {
+		return fmt.Errorf("更新充值码状态失败: %s", err)
+	}
+	// 并发兑换时另一边已经用掉了这个兑换码
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("充值码已被使用")
+	}
+	result, err = tx.Exec(`UPDATE trade_items SET buyers = IFNULL(buyers, '') || ? || '|', quantity = quantity - 1
+	WHERE id = ? AND quantity > 0`, order.Buyer, order.ItemID)
+	if err != nil {
+		return fmt.Errorf("更新交易品失败: %s", err)
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("交易品已售罄")
+	}
+	if _, err := tx.Exec(`UPDATE trade_orders SET status = ?, recharge_code = ?, updated_at = datetime('now') WHERE id = ?`,
+		orderPaid, rechargeCode, order.ID); err != nil {
+		return fmt.Errorf("更新订单状态失败: %s", err)
+	}
+	if err := rewardReferral(tx, buyer, amount, rechargeCode); err != nil {
+		return fmt.Errorf("发放邀请奖励失败: %s", err)
+	}
+	paid := *order
+	paid.Status = orderPaid
+	if err := emitEvent(tx, eventCodeRedeemed, map[string]interface{}{
+		"code": rechargeCode, "amount": amount, "redeemer": buyer, "order_id": order.ID,
+	}); err != nil {
+		return err
+	}
+	if err := emitOrderStatusChanged(tx, &paid, orderPending); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	order.Status = orderPaid
+	return nil
+}
+
+// 买家确认收货，订单完成并结算给卖家
+func completeTradeOrder(db *sql.DB, order *TradeOrder) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE trade_orders SET status = ?, updated_at = datetime('now'), completed_at = datetime('now') WHERE id = ? AND status = ?`,
+		orderCompleted, order.ID, orderPaid)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("订单状态已变化")
+	}
+	commission, err := settleTradeOrder(tx, order, order.Price, order.Discount)
+	if err != nil {
+		return err
+	}
+	if err := postCouponSubsidy(tx, order); err != nil {
+		return err
+	}
+	completed := *order
+	completed.Status = orderCompleted
+	completed.Commission, completed.SellerIncome = commission, roundCents(order.Price-commission)
+	if err := emitOrderStatusChanged(tx, &completed, orderPaid); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	*order = completed
+	return nil
+}
+
+// 处理交易群中的 "确认收货" 与 "取消交易" 命令
+func handleTradeGroupCommand(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, qun, sender *openwechat.User, order *TradeOrder) {
+	switch msg.Content {
+	case "确认收货":
+		if sender.NickName != order.Buyer {
+			msg.ReplyText("只有买家可以确认收货。")
+			return
+		}
+		if order.Status != orderPaid {
+			msg.ReplyText(fmt.Sprintf("订单当前状态为%s，无法确认收货。", order.Status))
+			return
+		}
+		if err := completeTradeOrder(db, order); err != nil {
+			log.Printf("完成订单失败: %v\n", err)
+			msg.ReplyText("确认收货失败，请稍后重试。")
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("交易单%d号已完成，卖家实得%.2f元（平台佣金%.2f元）已记入卖家账户。感谢使用！本群将不再处理该订单。",
+			order.ID, order.SellerIncome, order.Commission))
+		closeTradeGroup(self, qun, order)
+		promptTradeReviews(self, order)
+
+	case "取消交易":
+		if sender.NickName != order.Buyer && sender.NickName != order.Seller {
+			msg.ReplyText("只有买卖双方可以取消交易。")
+			return
+		}
+		if order.Status != orderPending {
+			msg.ReplyText(fmt.Sprintf("订单当前状态为%s，无法取消。", order.Status))
+			return
+		}
+		if err := setTradeOrderStatus(db, order.ID, orderPending, orderCancelled); err != nil {
+			log.Printf("取消订单失败: %v\n", err)
+			msg.ReplyText("取消交易失败，请稍后重试。")
+			return
+		}
+		order.Status = orderCancelled
+		msg.ReplyText(fmt.Sprintf("交易单%d号已取消。", order.ID))
+		closeTradeGroup(self, qun, order)
+	}
+}
+
+// 订单结束后修改群名，标记交易群已关闭
+func closeTradeGroup(self *openwechat.Self, qun *openwechat.User, order *TradeOrder) {
+	group, ok := qun.AsGroup()
+	if !ok {
+		return
+	}
+	if err := self.RenameGroup(group, fmt.Sprintf("[%s]%s", order.Status, order.GroupName)); err != nil {
+		log.Printf("修改交易群名称失败: %v\n", err)
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+func TestGetTradeOrderByGroupOnlyBotGroups(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestTradeItem(t, db, "卖家", 10, 5)
+
+	// 手动交易的订单不绑定群
+	manual, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	if order, err := getTradeOrderByGroup(db, &openwechat.User{UserName: "@@普通群", NickName: "普通群"}); err != nil || order != nil {
+		t.Fatalf("普通群不应匹配订单，得到 %+v, %v", order, err)
+	}
+
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	if err := bindTradeOrderToGroup(db, order.ID, "@@交易群", "交易单2号-测试交易品"); err != nil {
+		t.Fatalf("绑定交易群失败: %v", err)
+	}
+	// 重新登录后 UserName 变化，按群名找回
+	found, err := getTradeOrderByGroup(db, &openwechat.User{UserName: "@@新交易群", NickName: "交易单2号-测试交易品"})
+	if err != nil || found == nil || found.ID != order.ID {
+		t.Fatalf("应按群名找回订单%d，得到 %+v, %v", order.ID, found, err)
+	}
+	if found.ID == manual.ID {
+		t.Fatal("不应匹配手动交易的订单")
+	}
+
+	// 结束的订单不再匹配
+	if err := setTradeOrderStatus(db, order.ID, orderPending, orderCancelled); err != nil {
+		t.Fatalf("取消订单失败: %v", err)
+	}
+	if found, err := getTradeOrderByGroup(db, &openwechat.User{UserName: "@@新交易群"}); err != nil || found != nil {
+		t.Fatalf("已取消的订单不应匹配，得到 %+v, %v", found, err)
+	}
+}
+
+func TestPayTradeOrderRequiresExactAmount(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestTradeItem(t, db, "卖家", 10, 1)
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	addTestRechargeCode(t, db, "1001", 12)
+	addTestRechargeCode(t, db, "1002", 8)
+	addTestRechargeCode(t, db, "1003", 10)
+
+	for _, code := range []string{"1001", "1002"} {
+		if err := payTradeOrder(db, order, code, "买家"); err == nil {
+			t.Fatalf("兑换码%s金额不一致时应付款失败", code)
+		}
+	}
+	var used int
+	db.QueryRow(`SELECT used FROM recharge_records WHERE recharge_code = '1001'`).Scan(&used)
+	if used != 0 {
+		t.Fatal("付款失败时兑换码不应被使用")
+	}
+
+	if err := payTradeOrder(db, order, "1003", "买家"); err != nil {
+		t.Fatalf("金额一致时付款失败: %v", err)
+	}
+	if order.Status != orderPaid {
+		t.Fatalf("订单状态应为%s，实际为%s", orderPaid, order.Status)
+	}
+}
+
+func TestSetTradeOrderStatusOnlyOnce(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestTradeItem(t, db, "卖家", 10, 1)
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	if err := setTradeOrderStatus(db, order.ID, orderPending, orderCancelled); err != nil {
+		t.Fatalf("取消订单失败: %v", err)
+	}
+	// 第二次取消时订单已不是待付款，不能再改
+	if err := setTradeOrderStatus(db, order.ID, orderPending, orderCancelled); err == nil {
+		t.Fatal("重复取消应失败")
+	}
+	if err := setTradeOrderStatus(db, order.ID, orderPending, orderPaid); err == nil {
+		t.Fatal("已取消的订单不应被改成已付款")
+	}
+	found, _ := getTradeOrderByID(db, order.ID)
+	if found.Status != orderCancelled {
+		t.Fatalf("订单状态应保持已取消，实际为%s", found.Status)
+	}
+}
@@ -0,0 +1,24 @@
+package main
+
+import (
+	"log"
+	"time"
+)
+
+// 按固定间隔执行定时任务，任务中的 panic 不会影响后续执行
+func runPeriodically(name string, interval time.Duration, job func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		func() {
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("定时任务 %s 异常: %v\n", name, r)
+				}
+			}()
+			job()
+		}()
+		<-ticker.C
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+const reconciliationDir = "../duizhang"
+
+// 对账中发现的异常
+type reconciliationIssue struct {
+	Kind   string
+	Detail string
+}
+
+// 某一天的对账结果，金额单位为元
+type reconciliationReport struct {
+	Date string
+
+	Transfers        int
+	TransferAmount   float64
+	GroupTransfers   int // 群内转账直接用于交易，不发兑换码
+	GroupAmount      float64
+	Issued           int
+	IssuedAmount     float64
+	Redeemed         int
+	RedeemedAmount   float64
+	OrdersPaid       int
+	OrdersPaidAmount float64
+	OrdersCompleted  int
+	Commission       float64
+
+	Outstanding       int // 截至对账时所有未兑换的兑换码
+	OutstandingAmount float64
+	MemberStars       int
+	WalletTotal       float64
+	PlatformBalance   float64
+
+	Issues []reconciliationIssue
+}
+
+func (r *reconciliationReport) flag(kind, format string, args ...interface{}) {
+	r.Issues = append(r.Issues, reconciliationIssue{Kind: kind, Detail: fmt.Sprintf(format, args...)})
+}
+
+// 收到的每一笔转账消息都记一条，包括金额为 0 的收款确认
+func initReconciliationTables(db *sql.DB) {
+	createTransferLogsTableSQL := `
+	CREATE TABLE IF NOT EXISTS transfer_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		payer TEXT NOT NULL,
+		chat TEXT NOT NULL DEFAULT '',  -- 群名，私聊为空
+		transfer_id TEXT NOT NULL DEFAULT '',
+		pay_sub_type INTEGER NOT NULL DEFAULT 0,
+		fee REAL NOT NULL DEFAULT 0,     -- 转账消息中的金额
+		amount REAL NOT NULL DEFAULT 0,  -- 实际入账的金额
+		recharge_code TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createTransferLogsTableSQL); err != nil {
+		log.Fatalf("创建 transfer_logs 表失败: %s\n", err)
+	}
+
+	createReconciliationReportsTableSQL := `
+	CREATE TABLE IF NOT EXISTS reconciliation_reports (
+		report_date TEXT PRIMARY KEY,
+		file_name TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createReconciliationReportsTableSQL); err != nil {
+		log.Fatalf("创建 reconciliation_reports 表失败: %s\n", err)
+	}
+
+	addColumnIfMissing(db, "recharge_records", "used_at", "TEXT NOT NULL DEFAULT ''")
+	// 日报时的群成员星卷合计，-1 表示没有记录
+	addColumnIfMissing(db, "reconciliation_reports", "member_stars", "INTEGER NOT NULL DEFAULT -1")
+}
+
+// 记录一条转账消息，rechargeCode 为本次转账发出的兑换码
+func recordTransferLog(db *sql.DB, content, payer, chat, rechargeCode string) {
+	var m Msg
+	if err := xml.Unmarshal([]byte(content), &m); err != nil {
+		log.Printf("解析转账消息失败: %v\n", err)
+	}
+	info := m.AppMsg.WcpayInfo
+	fee, _ := strconv.ParseFloat(regexp.MustCompile(`[0-9]+(?:\.[0-9]+)?`).FindString(info.FeeDesc), 64)
+	amount := extractAmountFromXML(content)
+
+	tx, err := db.Begin()
+	if err != nil {
+		log.Printf("记录转账失败: %v\n", err)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`INSERT INTO transfer_logs (payer, chat, transfer_id, pay_sub_type, fee, amount, recharge_code) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		payer, chat, info.TransferId, info.PaySubType, fee, amount, rechargeCode); err != nil {
+		log.Printf("记录转账失败: %v\n", err)
+		return
+	}
+	if err := emitEvent(tx, eventTransferReceived, map[string]interface{}{
+		"payer": payer, "chat": chat, "transfer_id": info.TransferId, "pay_sub_type": info.PaySubType,
+		"fee": fee, "amount": amount, "recharge_code": rechargeCode,
+	}); err != nil {
+		log.Printf("记录转账失败: %v\n", err)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		log.Printf("记录转账失败: %v\n", err)
+	}
+}
+
+// 核对指定日期（本地时间，YYYY-MM-DD）的转账、兑换码、星卷和交易
+func buildReconciliationReport(db *sql.DB, date string) (*reconciliationReport, error) {
+	r := &reconciliationReport{Date: date}
+
+	// 转账：私聊入账的转账都应该发出兑换码，群内转账是交易付款，不发码
+	rows, err := db.Query(`SELECT id, payer, chat, transfer_id, pay_sub_type, fee, amount, recharge_code FROM transfer_logs
+	WHERE date(created_at, 'localtime') = ? ORDER BY id`, date)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id, subType int
+		var payer, chat, transferID, code string
+		var fee, amount float64
+		if err := rows.Scan(&id, &payer, &chat, &transferID, &subType, &fee, &amount, &code); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		from := payer
+		if chat != "" {
+			from = fmt.Sprintf("%s（群%s）", payer, chat)
+		}
+		switch {
+		case amount == 0:
+			r.flag("零金额转账", "转账记录%d：%s，转账单号%s，paysubtype %d，消息金额%.2f元，未入账", id, from, transferID, subType, fee)
+		case chat != "":
+			r.GroupTransfers++
+			r.GroupAmount += amount
+		case code == "":
+			r.Transfers++
+			r.TransferAmount += amount
+			r.flag("转账未发码", "转账记录%d：%s转账%.2f元，转账单号%s，没有发出兑换码", id, from, amount, transferID)
+		default:
+			r.Transfers++
+			r.TransferAmount += amount
+		}
+	}
+	rows.Close()
+
+	// 同一笔转账发出了多个兑换码
+	rows, err = db.Query(`SELECT transfer_id, COUNT(*), GROUP_CONCAT(recharge_code, '、') FROM recharge_records
+	WHERE transfer_id != '' AND transfer_id IN (SELECT transfer_id FROM recharge_records WHERE date(created_at, 'localtime') = ?)
+	GROUP BY transfer_id HAVING COUNT(*) > 1`, date)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var transferID, codes string
+		var count int
+		if err := rows.Scan(&transferID, &count, &codes); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.flag("重复发码", "转账单号%s发出了%d个兑换码：%s", transferID, count, codes)
+	}
+	rows.Close()
+
+	// 当天发出的兑换码
+	rows, err = db.Query(`SELECT c.recharge_code, c.amount, c.used, c.payer, IFNULL(t.amount, -1) FROM recharge_records c
+	LEFT JOIN transfer_logs t ON t.recharge_code = c.recharge_code
+	WHERE date(c.created_at, 'localtime') = ? ORDER BY c.id`, date)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var code, payer string
+		var amount, transferAmount float64
+		var used int
+		if err := rows.Scan(&code, &amount, &used, &payer, &transferAmount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		r.Issued++
+		r.IssuedAmount += amount
+		switch {
+		case transferAmount < 0:
+			r.flag("兑换码无对应转账", "兑换码%s（%s，%.2f元）没有对应的转账记录", code, payer, amount)
+		case transferAmount != amount:
+			r.flag("金额不符", "兑换码%s金额%.2f元，转账金额%.2f元", code, amount, transferAmount)
+		}
+		if used == codeUnused {
+			r.flag("已发未兑", "兑换码%s（%s，%.2f元）尚未兑换", code, payer, amount)
+		}
+	}
+	rows.Close()
+
+	if err := db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(amount), 0) FROM recharge_records WHERE used = ? AND date(used_at, 'localtime') = ?`,
+		codeUsed, date).Scan(&r.Redeemed, &r.RedeemedAmount); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(amount), 0) FROM recharge_records WHERE used = ?`,
+		codeUnused).Scan(&r.Outstanding, &r.OutstandingAmount); err != nil {
+		return nil, err
+	}
+
+	// 交易：当天用兑换码付款的订单和当天完成的订单
+	if err := db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(o.price), 0) FROM trade_orders o
+	JOIN recharge_records c ON c.recharge_code = o.recharge_code WHERE date(c.used_at, 'localtime') = ?`,
+		date).Scan(&r.OrdersPaid, &r.OrdersPaidAmount); err != nil {
+		return nil, err
+	}
+	if err := db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(commission), 0) FROM trade_orders
+	WHERE status IN (?, ?) AND date(completed_at, 'localtime') = ?`, orderCompleted, orderSplit, date).Scan(&r.OrdersCompleted, &r.Commission); err != nil {
+		return nil, err
+	}
+
+	// 余额：星卷合计、钱包合计，以及每个钱包的余额与流水是否一致
+	if err := db.QueryRow(`SELECT IFNULL(SUM(StarsCount), 0) FROM member_stars`).Scan(&r.MemberStars); err != nil {
+		return nil, err
+	}
+	// 星卷调整都记在钱包流水里，群成员星卷不应再变化，和上一份日报比较
+	var lastDate string
+	var lastStars int
+	err = db.QueryRow(`SELECT report_date, member_stars FROM reconciliation_reports WHERE report_date < ? AND member_stars >= 0
+	ORDER BY report_date DESC LIMIT 1`, date).Scan(&lastDate, &lastStars)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, err
+	}
+	if err == nil && lastStars != r.MemberStars {
+		r.flag("群星卷变动", "群成员星卷合计从%s日报的%d变为%d，星卷调整应通过钱包流水", lastDate, lastStars, r.MemberStars)
+	}
+	if err := db.QueryRow(`SELECT IFNULL(SUM(balance), 0) FROM wallets WHERE account != ?`, platformAccount).Scan(&r.WalletTotal); err != nil {
+		return nil, err
+	}
+	if r.PlatformBalance, err = getWalletBalance(db, platformAccount); err != nil {
+		return nil, err
+	}
+	rows, err = db.Query(`SELECT w.account, w.balance, IFNULL(SUM(e.amount), 0) FROM wallets w
+	LEFT JOIN wallet_entries e ON e.account = w.account GROUP BY w.account`)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var account string
+		var balance, ledger float64
+		if err := rows.Scan(&account, &balance, &ledger); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if roundCents(balance) != roundCents(ledger) {
+			r.flag("余额与流水不符", "%s：余额%.2f元，流水合计%.2f元", account, balance, ledger)
+		}
+	}
+	rows.Close()
+
+	return r, nil
+}
+
+func (r *reconciliationReport) summary() string {
+	var b strings.Builder
+	b.WriteString(fmt.Sprintf("————%s对账报告————\n", r.Date))
+	b.WriteString(fmt.Sprintf("收到转账：%d笔，%.2f元\n", r.Transfers, roundCents(r.TransferAmount)))
+	b.WriteString(fmt.Sprintf("群内交易转账：%d笔，%.2f元\n", r.GroupTransfers, roundCents(r.GroupAmount)))
+	b.WriteString(fmt.Sprintf("发出兑换码：%d个，%.2f元\n", r.Issued, roundCents(r.IssuedAmount)))
+	b.WriteString(fmt.Sprintf("兑换兑换码：%d个，%.2f元\n", r.Redeemed, roundCents(r.RedeemedAmount)))
+	b.WriteString(fmt.Sprintf("交易付款：%d单，%.2f元；完成%d单，佣金%.2f元\n", r.OrdersPaid, roundCents(r.OrdersPaidAmount), r.OrdersCompleted, roundCents(r.Commission)))
+	b.WriteString(fmt.Sprintf("未兑换兑换码合计：%d个，%.2f元\n", r.Outstanding, roundCents(r.OutstandingAmount)))
+	b.WriteString(fmt.Sprintf("群成员星卷合计：%d，用户钱包合计：%.2f元，平台账户：%.2f元\n", r.MemberStars, roundCents(r.WalletTotal), r.PlatformBalance))
+
+	if len(r.Issues) == 0 {
+		b.WriteString("未发现异常。")
+		return b.String()
+	}
+	counts := make(map[string]int)
+	var kinds []string
+	for _, issue := range r.Issues {
+		if counts[issue.Kind] == 0 {
+			kinds = append(kinds, issue.Kind)
+		}
+		counts[issue.Kind]++
+	}
+	b.WriteString(fmt.Sprintf("发现%d项异常：", len(r.Issues)))
+	for i, kind := range kinds {
+		if i > 0 {
+			b.WriteString("，")
+		}
+		b.WriteString(fmt.Sprintf("%s%d项", kind, counts[kind]))
+	}
+	return b.String()
+}
+
+// 导出对账报告 CSV，返回文件名
+func (r *reconciliationReport) writeCSV() (string, error) {
+	if err := os.MkdirAll(reconciliationDir, 0755); err != nil {
+		return "", err
+	}
+	fileName := fmt.Sprintf("reconcile_%s.csv", r.Date)
+	file, err := os.Create(filepath.Join(reconciliationDir, fileName))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"类型", "项目", "数量", "金额/说明"})
+	summaryRows := [][]string{
+		{"汇总", "收到转账", strconv.Itoa(r.Transfers), fmt.Sprintf("%.2f", r.TransferAmount)},
+		{"汇总", "群内交易转账", strconv.Itoa(r.GroupTransfers), fmt.Sprintf("%.2f", r.GroupAmount)},
+		{"汇总", "发出兑换码", strconv.Itoa(r.Issued), fmt.Sprintf("%.2f", r.IssuedAmount)},
+		{"汇总", "兑换兑换码", strconv.Itoa(r.Redeemed), fmt.Sprintf("%.2f", r.RedeemedAmount)},
+		{"汇总", "交易付款", strconv.Itoa(r.OrdersPaid), fmt.Sprintf("%.2f", r.OrdersPaidAmount)},
+		{"汇总", "交易完成佣金", strconv.Itoa(r.OrdersCompleted), fmt.Sprintf("%.2f", r.Commission)},
+		{"汇总", "未兑换兑换码合计", strconv.Itoa(r.Outstanding), fmt.Sprintf("%.2f", r.OutstandingAmount)},
+		{"汇总", "群成员星卷合计", strconv.Itoa(r.MemberStars), ""},
+		{"汇总", "用户钱包合计", "", fmt.Sprintf("%.2f", r.WalletTotal)},
+		{"汇总", "平台账户", "", fmt.Sprintf("%.2f", r.PlatformBalance)},
+	}
+	w.WriteAll(summaryRows)
+	for _, issue := range r.Issues {
+		w.Write([]string{"异常", issue.Kind, "", issue.Detail})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return "", err
+	}
+	return fileName, nil
+}
+
+// 生成对账报告并导出 CSV，返回报告和发给管理员的摘要
+func reconcileDay(db *sql.DB, date string) (*reconciliationReport, string, error) {
+	report, err := buildReconciliationReport(db, date)
+	if err != nil {
+		return nil, "", err
+	}
+	fileName, err := report.writeCSV()
+	if err != nil {
+		return nil, "", err
+	}
+	return report, fmt.Sprintf("%s\n明细已导出到%s。", report.summary(), fileName), nil
+}
+
+// 定时任务：每天生成一次前一天的对账报告并私聊管理员
+func runDailyReconciliation(db *sql.DB, self *openwechat.Self) {
+	date := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM reconciliation_reports WHERE report_date = ?`, date).Scan(&exists); err != nil || exists > 0 {
+		return
+	}
+	report, summary, err := reconcileDay(db, date)
+	if err != nil {
+		log.Printf("生成对账报告失败: %v\n", err)
+		return
+	}
+	// 管理员手动对账不记录，只有定时任务生成的日报才算完成，同时记下星卷合计供下次比较
+	if _, err := db.Exec(`INSERT OR REPLACE INTO reconciliation_reports (report_date, file_name, member_stars) VALUES (?, ?, ?)`,
+		date, fmt.Sprintf("reconcile_%s.csv", date), report.MemberStars); err != nil {
+		log.Printf("记录对账报告失败: %v\n", err)
+	}
+	notifyAdmins(self, summary)
+}
+
+// 处理 "对账[ YYYY-MM-DD]" 管理员命令，默认核对今天
+func handleReconciliation(msg *openwechat.Message, db *sql.DB) {
+	date := strings.TrimSpace(strings.TrimPrefix(msg.Content, "对账"))
+	if date == "" {
+		date = time.Now().Format("2006-01-02")
+	}
+	if _, err := time.Parse("2006-01-02", date); err != nil {
+		msg.ReplyText("指令格式错误，请按照 '对账 2024-06-01' 的格式输入。")
+		return
+	}
+	_, summary, err := reconcileDay(db, date)
+	if err != nil {
+		log.Printf("生成对账报告失败: %v\n", err)
+		msg.ReplyText("生成对账报告时发生错误，请稍后重试。")
+		return
+	}
+	msg.ReplyText(summary)
+}
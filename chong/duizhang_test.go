@@ -0,0 +1,43 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestReconciliationGroupTransfersAndMemberStars(t *testing.T) {
+	db := newTestDB(t)
+	today := time.Now().Format("2006-01-02")
+	yesterday := time.Now().AddDate(0, 0, -1).Format("2006-01-02")
+
+	// 私聊转账没发码要报异常，群内交易转账不发码是正常的
+	if _, err := db.Exec(`INSERT INTO transfer_logs (payer, chat, transfer_id, amount) VALUES
+		('甲', '', 't1', 10), ('乙', '交易群', 't2', 20)`); err != nil {
+		t.Fatalf("写入转账记录失败: %v", err)
+	}
+	// 上次日报时群成员星卷合计为5，之后被直接改成了8
+	if _, err := db.Exec(`INSERT INTO reconciliation_reports (report_date, member_stars) VALUES (?, 5)`, yesterday); err != nil {
+		t.Fatalf("写入日报失败: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO member_stars (GroupID, UserName, StarsCount) VALUES ('群', '丙', 8)`); err != nil {
+		t.Fatalf("写入星卷失败: %v", err)
+	}
+
+	r, err := buildReconciliationReport(db, today)
+	if err != nil {
+		t.Fatalf("生成对账报告失败: %v", err)
+	}
+	if r.Transfers != 1 || r.GroupTransfers != 1 || r.GroupAmount != 20 {
+		t.Fatalf("转账统计错误: %+v", r)
+	}
+	kinds := make(map[string]int)
+	for _, issue := range r.Issues {
+		kinds[issue.Kind]++
+	}
+	if kinds["转账未发码"] != 1 {
+		t.Fatalf("只有私聊转账应报转账未发码，实际为 %v", r.Issues)
+	}
+	if kinds["群星卷变动"] != 1 {
+		t.Fatalf("群成员星卷和上次日报不一致应报异常，实际为 %v", r.Issues)
+	}
+}
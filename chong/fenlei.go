@@ -0,0 +1,287 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 交易区的筛选条件
+type tradeItemFilter struct {
+	Keyword     string // 名称或标签包含的关键字
+	Category    string // 交易品分类
+	MarketGroup string // 所属群聊，空字符串表示不限群聊
+	AllMarkets  bool   // 为 true 时展示所有公开群聊的交易品
+}
+
+// 群聊交易区设置，群聊以昵称标识，因为 UserName 每次登录都会变化。
+// 群昵称任何群成员都能修改，所以另外记下本次登录中该群的 UserName，
+// 私有市场只认这个 UserName，见 resolveMarketGroup
+func initMarketTables(db *sql.DB) {
+	addColumnIfMissing(db, "trade_items", "category", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "trade_items", "tags", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "trade_items", "market_group", "TEXT NOT NULL DEFAULT ''")
+
+	createGroupMarketsTableSQL := `
+	CREATE TABLE IF NOT EXISTS group_markets (
+		group_name TEXT PRIMARY KEY,
+		private INTEGER NOT NULL DEFAULT 0  -- 0: 公开, 1: 仅本群可见
+	);`
+	if _, err := db.Exec(createGroupMarketsTableSQL); err != nil {
+		log.Fatalf("创建 group_markets 表失败: %s\n", err)
+	}
+	addColumnIfMissing(db, "group_markets", "group_username", "TEXT NOT NULL DEFAULT ''")
+}
+
+// 登录后按群昵称重新绑定交易区设置。同名的群只有一个时才绑定，
+// 找不到或有重名时留空，这个交易区在管理员重新设置前不对任何群开放
+func bindGroupMarkets(db *sql.DB, groups openwechat.Groups) error {
+	rows, err := db.Query(`SELECT group_name FROM group_markets`)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		userName := ""
+		matched := groups.SearchByNickName(2, name)
+		if matched.Count() == 1 {
+			userName = matched.First().UserName
+		} else {
+			log.Printf("群聊交易区%s找到%d个同名群，暂不开放\n", name, matched.Count())
+		}
+		if _, err := db.Exec(`UPDATE group_markets SET group_username = ? WHERE group_name = ?`, userName, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 确定群聊对应的交易区名称。群改名后仍沿用原来的交易区；
+// 其他群改成已设置过的交易区的名字时返回 false，不能借此访问别人的私有市场
+func resolveMarketGroup(db *sql.DB, group *openwechat.User) (string, bool) {
+	var name string
+	err := db.QueryRow(`SELECT group_name FROM group_markets WHERE group_username = ?`, group.UserName).Scan(&name)
+	if err == nil {
+		return name, true
+	}
+	if err != sql.ErrNoRows {
+		log.Printf("查询群聊交易区设置失败: %v\n", err)
+		return "", false
+	}
+
+	var userName string
+	err = db.QueryRow(`SELECT group_username FROM group_markets WHERE group_name = ?`, group.NickName).Scan(&userName)
+	if err == sql.ErrNoRows {
+		return group.NickName, true
+	}
+	if err != nil {
+		log.Printf("查询群聊交易区设置失败: %v\n", err)
+	}
+	return "", false
+}
+
+// 解析失败时提示用户，返回 false 表示本群暂时不能使用交易区
+func marketGroupOrReply(msg *openwechat.Message, db *sql.DB, group *openwechat.User) (string, bool) {
+	name, ok := resolveMarketGroup(db, group)
+	if !ok {
+		msg.ReplyText("本群名称与其他群的交易区重名，暂时不能使用交易区，请修改群名或联系管理员。")
+	}
+	return name, ok
+}
+
+var setCategoryRe = regexp.MustCompile(`^设置分类(\d+)号，([^，]+)(?:，(.+))?$`)
+
+// 处理 "设置分类N号，类别[，标签1、标签2]" 命令，只有卖家本人可以设置
+func handleSetCategory(msg *openwechat.Message, db *sql.DB, seller string) {
+	matches := setCategoryRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '设置分类[交易ID]号，类别[，标签1、标签2]' 的格式输入。")
+		return
+	}
+	var tradeID int
+	fmt.Sscanf(matches[1], "%d", &tradeID)
+	category := strings.TrimSpace(matches[2])
+	tags := normalizeTags(matches[3])
+
+	tradeItem, err := getTradeItemByID(db, tradeID)
+	if err != nil {
+		msg.ReplyText("获取交易品信息时发生错误，请稍后重试。")
+		return
+	}
+	if tradeItem == nil || tradeItem.Seller != seller {
+		msg.ReplyText("未找到您发布的该交易品。")
+		return
+	}
+
+	if _, err := db.Exec(`UPDATE trade_items SET category = ?, tags = ? WHERE id = ?`, category, tags, tradeID); err != nil {
+		log.Printf("更新交易品分类失败: %v\n", err)
+		msg.ReplyText("设置分类失败，请稍后重试。")
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("交易品%s已归入分类“%s”，%s", tradeItem.ItemName, category, commissionNotice(tradeItem.Price, category)))
+}
+
+// 处理 "分类" 与 "分类：[类别]" 命令
+func handleCategories(msg *openwechat.Message, db *sql.DB, marketGroup string) {
+	filter := tradeItemFilter{MarketGroup: marketGroup, AllMarkets: marketGroup == ""}
+	if strings.HasPrefix(msg.Content, "分类：") {
+		filter.Category = strings.TrimSpace(strings.TrimPrefix(msg.Content, "分类："))
+		tradeItems, err := getAvailableTradeItems(db, filter)
+		if err != nil {
+			msg.ReplyText("获取交易区信息时发生错误，请稍后重试。")
+			return
+		}
+		replyTradeItems(msg, db, tradeItems)
+		return
+	}
+
+	counts, err := getCategoryCounts(db, filter)
+	if err != nil {
+		msg.ReplyText("获取分类信息时发生错误，请稍后重试。")
+		return
+	}
+	if len(counts) == 0 {
+		msg.ReplyText("当前没有可用的交易品。")
+		return
+	}
+	var response strings.Builder
+	response.WriteString("————交易品分类————\n")
+	for _, c := range counts {
+		response.WriteString(fmt.Sprintf("%s（%d件）\n", c.Category, c.Count))
+	}
+	response.WriteString("发送“分类：[类别]”查看该分类下的交易品")
+	msg.ReplyText(response.String())
+}
+
+// 处理 "市场设为私有" / "市场设为公开" 命令，仅管理员可用
+func handleMarketPrivacy(msg *openwechat.Message, db *sql.DB, group *openwechat.User, senderName string) {
+	if !isAdmin(senderName) {
+		msg.ReplyText("只有管理员可以修改本群交易区设置。")
+		return
+	}
+	groupName, ok := marketGroupOrReply(msg, db, group)
+	if !ok {
+		return
+	}
+	private := msg.Content == "市场设为私有"
+	if err := setGroupMarketPrivate(db, groupName, group.UserName, private); err != nil {
+		log.Printf("更新群聊交易区设置失败: %v\n", err)
+		msg.ReplyText("修改交易区设置失败，请稍后重试。")
+		return
+	}
+	if private {
+		msg.ReplyText("本群交易区已设为私有，交易品只在本群可见。")
+	} else {
+		msg.ReplyText("本群交易区已设为公开。")
+	}
+}
+
+type categoryCount struct {
+	Category string
+	Count    int
+}
+
+func getCategoryCounts(db *sql.DB, filter tradeItemFilter) ([]categoryCount, error) {
+	where, args := tradeItemFilterSQL(filter)
+	query := `SELECT CASE WHEN category = '' THEN '未分类' ELSE category END AS c, COUNT(*)
+	FROM trade_items WHERE ` + where + ` GROUP BY c ORDER BY COUNT(*) DESC, c`
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var counts []categoryCount
+	for rows.Next() {
+		var c categoryCount
+		if err := rows.Scan(&c.Category, &c.Count); err != nil {
+			return nil, err
+		}
+		counts = append(counts, c)
+	}
+	return counts, rows.Err()
+}
+
+// 根据筛选条件生成 WHERE 子句
+func tradeItemFilterSQL(filter tradeItemFilter) (string, []interface{}) {
+	conditions := []string{"quantity > 0", "status = '在售'"}
+	var args []interface{}
+
+	switch {
+	case filter.MarketGroup != "" && !filter.AllMarkets:
+		conditions = append(conditions, "market_group = ?")
+		args = append(args, filter.MarketGroup)
+	case filter.MarketGroup != "":
+		// 所有公开市场，加上当前群自己的市场
+		conditions = append(conditions, "(market_group = ? OR market_group NOT IN (SELECT group_name FROM group_markets WHERE private = 1))")
+		args = append(args, filter.MarketGroup)
+	default:
+		conditions = append(conditions, "market_group NOT IN (SELECT group_name FROM group_markets WHERE private = 1)")
+	}
+	if filter.Category == "未分类" {
+		conditions = append(conditions, "category = ''")
+	} else if filter.Category != "" {
+		conditions = append(conditions, "category = ?")
+		args = append(args, filter.Category)
+	}
+	if filter.Keyword != "" {
+		conditions = append(conditions, "(item_name LIKE ? OR tags LIKE ?)")
+		args = append(args, "%"+filter.Keyword+"%", "%"+filter.Keyword+"%")
+	}
+	return strings.Join(conditions, " AND "), args
+}
+
+func isGroupMarketPrivate(db *sql.DB, groupName string) bool {
+	if groupName == "" {
+		return false
+	}
+	var private int
+	err := db.QueryRow(`SELECT private FROM group_markets WHERE group_name = ?`, groupName).Scan(&private)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("查询群聊交易区设置失败: %v\n", err)
+	}
+	return private == 1
+}
+
+func setGroupMarketPrivate(db *sql.DB, groupName, groupUserName string, private bool) error {
+	value := 0
+	if private {
+		value = 1
+	}
+	_, err := db.Exec(`INSERT INTO group_markets (group_name, private, group_username) VALUES (?, ?, ?)
+	ON CONFLICT(group_name) DO UPDATE SET private = excluded.private, group_username = excluded.group_username`, groupName, value, groupUserName)
+	return err
+}
+
+// 私有市场的交易品只能在所属群聊中查看和购买
+func canAccessTradeItem(db *sql.DB, item *TradeItem, marketGroup string) bool {
+	if item.MarketGroup == "" || item.MarketGroup == marketGroup {
+		return true
+	}
+	return !isGroupMarketPrivate(db, item.MarketGroup)
+}
+
+// 标签统一用顿号分隔
+func normalizeTags(raw string) string {
+	fields := strings.FieldsFunc(raw, func(r rune) bool {
+		return r == '、' || r == ',' || r == '，' || r == ' '
+	})
+	return strings.Join(fields, "、")
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+func testGroup(userName, nickName string) *openwechat.User {
+	return &openwechat.User{UserName: userName, NickName: nickName}
+}
+
+// 在指定群聊的交易区上架一个交易品
+func addTestMarketItem(t *testing.T, db *sql.DB, marketGroup string) *TradeItem {
+	t.Helper()
+	item := addTestTradeItem(t, db, "卖家", 10, 1)
+	if _, err := db.Exec(`UPDATE trade_items SET market_group = ? WHERE id = ?`, marketGroup, item.ID); err != nil {
+		t.Fatalf("设置交易品所属群聊失败: %v", err)
+	}
+	item.MarketGroup = marketGroup
+	return item
+}
+
+func TestPrivateMarketHiddenFromOtherGroups(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestMarketItem(t, db, "私有群")
+	addTestMarketItem(t, db, "公开群")
+	if err := setGroupMarketPrivate(db, "私有群", "@@private", true); err != nil {
+		t.Fatalf("设置私有市场失败: %v", err)
+	}
+
+	items, err := getAvailableTradeItems(db, tradeItemFilter{AllMarkets: true})
+	if err != nil || len(items) != 1 || items[0].MarketGroup != "公开群" {
+		t.Fatalf("私聊浏览只应看到公开市场: %+v %v", items, err)
+	}
+	items, err = getAvailableTradeItems(db, tradeItemFilter{MarketGroup: "私有群"})
+	if err != nil || len(items) != 1 || items[0].ID != item.ID {
+		t.Fatalf("本群应能看到自己的私有市场: %+v %v", items, err)
+	}
+	if canAccessTradeItem(db, item, "公开群") || !canAccessTradeItem(db, item, "私有群") {
+		t.Fatal("私有市场的交易品只能在本群购买")
+	}
+}
+
+func TestRenamedGroupCannotTakeOverPrivateMarket(t *testing.T) {
+	db := newTestDB(t)
+	if err := setGroupMarketPrivate(db, "私有群", "@@private", true); err != nil {
+		t.Fatalf("设置私有市场失败: %v", err)
+	}
+
+	// 别的群改成同样的名字，不能进入这个交易区
+	if name, ok := resolveMarketGroup(db, testGroup("@@other", "私有群")); ok {
+		t.Fatalf("重名的群不应访问私有市场，得到%s", name)
+	}
+	// 原来的群改名后仍是原来的交易区
+	if name, ok := resolveMarketGroup(db, testGroup("@@private", "改名后")); !ok || name != "私有群" {
+		t.Fatalf("改名的群应沿用原交易区: %s %v", name, ok)
+	}
+	// 没有设置过的群按昵称使用自己的交易区
+	if name, ok := resolveMarketGroup(db, testGroup("@@new", "新群")); !ok || name != "新群" {
+		t.Fatalf("普通群应使用自己的昵称: %s %v", name, ok)
+	}
+}
+
+func TestBindGroupMarketsAfterLogin(t *testing.T) {
+	db := newTestDB(t)
+	setGroupMarketPrivate(db, "私有群", "@@old", true)
+	setGroupMarketPrivate(db, "重名群", "@@old2", true)
+
+	groups := openwechat.Groups{
+		{User: testGroup("@@a", "私有群")},
+		{User: testGroup("@@b", "重名群")},
+		{User: testGroup("@@c", "重名群")},
+	}
+	if err := bindGroupMarkets(db, groups); err != nil {
+		t.Fatalf("绑定群聊交易区失败: %v", err)
+	}
+	if name, ok := resolveMarketGroup(db, testGroup("@@a", "私有群")); !ok || name != "私有群" {
+		t.Fatalf("唯一同名的群应重新绑定: %s %v", name, ok)
+	}
+	// 有重名时谁也不绑定
+	for _, userName := range []string{"@@b", "@@c"} {
+		if _, ok := resolveMarketGroup(db, testGroup(userName, "重名群")); ok {
+			t.Fatalf("重名的群%s不应绑定私有市场", userName)
+		}
+	}
+}
@@ -0,0 +1,15 @@
+module chong
+
+go 1.22
+
+require (
+	github.com/eatmoreapple/openwechat v1.4.8
+	github.com/hajimehoshi/bitmapfont/v3 v3.2.0
+	github.com/mattn/go-sqlite3 v1.14.22
+	golang.org/x/image v0.20.0
+)
+
+require (
+	github.com/pierrec/lz4/v4 v4.1.21 // indirect
+	golang.org/x/text v0.18.0 // indirect
+)
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// *sql.DB 和 *sql.Tx 都可以写审计日志
+type sqlExecer interface {
+	Exec(query string, args ...interface{}) (sql.Result, error)
+}
+
+// 管理员的每次操作都记一条审计日志，保存修改前后的值
+func initAdminTables(db *sql.DB) {
+	createAuditLogsTableSQL := `
+	CREATE TABLE IF NOT EXISTS admin_audit_logs (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		admin TEXT NOT NULL,
+		action TEXT NOT NULL,
+		target TEXT NOT NULL,
+		before_value TEXT NOT NULL DEFAULT '',
+		after_value TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createAuditLogsTableSQL); err != nil {
+		log.Fatalf("创建 admin_audit_logs 表失败: %s\n", err)
+	}
+
+	createBannedUsersTableSQL := `
+	CREATE TABLE IF NOT EXISTS banned_users (
+		nick_name TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		banned_by TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createBannedUsersTableSQL); err != nil {
+		log.Fatalf("创建 banned_users 表失败: %s\n", err)
+	}
+}
+
+func writeAuditLog(db sqlExecer, admin, action, target, before, after, note string) error {
+	_, err := db.Exec(`INSERT INTO admin_audit_logs (admin, action, target, before_value, after_value, note) VALUES (?, ?, ?, ?, ?, ?)`,
+		admin, action, target, before, after, note)
+	return err
+}
+
+// 被封禁的用户发来的消息一律忽略
+func isBanned(db *sql.DB, nickName string) bool {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM banned_users WHERE nick_name = ?`, nickName).Scan(&count); err != nil {
+		log.Printf("查询封禁状态失败: %v\n", err)
+		return false
+	}
+	return count > 0
+}
+
+func rechargeCodeStatusText(used int) string {
+	switch used {
+	case codeUnused:
+		return "未使用"
+	case codeUsed:
+		return "已使用"
+	case codeVoided:
+		return "已作废"
+	case codeRefunding:
+		return "退款审核中"
+	default:
+		return fmt.Sprintf("未知状态%d", used)
+	}
+}
+
+var (
+	adminQueryCodeRe  = regexp.MustCompile(`^查码(?:：)?(\d+)$`)
+	adminStarsRe      = regexp.MustCompile(`^([补扣])星(.+?)，(\d+(?:\.\d+)?)(?:，(.+))?$`)
+	adminVoidCodeRe   = regexp.MustCompile(`^作废码(?:：)?(\d+)(?:，(.+))?$`)
+	adminDelistRe     = regexp.MustCompile(`^下架(\d+)号(?:，(.+))?$`)
+	adminBanRe        = regexp.MustCompile(`^(封禁|解封)(.+?)(?:，(.+))?$`)
+	adminAuditQueryRe = regexp.MustCompile(`^审计日志(?:\s*(\d+))?$`)
+)
+
+// 判断私聊消息是否是管理后台命令
+func isAdminConsoleCommand(content string) bool {
+	return content == "统计" || adminQueryCodeRe.MatchString(content) || adminStarsRe.MatchString(content) ||
+		adminVoidCodeRe.MatchString(content) || adminDelistRe.MatchString(content) || adminBanRe.MatchString(content) ||
+		adminAuditQueryRe.MatchString(content)
+}
+
+// 会动到钱的管理员命令，除了昵称还要核对备注名
+func isMoneyAdminCommand(content string) bool {
+	return adminStarsRe.MatchString(content) || adminVoidCodeRe.MatchString(content) ||
+		approvePayoutRe.MatchString(content) || rejectPayoutRe.MatchString(content) || markPaidRe.MatchString(content) ||
+		approveRefundRe.MatchString(content) || rejectRefundRe.MatchString(content) || markRefundedRe.MatchString(content) ||
+		content == "生成结算批次" || strings.HasPrefix(content, "裁决") ||
+		closeBridgeRe.MatchString(content) || cancelBridgeRe.MatchString(content) ||
+		addBoosterRe.MatchString(content) || addPromotionRe.MatchString(content) || stopPromotionRe.MatchString(content) ||
+		addCouponRe.MatchString(content)
+}
+
+// 昵称谁都能改成管理员的名字，资金类命令还要求机器人给对方设置的备注名在 admin_remarks 中，
+// 备注名只有机器人账号自己能改
+func isTrustedAdmin(user *openwechat.User) bool {
+	if !isAdmin(user.NickName) || user.RemarkName == "" {
+		return false
+	}
+	for _, remark := range config.AdminRemarks {
+		if remark == user.RemarkName {
+			return true
+		}
+	}
+	return false
+}
+
+// 管理后台命令：查码、补星、扣星、作废码、下架、封禁、解封、统计、审计日志
+func handleAdminConsole(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	switch {
+	case msg.Content == "统计":
+		handleAdminStats(msg, db)
+	case adminQueryCodeRe.MatchString(msg.Content):
+		handleQueryCode(msg, db, adminQueryCodeRe.FindStringSubmatch(msg.Content)[1])
+	case adminStarsRe.MatchString(msg.Content):
+		handleAdjustStars(msg, db, admin)
+	case adminVoidCodeRe.MatchString(msg.Content):
+		handleVoidCode(msg, db, admin)
+	case adminDelistRe.MatchString(msg.Content):
+		handleAdminDelist(msg, db, self, admin)
+	case adminBanRe.MatchString(msg.Content):
+		handleBanUser(msg, db, admin)
+	case adminAuditQueryRe.MatchString(msg.Content):
+		handleAuditQuery(msg, db)
+	}
+}
+
+// 查码：兑换码的金额、状态、付款人和使用情况
+func handleQueryCode(msg *openwechat.Message, db *sql.DB, code string) {
+	var amount float64
+	var used int
+	var payer, transferID, createdAt, usedAt string
+	err := db.QueryRow(`SELECT amount, used, payer, transfer_id, created_at, used_at FROM recharge_records WHERE recharge_code = ?`, code).
+		Scan(&amount, &used, &payer, &transferID, &createdAt, &usedAt)
+	if err == sql.ErrNoRows {
+		msg.ReplyText(fmt.Sprintf("兑换码%s不存在。", code))
+		return
+	}
+	if err != nil {
+		log.Printf("查询兑换码失败: %v\n", err)
+		msg.ReplyText("查询兑换码时发生错误，请稍后重试。")
+		return
+	}
+
+	response := fmt.Sprintf("兑换码%s：%.2f元，%s\n付款人：%s\n转账单号：%s\n发码时间：%s",
+		code, amount, rechargeCodeStatusText(used), payer, transferID, createdAt)
+	if usedAt != "" {
+		response += fmt.Sprintf("\n使用时间：%s", usedAt)
+	}
+	var orderID int
+	var buyer, itemName string
+	if err := db.QueryRow(`SELECT id, buyer, item_name FROM trade_orders WHERE recharge_code = ?`, code).Scan(&orderID, &buyer, &itemName); err == nil {
+		response += fmt.Sprintf("\n用于交易单%d号：%s购买%s", orderID, buyer, itemName)
+	}
+	var refundID int
+	var refundStatus string
+	if err := db.QueryRow(`SELECT id, status FROM refund_requests WHERE recharge_code = ? ORDER BY id DESC LIMIT 1`, code).Scan(&refundID, &refundStatus); err == nil {
+		response += fmt.Sprintf("\n退款%d号：%s", refundID, refundStatus)
+	}
+	msg.ReplyText(response)
+}
+
+// 补星[昵称]，[数量][，原因] / 扣星[昵称]，[数量][，原因]
+// 调整记在钱包流水里，对方是平台账户，余额与流水始终能对上
+func handleAdjustStars(msg *openwechat.Message, db *sql.DB, admin string) {
+	matches := adminStarsRe.FindStringSubmatch(msg.Content)
+	nickName, note := strings.TrimSpace(matches[2]), strings.TrimSpace(matches[4])
+	amount, err := strconv.ParseFloat(matches[3], 64)
+	amount = roundCents(amount)
+	if err != nil || amount <= 0 {
+		msg.ReplyText("数量格式不正确。请确保是正数。")
+		return
+	}
+	action := "补星"
+	if matches[1] == "扣" {
+		action = "扣星"
+		amount = -amount
+	}
+	before, after, err := adjustWalletByAdmin(db, admin, action, nickName, amount, note)
+	if err != nil {
+		log.Printf("%s失败: %v\n", action, err)
+		msg.ReplyText(fmt.Sprintf("%s失败：%v", action, err))
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("已为%s%s，钱包余额：%.2f → %.2f 星卷", nickName, action, before, after))
+}
+
+func adjustWalletByAdmin(db *sql.DB, admin, action, nickName string, amount float64, note string) (float64, float64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback()
+
+	before, err := getWalletBalanceTx(tx, nickName)
+	if err != nil {
+		return 0, 0, err
+	}
+	if before+amount < 0 {
+		return 0, 0, fmt.Errorf("%s当前只有%.2f星卷，不能扣除%.2f", nickName, before, -amount)
+	}
+	memo := fmt.Sprintf("管理员%s%s", admin, action)
+	if note != "" {
+		memo += "：" + note
+	}
+	after, err := postWalletEntry(tx, nickName, amount, "管理员"+action, "admin_adjust", 0, memo)
+	if err != nil {
+		return 0, 0, err
+	}
+	if _, err := postWalletEntry(tx, platformAccount, -amount, "管理员"+action, "admin_adjust", 0, nickName+" "+memo); err != nil {
+		return 0, 0, err
+	}
+	if err := writeAuditLog(tx, admin, action, nickName, fmt.Sprintf("%.2f", before), fmt.Sprintf("%.2f", after), note); err != nil {
+		return 0, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, 0, err
+	}
+	return before, after, nil
+}
+
+// 作废码[兑换码][，原因]：只能作废未使用的兑换码
+func handleVoidCode(msg *openwechat.Message, db *sql.DB, admin string) {
+	matches := adminVoidCodeRe.FindStringSubmatch(msg.Content)
+	code, reason := matches[1], strings.TrimSpace(matches[2])
+
+	tx, err := db.Begin()
+	if err != nil {
+		msg.ReplyText("作废兑换码失败，请稍后重试。")
+		return
+	}
+	defer tx.Rollback()
+
+	var used int
+	err = tx.QueryRow(`SELECT used FROM recharge_records WHERE recharge_code = ?`, code).Scan(&used)
+	if err == sql.ErrNoRows {
+		msg.ReplyText(fmt.Sprintf("兑换码%s不存在。", code))
+		return
+	}
+	if err != nil {
+		msg.ReplyText("作废兑换码失败，请稍后重试。")
+		return
+	}
+	if used != codeUnused {
+		msg.ReplyText(fmt.Sprintf("兑换码%s当前状态为%s，只能作废未使用的兑换码。", code, rechargeCodeStatusText(used)))
+		return
+	}
+
+	if _, err := tx.Exec(`UPDATE recharge_records SET used = ? WHERE recharge_code = ? AND used = ?`, codeVoided, code, codeUnused); err != nil {
+		msg.ReplyText("作废兑换码失败，请稍后重试。")
+		return
+	}
+	if err := writeAuditLog(tx, admin, "作废码", code, rechargeCodeStatusText(used), rechargeCodeStatusText(codeVoided), reason); err != nil {
+		log.Printf("写入审计日志失败: %v\n", err)
+		msg.ReplyText("作废兑换码失败，请稍后重试。")
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		msg.ReplyText("作废兑换码失败，请稍后重试。")
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("兑换码%s已作废。", code))
+}
+
+// 下架[交易ID]号[，原因]：管理员可以下架任何人的交易品
+func handleAdminDelist(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	matches := adminDelistRe.FindStringSubmatch(msg.Content)
+	tradeID, _ := strconv.Atoi(matches[1])
+	reason := strings.TrimSpace(matches[2])
+
+	tradeItem, err := getTradeItemByID(db, tradeID)
+	if err != nil {
+		msg.ReplyText("获取交易品信息时发生错误，请稍后重试。")
+		return
+	}
+	if tradeItem == nil {
+		msg.ReplyText(fmt.Sprintf("交易品%d号不存在。", tradeID))
+		return
+	}
+	if tradeItem.Status == tradeItemDelisted {
+		msg.ReplyText(fmt.Sprintf("交易品%s当前已是%s状态。", tradeItem.ItemName, tradeItemDelisted))
+		return
+	}
+
+	if err := setTradeItemStatus(db, tradeID, tradeItemDelisted); err != nil {
+		log.Printf("下架交易品失败: %v\n", err)
+		msg.ReplyText("下架交易品失败，请稍后重试。")
+		return
+	}
+	if err := writeAuditLog(db, admin, "下架", fmt.Sprintf("交易品%d号", tradeID), tradeItem.Status, tradeItemDelisted, reason); err != nil {
+		log.Printf("写入审计日志失败: %v\n", err)
+	}
+	msg.ReplyText(fmt.Sprintf("交易品%s（%d号）已下架。", tradeItem.ItemName, tradeID))
+
+	if tradeItem.Seller != admin {
+		notice := fmt.Sprintf("您的交易品%s（%d号）已被管理员下架。", tradeItem.ItemName, tradeID)
+		if reason != "" {
+			notice += "原因：" + reason
+		}
+		if err := sendTextToNickName(self, tradeItem.Seller, notice); err != nil {
+			log.Printf("通知卖家 [%s] 下架失败: %v\n", tradeItem.Seller, err)
+		}
+	}
+}
+
+// 封禁[昵称][，原因] / 解封[昵称]
+func handleBanUser(msg *openwechat.Message, db *sql.DB, admin string) {
+	matches := adminBanRe.FindStringSubmatch(msg.Content)
+	action, nickName, reason := matches[1], strings.TrimSpace(matches[2]), strings.TrimSpace(matches[3])
+
+	banned := isBanned(db, nickName)
+	var err error
+	switch {
+	case action == "封禁" && isAdmin(nickName):
+		msg.ReplyText("不能封禁管理员。")
+		return
+	case action == "封禁" && banned:
+		msg.ReplyText(fmt.Sprintf("%s已经被封禁。", nickName))
+		return
+	case action == "解封" && !banned:
+		msg.ReplyText(fmt.Sprintf("%s没有被封禁。", nickName))
+		return
+	case action == "封禁":
+		_, err = db.Exec(`INSERT INTO banned_users (nick_name, reason, banned_by) VALUES (?, ?, ?)`, nickName, reason, admin)
+	default:
+		_, err = db.Exec(`DELETE FROM banned_users WHERE nick_name = ?`, nickName)
+	}
+	if err != nil {
+		log.Printf("%s用户失败: %v\n", action, err)
+		msg.ReplyText(fmt.Sprintf("%s失败，请稍后重试。", action))
+		return
+	}
+
+	before, after := "正常", "封禁"
+	if action == "解封" {
+		before, after = after, before
+	}
+	if err := writeAuditLog(db, admin, action, nickName, before, after, reason); err != nil {
+		log.Printf("写入审计日志失败: %v\n", err)
+	}
+	msg.ReplyText(fmt.Sprintf("已%s%s。", action, nickName))
+}
+
+// 统计：平台运营概况
+func handleAdminStats(msg *openwechat.Message, db *sql.DB) {
+	stats := []struct {
+		label string
+		query string
+		args  []interface{}
+	}{
+		{"在售交易品", `SELECT COUNT(*) FROM trade_items WHERE status = ? AND quantity > 0`, []interface{}{tradeItemOnSale}},
+		{"待付款订单", `SELECT COUNT(*) FROM trade_orders WHERE status = ?`, []interface{}{orderPending}},
+		{"已付款订单", `SELECT COUNT(*) FROM trade_orders WHERE status = ?`, []interface{}{orderPaid}},
+		{"已完成订单", `SELECT COUNT(*) FROM trade_orders WHERE status = ?`, []interface{}{orderCompleted}},
+		{"申诉中订单", `SELECT COUNT(*) FROM trade_orders WHERE status = ?`, []interface{}{orderDisputed}},
+		{"未使用兑换码", `SELECT COUNT(*) FROM recharge_records WHERE used = ?`, []interface{}{codeUnused}},
+		{"待审核提现", `SELECT COUNT(*) FROM payout_requests WHERE status = ?`, []interface{}{payoutPending}},
+		{"待审核退款", `SELECT COUNT(*) FROM refund_requests WHERE status = ?`, []interface{}{refundPending}},
+		{"封禁用户", `SELECT COUNT(*) FROM banned_users`, nil},
+	}
+
+	var response strings.Builder
+	response.WriteString("————平台统计————\n")
+	for _, s := range stats {
+		var count int
+		if err := db.QueryRow(s.query, s.args...).Scan(&count); err != nil {
+			log.Printf("查询%s失败: %v\n", s.label, err)
+			continue
+		}
+		response.WriteString(fmt.Sprintf("%s：%d\n", s.label, count))
+	}
+
+	var outstanding, walletTotal float64
+	db.QueryRow(`SELECT IFNULL(SUM(amount), 0) FROM recharge_records WHERE used = ?`, codeUnused).Scan(&outstanding)
+	db.QueryRow(`SELECT IFNULL(SUM(balance), 0) FROM wallets WHERE account != ?`, platformAccount).Scan(&walletTotal)
+	platformBalance, _ := getWalletBalance(db, platformAccount)
+	response.WriteString(fmt.Sprintf("未兑换金额：%.2f元\n用户钱包合计：%.2f元\n平台账户：%.2f元", outstanding, walletTotal, platformBalance))
+	msg.ReplyText(response.String())
+}
+
+// 审计日志[ 条数]：查看最近的管理员操作，默认 20 条
+func handleAuditQuery(msg *openwechat.Message, db *sql.DB) {
+	limit := 20
+	if n := adminAuditQueryRe.FindStringSubmatch(msg.Content)[1]; n != "" {
+		limit, _ = strconv.Atoi(n)
+	}
+	rows, err := db.Query(`SELECT created_at, admin, action, target, before_value, after_value, note FROM admin_audit_logs
+	ORDER BY id DESC LIMIT ?`, limit)
+	if err != nil {
+		log.Printf("查询审计日志失败: %v\n", err)
+		msg.ReplyText("获取审计日志时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var createdAt, admin, action, target, before, after, note string
+		if err := rows.Scan(&createdAt, &admin, &action, &target, &before, &after, &note); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("%s %s %s %s：%s → %s", createdAt, admin, action, target, before, after))
+		if note != "" {
+			response.WriteString("（" + note + "）")
+		}
+		response.WriteString("\n")
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("暂无审计日志。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+func TestAdjustWalletByAdminPostsAgainstPlatform(t *testing.T) {
+	db := newTestDB(t)
+	if _, _, err := adjustWalletByAdmin(db, "管理员", "补星", "小明", 20, "活动补发"); err != nil {
+		t.Fatalf("补星失败: %v", err)
+	}
+	if _, _, err := adjustWalletByAdmin(db, "管理员", "扣星", "小明", -30, ""); err == nil {
+		t.Fatal("扣除超过余额的星卷应失败")
+	}
+	before, after, err := adjustWalletByAdmin(db, "管理员", "扣星", "小明", -5, "")
+	if err != nil || before != 20 || after != 15 {
+		t.Fatalf("扣星后余额应从20变为15，得到 %.2f → %.2f, %v", before, after, err)
+	}
+	if balance, _ := getWalletBalance(db, platformAccount); balance != -15 {
+		t.Fatalf("平台账户应为-15，实际为%.2f", balance)
+	}
+	for _, account := range []string{"小明", platformAccount} {
+		if balance, ledger, err := reconcileWalletAccount(db, account); err != nil || balance != ledger {
+			t.Fatalf("%s余额%.2f与流水%.2f不符: %v", account, balance, ledger, err)
+		}
+	}
+	var logs int
+	db.QueryRow(`SELECT COUNT(*) FROM admin_audit_logs WHERE target = '小明'`).Scan(&logs)
+	if logs != 2 {
+		t.Fatalf("应记录2条审计日志，实际为%d", logs)
+	}
+}
+
+func TestTrustedAdminRequiresRemark(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Admins = []string{"老王"}
+	config.AdminRemarks = []string{"管理员-老王"}
+
+	if isTrustedAdmin(&openwechat.User{NickName: "老王"}) {
+		t.Fatal("只有昵称相同不应通过")
+	}
+	if isTrustedAdmin(&openwechat.User{NickName: "老王", RemarkName: "别人"}) {
+		t.Fatal("备注名不符不应通过")
+	}
+	if !isTrustedAdmin(&openwechat.User{NickName: "老王", RemarkName: "管理员-老王"}) {
+		t.Fatal("昵称和备注名都符合时应通过")
+	}
+	if !isMoneyAdminCommand("补星小明，10") || isMoneyAdminCommand("查码123456") {
+		t.Fatal("资金类命令识别错误")
+	}
+	// 打手结单后会结算，添加打手也要核对备注名
+	if !isMoneyAdminCommand("添加打手 阿强，2") {
+		t.Fatal("添加打手应要求备注名")
+	}
+	// 活动赠送和优惠码补贴都由平台账户支出
+	for _, content := range []string{"添加活动六一，充100送10，2024-06-01 00:00~2024-06-07 23:59", "停止活动3号", "添加优惠码NEW10，减10"} {
+		if !isMoneyAdminCommand(content) {
+			t.Errorf("%s 应要求备注名", content)
+		}
+	}
+	if isMoneyAdminCommand("活动列表") {
+		t.Fatal("查看活动列表不动钱")
+	}
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 充值活动状态，结束时间已过的活动仍为进行中，但不再生效
+const (
+	promotionActive  = "进行中"
+	promotionStopped = "已停止"
+)
+
+// 兑换时到账的额外星卷，等级奖励和活动赠送都用它描述
+type rechargeBonus struct {
+	Name   string
+	Amount float64
+}
+
+type Promotion struct {
+	ID           int
+	Name         string
+	FirstOnly    bool    // 只对首次充值生效
+	MinAmount    float64 // 单次兑换达到多少元才赠送
+	BonusAmount  float64 // 固定赠送的星卷
+	BonusRate    float64 // 按兑换金额比例赠送，与固定赠送二选一
+	UserCap      float64 // 每人在本活动中最多获赠多少星卷，0 表示不限
+	GroupName    string  // 只在该群兑换时生效，空表示所有群
+	StartsAt     string  // UTC
+	EndsAt       string
+	Status       string
+	CreatedBy    string
+	GivenTotal   float64
+	GivenCredits int
+}
+
+// 活动规则和每一笔赠送记录，赠送同时记一笔 ref_type 为 promotion 的钱包流水
+func initPromotionTables(db *sql.DB) {
+	createPromotionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS promotions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		name TEXT NOT NULL,
+		first_only BOOLEAN NOT NULL DEFAULT 0,
+		min_amount REAL NOT NULL DEFAULT 0,
+		bonus_amount REAL NOT NULL DEFAULT 0,
+		bonus_rate REAL NOT NULL DEFAULT 0,
+		user_cap REAL NOT NULL DEFAULT 0,
+		group_name TEXT NOT NULL DEFAULT '',
+		starts_at TEXT NOT NULL,  -- UTC 时间，和 datetime('now') 比较
+		ends_at TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT '进行中',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createPromotionsTableSQL); err != nil {
+		log.Fatalf("创建 promotions 表失败: %s\n", err)
+	}
+
+	createPromotionCreditsTableSQL := `
+	CREATE TABLE IF NOT EXISTS promotion_credits (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		promotion_id INTEGER NOT NULL,
+		account TEXT NOT NULL,
+		recharge_code TEXT NOT NULL,
+		recharge_amount REAL NOT NULL,
+		bonus REAL NOT NULL,
+		group_name TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createPromotionCreditsTableSQL); err != nil {
+		log.Fatalf("创建 promotion_credits 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_promotion_credits_account ON promotion_credits (promotion_id, account)`); err != nil {
+		log.Fatalf("创建 promotion_credits 索引失败: %s\n", err)
+	}
+	// 昵称可以随时修改，首充和每人上限按机器人给的备注名计算，备注名只有机器人账号能改
+	addColumnIfMissing(db, "promotion_credits", "member", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "recharge_records", "redeemer_remark", "TEXT NOT NULL DEFAULT ''")
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_promotion_credits_member ON promotion_credits (promotion_id, member)`); err != nil {
+		log.Fatalf("创建 promotion_credits 索引失败: %s\n", err)
+	}
+}
+
+// 首次充值：当前昵称没有兑换过，备注名也没有兑换过。没有备注名时无法确认，不算首充
+func isFirstRecharge(tx *sql.Tx, spent float64, member string) (bool, error) {
+	if spent > 0 || member == "" {
+		return false, nil
+	}
+	var count int
+	err := tx.QueryRow(`SELECT COUNT(*) FROM recharge_records WHERE used = ? AND redeemer_remark = ?`, codeUsed, member).Scan(&count)
+	return count == 0, err
+}
+
+// 规则的文字说明，例如 “充100送10”、“首充送5%”
+func (p *Promotion) rule() string {
+	bonus := fmt.Sprintf("送%s", formatPromotionNumber(p.BonusAmount))
+	if p.BonusRate > 0 {
+		bonus = fmt.Sprintf("送%s%%", formatPromotionNumber(p.BonusRate*100))
+	}
+	rule := ""
+	switch {
+	case p.FirstOnly && p.MinAmount > 0:
+		rule = fmt.Sprintf("首充满%s%s", formatPromotionNumber(p.MinAmount), bonus)
+	case p.FirstOnly:
+		rule = "首充" + bonus
+	default:
+		rule = fmt.Sprintf("充%s%s", formatPromotionNumber(p.MinAmount), bonus)
+	}
+	if p.UserCap > 0 {
+		rule += fmt.Sprintf("，每人最多送%s星卷", formatPromotionNumber(p.UserCap))
+	}
+	return rule
+}
+
+func formatPromotionNumber(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+func (p *Promotion) summary() string {
+	starts, _ := time.ParseInLocation("2006-01-02 15:04:05", p.StartsAt, time.UTC)
+	ends, _ := time.ParseInLocation("2006-01-02 15:04:05", p.EndsAt, time.UTC)
+	text := fmt.Sprintf("活动%d号【%s】%s，%s至%s", p.ID, p.Name, p.rule(),
+		starts.Local().Format("01-02 15:04"), ends.Local().Format("01-02 15:04"))
+	if p.GroupName != "" {
+		text += "，仅限" + p.GroupName
+	}
+	return text
+}
+
+// 在兑换事务中计算并发放所有适用的活动赠送，多个活动可以叠加。
+// 首充和有每人上限的活动按备注名 member 计算，没有备注名的兑换人不参加
+func applyPromotions(tx *sql.Tx, account, member, group string, amount float64, code string, firstRecharge bool) ([]rechargeBonus, error) {
+	rows, err := tx.Query(`SELECT id, name, first_only, min_amount, bonus_amount, bonus_rate, user_cap FROM promotions
+	WHERE status = ? AND starts_at <= datetime('now') AND ends_at > datetime('now') AND (group_name = '' OR group_name = ?)
+	ORDER BY id`, promotionActive, group)
+	if err != nil {
+		return nil, err
+	}
+	var promotions []Promotion
+	for rows.Next() {
+		var p Promotion
+		if err := rows.Scan(&p.ID, &p.Name, &p.FirstOnly, &p.MinAmount, &p.BonusAmount, &p.BonusRate, &p.UserCap); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		promotions = append(promotions, p)
+	}
+	rows.Close()
+
+	var bonuses []rechargeBonus
+	for _, p := range promotions {
+		if (p.FirstOnly && !firstRecharge) || amount < p.MinAmount {
+			continue
+		}
+		if (p.FirstOnly || p.UserCap > 0) && member == "" {
+			continue
+		}
+		bonus := p.BonusAmount
+		if p.BonusRate > 0 {
+			bonus = amount * p.BonusRate
+		}
+		if p.UserCap > 0 {
+			var given float64
+			if err := tx.QueryRow(`SELECT IFNULL(SUM(bonus), 0) FROM promotion_credits WHERE promotion_id = ? AND member = ?`,
+				p.ID, member).Scan(&given); err != nil {
+				return nil, err
+			}
+			bonus = math.Min(bonus, p.UserCap-given)
+		}
+		bonus = roundCents(bonus)
+		if bonus <= 0 {
+			continue
+		}
+
+		memo := fmt.Sprintf("活动%d号%s，兑换码%s", p.ID, p.Name, code)
+		if _, err := postWalletEntry(tx, account, bonus, "活动赠送", "promotion", p.ID, memo); err != nil {
+			return nil, err
+		}
+		if _, err := postWalletEntry(tx, platformAccount, -bonus, "活动赠送支出", "promotion", p.ID, account+" "+memo); err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`INSERT INTO promotion_credits (promotion_id, account, member, recharge_code, recharge_amount, bonus, group_name) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+			p.ID, account, member, code, amount, bonus, group); err != nil {
+			return nil, err
+		}
+		bonuses = append(bonuses, rechargeBonus{Name: p.Name, Amount: bonus})
+	}
+	return bonuses, nil
+}
+
+var (
+	addPromotionRe  = regexp.MustCompile(`^添加活动(.+?)，(.+?)，(\d{4}-\d{1,2}-\d{1,2} \d{1,2}:\d{2})(?:~|至)(\d{4}-\d{1,2}-\d{1,2} \d{1,2}:\d{2})((?:，.+)*)$`)
+	promotionRuleRe = regexp.MustCompile(`^(?:首充(?:满(\d+(?:\.\d+)?))?|充(\d+(?:\.\d+)?))送(\d+(?:\.\d+)?)(%)?$`)
+	stopPromotionRe = regexp.MustCompile(`^停止活动(\d+)号$`)
+)
+
+func isPromotionAdminCommand(content string) bool {
+	return content == "活动列表" || addPromotionRe.MatchString(content) || stopPromotionRe.MatchString(content)
+}
+
+// 管理员活动命令：
+// 添加活动[名称]，[规则]，[开始时间]~[结束时间][，群：群名][，上限N]
+// 停止活动N号、活动列表
+func handlePromotionAdmin(msg *openwechat.Message, db *sql.DB, admin string) {
+	switch {
+	case msg.Content == "活动列表":
+		listPromotions(msg, db, "", true)
+
+	case addPromotionRe.MatchString(msg.Content):
+		p, err := parsePromotion(addPromotionRe.FindStringSubmatch(msg.Content))
+		if err != nil {
+			msg.ReplyText(err.Error())
+			return
+		}
+		p.CreatedBy = admin
+		result, err := db.Exec(`INSERT INTO promotions (name, first_only, min_amount, bonus_amount, bonus_rate, user_cap, group_name, starts_at, ends_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, p.Name, p.FirstOnly, p.MinAmount, p.BonusAmount, p.BonusRate, p.UserCap, p.GroupName, p.StartsAt, p.EndsAt, admin)
+		if err != nil {
+			log.Printf("保存充值活动失败: %v\n", err)
+			msg.ReplyText("保存充值活动失败，请稍后重试。")
+			return
+		}
+		id, _ := result.LastInsertId()
+		p.ID = int(id)
+		writeAuditLog(db, admin, "添加活动", fmt.Sprintf("活动%d号", p.ID), "", p.rule(), p.Name)
+		msg.ReplyText("已添加" + p.summary())
+
+	case stopPromotionRe.MatchString(msg.Content):
+		id, _ := strconv.Atoi(stopPromotionRe.FindStringSubmatch(msg.Content)[1])
+		result, err := db.Exec(`UPDATE promotions SET status = ? WHERE id = ? AND status = ?`, promotionStopped, id, promotionActive)
+		if err != nil {
+			log.Printf("停止充值活动失败: %v\n", err)
+			msg.ReplyText("停止活动失败，请稍后重试。")
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			msg.ReplyText(fmt.Sprintf("活动%d号不存在或已停止。", id))
+			return
+		}
+		writeAuditLog(db, admin, "停止活动", fmt.Sprintf("活动%d号", id), promotionActive, promotionStopped, "")
+		msg.ReplyText(fmt.Sprintf("活动%d号已停止。", id))
+	}
+}
+
+func parsePromotion(matches []string) (*Promotion, error) {
+	p := &Promotion{Name: strings.TrimSpace(matches[1]), Status: promotionActive}
+	rule := promotionRuleRe.FindStringSubmatch(strings.TrimSpace(matches[2]))
+	if len(rule) == 0 {
+		return nil, fmt.Errorf("活动规则格式错误，例如“充100送10”、“充100送10%%”、“首充送20”、“首充满50送10%%”。")
+	}
+	p.FirstOnly = strings.HasPrefix(matches[2], "首充")
+	threshold := rule[1]
+	if !p.FirstOnly {
+		threshold = rule[2]
+	}
+	if threshold != "" {
+		p.MinAmount, _ = strconv.ParseFloat(threshold, 64)
+	}
+	value, _ := strconv.ParseFloat(rule[3], 64)
+	if rule[4] == "%" {
+		p.BonusRate = value / 100
+	} else {
+		p.BonusAmount = value
+	}
+	if value <= 0 {
+		return nil, fmt.Errorf("赠送数量必须大于0。")
+	}
+
+	starts, err1 := time.ParseInLocation("2006-1-2 15:04", matches[3], time.Local)
+	ends, err2 := time.ParseInLocation("2006-1-2 15:04", matches[4], time.Local)
+	if err1 != nil || err2 != nil || !ends.After(starts) {
+		return nil, fmt.Errorf("活动时间格式错误，请按照 '2024-06-01 00:00~2024-06-07 23:59' 的格式输入。")
+	}
+	if ends.Before(time.Now()) {
+		return nil, fmt.Errorf("活动结束时间已经过去。")
+	}
+	p.StartsAt, p.EndsAt = starts.UTC().Format("2006-01-02 15:04:05"), ends.UTC().Format("2006-01-02 15:04:05")
+
+	for _, option := range strings.Split(strings.TrimPrefix(matches[5], "，"), "，") {
+		option = strings.TrimSpace(option)
+		switch {
+		case option == "":
+		case strings.HasPrefix(option, "群："):
+			p.GroupName = strings.TrimSpace(strings.TrimPrefix(option, "群："))
+		case strings.HasPrefix(option, "上限"):
+			cap, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimPrefix(option, "上限")), 64)
+			if err != nil || cap <= 0 {
+				return nil, fmt.Errorf("每人上限格式错误：%s", option)
+			}
+			p.UserCap = cap
+		default:
+			return nil, fmt.Errorf("无法识别的活动选项：%s，可选“群：群名”或“上限N”。", option)
+		}
+	}
+	return p, nil
+}
+
+// 列出活动。用户只看到当前生效且适用于本群的活动，管理员还能看到已停止和已结束的活动及发放统计
+func listPromotions(msg *openwechat.Message, db *sql.DB, group string, admin bool) {
+	query := `SELECT p.id, p.name, p.first_only, p.min_amount, p.bonus_amount, p.bonus_rate, p.user_cap, p.group_name, p.starts_at, p.ends_at, p.status,
+	(SELECT IFNULL(SUM(bonus), 0) FROM promotion_credits WHERE promotion_id = p.id),
+	(SELECT COUNT(*) FROM promotion_credits WHERE promotion_id = p.id)
+	FROM promotions p`
+	var args []interface{}
+	if admin {
+		query += ` ORDER BY p.id DESC LIMIT 20`
+	} else {
+		query += ` WHERE p.status = ? AND p.starts_at <= datetime('now') AND p.ends_at > datetime('now')`
+		args = append(args, promotionActive)
+		if group != "" {
+			query += ` AND (p.group_name = '' OR p.group_name = ?)`
+			args = append(args, group)
+		} else {
+			query += ` AND p.group_name = ''`
+		}
+		query += ` ORDER BY p.id`
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		msg.ReplyText("获取充值活动时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var p Promotion
+		if err := rows.Scan(&p.ID, &p.Name, &p.FirstOnly, &p.MinAmount, &p.BonusAmount, &p.BonusRate, &p.UserCap, &p.GroupName,
+			&p.StartsAt, &p.EndsAt, &p.Status, &p.GivenTotal, &p.GivenCredits); err != nil {
+			continue
+		}
+		line := p.summary()
+		if admin {
+			line += fmt.Sprintf("，%s，已赠送%d笔共%.2f星卷", p.Status, p.GivenCredits, p.GivenTotal)
+		}
+		response.WriteString(line + "\n")
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("当前没有充值活动。")
+		return
+	}
+	if !admin {
+		response.WriteString("发送“钱包充值：兑换码”把兑换码存入钱包即可自动获得赠送，首充和限额活动需要机器人给您设置过备注名。")
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
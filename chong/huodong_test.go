@@ -0,0 +1,107 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// 添加一个正在进行的活动
+func addTestPromotion(t *testing.T, db *sql.DB, p Promotion) {
+	t.Helper()
+	_, err := db.Exec(`INSERT INTO promotions (name, first_only, min_amount, bonus_amount, bonus_rate, user_cap, group_name, starts_at, ends_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, datetime('now', '-1 hours'), datetime('now', '+1 days'))`,
+		p.Name, p.FirstOnly, p.MinAmount, p.BonusAmount, p.BonusRate, p.UserCap, p.GroupName)
+	if err != nil {
+		t.Fatalf("添加活动失败: %v", err)
+	}
+}
+
+func newTestPromotionDB(t *testing.T) *sql.DB {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.VIPTiers = nil
+	config.Referral.Reward = 0
+	return newTestDB(t)
+}
+
+var testCodeSeq = 9000
+
+// 生成并兑换一个兑换码，返回活动赠送的合计
+func redeemTestCode(t *testing.T, db *sql.DB, amount float64, account, member, group string) float64 {
+	t.Helper()
+	testCodeSeq++
+	code := fmt.Sprint(testCodeSeq)
+	addTestRechargeCode(t, db, code, amount)
+	_, bonuses, _, err := redeemRechargeCode(db, code, account, member, group)
+	if err != nil {
+		t.Fatalf("兑换失败: %v", err)
+	}
+	total := 0.0
+	for _, bonus := range bonuses {
+		total += bonus.Amount
+	}
+	return total
+}
+
+func TestPromotionUserCapByRemark(t *testing.T) {
+	db := newTestPromotionDB(t)
+	addTestPromotion(t, db, Promotion{Name: "充值送", MinAmount: 100, BonusRate: 0.1, UserCap: 15})
+
+	for i, want := range []float64{10, 5, 0} {
+		if bonus := redeemTestCode(t, db, 100, "小明", "会员-小明", ""); bonus != want {
+			t.Fatalf("第%d次兑换应送%.2f，实际为%.2f", i+1, want, bonus)
+		}
+	}
+	// 改名后备注名不变，仍算同一个人
+	if bonus := redeemTestCode(t, db, 100, "小明改名", "会员-小明", ""); bonus != 0 {
+		t.Fatalf("改名后不应重新计算上限，实际送%.2f", bonus)
+	}
+	if bonus := redeemTestCode(t, db, 100, "路人", "", ""); bonus != 0 {
+		t.Fatalf("没有备注名时不参加限额活动，实际送%.2f", bonus)
+	}
+	if bonus := redeemTestCode(t, db, 50, "小红", "会员-小红", ""); bonus != 0 {
+		t.Fatalf("未达到门槛不应赠送，实际送%.2f", bonus)
+	}
+}
+
+func TestPromotionFirstRechargeOnly(t *testing.T) {
+	db := newTestPromotionDB(t)
+	addTestPromotion(t, db, Promotion{Name: "首充送", FirstOnly: true, BonusAmount: 20})
+
+	if bonus := redeemTestCode(t, db, 30, "小明", "会员-小明", ""); bonus != 20 {
+		t.Fatalf("首次充值应送20，实际为%.2f", bonus)
+	}
+	if bonus := redeemTestCode(t, db, 30, "小明", "会员-小明", ""); bonus != 0 {
+		t.Fatalf("第二次充值不应再送，实际为%.2f", bonus)
+	}
+	if bonus := redeemTestCode(t, db, 30, "小明改名", "会员-小明", ""); bonus != 0 {
+		t.Fatalf("改名后不算首充，实际送%.2f", bonus)
+	}
+	if bonus := redeemTestCode(t, db, 30, "路人", "", ""); bonus != 0 {
+		t.Fatalf("没有备注名时无法确认首充，实际送%.2f", bonus)
+	}
+}
+
+func TestPromotionGroupTargeting(t *testing.T) {
+	db := newTestPromotionDB(t)
+	addTestPromotion(t, db, Promotion{Name: "本群专享", MinAmount: 10, BonusAmount: 3, GroupName: "群A"})
+
+	for group, want := range map[string]float64{"群A": 3, "群B": 0, "": 0} {
+		if bonus := redeemTestCode(t, db, 10, "路人", "", group); bonus != want {
+			t.Errorf("在“%s”兑换应送%.2f，实际为%.2f", group, want, bonus)
+		}
+	}
+
+	// 赠送同时记入活动记录和平台支出
+	var credits int
+	var groupName string
+	db.QueryRow(`SELECT COUNT(*), MAX(group_name) FROM promotion_credits`).Scan(&credits, &groupName)
+	if credits != 1 || groupName != "群A" {
+		t.Fatalf("应有1条群A的赠送记录，实际为%d %s", credits, groupName)
+	}
+	if balance, _ := getWalletBalance(db, platformAccount); balance != -3 {
+		t.Fatalf("平台账户应支出3星卷，实际余额%.2f", balance)
+	}
+}
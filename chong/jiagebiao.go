@@ -0,0 +1,467 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 未指定名称时使用默认价格表；全局默认价格表同步写入 current_event，兼容旧的读取方式
+const defaultPriceListName = "默认"
+
+// 定时价格表状态
+const (
+	priceListScheduled = "待生效"
+	priceListApplied   = "已生效"
+	priceListCancelled = "已取消"
+)
+
+// 价格表按群区分，scope 为群名，空字符串表示全局（私聊和没有自己价格表的群）
+func initPriceListTables(db *sql.DB) {
+	createCurrentEventTableSQL := `
+	CREATE TABLE IF NOT EXISTS current_event (
+		id INTEGER PRIMARY KEY,
+		event_text TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createCurrentEventTableSQL); err != nil {
+		log.Fatalf("创建 current_event 表失败: %s\n", err)
+	}
+
+	createPriceListsTableSQL := `
+	CREATE TABLE IF NOT EXISTS price_lists (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		scope TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		content TEXT NOT NULL,
+		version INTEGER NOT NULL DEFAULT 1,
+		updated_by TEXT NOT NULL DEFAULT '',
+		updated_at TEXT NOT NULL DEFAULT (datetime('now')),
+		UNIQUE(scope, name)
+	);`
+	if _, err := db.Exec(createPriceListsTableSQL); err != nil {
+		log.Fatalf("创建 price_lists 表失败: %s\n", err)
+	}
+
+	createVersionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS price_list_versions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		price_list_id INTEGER NOT NULL,
+		version INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		action TEXT NOT NULL,  -- 设置、追加、定时、恢复
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createVersionsTableSQL); err != nil {
+		log.Fatalf("创建 price_list_versions 表失败: %s\n", err)
+	}
+
+	createSchedulesTableSQL := `
+	CREATE TABLE IF NOT EXISTS price_list_schedules (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		scope TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL,
+		content TEXT NOT NULL,
+		go_live_at TEXT NOT NULL,  -- UTC 时间，和 datetime('now') 比较
+		status TEXT NOT NULL DEFAULT '待生效',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		applied_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createSchedulesTableSQL); err != nil {
+		log.Fatalf("创建 price_list_schedules 表失败: %s\n", err)
+	}
+
+	// 把手工维护的 current_event 导入为全局默认价格表的第一个版本
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM price_lists`).Scan(&count); err != nil {
+		log.Fatalf("读取价格表失败: %s\n", err)
+	}
+	var eventText string
+	if count == 0 && db.QueryRow(`SELECT event_text FROM current_event WHERE id = 1`).Scan(&eventText) == nil && eventText != "" {
+		if _, err := savePriceList(db, "", defaultPriceListName, eventText, "导入", ""); err != nil {
+			log.Fatalf("导入 current_event 失败: %s\n", err)
+		}
+	}
+}
+
+// 保存价格表的新版本，返回版本号
+func savePriceList(db *sql.DB, scope, name, content, action, operator string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	version, err := savePriceListTx(tx, scope, name, content, action, operator)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// 在现有价格表后追加内容，读和写在同一个事务里，两个管理员同时追加不会丢掉一方的内容
+func appendPriceList(db *sql.DB, scope, name, content, operator string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var current string
+	err = tx.QueryRow(`SELECT content FROM price_lists WHERE scope = ? AND name = ?`, scope, name).Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if current != "" {
+		content = current + "\n" + content
+	}
+	version, err := savePriceListTx(tx, scope, name, content, "追加", operator)
+	if err != nil {
+		return 0, err
+	}
+	return version, tx.Commit()
+}
+
+// 在调用方的事务中保存价格表并记一个版本，返回新的版本号
+func savePriceListTx(tx *sql.Tx, scope, name, content, action, operator string) (int, error) {
+	var id, version int
+	err := tx.QueryRow(`SELECT id, version FROM price_lists WHERE scope = ? AND name = ?`, scope, name).Scan(&id, &version)
+	switch {
+	case err == sql.ErrNoRows:
+		version = 1
+		result, err := tx.Exec(`INSERT INTO price_lists (scope, name, content, version, updated_by) VALUES (?, ?, ?, ?, ?)`,
+			scope, name, content, version, operator)
+		if err != nil {
+			return 0, err
+		}
+		lastID, err := result.LastInsertId()
+		if err != nil {
+			return 0, err
+		}
+		id = int(lastID)
+	case err != nil:
+		return 0, err
+	default:
+		version++
+		if _, err := tx.Exec(`UPDATE price_lists SET content = ?, version = ?, updated_by = ?, updated_at = datetime('now') WHERE id = ?`,
+			content, version, operator, id); err != nil {
+			return 0, err
+		}
+	}
+
+	if _, err := tx.Exec(`INSERT INTO price_list_versions (price_list_id, version, content, action, created_by) VALUES (?, ?, ?, ?, ?)`,
+		id, version, content, action, operator); err != nil {
+		return 0, err
+	}
+	if scope == "" && name == defaultPriceListName {
+		if _, err := tx.Exec(`INSERT INTO current_event (id, event_text) VALUES (1, ?) ON CONFLICT(id) DO UPDATE SET event_text = excluded.event_text`, content); err != nil {
+			return 0, err
+		}
+	}
+	return version, nil
+}
+
+func getPriceList(db *sql.DB, scope, name string) (string, bool, error) {
+	var content string
+	err := db.QueryRow(`SELECT content FROM price_lists WHERE scope = ? AND name = ?`, scope, name).Scan(&content)
+	if err == sql.ErrNoRows {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return content, true, nil
+}
+
+// 解析命令中的价格表：空为默认价格表，“名称”为当前群的价格表，“群名/名称”指定群
+func parsePriceListTarget(spec, scope string) (string, string) {
+	spec = strings.TrimSpace(spec)
+	if i := strings.Index(spec, "/"); i >= 0 {
+		scope, spec = strings.TrimSpace(spec[:i]), strings.TrimSpace(spec[i+1:])
+	}
+	if spec == "" {
+		spec = defaultPriceListName
+	}
+	return scope, spec
+}
+
+func priceListLabel(scope, name string) string {
+	if scope == "" {
+		return fmt.Sprintf("价格表“%s”", name)
+	}
+	return fmt.Sprintf("%s的价格表“%s”", scope, name)
+}
+
+// 处理 "价格表[名称]" 和 "价格表列表"，群里没有的价格表使用全局价格表
+func handlePriceList(msg *openwechat.Message, db *sql.DB, scope string) {
+	spec := strings.TrimPrefix(msg.Content, "价格表")
+	if spec == "列表" {
+		listPriceLists(msg, db, scope)
+		return
+	}
+
+	scope, name := parsePriceListTarget(spec, scope)
+	content, found, err := getPriceList(db, scope, name)
+	if err == nil && !found && scope != "" {
+		content, found, err = getPriceList(db, "", name)
+	}
+	if err != nil {
+		log.Printf("查询价格表失败: %v\n", err)
+		msg.ReplyText("获取价格表时发生错误，请稍后重试。")
+		return
+	}
+	if !found {
+		if name == defaultPriceListName {
+			msg.ReplyText(getCurrentEventFromDB(db))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("没有找到价格表“%s”，发送“价格表列表”查看所有价格表。", name))
+		return
+	}
+	msg.ReplyText(content)
+}
+
+func listPriceLists(msg *openwechat.Message, db *sql.DB, scope string) {
+	rows, err := db.Query(`SELECT scope, name, version, updated_at FROM price_lists WHERE scope IN (?, '') ORDER BY scope DESC, name`, scope)
+	if err != nil {
+		msg.ReplyText("获取价格表列表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var s, name, updatedAt string
+		var version int
+		if err := rows.Scan(&s, &name, &version, &updatedAt); err != nil {
+			continue
+		}
+		where := "全局"
+		if s != "" {
+			where = "本群"
+		}
+		response.WriteString(fmt.Sprintf("%s（%s，第%d版，%s更新）\n", name, where, version, updatedAt))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("暂无价格表。")
+		return
+	}
+	msg.ReplyText(response.String() + "发送“价格表[名称]”查看。")
+}
+
+var (
+	setPriceListRe      = regexp.MustCompile(`(?s)^(设置|追加)价格表([^：]*)：(.+)$`)
+	schedulePriceListRe = regexp.MustCompile(`(?s)^定时价格表([^，：]*)，(\d{4}-\d{1,2}-\d{1,2} \d{1,2}:\d{2})：(.+)$`)
+	priceListHistoryRe  = regexp.MustCompile(`^价格表历史(.*)$`)
+	restorePriceListRe  = regexp.MustCompile(`^恢复价格表([^，]*)，[vV第]?(\d+)版?$`)
+	cancelScheduleRe    = regexp.MustCompile(`^取消定时价格表(\d+)号$`)
+)
+
+func isPriceListAdminCommand(content string) bool {
+	return content == "定时价格表列表" || setPriceListRe.MatchString(content) || schedulePriceListRe.MatchString(content) ||
+		priceListHistoryRe.MatchString(content) || restorePriceListRe.MatchString(content) || cancelScheduleRe.MatchString(content)
+}
+
+// 管理员价格表命令：设置、追加、定时、历史、恢复、定时列表、取消定时
+func handlePriceListAdmin(msg *openwechat.Message, db *sql.DB, scope, admin string) {
+	switch {
+	case msg.Content == "定时价格表列表":
+		listScheduledPriceLists(msg, db)
+
+	case setPriceListRe.MatchString(msg.Content):
+		matches := setPriceListRe.FindStringSubmatch(msg.Content)
+		scope, name := parsePriceListTarget(matches[2], scope)
+		content := strings.TrimSpace(matches[3])
+		var version int
+		var err error
+		if matches[1] == "追加" {
+			version, err = appendPriceList(db, scope, name, content, admin)
+		} else {
+			version, err = savePriceList(db, scope, name, content, matches[1], admin)
+		}
+		if err != nil {
+			log.Printf("保存价格表失败: %v\n", err)
+			msg.ReplyText("保存价格表失败，请稍后重试。")
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("%s已%s，当前为第%d版。", priceListLabel(scope, name), matches[1], version))
+
+	case schedulePriceListRe.MatchString(msg.Content):
+		matches := schedulePriceListRe.FindStringSubmatch(msg.Content)
+		scope, name := parsePriceListTarget(matches[1], scope)
+		goLive, err := time.ParseInLocation("2006-1-2 15:04", matches[2], time.Local)
+		if err != nil {
+			msg.ReplyText("时间格式不正确，请按照 '2024-06-01 20:00' 的格式输入。")
+			return
+		}
+		if goLive.Before(time.Now()) {
+			msg.ReplyText("生效时间已经过去，请直接使用“设置价格表”。")
+			return
+		}
+		result, err := db.Exec(`INSERT INTO price_list_schedules (scope, name, content, go_live_at, created_by) VALUES (?, ?, ?, ?, ?)`,
+			scope, name, strings.TrimSpace(matches[3]), goLive.UTC().Format("2006-01-02 15:04:05"), admin)
+		if err != nil {
+			log.Printf("保存定时价格表失败: %v\n", err)
+			msg.ReplyText("保存定时价格表失败，请稍后重试。")
+			return
+		}
+		id, _ := result.LastInsertId()
+		msg.ReplyText(fmt.Sprintf("定时价格表%d号：%s将于%s生效。", id, priceListLabel(scope, name), goLive.Format("2006-01-02 15:04")))
+
+	case priceListHistoryRe.MatchString(msg.Content):
+		scope, name := parsePriceListTarget(priceListHistoryRe.FindStringSubmatch(msg.Content)[1], scope)
+		showPriceListHistory(msg, db, scope, name)
+
+	case restorePriceListRe.MatchString(msg.Content):
+		matches := restorePriceListRe.FindStringSubmatch(msg.Content)
+		scope, name := parsePriceListTarget(matches[1], scope)
+		target, _ := strconv.Atoi(matches[2])
+		var content string
+		err := db.QueryRow(`SELECT v.content FROM price_list_versions v JOIN price_lists p ON p.id = v.price_list_id
+		WHERE p.scope = ? AND p.name = ? AND v.version = ?`, scope, name, target).Scan(&content)
+		if err == sql.ErrNoRows {
+			msg.ReplyText(fmt.Sprintf("%s没有第%d版。", priceListLabel(scope, name), target))
+			return
+		}
+		if err != nil {
+			msg.ReplyText("获取价格表历史时发生错误，请稍后重试。")
+			return
+		}
+		version, err := savePriceList(db, scope, name, content, "恢复", admin)
+		if err != nil {
+			log.Printf("恢复价格表失败: %v\n", err)
+			msg.ReplyText("恢复价格表失败，请稍后重试。")
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("%s已恢复为第%d版的内容，当前为第%d版。", priceListLabel(scope, name), target, version))
+
+	case cancelScheduleRe.MatchString(msg.Content):
+		id, _ := strconv.Atoi(cancelScheduleRe.FindStringSubmatch(msg.Content)[1])
+		result, err := db.Exec(`UPDATE price_list_schedules SET status = ? WHERE id = ? AND status = ?`, priceListCancelled, id, priceListScheduled)
+		if err != nil {
+			msg.ReplyText("取消定时价格表失败，请稍后重试。")
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			msg.ReplyText(fmt.Sprintf("定时价格表%d号不存在或已生效。", id))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("定时价格表%d号已取消。", id))
+	}
+}
+
+func showPriceListHistory(msg *openwechat.Message, db *sql.DB, scope, name string) {
+	rows, err := db.Query(`SELECT v.version, v.action, v.created_by, v.created_at, v.content FROM price_list_versions v
+	JOIN price_lists p ON p.id = v.price_list_id WHERE p.scope = ? AND p.name = ? ORDER BY v.version DESC LIMIT 10`, scope, name)
+	if err != nil {
+		msg.ReplyText("获取价格表历史时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var version int
+		var action, createdBy, createdAt, content string
+		if err := rows.Scan(&version, &action, &createdBy, &createdAt, &content); err != nil {
+			continue
+		}
+		preview := []rune(strings.ReplaceAll(content, "\n", " "))
+		if len(preview) > 20 {
+			preview = append(preview[:20], []rune("…")...)
+		}
+		response.WriteString(fmt.Sprintf("第%d版 %s %s %s：%s\n", version, createdAt, createdBy, action, string(preview)))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText(fmt.Sprintf("%s不存在。", priceListLabel(scope, name)))
+		return
+	}
+	msg.ReplyText(response.String() + "发送“恢复价格表[名称]，[版本号]”恢复旧版本。")
+}
+
+func listScheduledPriceLists(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, scope, name, go_live_at, created_by FROM price_list_schedules WHERE status = ? ORDER BY go_live_at`, priceListScheduled)
+	if err != nil {
+		msg.ReplyText("获取定时价格表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var id int
+		var scope, name, goLiveAt, createdBy string
+		if err := rows.Scan(&id, &scope, &name, &goLiveAt, &createdBy); err != nil {
+			continue
+		}
+		if t, err := time.ParseInLocation("2006-01-02 15:04:05", goLiveAt, time.UTC); err == nil {
+			goLiveAt = t.Local().Format("2006-01-02 15:04")
+		}
+		response.WriteString(fmt.Sprintf("%d号：%s，%s生效，%s设置\n", id, priceListLabel(scope, name), goLiveAt, createdBy))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("没有待生效的定时价格表。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+// 定时任务：到时间的定时价格表生效
+func applyScheduledPriceLists(db *sql.DB) {
+	rows, err := db.Query(`SELECT id, scope, name, content, created_by FROM price_list_schedules
+	WHERE status = ? AND go_live_at <= datetime('now') ORDER BY go_live_at`, priceListScheduled)
+	if err != nil {
+		log.Printf("查询定时价格表失败: %v\n", err)
+		return
+	}
+	type schedule struct {
+		id                             int
+		scope, name, content, operator string
+	}
+	var due []schedule
+	for rows.Next() {
+		var s schedule
+		if err := rows.Scan(&s.id, &s.scope, &s.name, &s.content, &s.operator); err != nil {
+			log.Printf("读取定时价格表失败: %v\n", err)
+			continue
+		}
+		due = append(due, s)
+	}
+	rows.Close()
+
+	for _, s := range due {
+		if err := applyScheduledPriceList(db, s.id, s.scope, s.name, s.content, s.operator); err != nil {
+			log.Printf("定时价格表%d号生效失败: %v\n", s.id, err)
+		}
+	}
+}
+
+// 价格表生效和定时任务标记已生效在同一个事务里，不会重复生效，也不会生效了却仍显示待生效
+func applyScheduledPriceList(db *sql.DB, id int, scope, name, content, operator string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE price_list_schedules SET status = ?, applied_at = datetime('now') WHERE id = ? AND status = ?`,
+		priceListApplied, id, priceListScheduled)
+	if err != nil {
+		return err
+	}
+	// 已被取消或已生效
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil
+	}
+	if _, err := savePriceListTx(tx, scope, name, content, "定时", operator); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestApplyScheduledPriceLists(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec(`INSERT INTO price_list_schedules (scope, name, content, go_live_at, created_by) VALUES
+		('', '周末', '周末价格', datetime('now', '-1 minutes'), '管理员'),
+		('', '下周', '下周价格', datetime('now', '+1 days'), '管理员')`); err != nil {
+		t.Fatalf("写入定时价格表失败: %v", err)
+	}
+
+	applyScheduledPriceLists(db)
+	applyScheduledPriceLists(db)
+
+	if content, ok, err := getPriceList(db, "", "周末"); err != nil || !ok || content != "周末价格" {
+		t.Fatalf("到期的价格表应生效，得到 %q, %v, %v", content, ok, err)
+	}
+	if _, ok, _ := getPriceList(db, "", "下周"); ok {
+		t.Fatal("未到期的价格表不应生效")
+	}
+	var versions int
+	db.QueryRow(`SELECT COUNT(*) FROM price_list_versions v JOIN price_lists p ON p.id = v.price_list_id WHERE p.name = '周末'`).Scan(&versions)
+	if versions != 1 {
+		t.Fatalf("重复执行定时任务不应重复生效，版本数为%d", versions)
+	}
+	var status string
+	db.QueryRow(`SELECT status FROM price_list_schedules WHERE name = '周末'`).Scan(&status)
+	if status != priceListApplied {
+		t.Fatalf("定时任务状态应为%s，实际为%s", priceListApplied, status)
+	}
+}
+
+func TestAppendPriceList(t *testing.T) {
+	db := newTestDB(t)
+	if version, err := appendPriceList(db, "", "代练", "青铜 10", "管理员"); err != nil || version != 1 {
+		t.Fatalf("追加到不存在的价格表应新建第1版: %d %v", version, err)
+	}
+	if version, err := appendPriceList(db, "", "代练", "白银 20", "管理员"); err != nil || version != 2 {
+		t.Fatalf("追加失败: %d %v", version, err)
+	}
+	content, _, _ := getPriceList(db, "", "代练")
+	if content != "青铜 10\n白银 20" {
+		t.Fatalf("追加后的内容不对: %q", content)
+	}
+	var action string
+	db.QueryRow(`SELECT action FROM price_list_versions WHERE version = 2`).Scan(&action)
+	if action != "追加" {
+		t.Fatalf("版本记录的操作应为追加，实际为%s", action)
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 交易品状态
+const (
+	tradeItemOnSale   = "在售"
+	tradeItemDelisted = "已下架"
+	tradeItemExpired  = "已过期"
+)
+
+// 交易品状态和更新时间，过期时间从最后一次修改或上架开始计算
+func initTradeItemStatus(db *sql.DB) {
+	addColumnIfMissing(db, "trade_items", "status", "TEXT NOT NULL DEFAULT '在售'")
+	addColumnIfMissing(db, "trade_items", "updated_at", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "trade_items", "expiry_reminded", "INTEGER NOT NULL DEFAULT 0")
+	if _, err := db.Exec(`UPDATE trade_items SET updated_at = datetime('now') WHERE updated_at = ''`); err != nil {
+		log.Fatalf("初始化交易品更新时间失败: %s\n", err)
+	}
+}
+
+var editTradeItemRe = regexp.MustCompile(`^修改交易品(\d+)号，(.+)$`)
+
+// 字段名只认这几个，值里可以带逗号，例如“描述：九成新，带包装”
+var editTradeFieldRe = regexp.MustCompile(`(?:^|，)(名称|价格|数量|描述)：`)
+
+// 处理 "修改交易品N号，价格：100，数量：2，描述：xxx" 命令，字段可任选
+func handleEditTradeItem(msg *openwechat.Message, db *sql.DB, seller string) {
+	matches := editTradeItemRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '修改交易品[交易ID]号，价格：[价格]，数量：[数量]，描述：[描述]' 的格式输入，字段可任选。")
+		return
+	}
+	tradeID, _ := strconv.Atoi(matches[1])
+
+	sets, args, err := parseTradeItemEdit(matches[2])
+	if err != nil {
+		msg.ReplyText(err.Error())
+		return
+	}
+
+	tradeItem, ok := getOwnTradeItem(msg, db, tradeID, seller)
+	if !ok {
+		return
+	}
+	if tradeItem.Status == tradeItemDelisted {
+		msg.ReplyText("该交易品已下架，请先发送“上架N号”重新上架。")
+		return
+	}
+
+	if err := editTradeItem(db, tradeItem, sets, args); err != nil {
+		log.Printf("修改交易品失败: %v\n", err)
+		msg.ReplyText("修改交易品失败，请稍后重试。")
+		return
+	}
+	if tradeItem.Status == tradeItemExpired {
+		msg.ReplyText(fmt.Sprintf("交易品%d号已修改并重新上架，有效期%d天。", tradeID, config.ListingExpiryDays))
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("交易品%d号已修改完成。", tradeID))
+}
+
+// 解析要修改的字段，返回 UPDATE 的 SET 子句和参数，错误信息可直接回复给用户
+func parseTradeItemEdit(text string) ([]string, []interface{}, error) {
+	locs := editTradeFieldRe.FindAllStringSubmatchIndex(text, -1)
+	if len(locs) == 0 || locs[0][0] != 0 {
+		field := text
+		if len(locs) > 0 {
+			field = text[:locs[0][0]]
+		}
+		if kv := strings.SplitN(field, "：", 2); len(kv) == 2 {
+			return nil, nil, fmt.Errorf("不支持修改“%s”，可修改的字段：名称、价格、数量、描述。", strings.TrimSpace(kv[0]))
+		}
+		return nil, nil, fmt.Errorf("无法识别“%s”，请使用“字段：值”的格式。", field)
+	}
+
+	var sets []string
+	var args []interface{}
+	for i, loc := range locs {
+		key := text[loc[2]:loc[3]]
+		end := len(text)
+		if i+1 < len(locs) {
+			end = locs[i+1][0]
+		}
+		value := strings.TrimSpace(text[loc[1]:end])
+		switch key {
+		case "价格":
+			price, err := strconv.ParseFloat(value, 64)
+			if err != nil || price <= 0 {
+				return nil, nil, fmt.Errorf("价格格式不正确。请确保是数字。")
+			}
+			sets, args = append(sets, "price = ?"), append(args, price)
+		case "数量":
+			quantity, err := strconv.Atoi(value)
+			if err != nil || quantity < 0 {
+				return nil, nil, fmt.Errorf("数量格式不正确。请确保是整数。")
+			}
+			sets, args = append(sets, "quantity = ?"), append(args, quantity)
+		case "描述":
+			sets, args = append(sets, "description = ?"), append(args, value)
+		case "名称":
+			if value == "" {
+				return nil, nil, fmt.Errorf("名称不能为空。")
+			}
+			sets, args = append(sets, "item_name = ?"), append(args, value)
+		}
+	}
+	return sets, args, nil
+}
+
+// 保存修改并重新计算有效期，已过期的交易品修改后重新上架
+func editTradeItem(db *sql.DB, tradeItem *TradeItem, sets []string, args []interface{}) error {
+	sets = append(sets, "status = ?", "updated_at = datetime('now')", "expiry_reminded = 0")
+	args = append(args, tradeItemOnSale, tradeItem.ID, tradeItem.Status)
+	result, err := db.Exec(`UPDATE trade_items SET `+strings.Join(sets, ", ")+` WHERE id = ? AND status = ?`, args...)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("交易品%d号状态已变化", tradeItem.ID)
+	}
+	return nil
+}
+
+// 处理 "下架N号" 与 "上架N号" 命令
+func handleListTradeItem(msg *openwechat.Message, db *sql.DB, seller string) {
+	var tradeID int
+	delist := strings.HasPrefix(msg.Content, "下架")
+	format := "上架%d号"
+	if delist {
+		format = "下架%d号"
+	}
+	if _, err := fmt.Sscanf(msg.Content, format, &tradeID); err != nil {
+		msg.ReplyText("指令格式错误，请按照 '下架[交易ID]号' 或 '上架[交易ID]号' 的格式输入。")
+		return
+	}
+
+	tradeItem, ok := getOwnTradeItem(msg, db, tradeID, seller)
+	if !ok {
+		return
+	}
+
+	status := tradeItemOnSale
+	if delist {
+		status = tradeItemDelisted
+	}
+	// 在售的交易品再次上架表示续期
+	if delist && tradeItem.Status == status {
+		msg.ReplyText(fmt.Sprintf("交易品%s当前已是%s状态。", tradeItem.ItemName, status))
+		return
+	}
+	if err := setTradeItemStatus(db, tradeID, status); err != nil {
+		log.Printf("更新交易品状态失败: %v\n", err)
+		msg.ReplyText("操作失败，请稍后重试。")
+		return
+	}
+	if delist {
+		msg.ReplyText(fmt.Sprintf("交易品%s已下架。", tradeItem.ItemName))
+	} else {
+		msg.ReplyText(fmt.Sprintf("交易品%s已重新上架，有效期%d天。", tradeItem.ItemName, config.ListingExpiryDays))
+	}
+}
+
+// 查询交易品并确认发送者是卖家本人
+func getOwnTradeItem(msg *openwechat.Message, db *sql.DB, tradeID int, seller string) (*TradeItem, bool) {
+	tradeItem, err := getTradeItemByID(db, tradeID)
+	if err != nil {
+		msg.ReplyText("获取交易品信息时发生错误，请稍后重试。")
+		return nil, false
+	}
+	if tradeItem == nil || tradeItem.Seller != seller {
+		msg.ReplyText("未找到您发布的该交易品，只有卖家本人可以操作。")
+		return nil, false
+	}
+	return tradeItem, true
+}
+
+func setTradeItemStatus(db *sql.DB, tradeItemID int, status string) error {
+	_, err := db.Exec(`UPDATE trade_items SET status = ?, updated_at = datetime('now'), expiry_reminded = 0 WHERE id = ?`, status, tradeItemID)
+	return err
+}
+
+// 定时检查交易品有效期：临近过期时提醒卖家，到期后自动下架
+func expireTradeItems(db *sql.DB, self *openwechat.Self) {
+	if config.ListingExpiryDays <= 0 {
+		return
+	}
+	expiry := fmt.Sprintf("-%d days", config.ListingExpiryDays)
+	remindAt := fmt.Sprintf("+%d hours", config.ExpiryReminderHours)
+
+	rows, err := db.Query(`SELECT id, seller, item_name FROM trade_items
+	WHERE status = ? AND expiry_reminded = 0 AND updated_at > datetime('now', ?) AND datetime(updated_at, ?) <= datetime('now', ?)`,
+		tradeItemOnSale, expiry, fmt.Sprintf("+%d days", config.ListingExpiryDays), remindAt)
+	if err != nil {
+		log.Printf("查询即将过期的交易品失败: %v\n", err)
+		return
+	}
+	var reminders []TradeItem
+	for rows.Next() {
+		var item TradeItem
+		if err := rows.Scan(&item.ID, &item.Seller, &item.ItemName); err != nil {
+			log.Printf("读取即将过期的交易品失败: %v\n", err)
+			continue
+		}
+		reminders = append(reminders, item)
+	}
+	rows.Close()
+
+	for _, item := range reminders {
+		text := fmt.Sprintf("您的交易品%d号（%s）将在%d小时内过期下架，发送“上架%d号”可以续期。", item.ID, item.ItemName, config.ExpiryReminderHours, item.ID)
+		if err := sendTextToNickName(self, item.Seller, text); err != nil {
+			log.Printf("发送过期提醒失败: %v\n", err)
+		}
+		if _, err := db.Exec(`UPDATE trade_items SET expiry_reminded = 1 WHERE id = ?`, item.ID); err != nil {
+			log.Printf("更新过期提醒状态失败: %v\n", err)
+		}
+	}
+
+	result, err := db.Exec(`UPDATE trade_items SET status = ? WHERE status = ? AND updated_at <= datetime('now', ?)`,
+		tradeItemExpired, tradeItemOnSale, expiry)
+	if err != nil {
+		log.Printf("下架过期交易品失败: %v\n", err)
+		return
+	}
+	if n, _ := result.RowsAffected(); n > 0 {
+		log.Printf("已自动下架 %d 件过期交易品\n", n)
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseTradeItemEdit(t *testing.T) {
+	sets, args, err := parseTradeItemEdit("价格：99.5，描述：九成新，带包装，数量：3")
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if strings.Join(sets, ",") != "price = ?,description = ?,quantity = ?" {
+		t.Fatalf("字段不对: %v", sets)
+	}
+	if args[0] != 99.5 || args[1] != "九成新，带包装" || args[2] != 3 {
+		t.Fatalf("字段值不对: %v", args)
+	}
+
+	for text, want := range map[string]string{
+		"颜色：红":      "不支持修改“颜色”",
+		"价格100":     "无法识别",
+		"价格：abc":    "价格格式不正确",
+		"数量：-1":     "数量格式不正确",
+		"名称：，价格：10": "名称不能为空",
+	} {
+		if _, _, err := parseTradeItemEdit(text); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s 应返回“%s”，实际为 %v", text, want, err)
+		}
+	}
+}
+
+func TestEditExpiredTradeItemRelists(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestTradeItem(t, db, "卖家", 10, 1)
+	if _, err := db.Exec(`UPDATE trade_items SET status = ?, updated_at = datetime('now', '-30 days') WHERE id = ?`, tradeItemExpired, item.ID); err != nil {
+		t.Fatalf("设置过期失败: %v", err)
+	}
+	item, _ = getTradeItemByID(db, item.ID)
+
+	sets, args, _ := parseTradeItemEdit("价格：20")
+	if err := editTradeItem(db, item, sets, args); err != nil {
+		t.Fatalf("修改交易品失败: %v", err)
+	}
+	edited, _ := getTradeItemByID(db, item.ID)
+	if edited.Status != tradeItemOnSale || edited.Price != 20 {
+		t.Fatalf("过期的交易品修改后应重新上架: %s %.2f", edited.Status, edited.Price)
+	}
+
+	// 读取后状态又变了，不覆盖
+	setTradeItemStatus(db, item.ID, tradeItemDelisted)
+	if err := editTradeItem(db, edited, sets, args); err == nil {
+		t.Fatal("已下架的交易品不应被修改")
+	}
+}
+
+func TestExpireTradeItems(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.ListingExpiryDays = 7
+	config.ExpiryReminderHours = 0
+
+	db := newTestDB(t)
+	old := addTestTradeItem(t, db, "卖家", 10, 1)
+	fresh := addTestTradeItem(t, db, "卖家", 10, 1)
+	delisted := addTestTradeItem(t, db, "卖家", 10, 1)
+	db.Exec(`UPDATE trade_items SET updated_at = datetime('now', '-8 days') WHERE id IN (?, ?)`, old.ID, delisted.ID)
+	db.Exec(`UPDATE trade_items SET status = ? WHERE id = ?`, tradeItemDelisted, delisted.ID)
+
+	expireTradeItems(db, nil)
+
+	for id, want := range map[int]string{old.ID: tradeItemExpired, fresh.ID: tradeItemOnSale, delisted.ID: tradeItemDelisted} {
+		item, _ := getTradeItemByID(db, id)
+		if item.Status != want {
+			t.Errorf("交易品%d号状态应为%s，实际为%s", id, want, item.Status)
+		}
+	}
+}
+
+// 新上架的交易品要从上架时间开始计算有效期
+func TestNewTradeItemNotExpiredImmediately(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.ListingExpiryDays = 7
+
+	db := newTestDB(t)
+	if err := insertTradeItem(db, "卖家", "新交易品", "", 10, 1, ""); err != nil {
+		t.Fatalf("上架失败: %v", err)
+	}
+	expireTradeItems(db, nil)
+	var status string
+	db.QueryRow(`SELECT status FROM trade_items WHERE item_name = '新交易品'`).Scan(&status)
+	if status != tradeItemOnSale {
+		t.Fatalf("新上架的交易品不应立即过期，状态为%s", status)
+	}
+}
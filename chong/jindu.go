@@ -0,0 +1,216 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+const (
+	// 进度截图保存目录，与交易品图片一样由 savePicture 写入
+	progressScreenshotDir = "../jindu"
+	// 更新进度后多少分钟内发送的图片算作这条进度的截图
+	progressScreenshotMinutes = 10
+)
+
+// 上星订单的进度时间线，note 为空表示普通进度，结单和撤单也各记一条
+func initProgressTables(db *sql.DB) {
+	createBridgeProgressTableSQL := `
+	CREATE TABLE IF NOT EXISTS bridge_progress (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		bridge_id INTEGER NOT NULL,
+		reporter TEXT NOT NULL,
+		stars INTEGER NOT NULL DEFAULT 0,
+		current_rank TEXT NOT NULL DEFAULT '',
+		screenshot TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createBridgeProgressTableSQL); err != nil {
+		log.Fatalf("创建 bridge_progress 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_bridge_progress_bridge ON bridge_progress (bridge_id, id)`); err != nil {
+		log.Fatalf("创建 bridge_progress 索引失败: %s\n", err)
+	}
+}
+
+func insertBridgeProgress(tx *sql.Tx, bridgeID int, reporter string, stars int, rank, note string) (int, error) {
+	result, err := tx.Exec(`INSERT INTO bridge_progress (bridge_id, reporter, stars, current_rank, note) VALUES (?, ?, ?, ?, ?)`,
+		bridgeID, reporter, stars, rank, note)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	return int(id), err
+}
+
+// 等待截图的进度，按上报人昵称记录
+type pendingScreenshot struct {
+	progressID int
+	expiresAt  time.Time
+}
+
+var progressScreenshots = struct {
+	sync.Mutex
+	m map[string]pendingScreenshot
+}{m: make(map[string]pendingScreenshot)}
+
+func awaitProgressScreenshot(reporter string, progressID int) {
+	progressScreenshots.Lock()
+	progressScreenshots.m[reporter] = pendingScreenshot{progressID, time.Now().Add(progressScreenshotMinutes * time.Minute)}
+	progressScreenshots.Unlock()
+}
+
+// 取出上报人等待截图的进度，每条进度只接收一张截图，超时后不再接收
+func takeProgressScreenshot(reporter string) (int, bool) {
+	progressScreenshots.Lock()
+	defer progressScreenshots.Unlock()
+	pending, ok := progressScreenshots.m[reporter]
+	if !ok {
+		return 0, false
+	}
+	delete(progressScreenshots.m, reporter)
+	if time.Now().After(pending.expiresAt) {
+		return 0, false
+	}
+	return pending.progressID, true
+}
+
+// 打手更新进度后发送的图片保存为进度截图并转发给下单用户，返回 true 表示图片已处理
+func attachProgressScreenshot(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, reporter string) bool {
+	progressID, ok := takeProgressScreenshot(reporter)
+	if !ok {
+		return false
+	}
+
+	imgData, err := msg.GetPicture()
+	if err != nil {
+		log.Printf("获取进度截图失败: %v\n", err)
+		msg.ReplyText("获取截图失败，请稍后重试。")
+		return true
+	}
+	fileName, err := savePicture(progressScreenshotDir, imgData)
+	if err != nil {
+		log.Printf("保存进度截图失败: %v\n", err)
+		msg.ReplyText("保存截图失败，请稍后重试。")
+		return true
+	}
+	var bridgeID int
+	if err := db.QueryRow(`SELECT bridge_id FROM bridge_progress WHERE id = ?`, progressID).Scan(&bridgeID); err != nil {
+		log.Printf("查询进度记录失败: %v\n", err)
+		return true
+	}
+	if _, err := db.Exec(`UPDATE bridge_progress SET screenshot = ? WHERE id = ?`, fileName, progressID); err != nil {
+		log.Printf("保存进度截图失败: %v\n", err)
+		msg.ReplyText("保存截图失败，请稍后重试。")
+		return true
+	}
+	msg.ReplyText(fmt.Sprintf("截图已附在上星订单%d号的进度上。", bridgeID))
+
+	if bridge, err := getBridge(db, bridgeID); err == nil {
+		if err := sendProgressScreenshot(self, bridge.User, fileName); err != nil {
+			log.Printf("向 [%s] 转发进度截图失败: %v\n", bridge.User, err)
+		}
+	}
+	return true
+}
+
+// 通过 replyToUser 私聊下单用户，数据库里记的是昵称，先换成好友的 UserName
+func notifyBridgeCustomer(self *openwechat.Self, user, content string) {
+	friend, err := findFriendByNickName(self, user)
+	if err != nil {
+		log.Printf("通知上星订单用户失败: %v\n", err)
+		return
+	}
+	replyToUser(self, friend.UserName, content)
+}
+
+func sendProgressScreenshot(self *openwechat.Self, user, fileName string) error {
+	friend, err := findFriendByNickName(self, user)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filepath.Join(progressScreenshotDir, fileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = friend.SendImage(file)
+	return err
+}
+
+var bridgeTimelineRe = regexp.MustCompile(`^进度(\d+)号$`)
+
+// 处理 "进度N号"，下单用户、接单打手和管理员可以查看进度时间线，最新的截图随后发出
+func handleBridgeTimeline(msg *openwechat.Message, db *sql.DB, viewer string) {
+	id, _ := strconv.Atoi(bridgeTimelineRe.FindStringSubmatch(msg.Content)[1])
+	bridge, err := getBridge(db, id)
+	if err != nil || (bridge.User != viewer && !canUpdateBridge(db, viewer, id)) {
+		msg.ReplyText(fmt.Sprintf("上星订单%d号不存在。", id))
+		return
+	}
+
+	text, latestScreenshot, err := bridgeTimeline(db, bridge)
+	if err != nil {
+		log.Printf("获取上星订单%d号进度失败: %v\n", id, err)
+		msg.ReplyText("获取进度时发生错误，请稍后重试。")
+		return
+	}
+	msg.ReplyText(text)
+
+	if latestScreenshot != "" {
+		if err := sendtupian(msg, filepath.Join(progressScreenshotDir, latestScreenshot)); err != nil {
+			log.Printf("发送进度截图失败: %v\n", err)
+		}
+	}
+}
+
+// 按上报顺序列出进度，同时返回最新的一张截图
+func bridgeTimeline(db *sql.DB, bridge *Bridge) (string, string, error) {
+	rows, err := db.Query(`SELECT stars, current_rank, screenshot, note, created_at FROM bridge_progress WHERE bridge_id = ? ORDER BY id`, bridge.ID)
+	if err != nil {
+		return "", "", err
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	response.WriteString(bridge.progressText() + "\n")
+	latestScreenshot := ""
+	entries := 0
+	for rows.Next() {
+		var stars int
+		var rank, screenshot, note, createdAt string
+		if err := rows.Scan(&stars, &rank, &screenshot, &note, &createdAt); err != nil {
+			return "", "", err
+		}
+		line := fmt.Sprintf("%s %d星", createdAt, stars)
+		if rank != "" {
+			line += " " + rank
+		}
+		if note != "" {
+			line += " " + note
+		}
+		if screenshot != "" {
+			line += "（有截图）"
+			latestScreenshot = screenshot
+		}
+		response.WriteString(line + "\n")
+		entries++
+	}
+	if err := rows.Err(); err != nil {
+		return "", "", err
+	}
+	if entries == 0 {
+		response.WriteString("还没有进度记录，打手接单后会及时更新。\n")
+	}
+	return strings.TrimRight(response.String(), "\n"), latestScreenshot, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// 进度、审计日志和时间线在同一个事务里写入，被拒绝的进度一样都不留
+func TestBridgeProgressWritesAuditLog(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	_, progressID, err := updateBridgeProgress(db, bridge.ID, 4, "星耀", "打手")
+	if err != nil {
+		t.Fatalf("更新进度失败: %v", err)
+	}
+	var before, after string
+	err = db.QueryRow(`SELECT before_value, after_value FROM admin_audit_logs WHERE action = '上星进度' AND target = ?`,
+		"上星订单1号").Scan(&before, &after)
+	if err != nil {
+		t.Fatalf("进度没有写入审计日志: %v", err)
+	}
+	if before != "0星 " || after != "4星 星耀" {
+		t.Fatalf("审计日志记录的进度为%q → %q", before, after)
+	}
+	var reporter, rank string
+	var stars int
+	err = db.QueryRow(`SELECT reporter, stars, current_rank FROM bridge_progress WHERE id = ? AND bridge_id = ?`,
+		progressID, bridge.ID).Scan(&reporter, &stars, &rank)
+	if err != nil || reporter != "打手" || stars != 4 || rank != "星耀" {
+		t.Fatalf("进度记录不对: %s %d %s %v", reporter, stars, rank, err)
+	}
+
+	// 不写段位时沿用上次的段位
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 5, "", "打手"); err != nil {
+		t.Fatalf("更新进度失败: %v", err)
+	}
+	db.QueryRow(`SELECT after_value FROM admin_audit_logs WHERE action = '上星进度' ORDER BY id DESC LIMIT 1`).Scan(&after)
+	if after != "5星 星耀" {
+		t.Fatalf("未写段位时应沿用星耀，审计日志为%q", after)
+	}
+
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 3, "", "打手"); err == nil {
+		t.Fatal("进度不能回退")
+	}
+	var logs, entries int
+	db.QueryRow(`SELECT COUNT(*) FROM admin_audit_logs WHERE action = '上星进度'`).Scan(&logs)
+	db.QueryRow(`SELECT COUNT(*) FROM bridge_progress WHERE bridge_id = ?`, bridge.ID).Scan(&entries)
+	if logs != 2 || entries != 2 {
+		t.Fatalf("被拒绝的进度不应写入，审计日志%d条，进度%d条", logs, entries)
+	}
+}
+
+func TestBridgeTimeline(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	text, screenshot, err := bridgeTimeline(db, bridge)
+	if err != nil || !strings.Contains(text, "还没有进度记录") || screenshot != "" {
+		t.Fatalf("没有进度时的时间线不对: %q %q %v", text, screenshot, err)
+	}
+
+	_, first, _ := updateBridgeProgress(db, bridge.ID, 3, "钻石", "打手")
+	_, second, _ := updateBridgeProgress(db, bridge.ID, 6, "星耀", "打手")
+	db.Exec(`UPDATE bridge_progress SET screenshot = ? WHERE id = ?`, "a.jpg", first)
+	db.Exec(`UPDATE bridge_progress SET screenshot = ? WHERE id = ?`, "b.jpg", second)
+	bridge, _ = getBridge(db, bridge.ID)
+	if _, err := closeBridge(db, bridge.ID, "王者", "管理员"); err != nil {
+		t.Fatalf("结单失败: %v", err)
+	}
+
+	text, screenshot, err = bridgeTimeline(db, bridge)
+	if err != nil {
+		t.Fatalf("获取时间线失败: %v", err)
+	}
+	lines := strings.Split(text, "\n")
+	if len(lines) != 4 {
+		t.Fatalf("时间线应有概况和3条进度: %q", text)
+	}
+	for i, want := range []string{"3星 钻石（有截图）", "6星 星耀（有截图）", "6星 王者 结单"} {
+		if !strings.HasSuffix(lines[i+1], want) {
+			t.Errorf("第%d条进度应以“%s”结尾，实际为%q", i+1, want, lines[i+1])
+		}
+	}
+	if screenshot != "b.jpg" {
+		t.Fatalf("应发出最新的截图，实际为%q", screenshot)
+	}
+}
+
+func TestCancelBridgeRecordsTimeline(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	if _, _, err := cancelBridge(db, bridge.ID, "老板", "用户撤单", true); err != nil {
+		t.Fatalf("撤单失败: %v", err)
+	}
+	var reporter, note string
+	db.QueryRow(`SELECT reporter, note FROM bridge_progress WHERE bridge_id = ?`, bridge.ID).Scan(&reporter, &note)
+	if reporter != "老板" || note != "撤单" {
+		t.Fatalf("撤单应记入时间线: %s %s", reporter, note)
+	}
+}
+
+// 每条进度只接收一张截图，过期后的图片不再当作截图
+func TestTakeProgressScreenshot(t *testing.T) {
+	awaitProgressScreenshot("打手甲", 7)
+	if id, ok := takeProgressScreenshot("打手甲"); !ok || id != 7 {
+		t.Fatalf("应取到7号进度，得到 %d %v", id, ok)
+	}
+	if _, ok := takeProgressScreenshot("打手甲"); ok {
+		t.Fatal("同一条进度不应接收第二张截图")
+	}
+	if _, ok := takeProgressScreenshot("打手乙"); ok {
+		t.Fatal("没有更新进度的打手发图不应当作截图")
+	}
+
+	awaitProgressScreenshot("打手甲", 8)
+	progressScreenshots.Lock()
+	pending := progressScreenshots.m["打手甲"]
+	pending.expiresAt = time.Now().Add(-time.Second)
+	progressScreenshots.m["打手甲"] = pending
+	progressScreenshots.Unlock()
+	if _, ok := takeProgressScreenshot("打手甲"); ok {
+		t.Fatal("超时后不应再接收截图")
+	}
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// 后台网页配置，Listen 为空时不启动，未设置密码时不开放看板
+type WebConfig struct {
+	Listen       string `json:"listen"`        // 监听地址，例如 127.0.0.1:8088
+	Username     string `json:"username"`      // 看板登录用户名
+	Password     string `json:"password"`      // 看板登录密码
+	SessionHours int    `json:"session_hours"` // 登录有效期
+}
+
+const sessionCookieName = "chong_session"
+
+// 登录会话只保存在内存中，机器人重启后需要重新登录
+var webSessions = struct {
+	sync.Mutex
+	expires map[string]time.Time
+}{expires: make(map[string]time.Time)}
+
+// 启动后台网页服务，和机器人在同一进程中运行
+func startWebServer(db *sql.DB) {
+	if config.Web.Listen == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	apiEnabled := registerAPIRoutes(mux, db)
+	if config.Web.Password == "" {
+		if !apiEnabled {
+			log.Printf("未设置后台登录密码和 API 密钥，不启动网页服务\n")
+			return
+		}
+		log.Printf("未设置后台登录密码，只开放 API\n")
+	} else {
+		registerDashboardRoutes(mux, db)
+	}
+
+	log.Printf("后台网页服务监听 %s\n", config.Web.Listen)
+	if err := http.ListenAndServe(config.Web.Listen, mux); err != nil {
+		log.Printf("后台网页服务退出: %v\n", err)
+	}
+}
+
+func registerDashboardRoutes(mux *http.ServeMux, db *sql.DB) {
+	// comon0.css 引用的 DS-DIGIT.TTF 和 iconfont 的字体文件都不在仓库里，页面只用系统字体
+	mux.Handle("/css/", http.StripPrefix("/css/", http.FileServer(http.Dir("../css"))))
+	mux.HandleFunc("/login", handleWebLogin)
+	mux.HandleFunc("/logout", handleWebLogout)
+	mux.HandleFunc("/", requireWebLogin(handleDashboardPage))
+	mux.HandleFunc("/dashboard/summary", requireWebLogin(func(w http.ResponseWriter, r *http.Request) { dashboardSummary(w, db) }))
+	mux.HandleFunc("/dashboard/top-sellers", requireWebLogin(func(w http.ResponseWriter, r *http.Request) { dashboardTopSellers(w, db) }))
+	mux.HandleFunc("/dashboard/groups", requireWebLogin(func(w http.ResponseWriter, r *http.Request) { dashboardGroups(w, db) }))
+	mux.HandleFunc("/dashboard/trades", requireWebLogin(func(w http.ResponseWriter, r *http.Request) { dashboardActiveTrades(w, db) }))
+}
+
+func requireWebLogin(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		cookie, err := r.Cookie(sessionCookieName)
+		if err == nil && validWebSession(cookie.Value) {
+			next(w, r)
+			return
+		}
+		if r.URL.Path == "/" {
+			http.Redirect(w, r, "/login", http.StatusFound)
+			return
+		}
+		http.Error(w, "未登录", http.StatusUnauthorized)
+	}
+}
+
+func validWebSession(token string) bool {
+	webSessions.Lock()
+	defer webSessions.Unlock()
+	expires, ok := webSessions.expires[token]
+	if !ok {
+		return false
+	}
+	if time.Now().After(expires) {
+		delete(webSessions.expires, token)
+		return false
+	}
+	return true
+}
+
+func handleWebLogin(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Write([]byte(loginPageHTML))
+		return
+	}
+
+	username := []byte(r.FormValue("username"))
+	password := []byte(r.FormValue("password"))
+	if subtle.ConstantTimeCompare(username, []byte(config.Web.Username)) != 1 ||
+		subtle.ConstantTimeCompare(password, []byte(config.Web.Password)) != 1 {
+		log.Printf("后台登录失败，来自 %s\n", r.RemoteAddr)
+		http.Redirect(w, r, "/login?failed=1", http.StatusFound)
+		return
+	}
+
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		http.Error(w, "生成会话失败", http.StatusInternalServerError)
+		return
+	}
+	token := hex.EncodeToString(buf)
+	hours := config.Web.SessionHours
+	if hours <= 0 {
+		hours = 12
+	}
+	expires := time.Now().Add(time.Duration(hours) * time.Hour)
+
+	webSessions.Lock()
+	for t, e := range webSessions.expires {
+		if time.Now().After(e) {
+			delete(webSessions.expires, t)
+		}
+	}
+	webSessions.expires[token] = expires
+	webSessions.Unlock()
+
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: token, Path: "/", Expires: expires,
+		HttpOnly: true, SameSite: http.SameSiteStrictMode})
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func handleWebLogout(w http.ResponseWriter, r *http.Request) {
+	if cookie, err := r.Cookie(sessionCookieName); err == nil {
+		webSessions.Lock()
+		delete(webSessions.expires, cookie.Value)
+		webSessions.Unlock()
+	}
+	http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: "", Path: "/", MaxAge: -1})
+	http.Redirect(w, r, "/login", http.StatusFound)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("输出 JSON 失败: %v\n", err)
+	}
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+func handleDashboardPage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write([]byte(dashboardPageHTML))
+}
+
+// 今日概况，沿用对账报告的统计口径
+func dashboardSummary(w http.ResponseWriter, db *sql.DB) {
+	report, err := buildReconciliationReport(db, time.Now().Format("2006-01-02"))
+	if err != nil {
+		log.Printf("查询看板概况失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	var activeTrades int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM trade_orders WHERE status IN (?, ?, ?)`, orderPending, orderPaid, orderDisputed).Scan(&activeTrades); err != nil {
+		log.Printf("查询进行中的交易失败: %v\n", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"date":                  report.Date,
+		"transfers":             report.Transfers,
+		"transfer_amount":       roundCents(report.TransferAmount),
+		"codes_issued":          report.Issued,
+		"codes_issued_amount":   roundCents(report.IssuedAmount),
+		"codes_redeemed":        report.Redeemed,
+		"codes_redeemed_amount": roundCents(report.RedeemedAmount),
+		"orders_paid":           report.OrdersPaid,
+		"orders_completed":      report.OrdersCompleted,
+		"commission":            roundCents(report.Commission),
+		"active_trades":         activeTrades,
+		"outstanding_codes":     report.Outstanding,
+		"outstanding_amount":    roundCents(report.OutstandingAmount),
+		"issues":                len(report.Issues),
+	})
+}
+
+// 近 30 天成交额最高的卖家
+func dashboardTopSellers(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(`SELECT seller, COUNT(*), SUM(price) FROM trade_orders
+	WHERE status IN (?, ?) AND completed_at >= datetime('now', '-30 days')
+	GROUP BY seller ORDER BY SUM(price) DESC LIMIT 10`, orderCompleted, orderSplit)
+	if err != nil {
+		log.Printf("查询卖家排行失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	defer rows.Close()
+
+	type sellerRank struct {
+		Seller string  `json:"seller"`
+		Orders int     `json:"orders"`
+		Amount float64 `json:"amount"`
+	}
+	sellers := []sellerRank{}
+	for rows.Next() {
+		var s sellerRank
+		if err := rows.Scan(&s.Seller, &s.Orders, &s.Amount); err != nil {
+			continue
+		}
+		s.Amount = roundCents(s.Amount)
+		sellers = append(sellers, s)
+	}
+	writeJSON(w, http.StatusOK, sellers)
+}
+
+// 各群的在售交易品、今日订单和今日转账
+func dashboardGroups(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(`SELECT g, SUM(listings), SUM(orders), SUM(transfers) FROM (
+		SELECT market_group AS g, COUNT(*) AS listings, 0 AS orders, 0 AS transfers FROM trade_items
+		WHERE status = ? AND quantity > 0 AND market_group != '' GROUP BY market_group
+		UNION ALL
+		SELECT i.market_group, 0, COUNT(*), 0 FROM trade_orders o JOIN trade_items i ON i.id = o.item_id
+		WHERE i.market_group != '' AND date(o.created_at, 'localtime') = date('now', 'localtime') GROUP BY i.market_group
+		UNION ALL
+		SELECT chat, 0, 0, COUNT(*) FROM transfer_logs
+		WHERE chat != '' AND date(created_at, 'localtime') = date('now', 'localtime') GROUP BY chat
+	) GROUP BY g ORDER BY SUM(orders) DESC, SUM(listings) DESC LIMIT 10`, tradeItemOnSale)
+	if err != nil {
+		log.Printf("查询群活跃度失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	defer rows.Close()
+
+	type groupActivity struct {
+		Group     string `json:"group"`
+		Listings  int    `json:"listings"`
+		Orders    int    `json:"orders"`
+		Transfers int    `json:"transfers"`
+	}
+	groups := []groupActivity{}
+	for rows.Next() {
+		var g groupActivity
+		if err := rows.Scan(&g.Group, &g.Listings, &g.Orders, &g.Transfers); err != nil {
+			continue
+		}
+		groups = append(groups, g)
+	}
+	writeJSON(w, http.StatusOK, groups)
+}
+
+// 进行中的交易：待付款、已付款和申诉中的订单
+func dashboardActiveTrades(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(`SELECT `+tradeOrderColumns+` FROM trade_orders WHERE status IN (?, ?, ?) ORDER BY id DESC LIMIT 50`,
+		orderPending, orderPaid, orderDisputed)
+	if err != nil {
+		log.Printf("查询进行中的交易失败: %v\n", err)
+		writeJSONError(w, http.StatusInternalServerError, "查询失败")
+		return
+	}
+	defer rows.Close()
+
+	orders := []TradeOrder{}
+	for rows.Next() {
+		order, err := scanTradeOrder(rows)
+		if err != nil {
+			continue
+		}
+		orders = append(orders, *order)
+	}
+	writeJSON(w, http.StatusOK, orders)
+}
+
+const loginPageHTML = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>登录 - 交易看板</title>
+<link rel="stylesheet" href="/css/comon0.css">
+<style>
+html{font-size:100px}
+.login{width:3.6rem;margin:2rem auto;padding:.3rem}
+.login input{width:100%;margin:.1rem 0;padding:.08rem;font-size:.16rem;border:1px solid #49bcf7;background:rgba(0,0,0,.3);color:#fff}
+.login button{width:100%;margin-top:.15rem;padding:.08rem;font-size:.18rem;background:#49bcf7;border:none;color:#fff;cursor:pointer}
+.login .failed{color:#ed405d;font-size:.14rem}
+</style>
+</head>
+<body>
+<form class="boxall login" method="post" action="/login">
+<div class="alltitle">交易看板登录</div>
+<input name="username" placeholder="用户名" autocomplete="username">
+<input name="password" type="password" placeholder="密码" autocomplete="current-password">
+<p class="failed" id="failed"></p>
+<button type="submit">登录</button>
+</form>
+<script>
+if (location.search.indexOf('failed=1') >= 0) document.getElementById('failed').textContent = '用户名或密码错误';
+</script>
+</body>
+</html>`
+
+const dashboardPageHTML = `<!DOCTYPE html>
+<html lang="zh-CN">
+<head>
+<meta charset="utf-8">
+<title>交易看板</title>
+<link rel="stylesheet" href="/css/comon0.css">
+<style>
+.num{font-family:Consolas,"Courier New",monospace;font-weight:bold;color:#fef000;font-size:.4rem}
+.grid{display:flex;flex-wrap:wrap}
+.grid>div{width:50%;padding:.1rem 0;text-align:center}
+.grid span{display:block;font-size:.16rem;opacity:.7}
+table{width:100%;font-size:.15rem;border-collapse:collapse}
+td,th{padding:.06rem;border-bottom:1px solid rgba(255,255,255,.1);text-align:left}
+.time a{color:rgba(255,255,255,.7);margin-left:.2rem}
+</style>
+</head>
+<body>
+<div class="head"><h1>星卷交易看板</h1><div class="time"><span id="clock"></span><a href="/logout">退出</a></div></div>
+<div class="mainbox">
+<ul class="clearfix">
+<li>
+<div class="boxall"><div class="alltitle">今日转账与兑换码</div>
+<div class="grid">
+<div><p class="num" id="transfers">-</p><span>转账笔数</span></div>
+<div><p class="num" id="transfer_amount">-</p><span>转账金额</span></div>
+<div><p class="num" id="codes_issued">-</p><span>发出兑换码</span></div>
+<div><p class="num" id="codes_redeemed">-</p><span>兑换兑换码</span></div>
+<div><p class="num" id="outstanding_codes">-</p><span>未兑换兑换码</span></div>
+<div><p class="num" id="issues">-</p><span>对账异常</span></div>
+</div></div>
+<div class="boxall"><div class="alltitle">今日交易</div>
+<div class="grid">
+<div><p class="num" id="active_trades">-</p><span>进行中</span></div>
+<div><p class="num" id="orders_paid">-</p><span>今日付款</span></div>
+<div><p class="num" id="orders_completed">-</p><span>今日完成</span></div>
+<div><p class="num" id="commission">-</p><span>今日佣金</span></div>
+</div></div>
+</li>
+<li>
+<div class="boxall"><div class="alltitle">进行中的交易</div>
+<table><thead><tr><th>单号</th><th>交易品</th><th>卖家</th><th>买家</th><th>金额</th><th>状态</th></tr></thead>
+<tbody id="trades"></tbody></table></div>
+</li>
+<li>
+<div class="boxall"><div class="alltitle">卖家排行（近30天）</div><ul class="paim" id="sellers"></ul></div>
+<div class="boxall"><div class="alltitle">群活跃度（今日）</div>
+<table><thead><tr><th>群</th><th>在售</th><th>订单</th><th>转账</th></tr></thead>
+<tbody id="groups"></tbody></table></div>
+</li>
+</ul>
+</div>
+<script>
+document.documentElement.style.fontSize = document.documentElement.clientWidth / 20 + 'px';
+function esc(s) { var d = document.createElement('div'); d.textContent = s; return d.innerHTML; }
+function load(path, render) {
+	fetch(path, {credentials: 'same-origin'}).then(function (r) {
+		if (r.status === 401) { location.href = '/login'; throw new Error('未登录'); }
+		return r.json();
+	}).then(render).catch(function (e) { console.log(e); });
+}
+function refresh() {
+	load('/dashboard/summary', function (s) {
+		['transfers', 'codes_issued', 'codes_redeemed', 'outstanding_codes', 'issues', 'active_trades', 'orders_paid', 'orders_completed'].forEach(function (k) {
+			document.getElementById(k).textContent = s[k];
+		});
+		document.getElementById('transfer_amount').textContent = s.transfer_amount.toFixed(2);
+		document.getElementById('commission').textContent = s.commission.toFixed(2);
+	});
+	load('/dashboard/trades', function (orders) {
+		document.getElementById('trades').innerHTML = orders.map(function (o) {
+			return '<tr><td>' + o.id + '</td><td>' + esc(o.item_name) + '</td><td>' + esc(o.seller) + '</td><td>' + esc(o.buyer) +
+				'</td><td>' + o.price.toFixed(2) + '</td><td>' + esc(o.status) + '</td></tr>';
+		}).join('');
+	});
+	load('/dashboard/top-sellers', function (sellers) {
+		var max = sellers.length ? sellers[0].amount : 1;
+		document.getElementById('sellers').innerHTML = sellers.slice(0, 5).map(function (s, i) {
+			return '<li><span>' + (i + 1) + '</span><div class="pmnav"><p>' + esc(s.seller) + '（' + s.orders + '单）</p>' +
+				'<div class="pmbar"><span style="width:' + Math.max(5, s.amount / max * 80) + '%"></span><i>' + s.amount.toFixed(2) + '</i></div></div></li>';
+		}).join('');
+	});
+	load('/dashboard/groups', function (groups) {
+		document.getElementById('groups').innerHTML = groups.map(function (g) {
+			return '<tr><td>' + esc(g.group) + '</td><td>' + g.listings + '</td><td>' + g.orders + '</td><td>' + g.transfers + '</td></tr>';
+		}).join('');
+	});
+	document.getElementById('clock').textContent = new Date().toLocaleString();
+}
+refresh();
+setInterval(refresh, 30000);
+</script>
+</body>
+</html>`
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 启动看板，客户端不跟随跳转，方便检查登录流程
+func newTestDashboard(t *testing.T) (*httptest.Server, *http.Client, *sql.DB) {
+	t.Helper()
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Web = WebConfig{Username: "admin", Password: "pass", SessionHours: 1}
+
+	db := newTestDB(t)
+	mux := http.NewServeMux()
+	registerDashboardRoutes(mux, db)
+	server := httptest.NewServer(mux)
+	t.Cleanup(server.Close)
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	return server, client, db
+}
+
+func webLogin(t *testing.T, server *httptest.Server, client *http.Client, password string) *http.Response {
+	t.Helper()
+	resp, err := client.PostForm(server.URL+"/login", url.Values{"username": {"admin"}, "password": {password}})
+	if err != nil {
+		t.Fatalf("登录请求失败: %v", err)
+	}
+	resp.Body.Close()
+	return resp
+}
+
+func sessionCookie(resp *http.Response) *http.Cookie {
+	for _, c := range resp.Cookies() {
+		if c.Name == sessionCookieName {
+			return c
+		}
+	}
+	return nil
+}
+
+func getWithCookie(t *testing.T, client *http.Client, target string, cookie *http.Cookie) *http.Response {
+	t.Helper()
+	req, _ := http.NewRequest(http.MethodGet, target, nil)
+	if cookie != nil {
+		req.AddCookie(cookie)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("请求%s失败: %v", target, err)
+	}
+	return resp
+}
+
+func TestDashboardRequiresLogin(t *testing.T) {
+	server, client, _ := newTestDashboard(t)
+
+	resp := getWithCookie(t, client, server.URL+"/", nil)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != "/login" {
+		t.Fatalf("未登录访问首页应跳转登录页，得到 %d %s", resp.StatusCode, resp.Header.Get("Location"))
+	}
+	resp = getWithCookie(t, client, server.URL+"/dashboard/summary", &http.Cookie{Name: sessionCookieName, Value: "伪造"})
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("伪造的会话应返回401，得到 %d", resp.StatusCode)
+	}
+
+	resp = webLogin(t, server, client, "wrong")
+	if resp.Header.Get("Location") != "/login?failed=1" || sessionCookie(resp) != nil {
+		t.Fatalf("密码错误不应登录成功: %s", resp.Header.Get("Location"))
+	}
+}
+
+func TestDashboardLoginAndLogout(t *testing.T) {
+	server, client, db := newTestDashboard(t)
+	item := addTestTradeItem(t, db, "卖家", 10, 1)
+	if _, err := createTradeOrder(db, item, "买家", "", "", couponUse{}); err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+
+	cookie := sessionCookie(webLogin(t, server, client, "pass"))
+	if cookie == nil || !cookie.HttpOnly {
+		t.Fatalf("登录后应下发 HttpOnly 会话: %+v", cookie)
+	}
+
+	resp := getWithCookie(t, client, server.URL+"/dashboard/summary", cookie)
+	var summary map[string]interface{}
+	json.NewDecoder(resp.Body).Decode(&summary)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || summary["active_trades"] != float64(1) {
+		t.Fatalf("概况应有1笔进行中的交易: %d %v", resp.StatusCode, summary)
+	}
+
+	resp = getWithCookie(t, client, server.URL+"/dashboard/trades", cookie)
+	var orders []TradeOrder
+	json.NewDecoder(resp.Body).Decode(&orders)
+	resp.Body.Close()
+	if len(orders) != 1 || orders[0].Buyer != "买家" {
+		t.Fatalf("进行中的交易不对: %+v", orders)
+	}
+	for _, path := range []string{"/dashboard/top-sellers", "/dashboard/groups"} {
+		resp := getWithCookie(t, client, server.URL+path, cookie)
+		var list []interface{}
+		err := json.NewDecoder(resp.Body).Decode(&list)
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || err != nil {
+			t.Fatalf("%s应返回 JSON 数组: %d %v", path, resp.StatusCode, err)
+		}
+	}
+
+	resp = getWithCookie(t, client, server.URL+"/logout", cookie)
+	resp.Body.Close()
+	resp = getWithCookie(t, client, server.URL+"/dashboard/summary", cookie)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("退出后会话应失效，得到 %d", resp.StatusCode)
+	}
+}
+
+func TestExpiredWebSessionRemoved(t *testing.T) {
+	webSessions.Lock()
+	webSessions.expires["过期"] = time.Now().Add(-time.Minute)
+	webSessions.Unlock()
+
+	if validWebSession("过期") {
+		t.Fatal("过期的会话不应有效")
+	}
+	webSessions.Lock()
+	_, ok := webSessions.expires["过期"]
+	webSessions.Unlock()
+	if ok {
+		t.Fatal("过期的会话应被清理")
+	}
+}
+
+// 页面引用的样式表都要能加载，不能指向仓库里没有的文件
+func TestDashboardAssetsExist(t *testing.T) {
+	server, client, _ := newTestDashboard(t)
+	hrefRe := regexp.MustCompile(`href="(/[^"]+\.css)"`)
+	for _, page := range []string{loginPageHTML, dashboardPageHTML} {
+		for _, m := range hrefRe.FindAllStringSubmatch(page, -1) {
+			resp := getWithCookie(t, client, server.URL+m[1], nil)
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Errorf("%s 返回 %d", m[1], resp.StatusCode)
+			}
+		}
+	}
+	if strings.Contains(dashboardPageHTML, "electronicFont") {
+		t.Error("看板不应使用缺失的 DS-DIGIT 字体")
+	}
+}
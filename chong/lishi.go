@@ -0,0 +1,424 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"image"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+	"golang.org/x/image/draw"
+)
+
+const (
+	historyPageSize = 10
+	// 导出的历史记录 CSV 保存目录
+	historyExportDir = "../lishi"
+	// 历史记录图片的宽度和最多展示的记录数
+	historyImageWidth   = 720
+	historyImageMaxRows = 200
+)
+
+// “我的历史”的查询条件，时间边界按本地时间计算后换成 UTC，与 CreatedAt 的存储方式一致
+type historyQuery struct {
+	User      string
+	OrderType string
+	Period    string
+	Since     string
+	Until     string
+	Page      int
+	Export    string // 空、csv 或 图片
+}
+
+type historyEntry struct {
+	CreatedAt time.Time
+	OrderType string
+	GameID    string
+	StarCost  int
+	Stars     int
+	FinalRank string
+	IsActive  bool
+}
+
+func (e historyEntry) status() string {
+	if e.IsActive {
+		return "正在进行中"
+	}
+	return "已结束"
+}
+
+var (
+	historyPageRe  = regexp.MustCompile(`^第(\d+)页$`)
+	historyRangeRe = regexp.MustCompile(`^(\d{4}-\d{2}-\d{2})(?:~|至)(\d{4}-\d{2}-\d{2})$`)
+	historyMonthRe = regexp.MustCompile(`^\d{4}-\d{2}$`)
+)
+
+const historyUsage = "指令格式错误，请按照 '我的历史 [时间] [类型] [第N页] [导出|图片]' 的格式输入，" +
+	"时间可以是今天、昨天、本周、本月、上月、今年、2024-05 或 2024-05-01~2024-05-31"
+
+// 可以筛选的类型：现有的上星类型，加上用户历史里出现过的类型（可能已经下架）
+func historyOrderTypes(db *sql.DB, user string) []string {
+	types := bridgeOrderTypes()
+	rows, err := db.Query(`SELECT DISTINCT OrderType FROM Bridges WHERE GroupUserNickName = ?`, user)
+	if err != nil {
+		log.Printf("查询历史类型失败: %v\n", err)
+		return types
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var orderType string
+		if rows.Scan(&orderType) == nil {
+			types = append(types, orderType)
+		}
+	}
+	return types
+}
+
+// 解析 "我的历史 [时间] [类型] [第N页] [导出|图片]"，各项以空格分隔、顺序不限。
+// 类型必须是 orderTypes 之一，认不出的内容返回用法说明，不当作类型去查
+func parseHistoryQuery(content, user string, orderTypes []string, now time.Time) (*historyQuery, error) {
+	q := &historyQuery{User: user, Page: 1}
+	for _, token := range strings.Fields(strings.TrimPrefix(content, "我的历史")) {
+		if matches := historyPageRe.FindStringSubmatch(token); len(matches) > 0 {
+			q.Page, _ = strconv.Atoi(matches[1])
+			if q.Page < 1 {
+				q.Page = 1
+			}
+			continue
+		}
+		switch token {
+		case "导出", "CSV", "csv":
+			q.Export = "csv"
+			continue
+		case "图片":
+			q.Export = "图片"
+			continue
+		case "全部":
+			continue
+		}
+		since, until, ok, err := historyPeriod(token, now)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			q.Period = token
+			q.Since, q.Until = since.UTC().Format("2006-01-02 15:04:05"), until.UTC().Format("2006-01-02 15:04:05")
+			continue
+		}
+		if !slices.Contains(orderTypes, token) || q.OrderType != "" {
+			return nil, fmt.Errorf("%s。无法识别“%s”，可选类型：%s", historyUsage, token, strings.Join(orderTypes, "、"))
+		}
+		q.OrderType = token
+	}
+	return q, nil
+}
+
+// 识别时间范围，返回的 until 不含
+func historyPeriod(token string, now time.Time) (time.Time, time.Time, bool, error) {
+	loc := now.Location()
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, loc)
+	switch token {
+	case "今天":
+		return today, today.AddDate(0, 0, 1), true, nil
+	case "昨天":
+		return today.AddDate(0, 0, -1), today, true, nil
+	case "本周":
+		// 周一为一周的第一天
+		start := today.AddDate(0, 0, -((int(today.Weekday()) + 6) % 7))
+		return start, start.AddDate(0, 0, 7), true, nil
+	case "本月":
+		start := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), true, nil
+	case "上月":
+		start := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0), true, nil
+	case "今年":
+		start := time.Date(now.Year(), 1, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(1, 0, 0), true, nil
+	}
+	if historyMonthRe.MatchString(token) {
+		start, err := time.ParseInLocation("2006-01", token, loc)
+		if err != nil {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("月份格式错误：%s", token)
+		}
+		return start, start.AddDate(0, 1, 0), true, nil
+	}
+	if matches := historyRangeRe.FindStringSubmatch(token); len(matches) > 0 {
+		start, err1 := time.ParseInLocation("2006-01-02", matches[1], loc)
+		end, err2 := time.ParseInLocation("2006-01-02", matches[2], loc)
+		if err1 != nil || err2 != nil || end.Before(start) {
+			return time.Time{}, time.Time{}, false, fmt.Errorf("日期范围格式错误：%s", token)
+		}
+		// 结束日期当天也包含在内
+		return start, end.AddDate(0, 0, 1), true, nil
+	}
+	return time.Time{}, time.Time{}, false, nil
+}
+
+func (q *historyQuery) where() (string, []interface{}) {
+	where := ` WHERE GroupUserNickName = ?`
+	args := []interface{}{q.User}
+	if q.OrderType != "" {
+		where += ` AND OrderType = ?`
+		args = append(args, q.OrderType)
+	}
+	if q.Since != "" {
+		where += ` AND CreatedAt >= ? AND CreatedAt < ?`
+		args = append(args, q.Since, q.Until)
+	}
+	return where, args
+}
+
+// 条件的文字说明，用在回复的标题里
+func (q *historyQuery) describe() string {
+	parts := []string{}
+	if q.Period != "" {
+		parts = append(parts, q.Period)
+	}
+	if q.OrderType != "" {
+		parts = append(parts, q.OrderType)
+	}
+	if len(parts) == 0 {
+		return "全部"
+	}
+	return strings.Join(parts, " ")
+}
+
+// 查询一页记录，limit 为 0 时返回全部。排序固定为类型、时间倒序，翻页结果稳定
+func queryHistory(db *sql.DB, q *historyQuery, limit, offset int) ([]historyEntry, error) {
+	where, args := q.where()
+	query := `SELECT CreatedAt, OrderType, GameID, StarCost, Stars, FinalRank, IsActive FROM Bridges` + where +
+		` ORDER BY OrderType, CreatedAt DESC, rowid DESC`
+	if limit > 0 {
+		query += ` LIMIT ? OFFSET ?`
+		args = append(args, limit, offset)
+	}
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []historyEntry
+	for rows.Next() {
+		var e historyEntry
+		if err := rows.Scan(&e.CreatedAt, &e.OrderType, &e.GameID, &e.StarCost, &e.Stars, &e.FinalRank, &e.IsActive); err != nil {
+			log.Printf("读取历史记录时出错: %v\n", err)
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+type historyTotal struct {
+	OrderType     string
+	Orders        int
+	TotalStarCost int
+	TotalStars    int
+}
+
+// 按类型统计整个查询范围的合计，不受分页影响
+func queryHistoryTotals(db *sql.DB, q *historyQuery) ([]historyTotal, int, error) {
+	where, args := q.where()
+	rows, err := db.Query(`SELECT OrderType, COUNT(*), COALESCE(SUM(StarCost), 0), COALESCE(SUM(Stars), 0) FROM Bridges`+where+
+		` GROUP BY OrderType ORDER BY OrderType`, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	var totals []historyTotal
+	count := 0
+	for rows.Next() {
+		var t historyTotal
+		if err := rows.Scan(&t.OrderType, &t.Orders, &t.TotalStarCost, &t.TotalStars); err != nil {
+			return nil, 0, err
+		}
+		count += t.Orders
+		totals = append(totals, t)
+	}
+	return totals, count, rows.Err()
+}
+
+// 处理 "我的历史" 命令，例如 “我的历史 本月”、“我的历史 王者 第2页”、“我的历史 导出”
+func handleUserHistory(msg *openwechat.Message, db *sql.DB, weChatUser string) {
+	q, err := parseHistoryQuery(msg.Content, weChatUser, historyOrderTypes(db, weChatUser), time.Now())
+	if err != nil {
+		msg.ReplyText(err.Error())
+		return
+	}
+	totals, count, err := queryHistoryTotals(db, q)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("获取历史记录时出错: %v", err))
+		return
+	}
+	if count == 0 {
+		msg.ReplyText("没有找到历史记录。")
+		return
+	}
+
+	switch q.Export {
+	case "csv":
+		sendHistoryCSV(msg, db, q)
+		return
+	case "图片":
+		sendHistoryImage(msg, db, q, totals)
+		return
+	}
+
+	pages := (count + historyPageSize - 1) / historyPageSize
+	if q.Page > pages {
+		q.Page = pages
+	}
+	entries, err := queryHistory(db, q, historyPageSize, (q.Page-1)*historyPageSize)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("获取历史记录时出错: %v", err))
+		return
+	}
+
+	underline := strings.Repeat("—", 12)
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("历史记录（%s）共%d条，第%d/%d页\n", q.describe(), count, q.Page, pages))
+	for _, t := range totals {
+		response.WriteString(fmt.Sprintf("%s:\n♥♥总使用星卷: %d♥♥\n🚗🚗总摘星: %d🚗🚗\n", t.OrderType, t.TotalStarCost, t.TotalStars))
+	}
+	response.WriteString(underline + "\n")
+	lastType := ""
+	for _, e := range entries {
+		if e.OrderType != lastType {
+			response.WriteString(fmt.Sprintf("【%s】\n", e.OrderType))
+			lastType = e.OrderType
+		}
+		response.WriteString(fmt.Sprintf("%s(使用%d星卷)\n%s--%d星[%s]$%s\n", e.CreatedAt.Local().Format("2006-01-02 15:04:05"),
+			e.StarCost, e.GameID, e.Stars, e.FinalRank, e.status()))
+		response.WriteString(underline + "\n")
+	}
+	if q.Page < pages {
+		response.WriteString(fmt.Sprintf("发送“%s 第%d页”查看下一页，", historyCommand(q), q.Page+1))
+	}
+	response.WriteString(fmt.Sprintf("发送“%s 导出”或“%s 图片”获取全部记录。", historyCommand(q), historyCommand(q)))
+	msg.ReplyText(response.String())
+}
+
+// 带上当前条件的命令，方便用户翻页和导出
+func historyCommand(q *historyQuery) string {
+	command := "我的历史"
+	if q.Period != "" {
+		command += " " + q.Period
+	}
+	if q.OrderType != "" {
+		command += " " + q.OrderType
+	}
+	return command
+}
+
+func sendHistoryCSV(msg *openwechat.Message, db *sql.DB, q *historyQuery) {
+	entries, err := queryHistory(db, q, 0, 0)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("获取历史记录时出错: %v", err))
+		return
+	}
+	if err := os.MkdirAll(historyExportDir, 0755); err != nil {
+		log.Printf("创建历史导出目录失败: %v\n", err)
+		msg.ReplyText("导出历史记录失败，请稍后重试。")
+		return
+	}
+	filePath := filepath.Join(historyExportDir, fmt.Sprintf("history_%d.csv", time.Now().UnixNano()))
+	file, err := os.Create(filePath)
+	if err != nil {
+		log.Printf("创建历史导出文件失败: %v\n", err)
+		msg.ReplyText("导出历史记录失败，请稍后重试。")
+		return
+	}
+	// 发送后文件就没用了，不在导出目录里堆积
+	defer os.Remove(filePath)
+	defer file.Close()
+
+	// 加 BOM 让 Excel 按 UTF-8 打开
+	file.WriteString("\xEF\xBB\xBF")
+	w := csv.NewWriter(file)
+	w.Write([]string{"时间", "类型", "游戏ID", "使用星卷", "星数", "段位", "状态"})
+	for _, e := range entries {
+		w.Write([]string{e.CreatedAt.Local().Format("2006-01-02 15:04:05"), e.OrderType, e.GameID,
+			strconv.Itoa(e.StarCost), strconv.Itoa(e.Stars), e.FinalRank, e.status()})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		log.Printf("写入历史导出文件失败: %v\n", err)
+		msg.ReplyText("导出历史记录失败，请稍后重试。")
+		return
+	}
+	if _, err := file.Seek(0, 0); err != nil {
+		log.Printf("读取历史导出文件失败: %v\n", err)
+		return
+	}
+	if _, err := msg.ReplyFile(file); err != nil {
+		log.Printf("发送历史导出文件失败: %v\n", err)
+		msg.ReplyText("发送文件失败，请稍后重试。")
+	}
+}
+
+// 把历史记录画成一张长图，合计在最上方
+func sendHistoryImage(msg *openwechat.Message, db *sql.DB, q *historyQuery, totals []historyTotal) {
+	entries, err := queryHistory(db, q, historyImageMaxRows, 0)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("获取历史记录时出错: %v", err))
+		return
+	}
+	lines := []string{fmt.Sprintf("%s的历史记录（%s）", q.User, q.describe())}
+	for _, t := range totals {
+		lines = append(lines, fmt.Sprintf("%s：%d单，总使用星卷%d，总摘星%d", t.OrderType, t.Orders, t.TotalStarCost, t.TotalStars))
+	}
+	lines = append(lines, "")
+	for _, e := range entries {
+		lines = append(lines, fmt.Sprintf("%s %s %s %d星卷 %d星 %s %s", e.CreatedAt.Local().Format("2006-01-02 15:04"),
+			e.OrderType, e.GameID, e.StarCost, e.Stars, e.FinalRank, e.status()))
+	}
+	if len(entries) == historyImageMaxRows {
+		lines = append(lines, fmt.Sprintf("图片最多展示%d条，完整记录请发送“%s 导出”。", historyImageMaxRows, historyCommand(q)))
+	}
+
+	buf, err := renderTextImage(lines, historyImageWidth)
+	if err != nil {
+		log.Printf("生成历史记录图片失败，改为文字发送: %v\n", err)
+		msg.ReplyText(strings.Join(lines, "\n"))
+		return
+	}
+	if _, err := msg.ReplyImage(buf); err != nil {
+		log.Printf("发送历史记录图片失败: %v\n", err)
+	}
+}
+
+// 逐行绘制文字，第一行用标题字体
+func renderTextImage(lines []string, width int) (*bytes.Buffer, error) {
+	if err := loadCardFonts(); err != nil {
+		return nil, err
+	}
+
+	lineHeight := faceHeight(cardTextFace) + 8
+	height := cardPadding*2 + faceHeight(cardTitleFace) + 8 + (len(lines)-1)*lineHeight
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	draw.Draw(img, img.Bounds(), image.NewUniform(cardCanvas), image.Point{}, draw.Src)
+
+	y := cardPadding + faceHeight(cardTitleFace)
+	for i, line := range lines {
+		if i == 0 {
+			drawText(img, cardTitleFace, cardTitleColor, cardPadding, y, truncateText(cardTitleFace, line, width-2*cardPadding))
+			y += 8 + lineHeight
+			continue
+		}
+		drawText(img, cardTextFace, cardTextColor, cardPadding, y, truncateText(cardTextFace, line, width-2*cardPadding))
+		y += lineHeight
+	}
+	return encodePNG(img)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryPeriod(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	// 2024-05-15 是星期三
+	now := time.Date(2024, 5, 15, 10, 30, 0, 0, loc)
+	day := func(y int, m time.Month, d int) time.Time { return time.Date(y, m, d, 0, 0, 0, 0, loc) }
+	for token, want := range map[string][2]time.Time{
+		"今天":                    {day(2024, 5, 15), day(2024, 5, 16)},
+		"昨天":                    {day(2024, 5, 14), day(2024, 5, 15)},
+		"本周":                    {day(2024, 5, 13), day(2024, 5, 20)},
+		"本月":                    {day(2024, 5, 1), day(2024, 6, 1)},
+		"上月":                    {day(2024, 4, 1), day(2024, 5, 1)},
+		"今年":                    {day(2024, 1, 1), day(2025, 1, 1)},
+		"2024-02":               {day(2024, 2, 1), day(2024, 3, 1)},
+		"2024-05-01~2024-05-03": {day(2024, 5, 1), day(2024, 5, 4)},
+		"2024-05-01至2024-05-01": {day(2024, 5, 1), day(2024, 5, 2)},
+	} {
+		since, until, ok, err := historyPeriod(token, now)
+		if err != nil || !ok || !since.Equal(want[0]) || !until.Equal(want[1]) {
+			t.Errorf("%s 应为 %v ~ %v，实际为 %v ~ %v %v %v", token, want[0], want[1], since, until, ok, err)
+		}
+	}
+
+	// 星期天算作本周的最后一天
+	sunday := time.Date(2024, 5, 19, 23, 0, 0, 0, loc)
+	if since, _, _, _ := historyPeriod("本周", sunday); !since.Equal(day(2024, 5, 13)) {
+		t.Errorf("星期天的本周应从5月13日开始，实际为 %v", since)
+	}
+	for _, token := range []string{"2024-13", "2024-05-03~2024-05-01", "2024-02-30~2024-03-01"} {
+		if _, _, _, err := historyPeriod(token, now); err == nil {
+			t.Errorf("%s 应返回格式错误", token)
+		}
+	}
+	if _, _, ok, err := historyPeriod("王者", now); ok || err != nil {
+		t.Errorf("非时间的内容不应识别为时间: %v %v", ok, err)
+	}
+}
+
+func TestParseHistoryQuery(t *testing.T) {
+	loc := time.FixedZone("CST", 8*3600)
+	now := time.Date(2024, 5, 15, 10, 30, 0, 0, loc)
+	types := []string{"王者", "星耀"}
+
+	q, err := parseHistoryQuery("我的历史 第3页 王者 本月 导出", "小明", types, now)
+	if err != nil {
+		t.Fatalf("解析失败: %v", err)
+	}
+	if q.User != "小明" || q.Page != 3 || q.OrderType != "王者" || q.Period != "本月" || q.Export != "csv" {
+		t.Fatalf("解析结果不对: %+v", q)
+	}
+	// 时间边界按本地时间计算后换成 UTC
+	if q.Since != "2024-04-30 16:00:00" || q.Until != "2024-05-31 16:00:00" {
+		t.Fatalf("时间边界不对: %s ~ %s", q.Since, q.Until)
+	}
+	if where, args := q.where(); !strings.Contains(where, "OrderType = ?") || len(args) != 4 {
+		t.Fatalf("查询条件不对: %s %v", where, args)
+	}
+	if historyCommand(q) != "我的历史 本月 王者" {
+		t.Fatalf("翻页命令不对: %s", historyCommand(q))
+	}
+
+	q, err = parseHistoryQuery("我的历史", "小明", types, now)
+	if err != nil || q.Page != 1 || q.OrderType != "" || q.Since != "" || q.describe() != "全部" {
+		t.Fatalf("不带条件时应查询全部: %+v %v", q, err)
+	}
+	if q, _ := parseHistoryQuery("我的历史 第0页 图片", "小明", types, now); q.Page != 1 || q.Export != "图片" {
+		t.Fatalf("页码至少为1: %+v", q)
+	}
+
+	for _, content := range []string{"我的历史 本越", "我的历史 王者 星耀", "我的历史 2024-13"} {
+		if _, err := parseHistoryQuery(content, "小明", types, now); err == nil {
+			t.Errorf("%s 应返回错误", content)
+		}
+	}
+	if _, err := parseHistoryQuery("我的历史 本越", "小明", types, now); !strings.Contains(err.Error(), "无法识别“本越”") {
+		t.Errorf("认不出的内容应提示用法: %v", err)
+	}
+}
+
+func TestHistoryOrderTypesIncludeRetiredTypes(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.BridgePrices = map[string]float64{"王者": 2}
+
+	db := newTestDB(t)
+	if _, err := db.Exec(`INSERT INTO Bridges (GroupUserNickName, OrderType, GameID) VALUES ('小明', '旧类型', '1')`); err != nil {
+		t.Fatalf("插入历史订单失败: %v", err)
+	}
+	types := historyOrderTypes(db, "小明")
+	if _, err := parseHistoryQuery("我的历史 旧类型", "小明", types, time.Now()); err != nil {
+		t.Fatalf("用户历史里的类型应能筛选: %v", err)
+	}
+	if _, err := parseHistoryQuery("我的历史 王者", "小明", types, time.Now()); err != nil {
+		t.Fatalf("现有的类型应能筛选: %v", err)
+	}
+	if _, err := parseHistoryQuery("我的历史 旧类型", "小红", historyOrderTypes(db, "小红"), time.Now()); err == nil {
+		t.Fatal("别人历史里的类型不应出现在可选类型里")
+	}
+}
@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 每个榜单展示的人数
+const leaderboardSize = 10
+
+// 每周一发到 leaderboard_groups 各群的上周排行榜，按周记录避免重复发送
+func initLeaderboardTables(db *sql.DB) {
+	createLeaderboardPostsTableSQL := `
+	CREATE TABLE IF NOT EXISTS leaderboard_posts (
+		week_start TEXT PRIMARY KEY,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createLeaderboardPostsTableSQL); err != nil {
+		log.Fatalf("创建 leaderboard_posts 表失败: %s\n", err)
+	}
+}
+
+type leaderboardRow struct {
+	Name   string
+	Value  float64
+	Orders int
+}
+
+// 排行榜的统计范围。Group 为空表示全平台，Members 为群成员昵称，只统计群里的人
+type leaderboardScope struct {
+	Group   string
+	Members map[string]bool
+	Label   string
+	Since   string // UTC，空表示总榜
+	Until   string
+}
+
+func (s *leaderboardScope) includes(nick string) bool {
+	return s.Members == nil || s.Members[nick]
+}
+
+// 摘星榜：有时间范围时按进度时间线里每次增加的星数累计，总榜为上星订单的星数加上 member_stars。
+// member_stars 是上星订单之前按群记的星数，没有时间，只计入总榜；补星扣星已改走钱包流水，
+// 这张表不再变化，对账日报也会标出任何改动
+func starsLeaderboard(db *sql.DB, scope *leaderboardScope) ([]leaderboardRow, error) {
+	totals := make(map[string]float64)
+	var rows *sql.Rows
+	var err error
+	if scope.Since != "" {
+		rows, err = db.Query(`WITH deltas AS (
+			SELECT bridge_id, created_at, stars - LAG(stars, 1, 0) OVER (PARTITION BY bridge_id ORDER BY id) AS delta
+			FROM bridge_progress
+		)
+		SELECT b.GroupUserNickName, SUM(d.delta) FROM deltas d JOIN Bridges b ON b.rowid = d.bridge_id
+		WHERE d.created_at >= ? AND d.created_at < ? GROUP BY b.GroupUserNickName`, scope.Since, scope.Until)
+	} else {
+		rows, err = db.Query(`SELECT GroupUserNickName, SUM(Stars) FROM Bridges GROUP BY GroupUserNickName`)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := sumLeaderboardRows(rows, scope, totals, nil); err != nil {
+		return nil, err
+	}
+
+	if scope.Since == "" {
+		// 群里看本群记的星数，私聊看全平台的合计
+		query := `SELECT UserName, SUM(IFNULL(StarsCount, 0)) FROM member_stars`
+		var args []interface{}
+		if scope.Group != "" {
+			query += ` WHERE GroupID = ?`
+			args = append(args, scope.Group)
+		}
+		rows, err := db.Query(query+` GROUP BY UserName`, args...)
+		if err != nil {
+			return nil, err
+		}
+		if err := sumLeaderboardRows(rows, scope, totals, nil); err != nil {
+			return nil, err
+		}
+	}
+	return topLeaderboardRows(totals, nil), nil
+}
+
+// 星卷榜：上星订单实际花费的星卷（撤单退回的部分已从 StarCost 中扣除），加上直接用兑换码
+// 支付交易订单的金额。兑换进钱包的兑换码不算花费，之后开单时才计入，避免重复统计
+func spendLeaderboard(db *sql.DB, scope *leaderboardScope) ([]leaderboardRow, error) {
+	query := `SELECT GroupUserNickName, SUM(StarCost), COUNT(*) FROM Bridges`
+	var args []interface{}
+	if scope.Since != "" {
+		query += ` WHERE CreatedAt >= ? AND CreatedAt < ?`
+		args = append(args, scope.Since, scope.Until)
+	}
+	rows, err := db.Query(query+` GROUP BY GroupUserNickName`, args...)
+	if err != nil {
+		return nil, err
+	}
+	totals, orders := make(map[string]float64), make(map[string]int)
+	if err := sumLeaderboardRows(rows, scope, totals, orders); err != nil {
+		return nil, err
+	}
+
+	// 退款作废的兑换码 used 不再是已使用，不计入
+	query = `SELECT COALESCE(NULLIF(c.redeemed_by, ''), c.payer) AS nick, SUM(c.amount), COUNT(*) FROM recharge_records c
+	JOIN trade_orders o ON o.recharge_code = c.recharge_code WHERE c.used = ?`
+	args = []interface{}{codeUsed}
+	if scope.Group != "" {
+		query += ` AND o.item_id IN (SELECT id FROM trade_items WHERE market_group = ?)`
+		args = append(args, scope.Group)
+	}
+	if scope.Since != "" {
+		query += ` AND c.used_at >= ? AND c.used_at < ?`
+		args = append(args, scope.Since, scope.Until)
+	}
+	rows, err = db.Query(query+` GROUP BY nick`, args...)
+	if err != nil {
+		return nil, err
+	}
+	if err := sumLeaderboardRows(rows, scope, totals, orders); err != nil {
+		return nil, err
+	}
+	return topLeaderboardRows(totals, orders), nil
+}
+
+// 卖家榜：本群交易区成交的订单金额，私聊查看时统计全平台
+func sellerLeaderboard(db *sql.DB, scope *leaderboardScope) ([]leaderboardRow, error) {
+	query := `SELECT o.seller, SUM(o.price), COUNT(*) FROM trade_orders o
+	WHERE o.status IN (?, ?)`
+	args := []interface{}{orderCompleted, orderSplit}
+	if scope.Group != "" {
+		query += ` AND o.item_id IN (SELECT id FROM trade_items WHERE market_group = ?)`
+		args = append(args, scope.Group)
+	}
+	if scope.Since != "" {
+		query += ` AND o.completed_at >= ? AND o.completed_at < ?`
+		args = append(args, scope.Since, scope.Until)
+	}
+	rows, err := db.Query(query+` GROUP BY o.seller`, args...)
+	if err != nil {
+		return nil, err
+	}
+	totals, orders := make(map[string]float64), make(map[string]int)
+	// 卖家榜按交易区统计，不要求卖家在群里
+	all := &leaderboardScope{}
+	if err := sumLeaderboardRows(rows, all, totals, orders); err != nil {
+		return nil, err
+	}
+	return topLeaderboardRows(totals, orders), nil
+}
+
+// 读取 (昵称, 数值[, 单数]) 结果并累加，orders 为 nil 时只有两列
+func sumLeaderboardRows(rows *sql.Rows, scope *leaderboardScope, totals map[string]float64, orders map[string]int) error {
+	defer rows.Close()
+	for rows.Next() {
+		var nick string
+		var value sql.NullFloat64
+		var count int
+		var err error
+		if orders != nil {
+			err = rows.Scan(&nick, &value, &count)
+		} else {
+			err = rows.Scan(&nick, &value)
+		}
+		if err != nil {
+			return err
+		}
+		if !scope.includes(nick) {
+			continue
+		}
+		totals[nick] += value.Float64
+		if orders != nil {
+			orders[nick] += count
+		}
+	}
+	return rows.Err()
+}
+
+// 取前几名，数值相同时按昵称排序，保证每次结果一致
+func topLeaderboardRows(totals map[string]float64, orders map[string]int) []leaderboardRow {
+	var result []leaderboardRow
+	for nick, value := range totals {
+		if value <= 0 {
+			continue
+		}
+		result = append(result, leaderboardRow{Name: nick, Value: value, Orders: orders[nick]})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Value != result[j].Value {
+			return result[i].Value > result[j].Value
+		}
+		return result[i].Name < result[j].Name
+	})
+	if len(result) > leaderboardSize {
+		result = result[:leaderboardSize]
+	}
+	return result
+}
+
+// 生成三个榜单的文字，全部为空时返回空字符串
+func buildLeaderboard(db *sql.DB, scope *leaderboardScope) (string, error) {
+	stars, err := starsLeaderboard(db, scope)
+	if err != nil {
+		return "", err
+	}
+	spend, err := spendLeaderboard(db, scope)
+	if err != nil {
+		return "", err
+	}
+	sellers, err := sellerLeaderboard(db, scope)
+	if err != nil {
+		return "", err
+	}
+	if len(stars) == 0 && len(spend) == 0 && len(sellers) == 0 {
+		return "", nil
+	}
+
+	var b strings.Builder
+	title := "全平台"
+	if scope.Group != "" {
+		title = scope.Group
+	}
+	b.WriteString(fmt.Sprintf("🏆%s %s排行榜🏆\n", title, scope.Label))
+	writeSection := func(name string, rows []leaderboardRow, format func(leaderboardRow) string) {
+		if len(rows) == 0 {
+			return
+		}
+		b.WriteString(fmt.Sprintf("【%s】\n", name))
+		for i, row := range rows {
+			b.WriteString(fmt.Sprintf("%d. %s %s\n", i+1, row.Name, format(row)))
+		}
+	}
+	writeSection("摘星榜", stars, func(r leaderboardRow) string { return fmt.Sprintf("%d星", int(r.Value)) })
+	writeSection("星卷榜", spend, func(r leaderboardRow) string { return fmt.Sprintf("%d星卷（%d单）", int(r.Value), r.Orders) })
+	writeSection("卖家榜", sellers, func(r leaderboardRow) string { return fmt.Sprintf("%.2f元（%d单）", r.Value, r.Orders) })
+	return strings.TrimRight(b.String(), "\n"), nil
+}
+
+// 群成员昵称，获取失败时返回 nil，即不按成员过滤
+func groupMemberNicks(group *openwechat.Group) map[string]bool {
+	members, err := group.Members()
+	if err != nil {
+		log.Printf("获取群成员失败: %v\n", err)
+		return nil
+	}
+	nicks := make(map[string]bool, len(members))
+	for _, member := range members {
+		nicks[member.NickName] = true
+	}
+	return nicks
+}
+
+// 处理 "排行榜[ 本周|本月|总榜]"，群里只统计本群成员，私聊查看全平台
+func handleLeaderboard(msg *openwechat.Message, db *sql.DB, qun *openwechat.User) {
+	scope := &leaderboardScope{Label: "总榜"}
+	period := strings.TrimSpace(strings.TrimPrefix(msg.Content, "排行榜"))
+	switch period {
+	case "", "总榜", "全部":
+	case "本周", "本月":
+		since, until, _, _ := historyPeriod(period, time.Now())
+		scope.Label = period
+		scope.Since, scope.Until = since.UTC().Format("2006-01-02 15:04:05"), until.UTC().Format("2006-01-02 15:04:05")
+	default:
+		msg.ReplyText("指令格式错误，请发送“排行榜”、“排行榜 本周”或“排行榜 本月”。")
+		return
+	}
+	if qun != nil {
+		scope.Group = qun.NickName
+		if group, ok := qun.AsGroup(); ok {
+			scope.Members = groupMemberNicks(group)
+		}
+	}
+
+	text, err := buildLeaderboard(db, scope)
+	if err != nil {
+		log.Printf("生成排行榜失败: %v\n", err)
+		msg.ReplyText("生成排行榜失败，请稍后重试。")
+		return
+	}
+	if text == "" {
+		msg.ReplyText(fmt.Sprintf("%s暂时没有上榜记录。", scope.Label))
+		return
+	}
+	msg.ReplyText(text)
+}
+
+// 每周一上午把上周排行榜发到 leaderboard_groups 里的群，没有上榜记录的群不发
+func postWeeklyLeaderboards(db *sql.DB, self *openwechat.Self) {
+	now := time.Now()
+	if now.Weekday() != time.Monday || now.Hour() < 9 {
+		return
+	}
+	thisWeek, _, _, _ := historyPeriod("本周", now)
+	lastWeek := thisWeek.AddDate(0, 0, -7)
+	weekStart := lastWeek.Format("2006-01-02")
+	var exists int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM leaderboard_posts WHERE week_start = ?`, weekStart).Scan(&exists); err != nil || exists > 0 {
+		return
+	}
+	// 先记录再发送，发送途中出错也不会重复刷屏
+	if _, err := db.Exec(`INSERT INTO leaderboard_posts (week_start) VALUES (?)`, weekStart); err != nil {
+		log.Printf("记录排行榜发送失败: %v\n", err)
+		return
+	}
+
+	groups, err := self.Groups()
+	if err != nil {
+		log.Printf("获取群组列表失败: %v\n", err)
+		return
+	}
+	for _, name := range config.LeaderboardGroups {
+		group := groups.SearchByNickName(1, name).First()
+		if group == nil {
+			log.Printf("未找到排行榜群 [%s]\n", name)
+			continue
+		}
+		scope := &leaderboardScope{
+			Group:   group.NickName,
+			Members: groupMemberNicks(group),
+			Label:   "上周",
+			Since:   lastWeek.UTC().Format("2006-01-02 15:04:05"),
+			Until:   thisWeek.UTC().Format("2006-01-02 15:04:05"),
+		}
+		text, err := buildLeaderboard(db, scope)
+		if err != nil {
+			log.Printf("生成群 [%s] 排行榜失败: %v\n", group.NickName, err)
+			continue
+		}
+		if text == "" {
+			continue
+		}
+		if _, err := group.SendText(text); err != nil {
+			log.Printf("发送群 [%s] 排行榜失败: %v\n", group.NickName, err)
+		}
+	}
+}
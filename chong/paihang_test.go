@@ -0,0 +1,79 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// 总榜加上 member_stars 里按群记的星数，群里只算本群的，有时间范围的榜单不计入
+func TestStarsLeaderboardIncludesMemberStars(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 5, "", "管理员"); err != nil {
+		t.Fatalf("更新进度失败: %v", err)
+	}
+	if _, err := db.Exec(`INSERT INTO member_stars (GroupID, UserName, StarsCount) VALUES
+	('上星群', '老板', 30), ('上星群', '路人', 8), ('别的群', '老板', 100)`); err != nil {
+		t.Fatalf("写入群星数失败: %v", err)
+	}
+
+	rows, err := starsLeaderboard(db, &leaderboardScope{Group: "上星群", Label: "总榜"})
+	if err != nil {
+		t.Fatalf("生成摘星榜失败: %v", err)
+	}
+	if len(rows) != 2 || rows[0].Name != "老板" || rows[0].Value != 35 || rows[1].Name != "路人" || rows[1].Value != 8 {
+		t.Fatalf("群总榜应为订单星数加本群记的星数，实际为%+v", rows)
+	}
+	rows, _ = starsLeaderboard(db, &leaderboardScope{Label: "总榜"})
+	if len(rows) != 2 || rows[0].Value != 135 {
+		t.Fatalf("全平台总榜应合计各群的星数，实际为%+v", rows)
+	}
+
+	since, until, _, _ := historyPeriod("本周", time.Now())
+	scope := &leaderboardScope{Group: "上星群", Label: "本周",
+		Since: since.UTC().Format("2006-01-02 15:04:05"), Until: until.UTC().Format("2006-01-02 15:04:05")}
+	rows, _ = starsLeaderboard(db, scope)
+	if len(rows) != 1 || rows[0].Name != "老板" || rows[0].Value != 5 {
+		t.Fatalf("周榜只应统计本周的进度，实际为%+v", rows)
+	}
+}
+
+// 星卷榜算上用兑换码直接支付的交易订单，兑换进钱包的兑换码等开单时再计入
+func TestSpendLeaderboardIncludesRechargeCodes(t *testing.T) {
+	db := newTestDB(t)
+	addTestRechargeCode(t, db, "5001", 100)
+	if _, _, _, err := redeemRechargeCode(db, "5001", "老板", "", ""); err != nil {
+		t.Fatalf("兑换失败: %v", err)
+	}
+	if _, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{}); err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+
+	item := addTestMarketItem(t, db, "上星群")
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	addTestRechargeCode(t, db, "5002", 10)
+	if err := payTradeOrder(db, order, "5002", "买家"); err != nil {
+		t.Fatalf("付款失败: %v", err)
+	}
+
+	rows, err := spendLeaderboard(db, &leaderboardScope{Label: "总榜"})
+	if err != nil {
+		t.Fatalf("生成星卷榜失败: %v", err)
+	}
+	if len(rows) != 2 || rows[0].Name != "老板" || rows[0].Value != 20 || rows[1].Name != "买家" || rows[1].Value != 10 || rows[1].Orders != 1 {
+		t.Fatalf("星卷榜应为上星花费加兑换码付款，实际为%+v", rows)
+	}
+	rows, _ = spendLeaderboard(db, &leaderboardScope{Group: "别的群", Label: "总榜"})
+	for _, row := range rows {
+		if row.Name == "买家" {
+			t.Fatalf("别的群的交易区付款不应计入本群星卷榜: %+v", rows)
+		}
+	}
+}
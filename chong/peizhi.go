@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+)
+
+// 机器人的运行配置，从 config.json 读取，缺省字段使用默认值
+type Config struct {
+	Admins       []string `json:"admins"`        // 管理员微信昵称
+	AdminRemarks []string `json:"admin_remarks"` // 机器人给管理员设置的备注名，补星、提现、退款、裁决等资金类命令还要核对备注名
+
+	ListingExpiryDays   int `json:"listing_expiry_days"`   // 交易品上架有效期，0 表示不过期
+	ExpiryReminderHours int `json:"expiry_reminder_hours"` // 过期前多少小时提醒卖家
+
+	Commission CommissionConfig `json:"commission"` // 交易佣金规则
+
+	MinPayout               float64 `json:"min_payout"`                // 单次最低提现金额
+	SettlementIntervalHours int     `json:"settlement_interval_hours"` // 自动生成结算批次的间隔，0 表示只手动生成
+
+	DailyReconciliation bool `json:"daily_reconciliation"` // 每天私聊管理员前一天的对账报告
+
+	Web     WebConfig `json:"web"`      // 后台网页看板
+	APIKeys []APIKey  `json:"api_keys"` // 外部工具调用 /api/ 接口的密钥
+
+	Webhooks           []WebhookEndpoint `json:"webhooks"`             // 业务事件推送地址
+	WebhookMaxAttempts int               `json:"webhook_max_attempts"` // 投递失败多少次后转入死信表
+
+	BridgePrices            map[string]float64 `json:"bridge_prices"`              // 上星订单类型及每颗星的星卷价格
+	BoosterGroup            string             `json:"booster_group"`              // 发布待接订单的打手群名
+	BoosterMaxOrders        int                `json:"booster_max_orders"`         // 每个打手同时进行的订单上限
+	BridgeClaimTimeoutHours int                `json:"bridge_claim_timeout_hours"` // 接单后多少小时没有进度就重新派单，0 表示不限
+
+	LeaderboardGroups []string `json:"leaderboard_groups"` // 每周一发送上周排行榜的群名，为空时不发送
+
+	VIPTiers []VIPTier `json:"vip_tiers"` // 会员等级，按累计兑换金额划分，为空时不启用等级
+
+	Referral ReferralConfig `json:"referral"` // 邀请奖励规则
+	Transfer TransferConfig `json:"transfer"` // 会员之间转星卷的限制
+}
+
+var config = defaultConfig()
+
+func defaultConfig() Config {
+	return Config{
+		ListingExpiryDays:   30,
+		ExpiryReminderHours: 24,
+		Commission: CommissionConfig{
+			CommissionRule: CommissionRule{Rate: 0.05, Minimum: 1},
+		},
+		MinPayout:               10,
+		SettlementIntervalHours: 24,
+		DailyReconciliation:     true,
+		Web: WebConfig{
+			Listen:       "127.0.0.1:8088",
+			Username:     "admin",
+			SessionHours: 12,
+		},
+		WebhookMaxAttempts:      6,
+		BoosterMaxOrders:        2,
+		BridgeClaimTimeoutHours: 24,
+		Referral: ReferralConfig{
+			Reward:      0,
+			MinRecharge: 10,
+			DailyLimit:  5,
+			MaxRewards:  50,
+		},
+		Transfer: TransferConfig{
+			MinAmount:   1,
+			DailyAmount: 500,
+			DailyCount:  10,
+		},
+	}
+}
+
+// 读取配置文件，文件不存在时使用默认配置
+func loadConfig(path string) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			log.Printf("未找到配置文件 %s，使用默认配置\n", path)
+			return
+		}
+		log.Fatalf("读取配置文件失败: %s\n", err)
+	}
+	cfg := defaultConfig()
+	if err := json.Unmarshal(data, &cfg); err != nil {
+		log.Fatalf("解析配置文件失败: %s\n", err)
+	}
+	config = cfg
+}
+
+func isAdmin(nickName string) bool {
+	for _, admin := range config.Admins {
+		if admin == nickName {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+)
+
+// 平台收入记在这个账户下，其余账户都是用户昵称
+const platformAccount = "[平台]"
+
+// 钱包余额以星卷计，1 星卷对应 1 元。每次变动都写一条流水，wallets 中保存当前余额
+func initWalletTables(db *sql.DB) {
+	createWalletsTableSQL := `
+	CREATE TABLE IF NOT EXISTS wallets (
+		account TEXT PRIMARY KEY,
+		balance REAL NOT NULL DEFAULT 0,
+		updated_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createWalletsTableSQL); err != nil {
+		log.Fatalf("创建 wallets 表失败: %s\n", err)
+	}
+
+	createWalletEntriesTableSQL := `
+	CREATE TABLE IF NOT EXISTS wallet_entries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account TEXT NOT NULL,
+		amount REAL NOT NULL,  -- 正数为入账，负数为出账
+		balance_after REAL NOT NULL,
+		entry_type TEXT NOT NULL,
+		ref_type TEXT NOT NULL DEFAULT '',
+		ref_id INTEGER NOT NULL DEFAULT 0,
+		memo TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createWalletEntriesTableSQL); err != nil {
+		log.Fatalf("创建 wallet_entries 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_wallet_entries_account ON wallet_entries (account, created_at)`); err != nil {
+		log.Fatalf("创建 wallet_entries 索引失败: %s\n", err)
+	}
+
+	// 余额中可以提现的部分，-1 表示旧数据还没有计算，启动时按流水补算
+	addColumnIfMissing(db, "wallets", "withdrawable", "REAL NOT NULL DEFAULT -1")
+	if err := backfillWithdrawable(db); err != nil {
+		log.Fatalf("补算可提现金额失败: %s\n", err)
+	}
+}
+
+// 计算一笔流水之后的可提现金额：交易收入和退回的提现计入，
+// 任何出账都先从可提现部分扣，这样活动赠送、邀请奖励、转入的星卷花掉之前收入不会被重复提现
+func nextWithdrawable(withdrawable, amount float64, entryType string) float64 {
+	switch {
+	case entryType == withdrawableEntryType || entryType == payoutReturnedEntryType:
+		withdrawable += amount
+	case amount < 0:
+		withdrawable = math.Max(0, withdrawable+amount)
+	}
+	return roundCents(withdrawable)
+}
+
+// 按流水顺序为旧钱包补算可提现金额
+func backfillWithdrawable(db *sql.DB) error {
+	rows, err := db.Query(`SELECT e.account, e.amount, e.entry_type FROM wallet_entries e
+	JOIN wallets w ON w.account = e.account WHERE w.withdrawable < 0 ORDER BY e.id`)
+	if err != nil {
+		return err
+	}
+	withdrawable := make(map[string]float64)
+	for rows.Next() {
+		var account, entryType string
+		var amount float64
+		if err := rows.Scan(&account, &amount, &entryType); err != nil {
+			rows.Close()
+			return err
+		}
+		withdrawable[account] = nextWithdrawable(withdrawable[account], amount, entryType)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for account, amount := range withdrawable {
+		if _, err := tx.Exec(`UPDATE wallets SET withdrawable = MIN(?, balance) WHERE account = ?`, amount, account); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE wallets SET withdrawable = 0 WHERE withdrawable < 0`); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 在事务中记一笔钱包流水并更新余额，用户账户余额不能为负
+func postWalletEntry(tx *sql.Tx, account string, amount float64, entryType, refType string, refID int, memo string) (float64, error) {
+	amount = roundCents(amount)
+	if amount == 0 {
+		return getWalletBalanceTx(tx, account)
+	}
+
+	var balance, withdrawable float64
+	err := tx.QueryRow(`SELECT balance, withdrawable FROM wallets WHERE account = ?`, account).Scan(&balance, &withdrawable)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	balance = roundCents(balance + amount)
+	if balance < 0 && account != platformAccount {
+		return 0, fmt.Errorf("%s的余额不足", account)
+	}
+	withdrawable = math.Min(nextWithdrawable(withdrawable, amount, entryType), math.Max(balance, 0))
+
+	if _, err := tx.Exec(`INSERT INTO wallets (account, balance, withdrawable, updated_at) VALUES (?, ?, ?, datetime('now'))
+	ON CONFLICT(account) DO UPDATE SET balance = excluded.balance, withdrawable = excluded.withdrawable, updated_at = excluded.updated_at`,
+		account, balance, withdrawable); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO wallet_entries (account, amount, balance_after, entry_type, ref_type, ref_id, memo) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		account, amount, balance, entryType, refType, refID, memo); err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func getWalletBalanceTx(tx *sql.Tx, account string) (float64, error) {
+	var balance float64
+	err := tx.QueryRow(`SELECT balance FROM wallets WHERE account = ?`, account).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+func getWalletBalance(db *sql.DB, account string) (float64, error) {
+	var balance float64
+	err := db.QueryRow(`SELECT balance FROM wallets WHERE account = ?`, account).Scan(&balance)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return balance, err
+}
+
+// 核对账户余额与流水合计是否一致
+func reconcileWalletAccount(db *sql.DB, account string) (float64, float64, error) {
+	balance, err := getWalletBalance(db, account)
+	if err != nil {
+		return 0, 0, err
+	}
+	var ledger sql.NullFloat64
+	if err := db.QueryRow(`SELECT SUM(amount) FROM wallet_entries WHERE account = ?`, account).Scan(&ledger); err != nil {
+		return 0, 0, err
+	}
+	return roundCents(balance), roundCents(ledger.Float64), nil
+}
+
+func roundCents(amount float64) float64 {
+	return math.Round(amount*100) / 100
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 上星订单，即“我的历史”里展示的 Bridges 表。用户用钱包里的星卷下单，
+// 扣款和退款都记在钱包流水里，ref_type 为 bridge，ref_id 为订单号
+type Bridge struct {
+	ID          int
+	User        string
+	OrderType   string
+	GameID      string
+	TargetStars int
+	StarCost    int
+	UnitPrice   float64
+	Stars       int
+	FinalRank   string
+	IsActive    bool
+	CreatedAt   string
+}
+
+// Bridges 表最早由外部程序创建，列名沿用原来的写法，新增的列用 addColumnIfMissing 补上
+func initBridgeTables(db *sql.DB) {
+	createBridgesTableSQL := `
+	CREATE TABLE IF NOT EXISTS Bridges (
+		ID INTEGER PRIMARY KEY AUTOINCREMENT,
+		GroupUserNickName TEXT NOT NULL,
+		OrderType TEXT NOT NULL,
+		GameID TEXT NOT NULL,
+		StarCost INTEGER NOT NULL DEFAULT 0,
+		Stars INTEGER NOT NULL DEFAULT 0,
+		FinalRank TEXT NOT NULL DEFAULT '',
+		IsActive BOOLEAN NOT NULL DEFAULT 1,
+		CreatedAt DATETIME NOT NULL DEFAULT CURRENT_TIMESTAMP
+	);`
+	if _, err := db.Exec(createBridgesTableSQL); err != nil {
+		log.Fatalf("创建 Bridges 表失败: %s\n", err)
+	}
+	addColumnIfMissing(db, "Bridges", "TargetStars", "INTEGER NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "Bridges", "UnitPrice", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "Bridges", "UpdatedAt", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "Bridges", "ClosedAt", "TEXT NOT NULL DEFAULT ''")
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_bridges_user ON Bridges (GroupUserNickName, IsActive)`); err != nil {
+		log.Fatalf("创建 Bridges 索引失败: %s\n", err)
+	}
+}
+
+// 订单类型及每颗星的价格由 config.json 的 bridge_prices 配置
+func bridgeOrderTypes() []string {
+	var types []string
+	for orderType := range config.BridgePrices {
+		types = append(types, orderType)
+	}
+	return types
+}
+
+var openBridgeRe = regexp.MustCompile(`^开单(?:，)?([^，]+)，([^，]+)，(\d+)(?:，优惠码[A-Za-z0-9]+)?$`)
+
+// 处理 "开单[类型]，[游戏ID]，[星数][，优惠码XXX]" 命令，从钱包扣除星卷后创建上星订单
+func handleOpenBridge(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, sender *openwechat.User) {
+	user := sender.NickName
+	if len(config.BridgePrices) == 0 {
+		msg.ReplyText("管理员尚未设置上星价格，暂时不能开单。")
+		return
+	}
+	matches := openBridgeRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText(fmt.Sprintf("指令格式错误，请按照 '开单[类型]，[游戏ID]，[星数][，优惠码XXX]' 的格式输入。可选类型：%s", strings.Join(bridgeOrderTypes(), "、")))
+		return
+	}
+	orderType, gameID := strings.TrimSpace(matches[1]), strings.TrimSpace(matches[2])
+	stars, _ := strconv.Atoi(matches[3])
+	price, ok := config.BridgePrices[orderType]
+	if !ok {
+		msg.ReplyText(fmt.Sprintf("没有“%s”这个类型，可选类型：%s", orderType, strings.Join(bridgeOrderTypes(), "、")))
+		return
+	}
+	if stars <= 0 {
+		msg.ReplyText("星数必须大于0。")
+		return
+	}
+
+	// 会员等级的上星折扣直接算进单价，撤单时按折后单价退款
+	tier := memberTier(db, user)
+	discountText := ""
+	if tier.BridgeDiscount > 0 {
+		price *= 1 - tier.BridgeDiscount
+		discountText = fmt.Sprintf("（%s优惠%.0f%%）", tier.Name, tier.BridgeDiscount*100)
+	}
+
+	coupon := couponUse{Code: couponCodeFrom(msg.Content), Member: friendRemark(self, sender)}
+	bridge, balance, couponDiscount, err := createBridge(db, user, orderType, gameID, stars, price, coupon)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("开单失败：%v", err))
+		return
+	}
+	if couponDiscount > 0 {
+		discountText += fmt.Sprintf("（优惠码%s优惠%.2f星卷）", coupon.Code, couponDiscount)
+	}
+	msg.ReplyText(fmt.Sprintf("已创建上星订单%d号：%s %s %d星，扣除%d星卷%s，钱包余额%.2f星卷。发送“上星订单”查看进度。",
+		bridge.ID, orderType, gameID, stars, bridge.StarCost, discountText, balance))
+	notifyAdmins(self, fmt.Sprintf("新上星订单%d号：%s %s %s %d星（%d星卷）", bridge.ID, user, orderType, gameID, stars, bridge.StarCost))
+	announceBridge(self, bridge, "新上星订单")
+}
+
+// 扣款、平台入账、优惠码使用和建单在同一个事务里，余额不足或优惠码不可用时整单失败。
+// 优惠码的减免折算进单价，撤单时按折后单价退款
+func createBridge(db *sql.DB, user, orderType, gameID string, stars int, price float64, coupon couponUse) (*Bridge, float64, float64, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	defer tx.Rollback()
+
+	gross := float64(stars) * price
+	var discount float64
+	if coupon.Code != "" {
+		if _, discount, err = checkCoupon(tx, coupon, couponBridge, orderType, gross); err != nil {
+			return nil, 0, 0, err
+		}
+		price = (gross - discount) / float64(stars)
+	}
+	cost := int(math.Ceil(roundCents(float64(stars) * price)))
+
+	result, err := tx.Exec(`INSERT INTO Bridges (GroupUserNickName, OrderType, GameID, TargetStars, StarCost, UnitPrice, UpdatedAt)
+	VALUES (?, ?, ?, ?, ?, ?, datetime('now'))`, user, orderType, gameID, stars, cost, price)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	memo := fmt.Sprintf("上星订单%d号 %s %d星", id, orderType, stars)
+	balance, err := postWalletEntry(tx, user, -float64(cost), "上星订单", "bridge", int(id), memo)
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	if _, err := postWalletEntry(tx, platformAccount, float64(cost), "上星收入", "bridge", int(id), memo); err != nil {
+		return nil, 0, 0, err
+	}
+	if coupon.Code != "" {
+		if err := recordCouponRedemption(tx, coupon, user, "bridge", int(id), roundCents(gross), discount); err != nil {
+			return nil, 0, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, 0, err
+	}
+	return &Bridge{ID: int(id), User: user, OrderType: orderType, GameID: gameID, TargetStars: stars, StarCost: cost, UnitPrice: price, IsActive: true}, balance, discount, nil
+}
+
+func getBridge(db *sql.DB, id int) (*Bridge, error) {
+	var b Bridge
+	err := db.QueryRow(`SELECT rowid, GroupUserNickName, OrderType, GameID, TargetStars, StarCost, UnitPrice, Stars, FinalRank, IsActive, CreatedAt
+	FROM Bridges WHERE rowid = ?`, id).Scan(&b.ID, &b.User, &b.OrderType, &b.GameID, &b.TargetStars, &b.StarCost, &b.UnitPrice,
+		&b.Stars, &b.FinalRank, &b.IsActive, &b.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("上星订单%d号不存在", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+func (b *Bridge) progressText() string {
+	text := fmt.Sprintf("上星订单%d号：%s %s，%d/%d星", b.ID, b.OrderType, b.GameID, b.Stars, b.TargetStars)
+	if b.FinalRank != "" {
+		text += "，段位" + b.FinalRank
+	}
+	return text + fmt.Sprintf("，%d星卷", b.StarCost)
+}
+
+// 用户查看自己进行中的订单，管理员发送“上星列表”查看全部进行中的订单
+func listBridges(msg *openwechat.Message, db *sql.DB, user string) {
+	query := `SELECT rowid, GroupUserNickName, OrderType, GameID, TargetStars, StarCost, Stars, FinalRank, CreatedAt FROM Bridges WHERE IsActive = 1`
+	var args []interface{}
+	if user != "" {
+		query += ` AND GroupUserNickName = ?`
+		args = append(args, user)
+	}
+	rows, err := db.Query(query+` ORDER BY rowid`, args...)
+	if err != nil {
+		msg.ReplyText("获取上星订单时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var b Bridge
+		if err := rows.Scan(&b.ID, &b.User, &b.OrderType, &b.GameID, &b.TargetStars, &b.StarCost, &b.Stars, &b.FinalRank, &b.CreatedAt); err != nil {
+			continue
+		}
+		line := b.progressText()
+		if user == "" {
+			line = b.User + " " + line
+		}
+		response.WriteString(line + "\n")
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("当前没有进行中的上星订单。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+var (
+	bridgeProgressRe = regexp.MustCompile(`^进度(\d+)号，(\d+)星?(?:，(.+))?$`)
+	closeBridgeRe    = regexp.MustCompile(`^结单(\d+)号(?:，(.+))?$`)
+	cancelBridgeRe   = regexp.MustCompile(`^撤单(\d+)号(?:，(.*))?$`)
+)
+
+func isBridgeAdminCommand(content string) bool {
+	return content == "上星列表" || bridgeProgressRe.MatchString(content) || closeBridgeRe.MatchString(content) || cancelBridgeRe.MatchString(content)
+}
+
+// 管理员上星命令：上星列表、进度N号，[已上星数][，段位]、结单N号[，最终段位]、撤单N号[，原因]
+func handleBridgeAdmin(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, operator string) {
+	switch {
+	case msg.Content == "上星列表":
+		listBridges(msg, db, "")
+
+	case bridgeProgressRe.MatchString(msg.Content):
+		handleBridgeProgress(msg, db, self, operator)
+
+	case closeBridgeRe.MatchString(msg.Content):
+		handleCloseBridge(msg, db, self, operator)
+
+	case cancelBridgeRe.MatchString(msg.Content):
+		matches := cancelBridgeRe.FindStringSubmatch(msg.Content)
+		id, _ := strconv.Atoi(matches[1])
+		bridge, refund, err := cancelBridge(db, id, operator, strings.TrimSpace(matches[2]), false)
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("撤单失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("上星订单%d号已撤单，退还%s %d星卷。", id, bridge.User, refund))
+		sendTextToNickName(self, bridge.User, fmt.Sprintf("您的上星订单%d号已撤单，未完成的%d星卷已退回钱包。", id, refund))
+	}
+}
+
+// 处理 "进度N号，[已上星数][，段位]"，管理员或接单的打手可以记录
+func handleBridgeProgress(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, operator string) {
+	matches := bridgeProgressRe.FindStringSubmatch(msg.Content)
+	id, _ := strconv.Atoi(matches[1])
+	stars, _ := strconv.Atoi(matches[2])
+	if !canUpdateBridge(db, operator, id) {
+		msg.ReplyText(fmt.Sprintf("上星订单%d号不是您接的单。", id))
+		return
+	}
+	bridge, progressID, err := updateBridgeProgress(db, id, stars, strings.TrimSpace(matches[3]), operator)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("记录进度失败：%v", err))
+		return
+	}
+	awaitProgressScreenshot(operator, progressID)
+	msg.ReplyText(fmt.Sprintf("已记录%s。%d分钟内发送截图会附在这条进度上。", bridge.progressText(), progressScreenshotMinutes))
+	notifyBridgeCustomer(self, bridge.User, fmt.Sprintf("进度更新：%s\n发送“进度%d号”查看完整进度。", bridge.progressText(), id))
+}
+
+// 处理 "结单N号[，最终段位]"
+func handleCloseBridge(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, operator string) {
+	matches := closeBridgeRe.FindStringSubmatch(msg.Content)
+	id, _ := strconv.Atoi(matches[1])
+	if !canUpdateBridge(db, operator, id) {
+		msg.ReplyText(fmt.Sprintf("上星订单%d号不是您接的单。", id))
+		return
+	}
+	bridge, err := closeBridge(db, id, strings.TrimSpace(matches[2]), operator)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("结单失败：%v", err))
+		return
+	}
+	msg.ReplyText("已结单，" + bridge.progressText())
+	notifyBridgeCustomer(self, bridge.User, "订单已完成，"+bridge.progressText())
+}
+
+// 用户撤销自己的订单，只能在还没有进度时撤销，全额退回
+func handleCancelOwnBridge(msg *openwechat.Message, db *sql.DB, user string) {
+	matches := cancelBridgeRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '撤单[订单号]号' 的格式输入。")
+		return
+	}
+	id, _ := strconv.Atoi(matches[1])
+	bridge, err := getBridge(db, id)
+	if err != nil || bridge.User != user {
+		msg.ReplyText(fmt.Sprintf("上星订单%d号不存在。", id))
+		return
+	}
+	_, refund, err := cancelBridge(db, id, user, "用户撤单", true)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("撤单失败：%v", err))
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("上星订单%d号已撤单，%d星卷已退回钱包。", id, refund))
+}
+
+// 进度记录的是累计已上的星数，段位不填时保留原值。每次进度都写入 bridge_progress 时间线
+func updateBridgeProgress(db *sql.DB, id, stars int, rank, operator string) (*Bridge, int, error) {
+	bridge, err := getBridge(db, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !bridge.IsActive {
+		return nil, 0, fmt.Errorf("上星订单%d号已结束", id)
+	}
+	// 撤单按未上的星退款，进度只能前进且不能超过目标，否则退款会被多算或少算
+	if stars < bridge.Stars {
+		return nil, 0, fmt.Errorf("上星订单%d号已上%d星，进度不能回退", id, bridge.Stars)
+	}
+	if bridge.TargetStars > 0 && stars > bridge.TargetStars {
+		return nil, 0, fmt.Errorf("上星订单%d号目标为%d星，进度不能超过目标", id, bridge.TargetStars)
+	}
+	if rank == "" {
+		rank = bridge.FinalRank
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`UPDATE Bridges SET Stars = ?, FinalRank = ?, UpdatedAt = datetime('now'), LastProgressAt = datetime('now')
+	WHERE rowid = ? AND IsActive = 1 AND Stars = ?`, stars, rank, id, bridge.Stars)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, 0, fmt.Errorf("上星订单%d号已结束或进度刚刚更新，请重新查看", id)
+	}
+	before := fmt.Sprintf("%d星 %s", bridge.Stars, bridge.FinalRank)
+	after := fmt.Sprintf("%d星 %s", stars, rank)
+	if err := writeAuditLog(tx, operator, "上星进度", fmt.Sprintf("上星订单%d号", id), before, after, ""); err != nil {
+		return nil, 0, err
+	}
+	progressID, err := insertBridgeProgress(tx, id, operator, stars, rank, "")
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	bridge.Stars, bridge.FinalRank = stars, rank
+	return bridge, progressID, nil
+}
+
+// 结单后订单不再更新，星卷不退
+func closeBridge(db *sql.DB, id int, finalRank, operator string) (*Bridge, error) {
+	bridge, err := getBridge(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if finalRank == "" {
+		finalRank = bridge.FinalRank
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`UPDATE Bridges SET IsActive = 0, FinalRank = ?, UpdatedAt = datetime('now'), ClosedAt = datetime('now')
+	WHERE rowid = ? AND IsActive = 1`, finalRank, id)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("上星订单%d号已结束", id)
+	}
+	if err := writeAuditLog(tx, operator, "结单", fmt.Sprintf("上星订单%d号", id), "进行中", "已结束", finalRank); err != nil {
+		return nil, err
+	}
+	if _, err := insertBridgeProgress(tx, id, operator, bridge.Stars, finalRank, "结单"); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	bridge.IsActive, bridge.FinalRank = false, finalRank
+	return bridge, nil
+}
+
+// 撤单按未完成的星数退款，StarCost 同步减去退款，使“我的历史”显示实际花费。用户自己撤单时 unstartedOnly 为 true，只能撤还没开始上星的订单
+func cancelBridge(db *sql.DB, id int, operator, reason string, unstartedOnly bool) (*Bridge, int, error) {
+	bridge, err := getBridge(db, id)
+	if err != nil {
+		return nil, 0, err
+	}
+	if unstartedOnly && bridge.Stars > 0 {
+		return nil, 0, fmt.Errorf("订单已经开始上星，请联系管理员撤单")
+	}
+	used := bridge.StarCost
+	if bridge.Stars < bridge.TargetStars {
+		used = int(math.Ceil(float64(bridge.Stars) * bridge.UnitPrice))
+	}
+	if used > bridge.StarCost {
+		used = bridge.StarCost
+	}
+	refund := bridge.StarCost - used
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, 0, err
+	}
+	defer tx.Rollback()
+	// 退款按读到的星数计算，打手在这期间更新了进度就整单失败，用户撤单时也就保证了仍未开始上星
+	result, err := tx.Exec(`UPDATE Bridges SET IsActive = 0, StarCost = ?, UpdatedAt = datetime('now'), ClosedAt = datetime('now')
+	WHERE rowid = ? AND IsActive = 1 AND Stars = ?`, used, id, bridge.Stars)
+	if err != nil {
+		return nil, 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, 0, fmt.Errorf("上星订单%d号已结束或进度刚刚更新，请重新查看后再撤单", id)
+	}
+	memo := fmt.Sprintf("上星订单%d号撤单", id)
+	if _, err := postWalletEntry(tx, platformAccount, -float64(refund), "上星退款", "bridge", id, memo); err != nil {
+		return nil, 0, err
+	}
+	if _, err := postWalletEntry(tx, bridge.User, float64(refund), "上星退款", "bridge", id, memo); err != nil {
+		return nil, 0, err
+	}
+	if err := writeAuditLog(tx, operator, "撤单", fmt.Sprintf("上星订单%d号", id), strconv.Itoa(bridge.StarCost), strconv.Itoa(used), reason); err != nil {
+		return nil, 0, err
+	}
+	if _, err := insertBridgeProgress(tx, id, operator, bridge.Stars, bridge.FinalRank, "撤单"); err != nil {
+		return nil, 0, err
+	}
+	// 还没开始上星就撤单时，优惠码可以再次使用
+	if bridge.Stars == 0 {
+		if err := voidCouponRedemption(tx, "bridge", id); err != nil {
+			return nil, 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, 0, err
+	}
+	bridge.IsActive, bridge.StarCost = false, used
+	return bridge, refund, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import "testing"
+
+func TestOwnerCancelOnlyBeforeProgress(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 3, "", "打手"); err != nil {
+		t.Fatalf("更新进度失败: %v", err)
+	}
+	if _, _, err := cancelBridge(db, bridge.ID, "老板", "用户撤单", true); err == nil {
+		t.Fatal("已开始上星的订单用户不能自己撤单")
+	}
+	if balance, _ := getWalletBalance(db, "老板"); balance != 80 {
+		t.Fatalf("撤单失败后余额应为80，实际为%.2f", balance)
+	}
+
+	// 管理员撤单按未完成的星数退款
+	_, refund, err := cancelBridge(db, bridge.ID, "管理员", "测试", false)
+	if err != nil {
+		t.Fatalf("管理员撤单失败: %v", err)
+	}
+	if refund != 14 {
+		t.Fatalf("应退14星卷，实际为%d", refund)
+	}
+	if balance, _ := getWalletBalance(db, "老板"); balance != 94 {
+		t.Fatalf("撤单后余额应为94，实际为%.2f", balance)
+	}
+}
+
+func TestOwnerCancelRefundsUnstartedBridge(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	_, refund, err := cancelBridge(db, bridge.ID, "老板", "用户撤单", true)
+	if err != nil {
+		t.Fatalf("撤单失败: %v", err)
+	}
+	if refund != 20 {
+		t.Fatalf("应全额退20星卷，实际为%d", refund)
+	}
+	if balance, _ := getWalletBalance(db, "老板"); balance != 100 {
+		t.Fatalf("撤单后余额应为100，实际为%.2f", balance)
+	}
+}
+
+// 进度回退或超过目标会让撤单退款算错，已结束的订单也不能再记进度
+func TestBridgeProgressValidation(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "老板", 100, "兑换码充值")
+	bridge, _, _, err := createBridge(db, "老板", "王者", "123", 10, 2, couponUse{})
+	if err != nil {
+		t.Fatalf("开单失败: %v", err)
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 6, "", "打手"); err != nil {
+		t.Fatalf("更新进度失败: %v", err)
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 2, "", "打手"); err == nil {
+		t.Fatal("进度不能回退")
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 11, "", "打手"); err == nil {
+		t.Fatal("进度不能超过目标星数")
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 10, "", "打手"); err != nil {
+		t.Fatalf("进度达到目标应允许: %v", err)
+	}
+
+	if _, err := closeBridge(db, bridge.ID, "", "管理员"); err != nil {
+		t.Fatalf("结单失败: %v", err)
+	}
+	if _, _, err := updateBridgeProgress(db, bridge.ID, 10, "", "打手"); err == nil {
+		t.Fatal("已结单的订单不能再记进度")
+	}
+	var stars, logs int
+	db.QueryRow(`SELECT Stars FROM Bridges WHERE rowid = ?`, bridge.ID).Scan(&stars)
+	db.QueryRow(`SELECT COUNT(*) FROM admin_audit_logs WHERE action = '上星进度'`).Scan(&logs)
+	if stars != 10 || logs != 2 {
+		t.Fatalf("被拒绝的进度不应写入，星数%d，审计日志%d条", stars, logs)
+	}
+}
@@ -0,0 +1,476 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 申诉相关的订单状态和裁决结果
+const (
+	orderDisputed = "申诉中"
+	orderRefunded = "已退款"
+	orderSplit    = "已裁决"
+
+	disputeOpen   = "处理中"
+	disputeClosed = "已裁决"
+
+	rulingRefund  = "退款"
+	rulingRelease = "放款"
+	rulingSplit   = "分配"
+
+	// 交易群图片和申诉证据图片的保存目录
+	evidenceDir = "../shensu"
+	// 取证时文字证据的前缀
+	evidencePrefix = "证据："
+)
+
+type TradeDispute struct {
+	ID             int
+	OrderID        int
+	Complainant    string
+	Reason         string
+	Status         string
+	PreviousStatus string // 申诉前的订单状态
+	Ruling         string
+	BuyerAmount    float64
+	SellerAmount   float64
+	RuledBy        string
+	RulingNote     string
+	CreatedAt      string
+	RuledAt        string
+}
+
+func initDisputeTables(db *sql.DB) {
+	createTradeOrderMessagesTableSQL := `
+	CREATE TABLE IF NOT EXISTS trade_order_messages (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id INTEGER NOT NULL,
+		sender TEXT NOT NULL,
+		kind TEXT NOT NULL,  -- 文字 或 图片
+		content TEXT NOT NULL,  -- 文字内容或图片文件名
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createTradeOrderMessagesTableSQL); err != nil {
+		log.Fatalf("创建 trade_order_messages 表失败: %s\n", err)
+	}
+
+	createTradeDisputesTableSQL := `
+	CREATE TABLE IF NOT EXISTS trade_disputes (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id INTEGER NOT NULL,
+		complainant TEXT NOT NULL,
+		reason TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '处理中',
+		previous_status TEXT NOT NULL,
+		ruling TEXT NOT NULL DEFAULT '',
+		buyer_amount REAL NOT NULL DEFAULT 0,
+		seller_amount REAL NOT NULL DEFAULT 0,
+		ruled_by TEXT NOT NULL DEFAULT '',
+		ruling_note TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		ruled_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createTradeDisputesTableSQL); err != nil {
+		log.Fatalf("创建 trade_disputes 表失败: %s\n", err)
+	}
+
+	createDisputeEvidenceTableSQL := `
+	CREATE TABLE IF NOT EXISTS dispute_evidence (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		dispute_id INTEGER NOT NULL,
+		submitted_by TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		content TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createDisputeEvidenceTableSQL); err != nil {
+		log.Fatalf("创建 dispute_evidence 表失败: %s\n", err)
+	}
+}
+
+// 记录交易群中的消息，作为申诉时的聊天记录
+func logTradeOrderMessage(db *sql.DB, order *TradeOrder, sender string, msg *openwechat.Message) {
+	kind, content := "文字", msg.Content
+	if msg.IsPicture() {
+		fileName, err := saveMessagePicture(msg)
+		if err != nil {
+			log.Printf("保存交易群图片失败: %v\n", err)
+			return
+		}
+		kind, content = "图片", fileName
+	}
+	if _, err := db.Exec(`INSERT INTO trade_order_messages (order_id, sender, kind, content) VALUES (?, ?, ?, ?)`,
+		order.ID, sender, kind, content); err != nil {
+		log.Printf("记录交易群消息失败: %v\n", err)
+	}
+}
+
+func saveMessagePicture(msg *openwechat.Message) (string, error) {
+	imgData, err := msg.GetPicture()
+	if err != nil {
+		return "", err
+	}
+	return savePicture(evidenceDir, imgData)
+}
+
+// 处理申诉命令：交易群中发送 "申诉，[理由]"，私聊发送 "申诉[交易单号]号，[理由]"
+func handleDispute(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, order *TradeOrder, complainant string) {
+	reason := ""
+	if order == nil {
+		matches := regexp.MustCompile(`^申诉(\d+)号(?:，(.*))?$`).FindStringSubmatch(msg.Content)
+		if len(matches) == 0 {
+			msg.ReplyText("指令格式错误，请按照 '申诉[交易单号]号，[理由]' 的格式输入。")
+			return
+		}
+		orderID, _ := strconv.Atoi(matches[1])
+		var err error
+		if order, err = getTradeOrderByID(db, orderID); err != nil {
+			msg.ReplyText("获取订单信息时发生错误，请稍后重试。")
+			return
+		}
+		reason = matches[2]
+	} else {
+		reason = strings.TrimPrefix(strings.TrimPrefix(msg.Content, "申诉"), "，")
+	}
+
+	if order == nil || (order.Buyer != complainant && order.Seller != complainant) {
+		msg.ReplyText("未找到您参与的该交易单。")
+		return
+	}
+	if order.Status != orderPaid {
+		msg.ReplyText(fmt.Sprintf("订单当前状态为%s，只有已付款未完成的订单可以申诉。", order.Status))
+		return
+	}
+
+	dispute, err := openTradeDispute(db, order, complainant, strings.TrimSpace(reason))
+	if err != nil {
+		log.Printf("创建申诉失败: %v\n", err)
+		msg.ReplyText("提交申诉失败，请稍后重试。")
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("已提交申诉%d号，交易单%d号已冻结，管理员会尽快处理。", dispute.ID, order.ID))
+	notifyAdmins(self, disputeReport(db, dispute, order))
+}
+
+func openTradeDispute(db *sql.DB, order *TradeOrder, complainant, reason string) (*TradeDispute, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE trade_orders SET status = ?, updated_at = datetime('now') WHERE id = ? AND status = ?`,
+		orderDisputed, order.ID, order.Status)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("订单状态已变化")
+	}
+	result, err = tx.Exec(`INSERT INTO trade_disputes (order_id, complainant, reason, previous_status) VALUES (?, ?, ?, ?)`,
+		order.ID, complainant, reason, order.Status)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	dispute := &TradeDispute{ID: int(id), OrderID: order.ID, Complainant: complainant, Reason: reason,
+		Status: disputeOpen, PreviousStatus: order.Status}
+	disputed := *order
+	disputed.Status = orderDisputed
+	if err := emitOrderStatusChanged(tx, &disputed, dispute.PreviousStatus); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	order.Status = orderDisputed
+	return dispute, nil
+}
+
+// 组装发给管理员的申诉信息：订单详情和交易群聊天记录
+func disputeReport(db *sql.DB, dispute *TradeDispute, order *TradeOrder) string {
+	var report strings.Builder
+	report.WriteString(fmt.Sprintf("【申诉%d号】%s发起申诉\n理由：%s\n", dispute.ID, dispute.Complainant, dispute.Reason))
+	report.WriteString(fmt.Sprintf("交易单%d号：%s，价格%.2f\n卖家：%s，买家：%s\n创建：%s，群：%s\n",
+		order.ID, order.ItemName, order.Price, order.Seller, order.Buyer, order.CreatedAt, order.GroupName))
+
+	rows, err := db.Query(`SELECT sender, kind, content, created_at FROM trade_order_messages WHERE order_id = ? ORDER BY id`, order.ID)
+	if err != nil {
+		log.Printf("查询交易群聊天记录失败: %v\n", err)
+	} else {
+		defer rows.Close()
+		report.WriteString("——聊天记录——\n")
+		for rows.Next() {
+			var sender, kind, content, createdAt string
+			if err := rows.Scan(&sender, &kind, &content, &createdAt); err != nil {
+				continue
+			}
+			if kind == "图片" {
+				content = "[图片]" + content
+			}
+			report.WriteString(fmt.Sprintf("%s %s：%s\n", createdAt, sender, content))
+		}
+	}
+	report.WriteString(fmt.Sprintf("发送“取证%d号”开始收集证据，“裁决%d号，退款/放款/分配，[退给买家金额]，[备注]”给出裁决。", dispute.ID, dispute.ID))
+	return report.String()
+}
+
+// 管理员取证会话：管理员昵称 -> 申诉ID
+var evidenceSessions = struct {
+	sync.Mutex
+	m map[string]int
+}{m: make(map[string]int)}
+
+// 管理员私聊命令：申诉列表、取证N号、结束取证、裁决N号
+func handleDisputeAdmin(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	switch {
+	case msg.Content == "申诉列表":
+		listOpenDisputes(msg, db)
+
+	case strings.HasPrefix(msg.Content, "取证"):
+		var disputeID int
+		if _, err := fmt.Sscanf(msg.Content, "取证%d号", &disputeID); err != nil {
+			msg.ReplyText("指令格式错误，请按照 '取证[申诉ID]号' 的格式输入。")
+			return
+		}
+		dispute, err := getTradeDispute(db, disputeID)
+		if err != nil || dispute == nil || dispute.Status != disputeOpen {
+			msg.ReplyText("未找到处理中的该申诉。")
+			return
+		}
+		evidenceSessions.Lock()
+		evidenceSessions.m[admin] = disputeID
+		evidenceSessions.Unlock()
+		msg.ReplyText(fmt.Sprintf("开始收集申诉%d号的证据：直接发送图片，文字证据请以“证据：”开头，其他消息按普通命令处理。完成后发送“结束取证”。", disputeID))
+
+	case msg.Content == "结束取证":
+		evidenceSessions.Lock()
+		disputeID, ok := evidenceSessions.m[admin]
+		delete(evidenceSessions.m, admin)
+		evidenceSessions.Unlock()
+		if !ok {
+			msg.ReplyText("当前没有进行中的取证。")
+			return
+		}
+		var count int
+		db.QueryRow(`SELECT COUNT(*) FROM dispute_evidence WHERE dispute_id = ?`, disputeID).Scan(&count)
+		msg.ReplyText(fmt.Sprintf("申诉%d号取证结束，共%d条证据。", disputeID, count))
+
+	case strings.HasPrefix(msg.Content, "裁决"):
+		handleDisputeRuling(msg, db, self, admin)
+	}
+}
+
+// 取证中的管理员发来的图片和以“证据：”开头的文字记为证据，返回 true 表示消息已处理。
+// 其他消息（包括各种命令）照常处理，不会被误记为证据
+func collectDisputeEvidence(msg *openwechat.Message, db *sql.DB, admin string) bool {
+	evidenceSessions.Lock()
+	disputeID, ok := evidenceSessions.m[admin]
+	evidenceSessions.Unlock()
+	if !ok {
+		return false
+	}
+	if !msg.IsPicture() && !strings.HasPrefix(msg.Content, evidencePrefix) {
+		return false
+	}
+
+	kind, content := "文字", strings.TrimSpace(strings.TrimPrefix(msg.Content, evidencePrefix))
+	if msg.IsPicture() {
+		fileName, err := saveMessagePicture(msg)
+		if err != nil {
+			log.Printf("保存证据图片失败: %v\n", err)
+			msg.ReplyText("保存证据图片失败，请重新发送。")
+			return true
+		}
+		kind, content = "图片", fileName
+	}
+	if _, err := db.Exec(`INSERT INTO dispute_evidence (dispute_id, submitted_by, kind, content) VALUES (?, ?, ?, ?)`,
+		disputeID, admin, kind, content); err != nil {
+		log.Printf("保存证据失败: %v\n", err)
+		msg.ReplyText("保存证据失败，请重新发送。")
+		return true
+	}
+	msg.ReplyText(fmt.Sprintf("已记录为申诉%d号的%s证据。", disputeID, kind))
+	return true
+}
+
+var rulingRe = regexp.MustCompile(`^裁决(\d+)号，(退款|放款|分配)(?:，(\d+(?:\.\d+)?))?(?:，(.*))?$`)
+
+// 处理 "裁决N号，退款/放款/分配，[退给买家金额]，[备注]"
+func handleDisputeRuling(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	matches := rulingRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '裁决[申诉ID]号，退款/放款/分配，[退给买家金额]，[备注]' 的格式输入，分配时必须填写金额。")
+		return
+	}
+	disputeID, _ := strconv.Atoi(matches[1])
+	ruling, note := matches[2], strings.TrimSpace(matches[4])
+
+	dispute, err := getTradeDispute(db, disputeID)
+	if err != nil || dispute == nil || dispute.Status != disputeOpen {
+		msg.ReplyText("未找到处理中的该申诉。")
+		return
+	}
+	order, err := getTradeOrderByID(db, dispute.OrderID)
+	if err != nil || order == nil {
+		msg.ReplyText("获取订单信息时发生错误，请稍后重试。")
+		return
+	}
+
+	// 买家按优惠后的金额付款，放款时卖家仍按原价结算，优惠部分由平台承担
+	var buyerAmount float64
+	paid := order.amountDue()
+	orderStatus := orderSplit
+	switch ruling {
+	case rulingRefund:
+		buyerAmount, orderStatus = paid, orderRefunded
+	case rulingRelease:
+		buyerAmount, orderStatus = 0, orderCompleted
+	case rulingSplit:
+		if matches[3] == "" {
+			msg.ReplyText("分配裁决需要填写退给买家的金额。")
+			return
+		}
+		buyerAmount, _ = strconv.ParseFloat(matches[3], 64)
+		if buyerAmount <= 0 || buyerAmount >= paid {
+			msg.ReplyText(fmt.Sprintf("退给买家的金额必须在0到%.2f元之间。", paid))
+			return
+		}
+	}
+	sellerAmount := paid - buyerAmount
+	if ruling == rulingRelease {
+		sellerAmount = order.Price
+	}
+
+	refund, err := ruleTradeDispute(db, dispute, order, ruling, orderStatus, buyerAmount, sellerAmount, admin, note)
+	if err != nil {
+		log.Printf("保存裁决失败: %v\n", err)
+		msg.ReplyText("保存裁决失败，请稍后重试。")
+		return
+	}
+
+	result := fmt.Sprintf("申诉%d号裁决结果：%s。交易单%d号退还买家%s %.2f元，支付卖家%s %.2f元。备注：%s",
+		dispute.ID, ruling, order.ID, order.Buyer, buyerAmount, order.Seller, sellerAmount, note)
+	if refund != nil {
+		msg.ReplyText(fmt.Sprintf("%s\n已生成退款%d号，请向%s退还%.2f元（原转账单号%s），完成后发送“已退款%d号，[参考号]”。",
+			result, refund.ID, refundRecipient(refund), refund.Amount, refund.TransferID, refund.ID))
+	} else {
+		msg.ReplyText(result)
+	}
+	for _, party := range []string{order.Buyer, order.Seller} {
+		if err := sendTextToNickName(self, party, result); err != nil {
+			log.Printf("发送裁决通知失败: %v\n", err)
+		}
+	}
+}
+
+// 裁决申诉，退给买家的部分生成退款，返回的退款为 nil 表示不需要退款
+func ruleTradeDispute(db *sql.DB, dispute *TradeDispute, order *TradeOrder, ruling, orderStatus string, buyerAmount, sellerAmount float64, admin, note string) (*RefundRequest, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE trade_disputes SET status = ?, ruling = ?, buyer_amount = ?, seller_amount = ?, ruled_by = ?, ruling_note = ?, ruled_at = datetime('now')
+	WHERE id = ? AND status = ?`, disputeClosed, ruling, buyerAmount, sellerAmount, admin, note, dispute.ID, disputeOpen)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("申诉%d号已被处理", dispute.ID)
+	}
+	if _, err := tx.Exec(`UPDATE trade_orders SET status = ?, updated_at = datetime('now'), completed_at = datetime('now') WHERE id = ?`,
+		orderStatus, order.ID); err != nil {
+		return nil, err
+	}
+	// 买家付的是真钱，退给买家的部分按原转账退回，不记入钱包
+	var refund *RefundRequest
+	if buyerAmount > 0 {
+		reason := fmt.Sprintf("申诉%d号裁决退款 交易单%d号 %s", dispute.ID, order.ID, order.ItemName)
+		if refund, err = createDisputeRefund(tx, order, buyerAmount, admin, reason); err != nil {
+			return nil, err
+		}
+	}
+	// 判给卖家的部分同样扣除佣金后入账，全额放款时含平台的优惠码补贴
+	if sellerAmount > 0 {
+		subsidy := 0.0
+		if orderStatus == orderCompleted {
+			subsidy = order.Discount
+		}
+		if _, err := settleTradeOrder(tx, order, sellerAmount, subsidy); err != nil {
+			return nil, err
+		}
+	}
+	if orderStatus == orderCompleted {
+		if err := postCouponSubsidy(tx, order); err != nil {
+			return nil, err
+		}
+	}
+	// 判退款时订单没有成交，优惠码使用记录作废，买家可以再次使用
+	if orderStatus == orderRefunded {
+		if err := voidCouponRedemption(tx, "trade_order", order.ID); err != nil {
+			return nil, err
+		}
+	}
+	ruled := *order
+	ruled.Status = orderStatus
+	if err := emitOrderStatusChanged(tx, &ruled, orderDisputed); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	order.Status = orderStatus
+	return refund, nil
+}
+
+func getTradeDispute(db *sql.DB, disputeID int) (*TradeDispute, error) {
+	var d TradeDispute
+	err := db.QueryRow(`SELECT id, order_id, complainant, reason, status, previous_status, ruling, buyer_amount, seller_amount, ruled_by, ruling_note, created_at, ruled_at
+	FROM trade_disputes WHERE id = ?`, disputeID).Scan(&d.ID, &d.OrderID, &d.Complainant, &d.Reason, &d.Status, &d.PreviousStatus,
+		&d.Ruling, &d.BuyerAmount, &d.SellerAmount, &d.RuledBy, &d.RulingNote, &d.CreatedAt, &d.RuledAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+func listOpenDisputes(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT d.id, d.order_id, d.complainant, d.reason, d.created_at, o.item_name, o.price
+	FROM trade_disputes d JOIN trade_orders o ON o.id = d.order_id WHERE d.status = ? ORDER BY d.id`, disputeOpen)
+	if err != nil {
+		msg.ReplyText("获取申诉列表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var id, orderID int
+		var complainant, reason, createdAt, itemName string
+		var price float64
+		if err := rows.Scan(&id, &orderID, &complainant, &reason, &createdAt, &itemName, &price); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("申诉%d号：交易单%d号 %s（%.2f元），%s于%s申诉：%s\n", id, orderID, itemName, price, complainant, createdAt, reason))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("当前没有待处理的申诉。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
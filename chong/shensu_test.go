@@ -0,0 +1,72 @@
+package main
+
+import "testing"
+
+func TestRuleTradeDisputeRefundsBuyer(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestTradeItem(t, db, "卖家", 100, 1)
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	addTestRechargeCode(t, db, "2001", 100)
+	db.Exec(`UPDATE recharge_records SET payer = '买家', transfer_id = 'T2001' WHERE recharge_code = '2001'`)
+	if err := payTradeOrder(db, order, "2001", "买家"); err != nil {
+		t.Fatalf("付款失败: %v", err)
+	}
+	dispute, err := openTradeDispute(db, order, "买家", "没收到货")
+	if err != nil {
+		t.Fatalf("申诉失败: %v", err)
+	}
+
+	refund, err := ruleTradeDispute(db, dispute, order, rulingSplit, orderSplit, 30, 70, "管理员", "")
+	if err != nil {
+		t.Fatalf("裁决失败: %v", err)
+	}
+	// 退给买家的30元按原转账退回，不进钱包
+	if refund == nil || refund.Amount != 30 || refund.RechargeCode != "2001" || refund.TransferID != "T2001" || refund.Status != refundApproved {
+		t.Fatalf("应生成30元的已批准退款: %+v", refund)
+	}
+	if balance, _ := getWalletBalance(db, "买家"); balance != 0 {
+		t.Fatalf("买家钱包应为0，实际为%.2f", balance)
+	}
+	if balance, _ := getWalletBalance(db, "卖家"); balance <= 0 || balance > 70 {
+		t.Fatalf("卖家应得扣除佣金后的70元，实际为%.2f", balance)
+	}
+	// 同一申诉不能裁决两次
+	if _, err := ruleTradeDispute(db, dispute, order, rulingRefund, orderRefunded, 100, 0, "管理员", ""); err == nil {
+		t.Fatal("重复裁决应失败")
+	}
+	var refunds int
+	db.QueryRow(`SELECT COUNT(*) FROM refund_requests`).Scan(&refunds)
+	if refunds != 1 {
+		t.Fatalf("重复裁决后不应再生成退款，共有%d条", refunds)
+	}
+}
+
+func TestRefundRulingVoidsCoupon(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec(`INSERT INTO coupons (code, amount_off, per_user_limit) VALUES ('NEW10', 10, 1)`); err != nil {
+		t.Fatalf("添加优惠码失败: %v", err)
+	}
+	item := addTestTradeItem(t, db, "卖家", 100, 2)
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{Code: "NEW10", Member: "会员-买家"})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	addTestRechargeCode(t, db, "2001", 90)
+	if err := payTradeOrder(db, order, "2001", "买家"); err != nil {
+		t.Fatalf("付款失败: %v", err)
+	}
+	dispute, err := openTradeDispute(db, order, "买家", "没收到货")
+	if err != nil {
+		t.Fatalf("申诉失败: %v", err)
+	}
+	if _, err := ruleTradeDispute(db, dispute, order, rulingRefund, orderRefunded, 90, 0, "管理员", ""); err != nil {
+		t.Fatalf("裁决失败: %v", err)
+	}
+	// 退款后优惠码作废，每人限用1次的优惠码可以再次使用
+	if _, _, err := checkCoupon(db, couponUse{Code: "NEW10", Member: "会员-买家"}, couponTrade, "", 100); err != nil {
+		t.Fatalf("退款后优惠码应可再次使用: %v", err)
+	}
+}
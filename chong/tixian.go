@@ -0,0 +1,460 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 提现申请状态
+const (
+	payoutPending  = "待审核"
+	payoutApproved = "已批准"
+	payoutPaid     = "已支付"
+	payoutRejected = "已拒绝"
+
+	// 结算批次导出的 CSV 文件目录
+	settlementDir = "../jiesuan"
+
+	// 只有卖家的交易收入可以提现，充值、赠送、邀请奖励和转入的星卷只能在平台内消费
+	withdrawableEntryType = "交易收入"
+	// 优惠码补贴计入卖家余额，但和充值一样只能在平台内消费
+	couponSubsidyEntryType = "优惠券补贴"
+	// 被拒绝的提现退回钱包后仍可提现
+	payoutReturnedEntryType = "提现退回"
+)
+
+type PayoutRequest struct {
+	ID         int
+	Account    string
+	Amount     float64
+	Status     string
+	BatchID    int
+	Reference  string
+	ReviewedBy string
+	Note       string
+	CreatedAt  string
+}
+
+// 提现申请时即从钱包扣出，拒绝后退回，保证同一笔余额不会被重复提现
+func initPayoutTables(db *sql.DB) {
+	createPayoutRequestsTableSQL := `
+	CREATE TABLE IF NOT EXISTS payout_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		account TEXT NOT NULL,
+		amount REAL NOT NULL,
+		status TEXT NOT NULL DEFAULT '待审核',
+		batch_id INTEGER NOT NULL DEFAULT 0,
+		reference TEXT NOT NULL DEFAULT '',  -- 微信转账单号等付款参考号
+		reviewed_by TEXT NOT NULL DEFAULT '',
+		note TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		reviewed_at TEXT NOT NULL DEFAULT '',
+		paid_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createPayoutRequestsTableSQL); err != nil {
+		log.Fatalf("创建 payout_requests 表失败: %s\n", err)
+	}
+
+	createPayoutBatchesTableSQL := `
+	CREATE TABLE IF NOT EXISTS payout_batches (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		request_count INTEGER NOT NULL,
+		total_amount REAL NOT NULL,
+		file_name TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT '待支付',  -- 待支付, 已完成
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		closed_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createPayoutBatchesTableSQL); err != nil {
+		log.Fatalf("创建 payout_batches 表失败: %s\n", err)
+	}
+}
+
+// 处理 "我的钱包" 命令：余额、最近流水和处理中的提现
+func handleMyWallet(msg *openwechat.Message, db *sql.DB, account string) {
+	balance, err := getWalletBalance(db, account)
+	if err != nil {
+		msg.ReplyText("获取钱包信息时发生错误，请稍后重试。")
+		return
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("钱包余额：%.2f星卷\n", balance))
+	rows, err := db.Query(`SELECT amount, entry_type, memo, created_at FROM wallet_entries WHERE account = ? ORDER BY id DESC LIMIT 10`, account)
+	if err == nil {
+		defer rows.Close()
+		for rows.Next() {
+			var amount float64
+			var entryType, memo, createdAt string
+			if err := rows.Scan(&amount, &entryType, &memo, &createdAt); err != nil {
+				continue
+			}
+			response.WriteString(fmt.Sprintf("%s %s %+.2f %s\n", createdAt, entryType, amount, memo))
+		}
+	}
+
+	if withdrawable, err := getWithdrawableAmount(db, account); err == nil {
+		response.WriteString(fmt.Sprintf("可提现：%.2f元\n", withdrawable))
+	}
+
+	var pendingCount int
+	var pendingAmount sql.NullFloat64
+	db.QueryRow(`SELECT COUNT(*), SUM(amount) FROM payout_requests WHERE account = ? AND status IN (?, ?)`,
+		account, payoutPending, payoutApproved).Scan(&pendingCount, &pendingAmount)
+	if pendingCount > 0 {
+		response.WriteString(fmt.Sprintf("处理中的提现：%d笔，共%.2f元\n", pendingCount, pendingAmount.Float64))
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+var payoutRequestRe = regexp.MustCompile(`^提现(\d+(?:\.\d+)?)?$`)
+
+// 处理 "提现[金额]" 命令，不填金额时提现全部可提现金额
+func handlePayoutRequest(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, account string) {
+	matches := payoutRequestRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '提现[金额]' 的格式输入，例如：提现100")
+		return
+	}
+	withdrawable, err := getWithdrawableAmount(db, account)
+	if err != nil {
+		msg.ReplyText("获取钱包信息时发生错误，请稍后重试。")
+		return
+	}
+	amount := withdrawable
+	if matches[1] != "" {
+		amount, _ = strconv.ParseFloat(matches[1], 64)
+	}
+	amount = roundCents(amount)
+	if amount < config.MinPayout || amount <= 0 {
+		msg.ReplyText(fmt.Sprintf("单次提现金额不能低于%.2f元，当前可提现%.2f元（只有交易收入可以提现）。", config.MinPayout, withdrawable))
+		return
+	}
+
+	payoutID, err := createPayoutRequest(db, account, amount)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("提现申请失败：%v", err))
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("已提交提现申请%d号，金额%.2f元，管理员审核后会转账给您。", payoutID, amount))
+	notifyAdmins(self, fmt.Sprintf("%s申请提现%.2f元（提现%d号），发送“批准提现%d号”或“拒绝提现%d号，[原因]”处理。",
+		account, amount, payoutID, payoutID, payoutID))
+}
+
+// *sql.DB 和 *sql.Tx 都能用来查询
+type sqlQueryRower interface {
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+// 可提现金额由 postWalletEntry 随每笔流水维护，见 nextWithdrawable
+func getWithdrawableAmount(db sqlQueryRower, account string) (float64, error) {
+	var withdrawable float64
+	err := db.QueryRow(`SELECT MAX(MIN(withdrawable, balance), 0) FROM wallets WHERE account = ?`, account).Scan(&withdrawable)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return roundCents(withdrawable), nil
+}
+
+func createPayoutRequest(db *sql.DB, account string, amount float64) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// 在事务内重新核对，避免并发的提现申请超出可提现金额
+	withdrawable, err := getWithdrawableAmount(tx, account)
+	if err != nil {
+		return 0, err
+	}
+	if amount > withdrawable {
+		return 0, fmt.Errorf("可提现金额只有%.2f元，只有交易收入可以提现", withdrawable)
+	}
+
+	result, err := tx.Exec(`INSERT INTO payout_requests (account, amount) VALUES (?, ?)`, account, amount)
+	if err != nil {
+		return 0, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return 0, err
+	}
+	if _, err := postWalletEntry(tx, account, -amount, "提现", "payout_request", int(id), fmt.Sprintf("提现%d号", id)); err != nil {
+		return 0, err
+	}
+	return int(id), tx.Commit()
+}
+
+var (
+	approvePayoutRe = regexp.MustCompile(`^批准提现(\d+)号$`)
+	rejectPayoutRe  = regexp.MustCompile(`^拒绝提现(\d+)号(?:，(.*))?$`)
+	markPaidRe      = regexp.MustCompile(`^已支付(\d+)号，(.+)$`)
+)
+
+// 管理员提现命令：提现列表、批准提现N号、拒绝提现N号、已支付N号、生成结算批次
+func handlePayoutAdmin(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	switch {
+	case msg.Content == "提现列表":
+		listPayoutQueue(msg, db)
+
+	case approvePayoutRe.MatchString(msg.Content):
+		id, _ := strconv.Atoi(approvePayoutRe.FindStringSubmatch(msg.Content)[1])
+		request, err := reviewPayoutRequest(db, id, payoutApproved, admin, "")
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("批准提现失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("已批准提现%d号，将在下一个结算批次中导出。", id))
+		sendTextToNickName(self, request.Account, fmt.Sprintf("您的提现%d号（%.2f元）已审核通过，等待转账。", id, request.Amount))
+
+	case rejectPayoutRe.MatchString(msg.Content):
+		matches := rejectPayoutRe.FindStringSubmatch(msg.Content)
+		id, _ := strconv.Atoi(matches[1])
+		request, err := reviewPayoutRequest(db, id, payoutRejected, admin, matches[2])
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("拒绝提现失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("已拒绝提现%d号，金额已退回%s的钱包。", id, request.Account))
+		sendTextToNickName(self, request.Account, fmt.Sprintf("您的提现%d号（%.2f元）未通过审核，金额已退回钱包。原因：%s", id, request.Amount, matches[2]))
+
+	case markPaidRe.MatchString(msg.Content):
+		matches := markPaidRe.FindStringSubmatch(msg.Content)
+		id, _ := strconv.Atoi(matches[1])
+		request, err := markPayoutPaid(db, id, strings.TrimSpace(matches[2]), admin)
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("标记支付失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("提现%d号已标记为已支付。", id))
+		sendTextToNickName(self, request.Account, fmt.Sprintf("您的提现%d号（%.2f元）已转账，参考号：%s", id, request.Amount, request.Reference))
+
+	case msg.Content == "生成结算批次":
+		report, err := createSettlementBatch(db)
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("生成结算批次失败：%v", err))
+			return
+		}
+		msg.ReplyText(report)
+	}
+}
+
+func getPayoutRequest(db *sql.DB, id int) (*PayoutRequest, error) {
+	var r PayoutRequest
+	err := db.QueryRow(`SELECT id, account, amount, status, batch_id, reference, reviewed_by, note, created_at FROM payout_requests WHERE id = ?`, id).
+		Scan(&r.ID, &r.Account, &r.Amount, &r.Status, &r.BatchID, &r.Reference, &r.ReviewedBy, &r.Note, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("提现%d号不存在", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// 审核提现申请，拒绝时把金额退回钱包
+func reviewPayoutRequest(db *sql.DB, id int, status, admin, note string) (*PayoutRequest, error) {
+	request, err := getPayoutRequest(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != payoutPending {
+		return nil, fmt.Errorf("提现%d号当前状态为%s", id, request.Status)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE payout_requests SET status = ?, reviewed_by = ?, note = ?, reviewed_at = datetime('now') WHERE id = ? AND status = ?`,
+		status, admin, note, id, payoutPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("提现%d号已被处理", id)
+	}
+	if status == payoutRejected {
+		if _, err := postWalletEntry(tx, request.Account, request.Amount, payoutReturnedEntryType, "payout_request", id, note); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	request.Status, request.ReviewedBy, request.Note = status, admin, note
+	return request, nil
+}
+
+func markPayoutPaid(db *sql.DB, id int, reference, admin string) (*PayoutRequest, error) {
+	result, err := db.Exec(`UPDATE payout_requests SET status = ?, reference = ?, paid_at = datetime('now'),
+		reviewed_by = CASE WHEN reviewed_by = '' THEN ? ELSE reviewed_by END
+	WHERE id = ? AND status = ?`, payoutPaid, reference, admin, id, payoutApproved)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("提现%d号不存在或尚未批准", id)
+	}
+	// 批次中的提现全部支付后关闭批次
+	if _, err := db.Exec(`UPDATE payout_batches SET status = '已完成', closed_at = datetime('now')
+	WHERE status = '待支付' AND id = (SELECT batch_id FROM payout_requests WHERE id = ?)
+	AND NOT EXISTS (SELECT 1 FROM payout_requests WHERE batch_id = payout_batches.id AND status != ?)`, id, payoutPaid); err != nil {
+		log.Printf("更新结算批次状态失败: %v\n", err)
+	}
+	return getPayoutRequest(db, id)
+}
+
+func listPayoutQueue(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, account, amount, status, batch_id, created_at FROM payout_requests
+	WHERE status IN (?, ?) ORDER BY id`, payoutPending, payoutApproved)
+	if err != nil {
+		msg.ReplyText("获取提现列表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var r PayoutRequest
+		if err := rows.Scan(&r.ID, &r.Account, &r.Amount, &r.Status, &r.BatchID, &r.CreatedAt); err != nil {
+			continue
+		}
+		batch := "未导出"
+		if r.BatchID > 0 {
+			batch = fmt.Sprintf("批次%d", r.BatchID)
+		}
+		response.WriteString(fmt.Sprintf("提现%d号：%s %.2f元，%s，%s，%s\n", r.ID, r.Account, r.Amount, r.Status, batch, r.CreatedAt))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("当前没有待处理的提现。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+// 把已批准且未导出的提现打包成结算批次，导出 CSV 供人工微信转账，并核对相关账户余额
+func createSettlementBatch(db *sql.DB) (string, error) {
+	rows, err := db.Query(`SELECT id, account, amount, created_at FROM payout_requests WHERE status = ? AND batch_id = 0 ORDER BY id`, payoutApproved)
+	if err != nil {
+		return "", err
+	}
+	var requests []PayoutRequest
+	for rows.Next() {
+		var r PayoutRequest
+		if err := rows.Scan(&r.ID, &r.Account, &r.Amount, &r.CreatedAt); err != nil {
+			rows.Close()
+			return "", err
+		}
+		requests = append(requests, r)
+	}
+	rows.Close()
+	if len(requests) == 0 {
+		return "没有需要结算的提现。", nil
+	}
+
+	var total float64
+	var mismatches []string
+	checked := make(map[string]bool)
+	for _, r := range requests {
+		total += r.Amount
+		if !checked[r.Account] {
+			checked[r.Account] = true
+			if balance, ledger, err := reconcileWalletAccount(db, r.Account); err != nil || balance != ledger {
+				mismatches = append(mismatches, fmt.Sprintf("%s：余额%.2f，流水合计%.2f", r.Account, balance, ledger))
+			}
+		}
+	}
+	fileName := fmt.Sprintf("batch_%s.csv", time.Now().Format("20060102_150405"))
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(`INSERT INTO payout_batches (request_count, total_amount, file_name) VALUES (?, ?, ?)`,
+		len(requests), roundCents(total), fileName)
+	if err != nil {
+		return "", err
+	}
+	batchID, err := result.LastInsertId()
+	if err != nil {
+		return "", err
+	}
+	for _, r := range requests {
+		result, err := tx.Exec(`UPDATE payout_requests SET batch_id = ? WHERE id = ? AND batch_id = 0`, batchID, r.ID)
+		if err != nil {
+			return "", err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			return "", fmt.Errorf("提现%d号已被其他批次导出", r.ID)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return "", err
+	}
+
+	// 批次入库后再导出，事务失败时不会留下一份没有对应批次的转账清单
+	if err := writeSettlementCSV(fileName, requests); err != nil {
+		return "", fmt.Errorf("结算批次%d号已生成，但导出%s失败: %v", batchID, fileName, err)
+	}
+
+	report := fmt.Sprintf("结算批次%d号：%d笔提现，共%.2f元，已导出到%s。转账后发送“已支付[提现单号]号，[参考号]”登记。",
+		batchID, len(requests), roundCents(total), fileName)
+	if len(mismatches) > 0 {
+		report += "\n以下账户余额与流水不符，请核查：\n" + strings.Join(mismatches, "\n")
+	}
+	return report, nil
+}
+
+func writeSettlementCSV(fileName string, requests []PayoutRequest) error {
+	if err := os.MkdirAll(settlementDir, 0755); err != nil {
+		return err
+	}
+	file, err := os.Create(filepath.Join(settlementDir, fileName))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"提现单号", "收款人", "金额", "申请时间", "参考号"})
+	for _, r := range requests {
+		w.Write([]string{strconv.Itoa(r.ID), r.Account, fmt.Sprintf("%.2f", r.Amount), r.CreatedAt, ""})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return err
+	}
+	return file.Close()
+}
+
+// 定时生成结算批次并通知管理员
+func runSettlementBatch(db *sql.DB, self *openwechat.Self) {
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM payout_requests WHERE status = ? AND batch_id = 0`, payoutApproved).Scan(&count); err != nil || count == 0 {
+		return
+	}
+	report, err := createSettlementBatch(db)
+	if err != nil {
+		log.Printf("生成结算批次失败: %v\n", err)
+		return
+	}
+	notifyAdmins(self, report)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 直接记一笔流水，模拟充值、交易收入等入账
+func postTestWalletEntry(t *testing.T, db *sql.DB, account string, amount float64, entryType string) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("开启事务失败: %v", err)
+	}
+	defer tx.Rollback()
+	if _, err := postWalletEntry(tx, account, amount, entryType, "test", 0, ""); err != nil {
+		t.Fatalf("记账失败: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("提交失败: %v", err)
+	}
+}
+
+func TestPayoutLimitedToTradeIncome(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "卖家", 100, "兑换码充值")
+	postTestWalletEntry(t, db, "卖家", 20, "兑换码充值")
+	postTestWalletEntry(t, db, "卖家", 50, withdrawableEntryType)
+
+	if amount, _ := getWithdrawableAmount(db, "卖家"); amount != 50 {
+		t.Fatalf("可提现金额应为交易收入50，实际为%.2f", amount)
+	}
+	if _, err := createPayoutRequest(db, "卖家", 60); err == nil {
+		t.Fatal("超过交易收入的提现应失败")
+	}
+	id, err := createPayoutRequest(db, "卖家", 30)
+	if err != nil {
+		t.Fatalf("提现失败: %v", err)
+	}
+	if amount, _ := getWithdrawableAmount(db, "卖家"); amount != 20 {
+		t.Fatalf("提现30后可提现金额应为20，实际为%.2f", amount)
+	}
+	if _, err := createPayoutRequest(db, "卖家", 30); err == nil {
+		t.Fatal("再次提现30应失败")
+	}
+
+	// 拒绝后金额退回，可以重新提现
+	if _, err := reviewPayoutRequest(db, id, payoutRejected, "管理员", "信息有误"); err != nil {
+		t.Fatalf("拒绝提现失败: %v", err)
+	}
+	if amount, _ := getWithdrawableAmount(db, "卖家"); amount != 50 {
+		t.Fatalf("拒绝后可提现金额应恢复为50，实际为%.2f", amount)
+	}
+
+	// 消费先扣交易收入，剩下的10元是充值和奖励，不能提现
+	postTestWalletEntry(t, db, "卖家", -160, "上星订单")
+	if amount, _ := getWithdrawableAmount(db, "卖家"); amount != 0 {
+		t.Fatalf("交易收入已花完，可提现金额应为0，实际为%.2f", amount)
+	}
+}
+
+// 交易收入花在上星或转账上，再用赠送的星卷补回余额，也不能把赠送的部分提现
+func TestSpendingDebitsWithdrawableFirst(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "卖家", 100, withdrawableEntryType)
+	postTestWalletEntry(t, db, "卖家", -60, "转出星卷")
+	postTestWalletEntry(t, db, "卖家", 60, "活动赠送")
+	postTestWalletEntry(t, db, "卖家", 30, "转入星卷")
+
+	if amount, _ := getWithdrawableAmount(db, "卖家"); amount != 40 {
+		t.Fatalf("可提现金额应为剩下的交易收入40，实际为%.2f", amount)
+	}
+	if _, err := createPayoutRequest(db, "卖家", 50); err == nil {
+		t.Fatal("不能提现赠送和转入的星卷")
+	}
+}
+
+// 旧钱包没有 withdrawable，启动时按流水补算
+func TestBackfillWithdrawable(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "卖家", 100, withdrawableEntryType)
+	postTestWalletEntry(t, db, "卖家", 50, "兑换码充值")
+	postTestWalletEntry(t, db, "卖家", -70, "上星订单")
+	if _, err := db.Exec(`UPDATE wallets SET withdrawable = -1`); err != nil {
+		t.Fatalf("清空可提现金额失败: %v", err)
+	}
+
+	if err := backfillWithdrawable(db); err != nil {
+		t.Fatalf("补算失败: %v", err)
+	}
+	if amount, _ := getWithdrawableAmount(db, "卖家"); amount != 30 {
+		t.Fatalf("补算后可提现金额应为30，实际为%.2f", amount)
+	}
+}
+
+func TestSettlementBatchExportsAfterCommit(t *testing.T) {
+	db := newTestDB(t)
+	// settlementDir 是相对路径，切到临时目录下避免写到仓库里
+	dir := filepath.Join(t.TempDir(), "chong")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	wd, _ := os.Getwd()
+	if err := os.Chdir(dir); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Chdir(wd) })
+
+	postTestWalletEntry(t, db, "卖家", 80, withdrawableEntryType)
+	id, err := createPayoutRequest(db, "卖家", 80)
+	if err != nil {
+		t.Fatalf("提现失败: %v", err)
+	}
+	if _, err := reviewPayoutRequest(db, id, payoutApproved, "管理员", ""); err != nil {
+		t.Fatalf("批准提现失败: %v", err)
+	}
+	if _, err := createSettlementBatch(db); err != nil {
+		t.Fatalf("生成结算批次失败: %v", err)
+	}
+
+	var batchID int
+	var fileName string
+	if err := db.QueryRow(`SELECT b.id, b.file_name FROM payout_batches b JOIN payout_requests r ON r.batch_id = b.id WHERE r.id = ?`, id).
+		Scan(&batchID, &fileName); err != nil {
+		t.Fatalf("提现应归入结算批次: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(settlementDir, fileName)); err != nil {
+		t.Fatalf("结算批次%d号应导出%s: %v", batchID, fileName, err)
+	}
+	if report, err := createSettlementBatch(db); err != nil || report != "没有需要结算的提现。" {
+		t.Fatalf("已导出的提现不应再次结算，得到 %q, %v", report, err)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// recharge_records.used 的取值
+const (
+	codeUnused    = 0
+	codeUsed      = 1
+	codeVoided    = 2 // 已退款作废
+	codeRefunding = 3 // 退款审核中，暂不能兑换
+)
+
+// 退款申请状态
+const (
+	refundPending  = "待审核"
+	refundApproved = "已批准"
+	refundRejected = "已拒绝"
+	refundPaid     = "已退款"
+)
+
+type RefundRequest struct {
+	ID           int
+	RechargeCode string
+	Amount       float64
+	Requester    string
+	Payer        string
+	TransferID   string
+	Reason       string
+	Status       string
+	ReviewedBy   string
+	ReviewNote   string
+	RefundedBy   string
+	Reference    string
+	CreatedAt    string
+}
+
+// 每个环节的操作人和时间都记在退款申请上：申请、审核、退款
+func initRefundTables(db *sql.DB) {
+	createRefundRequestsTableSQL := `
+	CREATE TABLE IF NOT EXISTS refund_requests (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		recharge_code TEXT NOT NULL,
+		amount REAL NOT NULL,
+		requester TEXT NOT NULL,
+		payer TEXT NOT NULL DEFAULT '',
+		transfer_id TEXT NOT NULL DEFAULT '',  -- 原转账的微信转账单号
+		reason TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '待审核',
+		reviewed_by TEXT NOT NULL DEFAULT '',
+		review_note TEXT NOT NULL DEFAULT '',
+		reviewed_at TEXT NOT NULL DEFAULT '',
+		refunded_by TEXT NOT NULL DEFAULT '',
+		reference TEXT NOT NULL DEFAULT '',
+		refunded_at TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createRefundRequestsTableSQL); err != nil {
+		log.Fatalf("创建 refund_requests 表失败: %s\n", err)
+	}
+}
+
+// 兑换码不可用时的提示
+func rechargeCodeStatusError(used int) error {
+	switch used {
+	case codeUnused:
+		return nil
+	case codeVoided:
+		return fmt.Errorf("充值码已退款作废")
+	case codeRefunding:
+		return fmt.Errorf("充值码正在退款审核中")
+	default:
+		return fmt.Errorf("充值码已被使用")
+	}
+}
+
+var refundRequestRe = regexp.MustCompile(`^退款(?:：)?(\d+)(?:，(.*))?$`)
+
+// 处理 "退款[兑换码]，[理由]" 命令，只能申请未使用的兑换码
+func handleRefundRequest(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, requester string) {
+	matches := refundRequestRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '退款[兑换码]，[理由]' 的格式输入。")
+		return
+	}
+	code, reason := matches[1], strings.TrimSpace(matches[2])
+
+	request, err := createRefundRequest(db, code, requester, reason)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("退款申请失败：%v", err))
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("已提交退款申请%d号，兑换码%s已冻结，管理员审核后会原路退还%.2f元。", request.ID, code, request.Amount))
+
+	notice := fmt.Sprintf("%s申请退款（退款%d号）：兑换码%s，金额%.2f元，转账单号%s，理由：%s",
+		requester, request.ID, code, request.Amount, request.TransferID, reason)
+	if request.Payer != "" && request.Payer != requester {
+		notice += fmt.Sprintf("\n注意：该兑换码的付款人是%s，与申请人不一致。", request.Payer)
+	}
+	notifyAdmins(self, notice+fmt.Sprintf("\n发送“批准退款%d号”或“拒绝退款%d号，[原因]”处理。", request.ID, request.ID))
+}
+
+func createRefundRequest(db *sql.DB, code, requester, reason string) (*RefundRequest, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	r := RefundRequest{RechargeCode: code, Requester: requester, Reason: reason, Status: refundPending}
+	var used int
+	err = tx.QueryRow(`SELECT amount, used, payer, transfer_id FROM recharge_records WHERE recharge_code = ?`, code).
+		Scan(&r.Amount, &used, &r.Payer, &r.TransferID)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("充值码不存在")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := rechargeCodeStatusError(used); err != nil {
+		return nil, err
+	}
+	// 兑换码会被转发到群里，知道兑换码不代表是付款人，只有记录了付款人的兑换码才能由付款人本人申请
+	if r.Payer == "" {
+		return nil, fmt.Errorf("该充值码没有付款人记录，请联系管理员处理")
+	}
+	if r.Payer != requester {
+		return nil, fmt.Errorf("只有付款人可以申请退款")
+	}
+
+	result, err := tx.Exec(`UPDATE recharge_records SET used = ? WHERE recharge_code = ? AND used = ?`, codeRefunding, code, codeUnused)
+	if err != nil {
+		return nil, err
+	}
+	// 并发的兑换或退款申请已经改了兑换码状态
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("充值码状态已变化，请重新查询")
+	}
+	result, err = tx.Exec(`INSERT INTO refund_requests (recharge_code, amount, requester, payer, transfer_id, reason) VALUES (?, ?, ?, ?, ?, ?)`,
+		code, r.Amount, requester, r.Payer, r.TransferID, reason)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	r.ID = int(id)
+	return &r, tx.Commit()
+}
+
+var (
+	approveRefundRe = regexp.MustCompile(`^批准退款(\d+)号$`)
+	rejectRefundRe  = regexp.MustCompile(`^拒绝退款(\d+)号(?:，(.*))?$`)
+	markRefundedRe  = regexp.MustCompile(`^已退款(\d+)号，(.+)$`)
+)
+
+// 管理员退款命令：退款列表、批准退款N号、拒绝退款N号、已退款N号
+func handleRefundAdmin(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, admin string) {
+	switch {
+	case msg.Content == "退款列表":
+		listRefundQueue(msg, db)
+
+	case approveRefundRe.MatchString(msg.Content):
+		id, _ := strconv.Atoi(approveRefundRe.FindStringSubmatch(msg.Content)[1])
+		request, err := reviewRefundRequest(db, id, refundApproved, admin, "")
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("批准退款失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("退款%d号已批准，兑换码%s已作废。请向%s退还%.2f元（原转账单号%s），完成后发送“已退款%d号，[参考号]”。",
+			id, request.RechargeCode, refundRecipient(request), request.Amount, request.TransferID, id))
+		sendTextToNickName(self, request.Requester, fmt.Sprintf("您的退款%d号已审核通过，%.2f元将尽快退还。", id, request.Amount))
+
+	case rejectRefundRe.MatchString(msg.Content):
+		matches := rejectRefundRe.FindStringSubmatch(msg.Content)
+		id, _ := strconv.Atoi(matches[1])
+		request, err := reviewRefundRequest(db, id, refundRejected, admin, matches[2])
+		if err != nil {
+			msg.ReplyText(fmt.Sprintf("拒绝退款失败：%v", err))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("已拒绝退款%d号，兑换码%s恢复可用。", id, request.RechargeCode))
+		sendTextToNickName(self, request.Requester, fmt.Sprintf("您的退款%d号未通过审核，兑换码%s恢复可用。原因：%s", id, request.RechargeCode, matches[2]))
+
+	case markRefundedRe.MatchString(msg.Content):
+		matches := markRefundedRe.FindStringSubmatch(msg.Content)
+		id, _ := strconv.Atoi(matches[1])
+		reference := strings.TrimSpace(matches[2])
+		result, err := db.Exec(`UPDATE refund_requests SET status = ?, refunded_by = ?, reference = ?, refunded_at = datetime('now')
+		WHERE id = ? AND status = ?`, refundPaid, admin, reference, id, refundApproved)
+		if err != nil {
+			log.Printf("登记退款失败: %v\n", err)
+			msg.ReplyText("登记退款失败，请稍后重试。")
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			msg.ReplyText(fmt.Sprintf("退款%d号不存在或尚未批准。", id))
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("退款%d号已登记为已退款。", id))
+		if request, err := getRefundRequest(db, id); err == nil {
+			sendTextToNickName(self, request.Requester, fmt.Sprintf("您的退款%d号（%.2f元）已退还，参考号：%s", id, request.Amount, reference))
+		}
+	}
+}
+
+// 申诉裁决退给买家的钱按原付款的兑换码原路退回，裁决即审核，直接生成已批准的退款
+func createDisputeRefund(tx *sql.Tx, order *TradeOrder, amount float64, admin, reason string) (*RefundRequest, error) {
+	r := RefundRequest{Amount: amount, Requester: order.Buyer, Reason: reason, Status: refundApproved, ReviewedBy: admin}
+	err := tx.QueryRow(`SELECT o.recharge_code, IFNULL(r.payer, ''), IFNULL(r.transfer_id, '') FROM trade_orders o
+	LEFT JOIN recharge_records r ON r.recharge_code = o.recharge_code WHERE o.id = ?`, order.ID).Scan(&r.RechargeCode, &r.Payer, &r.TransferID)
+	if err != nil {
+		return nil, err
+	}
+	result, err := tx.Exec(`INSERT INTO refund_requests (recharge_code, amount, requester, payer, transfer_id, reason, status, reviewed_by, reviewed_at)
+	VALUES (?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`, r.RechargeCode, amount, r.Requester, r.Payer, r.TransferID, reason, refundApproved, admin)
+	if err != nil {
+		return nil, err
+	}
+	id, err := result.LastInsertId()
+	if err != nil {
+		return nil, err
+	}
+	r.ID = int(id)
+	return &r, nil
+}
+
+// 退款对象优先是原付款人
+func refundRecipient(r *RefundRequest) string {
+	if r.Payer != "" {
+		return r.Payer
+	}
+	return r.Requester
+}
+
+// 审核退款申请：批准时作废兑换码，拒绝时恢复兑换码
+func reviewRefundRequest(db *sql.DB, id int, status, admin, note string) (*RefundRequest, error) {
+	request, err := getRefundRequest(db, id)
+	if err != nil {
+		return nil, err
+	}
+	if request.Status != refundPending {
+		return nil, fmt.Errorf("退款%d号当前状态为%s", id, request.Status)
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`UPDATE refund_requests SET status = ?, reviewed_by = ?, review_note = ?, reviewed_at = datetime('now') WHERE id = ? AND status = ?`,
+		status, admin, note, id, refundPending)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("退款%d号已被处理", id)
+	}
+	codeStatus := codeVoided
+	if status == refundRejected {
+		codeStatus = codeUnused
+	}
+	result, err = tx.Exec(`UPDATE recharge_records SET used = ? WHERE recharge_code = ? AND used = ?`, codeStatus, request.RechargeCode, codeRefunding)
+	if err != nil {
+		return nil, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return nil, fmt.Errorf("兑换码%s不在退款审核中", request.RechargeCode)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	request.Status, request.ReviewedBy, request.ReviewNote = status, admin, note
+	return request, nil
+}
+
+func getRefundRequest(db *sql.DB, id int) (*RefundRequest, error) {
+	var r RefundRequest
+	err := db.QueryRow(`SELECT id, recharge_code, amount, requester, payer, transfer_id, reason, status, reviewed_by, review_note, refunded_by, reference, created_at
+	FROM refund_requests WHERE id = ?`, id).Scan(&r.ID, &r.RechargeCode, &r.Amount, &r.Requester, &r.Payer, &r.TransferID, &r.Reason,
+		&r.Status, &r.ReviewedBy, &r.ReviewNote, &r.RefundedBy, &r.Reference, &r.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("退款%d号不存在", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+func listRefundQueue(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, recharge_code, amount, requester, transfer_id, reason, status, created_at FROM refund_requests
+	WHERE status IN (?, ?) ORDER BY id`, refundPending, refundApproved)
+	if err != nil {
+		msg.ReplyText("获取退款列表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var r RefundRequest
+		if err := rows.Scan(&r.ID, &r.RechargeCode, &r.Amount, &r.Requester, &r.TransferID, &r.Reason, &r.Status, &r.CreatedAt); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("退款%d号：%s %.2f元，兑换码%s，转账单号%s，%s，%s，理由：%s\n",
+			r.ID, r.Requester, r.Amount, r.RechargeCode, r.TransferID, r.Status, r.CreatedAt, r.Reason))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("当前没有待处理的退款。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
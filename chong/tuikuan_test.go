@@ -0,0 +1,97 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// 生成一个记录了付款人的兑换码
+func addTestPaidCode(t *testing.T, db *sql.DB, code string, amount float64, payer string) {
+	t.Helper()
+	addTestRechargeCode(t, db, code, amount)
+	if _, err := db.Exec(`UPDATE recharge_records SET payer = ?, transfer_id = ? WHERE recharge_code = ?`, payer, "T"+code, code); err != nil {
+		t.Fatalf("设置付款人失败: %v", err)
+	}
+}
+
+func codeStatus(t *testing.T, db *sql.DB, code string) int {
+	t.Helper()
+	var used int
+	if err := db.QueryRow(`SELECT used FROM recharge_records WHERE recharge_code = ?`, code).Scan(&used); err != nil {
+		t.Fatalf("查询兑换码失败: %v", err)
+	}
+	return used
+}
+
+func TestRefundRequestOnlyByPayer(t *testing.T) {
+	db := newTestDB(t)
+	addTestPaidCode(t, db, "3001", 50, "付款人")
+	addTestRechargeCode(t, db, "3002", 50)
+
+	if _, err := createRefundRequest(db, "3001", "路人", ""); err == nil {
+		t.Fatal("非付款人不能申请退款")
+	}
+	// 没有付款人记录的兑换码谁都可能知道，不能自助退款
+	if _, err := createRefundRequest(db, "3002", "路人", ""); err == nil {
+		t.Fatal("没有付款人记录的兑换码不能申请退款")
+	}
+	if codeStatus(t, db, "3002") != codeUnused {
+		t.Fatal("申请失败不应冻结兑换码")
+	}
+
+	request, err := createRefundRequest(db, "3001", "付款人", "拍错了")
+	if err != nil {
+		t.Fatalf("付款人申请退款失败: %v", err)
+	}
+	if request.Amount != 50 || request.TransferID != "T3001" || codeStatus(t, db, "3001") != codeRefunding {
+		t.Fatalf("退款申请或兑换码状态不对: %+v", request)
+	}
+	// 审核中的兑换码不能再申请，也不能兑换
+	if _, err := createRefundRequest(db, "3001", "付款人", ""); err == nil {
+		t.Fatal("重复申请退款应失败")
+	}
+	if _, _, _, err := redeemRechargeCode(db, "3001", "付款人", "", ""); err == nil {
+		t.Fatal("退款审核中的兑换码不能兑换")
+	}
+}
+
+func TestReviewRefundRequest(t *testing.T) {
+	db := newTestDB(t)
+	addTestPaidCode(t, db, "3001", 50, "付款人")
+	addTestPaidCode(t, db, "3002", 20, "付款人")
+	approved, _ := createRefundRequest(db, "3001", "付款人", "")
+	rejected, _ := createRefundRequest(db, "3002", "付款人", "")
+
+	if _, err := reviewRefundRequest(db, approved.ID, refundApproved, "管理员", ""); err != nil {
+		t.Fatalf("批准退款失败: %v", err)
+	}
+	if codeStatus(t, db, "3001") != codeVoided {
+		t.Fatal("批准后兑换码应作废")
+	}
+	if _, err := reviewRefundRequest(db, approved.ID, refundRejected, "管理员", ""); err == nil {
+		t.Fatal("已批准的退款不能再拒绝")
+	}
+
+	if _, err := reviewRefundRequest(db, rejected.ID, refundRejected, "管理员", "已发货"); err != nil {
+		t.Fatalf("拒绝退款失败: %v", err)
+	}
+	if codeStatus(t, db, "3002") != codeUnused {
+		t.Fatal("拒绝后兑换码应恢复可用")
+	}
+}
+
+// 兑换码状态被别处改掉时，审核整体回滚，不留下已批准但兑换码没作废的退款
+func TestReviewRefundRequiresRefundingCode(t *testing.T) {
+	db := newTestDB(t)
+	addTestPaidCode(t, db, "3001", 50, "付款人")
+	request, _ := createRefundRequest(db, "3001", "付款人", "")
+	db.Exec(`UPDATE recharge_records SET used = ? WHERE recharge_code = '3001'`, codeUsed)
+
+	if _, err := reviewRefundRequest(db, request.ID, refundApproved, "管理员", ""); err == nil {
+		t.Fatal("兑换码不在审核中时批准应失败")
+	}
+	found, _ := getRefundRequest(db, request.ID)
+	if found.Status != refundPending {
+		t.Fatalf("批准失败后退款应仍为待审核，实际为%s", found.Status)
+	}
+}
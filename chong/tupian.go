@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/hajimehoshi/bitmapfont/v3"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// 交易品卡片的尺寸和排版参数
+const (
+	cardWidth       = 360
+	cardHeight      = 540
+	cardPhotoHeight = 300
+	cardPadding     = 16
+	cardGap         = 12
+	catalogColumns  = 3
+	catalogPageSize = 9 // 每张目录图最多展示的交易品数量
+
+	// 卡片优先使用的中文字体，不存在时使用内置的中文像素字体
+	cardFontFile = "../font/msyh.ttf"
+	// 内置像素字体是 12px 的，放大后使用
+	pixelFontScale = 2
+)
+
+var (
+	cardBackground = color.RGBA{0x06, 0x30, 0x6d, 0xff}
+	cardCanvas     = color.RGBA{0x00, 0x0d, 0x4a, 0xff}
+	cardPhotoBg    = color.RGBA{0x1a, 0x1a, 0x1c, 0xff}
+	cardTitleColor = color.RGBA{0xff, 0xff, 0xff, 0xff}
+	cardPriceColor = color.RGBA{0xff, 0xc0, 0x3d, 0xff}
+	cardTextColor  = color.RGBA{0xb0, 0xc4, 0xde, 0xff}
+	cardIDColor    = color.RGBA{0x49, 0xbc, 0xf7, 0xff}
+)
+
+var (
+	cardFontOnce  sync.Once
+	cardFontErr   error
+	cardTitleFace font.Face
+	cardTextFace  font.Face
+)
+
+// 加载卡片字体。没有 cardFontFile 时使用 bitmapfont 内置的中文像素字体（OFL 授权，随程序编译），
+// 字体文件存在但损坏时返回错误，调用方据此改为发送文字
+func loadCardFonts() error {
+	cardFontOnce.Do(func() {
+		cardFontErr = func() error {
+			data, err := os.ReadFile(cardFontFile)
+			if os.IsNotExist(err) {
+				cardTitleFace = &pixelFace{Face: bitmapfont.FaceSC, scale: pixelFontScale}
+				cardTextFace = cardTitleFace
+				return nil
+			}
+			if err != nil {
+				return fmt.Errorf("读取卡片字体失败: %v", err)
+			}
+			f, err := opentype.Parse(data)
+			if err != nil {
+				return fmt.Errorf("解析卡片字体失败: %v", err)
+			}
+			if cardTitleFace, err = opentype.NewFace(f, &opentype.FaceOptions{Size: 26, DPI: 72, Hinting: font.HintingFull}); err != nil {
+				return fmt.Errorf("创建标题字体失败: %v", err)
+			}
+			if cardTextFace, err = opentype.NewFace(f, &opentype.FaceOptions{Size: 20, DPI: 72, Hinting: font.HintingFull}); err != nil {
+				return fmt.Errorf("创建正文字体失败: %v", err)
+			}
+			return nil
+		}()
+		if cardFontErr != nil {
+			log.Printf("%v，图片将改为文字发送\n", cardFontErr)
+		}
+	})
+	return cardFontErr
+}
+
+// 绘制单个交易品的卡片：图片、名称、价格、库存、卖家
+func drawTradeItemCard(dst draw.Image, origin image.Point, item TradeItem) {
+	cardRect := image.Rect(origin.X, origin.Y, origin.X+cardWidth, origin.Y+cardHeight)
+	draw.Draw(dst, cardRect, image.NewUniform(cardBackground), image.Point{}, draw.Src)
+
+	photoRect := image.Rect(origin.X, origin.Y, origin.X+cardWidth, origin.Y+cardPhotoHeight)
+	draw.Draw(dst, photoRect, image.NewUniform(cardPhotoBg), image.Point{}, draw.Src)
+	if item.ImageFileName != "" {
+		if photo, err := loadTradeItemPhoto(item.ImageFileName); err != nil {
+			log.Printf("读取交易品%d的图片失败: %v\n", item.ID, err)
+		} else {
+			draw.CatmullRom.Scale(dst, fitRect(photo.Bounds(), photoRect), photo, photo.Bounds(), draw.Over, nil)
+		}
+	}
+
+	textWidth := cardWidth - 2*cardPadding
+	x := origin.X + cardPadding
+	y := origin.Y + cardPhotoHeight + cardPadding
+
+	y += faceHeight(cardTitleFace)
+	drawText(dst, cardTitleFace, cardIDColor, x, y, fmt.Sprintf("%d号", item.ID))
+	idWidth := font.MeasureString(cardTitleFace, fmt.Sprintf("%d号 ", item.ID)).Ceil()
+	drawText(dst, cardTitleFace, cardTitleColor, x+idWidth, y, truncateText(cardTitleFace, item.ItemName, textWidth-idWidth))
+
+	y += faceHeight(cardTitleFace) + 8
+	drawText(dst, cardTitleFace, cardPriceColor, x, y, fmt.Sprintf("￥%.2f", item.Price))
+
+	y += faceHeight(cardTextFace) + 10
+	drawText(dst, cardTextFace, cardTextColor, x, y, fmt.Sprintf("库存：%d", item.Quantity))
+
+	y += faceHeight(cardTextFace) + 6
+	drawText(dst, cardTextFace, cardTextColor, x, y, truncateText(cardTextFace, "卖家："+item.Seller, textWidth))
+
+	y += faceHeight(cardTextFace) + 6
+	drawText(dst, cardTextFace, cardPriceColor, x, y, truncateText(cardTextFace, item.SellerReputation.String(), textWidth))
+
+	if item.Description != "" {
+		y += faceHeight(cardTextFace) + 6
+		drawText(dst, cardTextFace, cardTextColor, x, y, truncateText(cardTextFace, item.Description, textWidth))
+	}
+}
+
+// 渲染单个交易品卡片
+func renderTradeItemCard(item TradeItem) (*bytes.Buffer, error) {
+	if err := loadCardFonts(); err != nil {
+		return nil, err
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, cardWidth, cardHeight))
+	drawTradeItemCard(img, image.Point{}, item)
+	return encodePNG(img)
+}
+
+// 渲染交易品目录网格，超过一页的交易品拆分成多张图片
+func renderTradeCatalog(items []TradeItem) ([]*bytes.Buffer, error) {
+	if err := loadCardFonts(); err != nil {
+		return nil, err
+	}
+
+	var pages []*bytes.Buffer
+	for start := 0; start < len(items); start += catalogPageSize {
+		end := start + catalogPageSize
+		if end > len(items) {
+			end = len(items)
+		}
+		pageItems := items[start:end]
+
+		cols := catalogColumns
+		if len(pageItems) < cols {
+			cols = len(pageItems)
+		}
+		rows := (len(pageItems) + cols - 1) / cols
+		width := cols*cardWidth + (cols+1)*cardGap
+		height := rows*cardHeight + (rows+1)*cardGap
+
+		img := image.NewRGBA(image.Rect(0, 0, width, height))
+		draw.Draw(img, img.Bounds(), image.NewUniform(cardCanvas), image.Point{}, draw.Src)
+		for i, item := range pageItems {
+			col, row := i%cols, i/cols
+			origin := image.Pt(cardGap+col*(cardWidth+cardGap), cardGap+row*(cardHeight+cardGap))
+			drawTradeItemCard(img, origin, item)
+		}
+
+		buf, err := encodePNG(img)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, buf)
+	}
+	return pages, nil
+}
+
+func loadTradeItemPhoto(imageFileName string) (image.Image, error) {
+	file, err := os.Open(filepath.Join("../jiaoyi", imageFileName))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	img, _, err := image.Decode(file)
+	return img, err
+}
+
+func encodePNG(img image.Image) (*bytes.Buffer, error) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+	return &buf, nil
+}
+
+// 按比例缩放 src 使其完整放入 area，并居中
+func fitRect(src, area image.Rectangle) image.Rectangle {
+	sw, sh := src.Dx(), src.Dy()
+	aw, ah := area.Dx(), area.Dy()
+	if sw == 0 || sh == 0 {
+		return area
+	}
+	w, h := aw, sh*aw/sw
+	if h > ah {
+		w, h = sw*ah/sh, ah
+	}
+	x := area.Min.X + (aw-w)/2
+	y := area.Min.Y + (ah-h)/2
+	return image.Rect(x, y, x+w, y+h)
+}
+
+func faceHeight(face font.Face) int {
+	return face.Metrics().Height.Ceil()
+}
+
+func drawText(dst draw.Image, face font.Face, c color.Color, x, y int, text string) {
+	d := &font.Drawer{
+		Dst:  dst,
+		Src:  image.NewUniform(c),
+		Face: face,
+		Dot:  fixed.P(x, y),
+	}
+	d.DrawString(text)
+}
+
+// 文字超出宽度时截断并加省略号
+func truncateText(face font.Face, text string, maxWidth int) string {
+	if font.MeasureString(face, text).Ceil() <= maxWidth {
+		return text
+	}
+	runes := []rune(text)
+	for len(runes) > 0 {
+		runes = runes[:len(runes)-1]
+		candidate := string(runes) + "…"
+		if font.MeasureString(face, candidate).Ceil() <= maxWidth {
+			return candidate
+		}
+	}
+	return ""
+}
+
+// 把像素字体按整数倍放大，每个像素复制成 scale×scale 的方块，保持笔画清晰
+type pixelFace struct {
+	font.Face
+	scale int
+}
+
+func (f *pixelFace) Glyph(dot fixed.Point26_6, r rune) (image.Rectangle, image.Image, image.Point, fixed.Int26_6, bool) {
+	dr, mask, maskp, advance, ok := f.Face.Glyph(fixed.Point26_6{}, r)
+	if !ok {
+		return image.Rectangle{}, nil, image.Point{}, 0, false
+	}
+	size := dr.Size()
+	scaled := image.NewAlpha(image.Rect(0, 0, size.X*f.scale, size.Y*f.scale))
+	for y := 0; y < scaled.Rect.Dy(); y++ {
+		for x := 0; x < scaled.Rect.Dx(); x++ {
+			_, _, _, a := mask.At(maskp.X+x/f.scale, maskp.Y+y/f.scale).RGBA()
+			scaled.SetAlpha(x, y, color.Alpha{A: uint8(a >> 8)})
+		}
+	}
+	origin := image.Pt(dot.X.Floor(), dot.Y.Floor())
+	dr = image.Rectangle{Min: dr.Min.Mul(f.scale), Max: dr.Max.Mul(f.scale)}.Add(origin)
+	return dr, scaled, image.Point{}, advance * fixed.Int26_6(f.scale), true
+}
+
+func (f *pixelFace) GlyphBounds(r rune) (fixed.Rectangle26_6, fixed.Int26_6, bool) {
+	bounds, advance, ok := f.Face.GlyphBounds(r)
+	s := fixed.Int26_6(f.scale)
+	bounds.Min.X, bounds.Min.Y, bounds.Max.X, bounds.Max.Y = bounds.Min.X*s, bounds.Min.Y*s, bounds.Max.X*s, bounds.Max.Y*s
+	return bounds, advance * s, ok
+}
+
+func (f *pixelFace) GlyphAdvance(r rune) (fixed.Int26_6, bool) {
+	advance, ok := f.Face.GlyphAdvance(r)
+	return advance * fixed.Int26_6(f.scale), ok
+}
+
+func (f *pixelFace) Kern(r0, r1 rune) fixed.Int26_6 {
+	return f.Face.Kern(r0, r1) * fixed.Int26_6(f.scale)
+}
+
+func (f *pixelFace) Metrics() font.Metrics {
+	m := f.Face.Metrics()
+	s := fixed.Int26_6(f.scale)
+	m.Height, m.Ascent, m.Descent, m.XHeight, m.CapHeight = m.Height*s, m.Ascent*s, m.Descent*s, m.XHeight*s, m.CapHeight*s
+	return m
+}
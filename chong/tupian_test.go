@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/png"
+	"os"
+	"testing"
+
+	"golang.org/x/image/math/fixed"
+)
+
+// 统计图片中指定颜色的像素数
+func countColor(t *testing.T, buf *bytes.Buffer, r, g, b uint8) int {
+	t.Helper()
+	img, err := png.Decode(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("解码图片失败: %v", err)
+	}
+	count := 0
+	bounds := img.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			cr, cg, cb, _ := img.At(x, y).RGBA()
+			if uint8(cr>>8) == r && uint8(cg>>8) == g && uint8(cb>>8) == b {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// 没有 msyh.ttf 时使用内置的像素字体，卡片和文字图片都能画出中文
+func TestRenderWithBundledFont(t *testing.T) {
+	if _, err := os.Stat(cardFontFile); err == nil {
+		t.Skipf("字体文件%s存在，跳过", cardFontFile)
+	}
+	card, err := renderTradeItemCard(TradeItem{ID: 1, ItemName: "王者荣耀账号", Price: 88, Quantity: 2, Seller: "卖家"})
+	if err != nil {
+		t.Fatalf("渲染交易品卡片失败: %v", err)
+	}
+	cfg, err := png.DecodeConfig(bytes.NewReader(card.Bytes()))
+	if err != nil || cfg.Width != cardWidth || cfg.Height != cardHeight {
+		t.Fatalf("卡片尺寸不对: %+v %v", cfg, err)
+	}
+	// 名称用白色、价格用金色绘制，能找到这些像素说明文字确实画出来了
+	if countColor(t, card, cardTitleColor.R, cardTitleColor.G, cardTitleColor.B) == 0 {
+		t.Fatal("卡片上没有画出交易品名称")
+	}
+	if countColor(t, card, cardPriceColor.R, cardPriceColor.G, cardPriceColor.B) == 0 {
+		t.Fatal("卡片上没有画出价格")
+	}
+
+	pages, err := renderTradeCatalog(make([]TradeItem, catalogPageSize+1))
+	if err != nil || len(pages) != 2 {
+		t.Fatalf("目录应分为2页: %d %v", len(pages), err)
+	}
+	if _, err := renderTextImage([]string{"标题", "内容"}, 400); err != nil {
+		t.Fatalf("渲染文字图片失败: %v", err)
+	}
+}
+
+func TestPixelFaceScalesMetrics(t *testing.T) {
+	if err := loadCardFonts(); err != nil {
+		t.Fatalf("加载字体失败: %v", err)
+	}
+	face, ok := cardTitleFace.(*pixelFace)
+	if !ok {
+		t.Skip("使用的是字体文件，跳过")
+	}
+	if faceHeight(face) != faceHeight(face.Face)*pixelFontScale {
+		t.Fatalf("行高应放大%d倍", pixelFontScale)
+	}
+	dr, mask, _, _, ok := face.Glyph(fixed.P(10, 30), '卖')
+	if !ok || mask == nil || dr.Empty() || !dr.In(image.Rect(0, 0, 100, 100)) {
+		t.Fatalf("放大后的字形位置不对: %v %v", dr, ok)
+	}
+}
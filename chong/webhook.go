@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 业务事件名称
+const (
+	eventTransferReceived   = "transfer.received"
+	eventCodeIssued         = "code.issued"
+	eventCodeRedeemed       = "code.redeemed"
+	eventItemListed         = "item.listed"
+	eventOrderStatusChanged = "order.status_changed"
+	eventPing               = "ping"
+)
+
+// 投递状态
+const (
+	webhookPending   = "待发送"
+	webhookDelivered = "已送达"
+	webhookFailed    = "失败"
+)
+
+// 接收事件的外部地址，Events 为空时接收所有事件
+type WebhookEndpoint struct {
+	Name   string   `json:"name"`
+	URL    string   `json:"url"`
+	Secret string   `json:"secret"` // 用于签名，接收方用同一密钥校验
+	Events []string `json:"events"`
+}
+
+func (e WebhookEndpoint) accepts(event string) bool {
+	if len(e.Events) == 0 || event == eventPing {
+		return true
+	}
+	for _, ev := range e.Events {
+		if ev == event || ev == "*" {
+			return true
+		}
+	}
+	return false
+}
+
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// 每个事件按接收地址拆成一条投递记录，多次失败后转入死信表
+func initWebhookTables(db *sql.DB) {
+	createDeliveriesTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_deliveries (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		endpoint TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		status TEXT NOT NULL DEFAULT '待发送',
+		attempts INTEGER NOT NULL DEFAULT 0,
+		next_attempt_at TEXT NOT NULL DEFAULT (datetime('now')),
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		delivered_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createDeliveriesTableSQL); err != nil {
+		log.Fatalf("创建 webhook_deliveries 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_pending ON webhook_deliveries (status, next_attempt_at)`); err != nil {
+		log.Fatalf("创建 webhook_deliveries 索引失败: %s\n", err)
+	}
+
+	createDeadLettersTableSQL := `
+	CREATE TABLE IF NOT EXISTS webhook_dead_letters (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		delivery_id INTEGER NOT NULL,
+		endpoint TEXT NOT NULL,
+		event TEXT NOT NULL,
+		payload TEXT NOT NULL,
+		attempts INTEGER NOT NULL,
+		last_error TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		replayed_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createDeadLettersTableSQL); err != nil {
+		log.Fatalf("创建 webhook_dead_letters 表失败: %s\n", err)
+	}
+}
+
+// 记录一个业务事件，由后台任务异步投递到订阅了该事件的地址。
+// 在业务事务中传入 tx，事件随业务数据一起提交或回滚，不会推送没有发生的事；
+// 记录失败时返回错误，调用方回滚事务，不能让业务成功而事件丢失
+func emitEvent(db sqlExecer, event string, data interface{}) error {
+	if len(config.Webhooks) == 0 {
+		return nil
+	}
+	payload, err := json.Marshal(map[string]interface{}{
+		"event":      event,
+		"created_at": time.Now().Format(time.RFC3339),
+		"data":       data,
+	})
+	if err != nil {
+		return fmt.Errorf("序列化事件 %s 失败: %v", event, err)
+	}
+	for _, endpoint := range config.Webhooks {
+		if !endpoint.accepts(event) {
+			continue
+		}
+		if _, err := db.Exec(`INSERT INTO webhook_deliveries (endpoint, event, payload) VALUES (?, ?, ?)`,
+			endpoint.Name, event, string(payload)); err != nil {
+			return fmt.Errorf("记录事件 %s 失败: %v", event, err)
+		}
+	}
+	return nil
+}
+
+// 订单状态变化事件，from 为变化前的状态，新建订单时为空
+func emitOrderStatusChanged(db sqlExecer, order *TradeOrder, from string) error {
+	return emitEvent(db, eventOrderStatusChanged, map[string]interface{}{
+		"order_id":  order.ID,
+		"item_id":   order.ItemID,
+		"item_name": order.ItemName,
+		"seller":    order.Seller,
+		"buyer":     order.Buyer,
+		"price":     order.Price,
+		"from":      from,
+		"to":        order.Status,
+	})
+}
+
+func findWebhookEndpoint(name string) (WebhookEndpoint, bool) {
+	for _, endpoint := range config.Webhooks {
+		if endpoint.Name == name {
+			return endpoint, true
+		}
+	}
+	return WebhookEndpoint{}, false
+}
+
+// 定时任务：投递到期的事件，失败后按 30 秒、1 分钟、2 分钟……退避重试
+func deliverPendingWebhooks(db *sql.DB) {
+	rows, err := db.Query(`SELECT id, endpoint, event, payload, attempts FROM webhook_deliveries
+	WHERE status = ? AND next_attempt_at <= datetime('now') ORDER BY id LIMIT 50`, webhookPending)
+	if err != nil {
+		log.Printf("查询待投递事件失败: %v\n", err)
+		return
+	}
+	type delivery struct {
+		id       int
+		endpoint string
+		event    string
+		payload  string
+		attempts int
+	}
+	var deliveries []delivery
+	for rows.Next() {
+		var d delivery
+		if err := rows.Scan(&d.id, &d.endpoint, &d.event, &d.payload, &d.attempts); err != nil {
+			log.Printf("读取待投递事件失败: %v\n", err)
+			continue
+		}
+		deliveries = append(deliveries, d)
+	}
+	rows.Close()
+
+	for _, d := range deliveries {
+		attempts := d.attempts + 1
+		endpoint, ok := findWebhookEndpoint(d.endpoint)
+		var deliverErr error
+		if !ok {
+			deliverErr = fmt.Errorf("配置中已没有接收地址 %s", d.endpoint)
+			attempts = config.WebhookMaxAttempts
+		} else {
+			deliverErr = postWebhook(endpoint, d.id, d.event, []byte(d.payload))
+		}
+
+		if deliverErr == nil {
+			if _, err := db.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = '', delivered_at = datetime('now') WHERE id = ?`,
+				webhookDelivered, attempts, d.id); err != nil {
+				log.Printf("更新投递状态失败: %v\n", err)
+			}
+			continue
+		}
+
+		if attempts < config.WebhookMaxAttempts {
+			backoff := fmt.Sprintf("+%d seconds", 30<<(attempts-1))
+			if _, err := db.Exec(`UPDATE webhook_deliveries SET attempts = ?, last_error = ?, next_attempt_at = datetime('now', ?) WHERE id = ?`,
+				attempts, deliverErr.Error(), backoff, d.id); err != nil {
+				log.Printf("更新投递状态失败: %v\n", err)
+			}
+			continue
+		}
+		log.Printf("事件 %s 投递到 %s 失败 %d 次，转入死信表: %v\n", d.event, d.endpoint, attempts, deliverErr)
+		if err := moveToDeadLetter(db, d.id, d.endpoint, d.event, d.payload, attempts, deliverErr.Error()); err != nil {
+			log.Printf("转入死信表失败: %v\n", err)
+		}
+	}
+}
+
+func moveToDeadLetter(db *sql.DB, deliveryID int, endpoint, event, payload string, attempts int, lastError string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = ?, last_error = ? WHERE id = ?`,
+		webhookFailed, attempts, lastError, deliveryID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO webhook_dead_letters (delivery_id, endpoint, event, payload, attempts, last_error) VALUES (?, ?, ?, ?, ?, ?)`,
+		deliveryID, endpoint, event, payload, attempts, lastError); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// 发送一次事件。签名为 HMAC-SHA256(secret, 时间戳 + "." + 请求体)
+func postWebhook(endpoint WebhookEndpoint, deliveryID int, event string, payload []byte) error {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	mac := hmac.New(sha256.New, []byte(endpoint.Secret))
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(payload)
+
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Chong-Event", event)
+	req.Header.Set("X-Chong-Delivery", strconv.Itoa(deliveryID))
+	req.Header.Set("X-Chong-Timestamp", timestamp)
+	req.Header.Set("X-Chong-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+
+	resp, err := webhookClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 4096))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("接收方返回 %s", resp.Status)
+	}
+	return nil
+}
+
+var replayWebhookRe = regexp.MustCompile(`^重放Webhook(?:(\d+)号)?$`)
+
+// 管理员 Webhook 命令：Webhook失败列表、重放Webhook[N号]、测试Webhook
+func handleWebhookAdmin(msg *openwechat.Message, db *sql.DB) {
+	switch {
+	case msg.Content == "Webhook失败列表":
+		listDeadLetters(msg, db)
+	case msg.Content == "测试Webhook":
+		if len(config.Webhooks) == 0 {
+			msg.ReplyText("没有配置 Webhook 接收地址。")
+			return
+		}
+		if err := emitEvent(db, eventPing, map[string]interface{}{"message": "测试事件"}); err != nil {
+			log.Printf("发送测试事件失败: %v\n", err)
+			msg.ReplyText("发送测试事件失败，请稍后重试。")
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("已向%d个接收地址发送测试事件，稍后发送“Webhook失败列表”查看结果。", len(config.Webhooks)))
+	case replayWebhookRe.MatchString(msg.Content):
+		id, _ := strconv.Atoi(replayWebhookRe.FindStringSubmatch(msg.Content)[1])
+		count, err := replayDeadLetters(db, id)
+		if err != nil {
+			log.Printf("重放 Webhook 失败: %v\n", err)
+			msg.ReplyText("重放失败，请稍后重试。")
+			return
+		}
+		if count == 0 {
+			msg.ReplyText("没有需要重放的投递。")
+			return
+		}
+		msg.ReplyText(fmt.Sprintf("已重新排队%d条投递。", count))
+	}
+}
+
+// 把死信重新放回投递队列，id 为 0 时重放全部未重放的死信
+func replayDeadLetters(db *sql.DB, id int) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	query := `SELECT id, delivery_id FROM webhook_dead_letters WHERE replayed_at = ''`
+	var args []interface{}
+	if id > 0 {
+		query += ` AND id = ?`
+		args = append(args, id)
+	}
+	rows, err := tx.Query(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	var letters [][2]int
+	for rows.Next() {
+		var letterID, deliveryID int
+		if err := rows.Scan(&letterID, &deliveryID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		letters = append(letters, [2]int{letterID, deliveryID})
+	}
+	rows.Close()
+
+	for _, l := range letters {
+		if _, err := tx.Exec(`UPDATE webhook_deliveries SET status = ?, attempts = 0, next_attempt_at = datetime('now') WHERE id = ?`,
+			webhookPending, l[1]); err != nil {
+			return 0, err
+		}
+		if _, err := tx.Exec(`UPDATE webhook_dead_letters SET replayed_at = datetime('now') WHERE id = ?`, l[0]); err != nil {
+			return 0, err
+		}
+	}
+	return len(letters), tx.Commit()
+}
+
+func listDeadLetters(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, endpoint, event, attempts, last_error, created_at FROM webhook_dead_letters
+	WHERE replayed_at = '' ORDER BY id DESC LIMIT 20`)
+	if err != nil {
+		msg.ReplyText("获取 Webhook 失败列表时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var id, attempts int
+		var endpoint, event, lastError, createdAt string
+		if err := rows.Scan(&id, &endpoint, &event, &attempts, &lastError, &createdAt); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("%d号：%s → %s，尝试%d次，%s，%s\n", id, event, endpoint, attempts, createdAt, lastError))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("没有投递失败的 Webhook。")
+		return
+	}
+	msg.ReplyText(response.String() + "发送“重放Webhook”重放全部，或“重放Webhook[N]号”重放指定一条。")
+}
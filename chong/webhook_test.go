@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+)
+
+// 记录收到的请求的接收方，fail 为 true 时返回 500
+type webhookReceiver struct {
+	mu       sync.Mutex
+	fail     bool
+	requests []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.requests = append(rcv.requests, r)
+	rcv.bodies = append(rcv.bodies, body)
+	if rcv.fail {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (rcv *webhookReceiver) count() int {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	return len(rcv.requests)
+}
+
+func newTestWebhook(t *testing.T, fail bool) (*sql.DB, *webhookReceiver) {
+	t.Helper()
+	rcv := &webhookReceiver{fail: fail}
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Webhooks = []WebhookEndpoint{{Name: "测试", URL: server.URL, Secret: "s3cret"}}
+	config.WebhookMaxAttempts = 3
+	return newTestDB(t), rcv
+}
+
+type testDelivery struct {
+	status   string
+	attempts int
+	delay    int // 距下次投递的秒数
+}
+
+func getTestDelivery(t *testing.T, db *sql.DB) testDelivery {
+	t.Helper()
+	var d testDelivery
+	err := db.QueryRow(`SELECT status, attempts, CAST(strftime('%s', next_attempt_at) - strftime('%s', 'now') AS INTEGER)
+	FROM webhook_deliveries ORDER BY id DESC LIMIT 1`).Scan(&d.status, &d.attempts, &d.delay)
+	if err != nil {
+		t.Fatalf("查询投递记录失败: %v", err)
+	}
+	return d
+}
+
+// 让所有待投递的记录立即到期
+func expireTestDeliveries(t *testing.T, db *sql.DB) {
+	t.Helper()
+	if _, err := db.Exec(`UPDATE webhook_deliveries SET next_attempt_at = datetime('now', '-1 seconds')`); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestWebhookSignature(t *testing.T) {
+	db, rcv := newTestWebhook(t, false)
+	emitEvent(db, eventPing, map[string]interface{}{"message": "测试事件"})
+	deliverPendingWebhooks(db)
+
+	if rcv.count() != 1 {
+		t.Fatalf("应收到1个请求，实际为%d", rcv.count())
+	}
+	req, body := rcv.requests[0], rcv.bodies[0]
+	mac := hmac.New(sha256.New, []byte("s3cret"))
+	mac.Write([]byte(req.Header.Get("X-Chong-Timestamp") + "."))
+	mac.Write(body)
+	if want := "sha256=" + hex.EncodeToString(mac.Sum(nil)); req.Header.Get("X-Chong-Signature") != want {
+		t.Fatalf("签名不符：%s，应为%s", req.Header.Get("X-Chong-Signature"), want)
+	}
+	if req.Header.Get("X-Chong-Event") != eventPing {
+		t.Fatalf("事件头应为%s，实际为%s", eventPing, req.Header.Get("X-Chong-Event"))
+	}
+	if d := getTestDelivery(t, db); d.status != webhookDelivered || d.attempts != 1 {
+		t.Fatalf("投递状态应为已送达，实际为 %+v", d)
+	}
+}
+
+func TestWebhookBackoffDeadLetterAndReplay(t *testing.T) {
+	db, rcv := newTestWebhook(t, true)
+	emitEvent(db, eventPing, nil)
+
+	// 第1、2次失败后分别等30秒、60秒
+	for i, wantDelay := range []int{30, 60} {
+		deliverPendingWebhooks(db)
+		d := getTestDelivery(t, db)
+		if d.status != webhookPending || d.attempts != i+1 || d.delay < wantDelay-2 || d.delay > wantDelay {
+			t.Fatalf("第%d次失败后应等待%d秒重试，实际为 %+v", i+1, wantDelay, d)
+		}
+		// 未到期时不重试
+		deliverPendingWebhooks(db)
+		if rcv.count() != i+1 {
+			t.Fatalf("未到重试时间不应投递，已收到%d个请求", rcv.count())
+		}
+		expireTestDeliveries(t, db)
+	}
+
+	// 第3次失败达到上限，转入死信表
+	deliverPendingWebhooks(db)
+	if d := getTestDelivery(t, db); d.status != webhookFailed || d.attempts != 3 {
+		t.Fatalf("达到上限后应标记失败，实际为 %+v", d)
+	}
+	var letters int
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_dead_letters WHERE replayed_at = ''`).Scan(&letters)
+	if letters != 1 {
+		t.Fatalf("应有1条死信，实际为%d", letters)
+	}
+
+	// 接收方恢复后重放
+	rcv.mu.Lock()
+	rcv.fail = false
+	rcv.mu.Unlock()
+	if count, err := replayDeadLetters(db, 0); err != nil || count != 1 {
+		t.Fatalf("应重放1条死信，得到 %d, %v", count, err)
+	}
+	if count, _ := replayDeadLetters(db, 0); count != 0 {
+		t.Fatalf("已重放的死信不应再次重放，得到%d", count)
+	}
+	deliverPendingWebhooks(db)
+	if d := getTestDelivery(t, db); d.status != webhookDelivered || d.attempts != 1 {
+		t.Fatalf("重放后应送达，实际为 %+v", d)
+	}
+}
+
+func TestEmitEventRollsBackWithTransaction(t *testing.T) {
+	db, _ := newTestWebhook(t, false)
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	emitEvent(tx, eventPing, nil)
+	tx.Rollback()
+
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM webhook_deliveries`).Scan(&count)
+	if count != 0 {
+		t.Fatalf("事务回滚后不应留下投递记录，实际为%d条", count)
+	}
+}
+
+// 事件记不下来时业务也要失败，不能出现订单已付款而没有事件的情况
+func TestEmitEventFailureAbortsBusiness(t *testing.T) {
+	db, _ := newTestWebhook(t, false)
+	item := addTestTradeItem(t, db, "卖家", 10, 1)
+	if _, err := db.Exec(`DROP TABLE webhook_deliveries`); err != nil {
+		t.Fatalf("删除投递表失败: %v", err)
+	}
+
+	if err := emitEvent(db, eventPing, nil); err == nil {
+		t.Fatal("记录事件失败时应返回错误")
+	}
+	if _, err := createTradeOrder(db, item, "买家", "", "", couponUse{}); err == nil {
+		t.Fatal("事件记录失败时建单应失败")
+	}
+	var count int
+	db.QueryRow(`SELECT COUNT(*) FROM trade_orders`).Scan(&count)
+	if count != 0 {
+		t.Fatalf("建单应回滚，实际有%d个订单", count)
+	}
+}
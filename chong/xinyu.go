@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 用户信誉：收到的评价均分、评价数和完成的交易数
+type Reputation struct {
+	AvgRating       float64
+	Reviews         int
+	CompletedTrades int
+}
+
+func (r Reputation) String() string {
+	if r.Reviews == 0 {
+		return fmt.Sprintf("暂无评分，成交%d单", r.CompletedTrades)
+	}
+	return fmt.Sprintf("★%.1f（%d条评价），成交%d单", r.AvgRating, r.Reviews, r.CompletedTrades)
+}
+
+func initReviewTables(db *sql.DB) {
+	createTradeReviewsTableSQL := `
+	CREATE TABLE IF NOT EXISTS trade_reviews (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		order_id INTEGER NOT NULL,
+		reviewer TEXT NOT NULL,
+		reviewee TEXT NOT NULL,
+		reviewee_role TEXT NOT NULL,  -- 卖家 或 买家
+		rating INTEGER NOT NULL CHECK (rating BETWEEN 1 AND 5),
+		comment TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		UNIQUE (order_id, reviewer)
+	);`
+	if _, err := db.Exec(createTradeReviewsTableSQL); err != nil {
+		log.Fatalf("创建 trade_reviews 表失败: %s\n", err)
+	}
+}
+
+// 订单完成后私聊邀请买卖双方互评
+func promptTradeReviews(self *openwechat.Self, order *TradeOrder) {
+	prompts := map[string]string{
+		order.Buyer:  fmt.Sprintf("交易单%d号（%s）已完成，请为卖家%s评分：发送“评价%d号，[1-5分]，[评价内容]”，评价内容可选。", order.ID, order.ItemName, order.Seller, order.ID),
+		order.Seller: fmt.Sprintf("交易单%d号（%s）已完成，请为买家%s评分：发送“评价%d号，[1-5分]，[评价内容]”，评价内容可选。", order.ID, order.ItemName, order.Buyer, order.ID),
+	}
+	for nickName, text := range prompts {
+		if err := sendTextToNickName(self, nickName, text); err != nil {
+			log.Printf("发送评价邀请失败: %v\n", err)
+		}
+	}
+}
+
+var reviewRe = regexp.MustCompile(`^评价(\d+)号，([1-5])分?(?:，(.*))?$`)
+
+// 处理 "评价N号，分数[，评价内容]" 命令
+func handleReview(msg *openwechat.Message, db *sql.DB, reviewer string) {
+	matches := reviewRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '评价[交易单号]号，[1-5分]，[评价内容]' 的格式输入。")
+		return
+	}
+	orderID, _ := strconv.Atoi(matches[1])
+	rating, _ := strconv.Atoi(matches[2])
+	comment := strings.TrimSpace(matches[3])
+
+	order, err := getTradeOrderByID(db, orderID)
+	if err != nil {
+		msg.ReplyText("获取订单信息时发生错误，请稍后重试。")
+		return
+	}
+	if order == nil || (order.Buyer != reviewer && order.Seller != reviewer) {
+		msg.ReplyText("未找到您参与的该交易单。")
+		return
+	}
+	if order.Status != orderCompleted {
+		msg.ReplyText("交易完成后才能评价。")
+		return
+	}
+
+	reviewee, role := order.Seller, "卖家"
+	if reviewer == order.Seller {
+		reviewee, role = order.Buyer, "买家"
+	}
+	_, err = db.Exec(`INSERT INTO trade_reviews (order_id, reviewer, reviewee, reviewee_role, rating, comment) VALUES (?, ?, ?, ?, ?, ?)`,
+		orderID, reviewer, reviewee, role, rating, comment)
+	if err != nil {
+		if strings.Contains(err.Error(), "UNIQUE") {
+			msg.ReplyText("您已经评价过该交易单。")
+			return
+		}
+		log.Printf("保存评价失败: %v\n", err)
+		msg.ReplyText("保存评价失败，请稍后重试。")
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("感谢评价！您给%s%s打了%d分。", role, reviewee, rating))
+}
+
+// 处理 "信誉" 与 "信誉：[昵称]" 命令
+func handleReputation(msg *openwechat.Message, db *sql.DB, nickName string) {
+	if strings.HasPrefix(msg.Content, "信誉：") {
+		nickName = strings.TrimSpace(strings.TrimPrefix(msg.Content, "信誉："))
+	}
+	rep, err := getReputation(db, nickName)
+	if err != nil {
+		msg.ReplyText("获取信誉信息时发生错误，请稍后重试。")
+		return
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("%s的信誉：%s\n", nickName, rep))
+	rows, err := db.Query(`SELECT reviewer, reviewee_role, rating, comment, created_at FROM trade_reviews
+	WHERE reviewee = ? ORDER BY id DESC LIMIT 5`, nickName)
+	if err != nil {
+		log.Printf("查询评价失败: %v\n", err)
+		msg.ReplyText(response.String())
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reviewer, role, comment, createdAt string
+		var rating int
+		if err := rows.Scan(&reviewer, &role, &rating, &comment, &createdAt); err != nil {
+			log.Printf("读取评价失败: %v\n", err)
+			continue
+		}
+		if comment == "" {
+			comment = "（无评价内容）"
+		}
+		response.WriteString(fmt.Sprintf("%s 作为%s获%s评%d分：%s\n", createdAt[:10], role, reviewer, rating, comment))
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
+
+func getReputation(db *sql.DB, nickName string) (Reputation, error) {
+	var rep Reputation
+	var avg sql.NullFloat64
+	err := db.QueryRow(`SELECT AVG(rating), COUNT(*) FROM trade_reviews WHERE reviewee = ?`, nickName).Scan(&avg, &rep.Reviews)
+	if err != nil {
+		return rep, err
+	}
+	rep.AvgRating = avg.Float64
+	err = db.QueryRow(`SELECT COUNT(*) FROM trade_orders WHERE status = ? AND (seller = ? OR buyer = ?)`,
+		orderCompleted, nickName, nickName).Scan(&rep.CompletedTrades)
+	return rep, err
+}
+
+// 作为卖家的信誉：只算买家给的评价和卖出的订单，用于交易品上的信誉标识
+func getSellerReputation(db *sql.DB, nickName string) (Reputation, error) {
+	var rep Reputation
+	var avg sql.NullFloat64
+	err := db.QueryRow(`SELECT AVG(rating), COUNT(*) FROM trade_reviews WHERE reviewee = ? AND reviewee_role = '卖家'`,
+		nickName).Scan(&avg, &rep.Reviews)
+	if err != nil {
+		return rep, err
+	}
+	rep.AvgRating = avg.Float64
+	err = db.QueryRow(`SELECT COUNT(*) FROM trade_orders WHERE status = ? AND seller = ?`,
+		orderCompleted, nickName).Scan(&rep.CompletedTrades)
+	return rep, err
+}
+
+// 为交易品列表附上卖家信誉
+func attachSellerReputation(db *sql.DB, items []TradeItem) {
+	cache := make(map[string]Reputation)
+	for i := range items {
+		rep, ok := cache[items[i].Seller]
+		if !ok {
+			var err error
+			if rep, err = getSellerReputation(db, items[i].Seller); err != nil {
+				log.Printf("查询卖家信誉失败: %v\n", err)
+			}
+			cache[items[i].Seller] = rep
+		}
+		items[i].SellerReputation = rep
+	}
+}
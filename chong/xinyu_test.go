@@ -0,0 +1,42 @@
+package main
+
+import "testing"
+
+func TestSellerReputationIgnoresBuyerSide(t *testing.T) {
+	db := newTestDB(t)
+	for i, r := range []struct {
+		reviewee, role string
+		rating         int
+	}{
+		{"小明", "卖家", 5},
+		{"小明", "买家", 1},
+		{"小明", "买家", 1},
+	} {
+		if _, err := db.Exec(`INSERT INTO trade_reviews (order_id, reviewer, reviewee, reviewee_role, rating, comment) VALUES (?, '路人', ?, ?, ?, '')`,
+			i+1, r.reviewee, r.role, r.rating); err != nil {
+			t.Fatalf("写入评价失败: %v", err)
+		}
+	}
+	// 小明卖出一单、买入两单
+	for _, o := range [][2]string{{"小明", "甲"}, {"乙", "小明"}, {"丙", "小明"}} {
+		if _, err := db.Exec(`INSERT INTO trade_orders (item_id, item_name, seller, buyer, price, status) VALUES (1, '测试', ?, ?, 10, ?)`,
+			o[0], o[1], orderCompleted); err != nil {
+			t.Fatalf("写入订单失败: %v", err)
+		}
+	}
+
+	rep, err := getSellerReputation(db, "小明")
+	if err != nil {
+		t.Fatalf("查询卖家信誉失败: %v", err)
+	}
+	if rep.Reviews != 1 || rep.AvgRating != 5 || rep.CompletedTrades != 1 {
+		t.Fatalf("卖家信誉应为1条5分评价、成交1单，实际为 %+v", rep)
+	}
+	all, err := getReputation(db, "小明")
+	if err != nil {
+		t.Fatalf("查询信誉失败: %v", err)
+	}
+	if all.Reviews != 3 || all.CompletedTrades != 3 {
+		t.Fatalf("总信誉应包含买卖双方，实际为 %+v", all)
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 邀请奖励规则
+type ReferralConfig struct {
+	Reward      float64 `json:"reward"`       // 被邀请人首次充值后奖励邀请人的星卷，0 表示关闭邀请奖励
+	MinRecharge float64 `json:"min_recharge"` // 被邀请人首次充值达到多少元才发放奖励，首次不满则不再奖励
+	DailyLimit  int     `json:"daily_limit"`  // 每人 24 小时内最多绑定多少个被邀请人，0 表示不限
+	MaxRewards  int     `json:"max_rewards"`  // 每人最多获得多少次邀请奖励，0 表示不限
+}
+
+// 邀请记录状态
+const (
+	referralPending  = "待充值"
+	referralRewarded = "已奖励"
+	referralCapped   = "已达上限" // 邀请人奖励次数用完，只记录归属不发奖励
+	referralSkipped  = "未奖励"  // 首次充值不满 min_recharge 或奖励未开启，以后充值也不再奖励
+)
+
+// 每个用户一个固定的邀请码；每个被邀请人只能绑定一次，奖励记在钱包流水里，ref_type 为 referral
+func initReferralTables(db *sql.DB) {
+	createReferralCodesTableSQL := `
+	CREATE TABLE IF NOT EXISTS referral_codes (
+		nick TEXT PRIMARY KEY,
+		code TEXT NOT NULL UNIQUE,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createReferralCodesTableSQL); err != nil {
+		log.Fatalf("创建 referral_codes 表失败: %s\n", err)
+	}
+
+	createReferralsTableSQL := `
+	CREATE TABLE IF NOT EXISTS referrals (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		referee TEXT NOT NULL UNIQUE,
+		referrer TEXT NOT NULL,
+		code TEXT NOT NULL,
+		source TEXT NOT NULL,  -- 加好友、群聊或私聊
+		group_name TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '待充值',
+		reward REAL NOT NULL DEFAULT 0,
+		recharge_code TEXT NOT NULL DEFAULT '',
+		notified BOOLEAN NOT NULL DEFAULT 0,
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		rewarded_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createReferralsTableSQL); err != nil {
+		log.Fatalf("创建 referrals 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_referrals_referrer ON referrals (referrer, created_at)`); err != nil {
+		log.Fatalf("创建 referrals 索引失败: %s\n", err)
+	}
+	// 昵称可以随意修改，改名后会被当作新用户，所以另外记下头像标识（openwechat 的 User.AvatarID()）挡住
+	// 只改昵称的重复绑定。这只是经验判断，不是账号标识：网页版登录时 Uin 一般为 0，取的是头像地址里的
+	// seq，用户换了头像就会变。列名沿用 user_id 和 referee_id
+	addColumnIfMissing(db, "referral_codes", "user_id", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "referrals", "referee_id", "TEXT NOT NULL DEFAULT ''")
+	if _, err := db.Exec(`CREATE UNIQUE INDEX IF NOT EXISTS idx_referrals_referee_id ON referrals (referee_id) WHERE referee_id != ''`); err != nil {
+		log.Fatalf("创建 referrals 账号索引失败: %s\n", err)
+	}
+}
+
+// 用户的邀请码，第一次查看时生成，同时记下头像标识
+func referralCodeFor(db *sql.DB, nick, avatarID string) (string, error) {
+	var code string
+	err := db.QueryRow(`SELECT code FROM referral_codes WHERE nick = ?`, nick).Scan(&code)
+	if err == nil && avatarID != "" {
+		_, err = db.Exec(`UPDATE referral_codes SET user_id = ? WHERE nick = ? AND user_id = ''`, avatarID, nick)
+	}
+	if err != sql.ErrNoRows {
+		return code, err
+	}
+	buf := make([]byte, 4)
+	for attempt := 0; attempt < 5; attempt++ {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		code = strings.ToUpper(hex.EncodeToString(buf))
+		// 邀请码重复时换一个重试，昵称重复说明已被并发生成，直接读取
+		if _, err := db.Exec(`INSERT INTO referral_codes (nick, code, user_id) VALUES (?, ?, ?) ON CONFLICT(nick) DO NOTHING`, nick, code, avatarID); err == nil {
+			break
+		}
+	}
+	err = db.QueryRow(`SELECT code FROM referral_codes WHERE nick = ?`, nick).Scan(&code)
+	return code, err
+}
+
+// 好友验证消息或聊天里提到的 “邀请码XXXX”
+var referralMentionRe = regexp.MustCompile(`邀请码[：:\s]*([A-Fa-f0-9]{8})`)
+
+func referralCodeFrom(content string) string {
+	if matches := referralMentionRe.FindStringSubmatch(content); len(matches) > 0 {
+		return strings.ToUpper(matches[1])
+	}
+	return ""
+}
+
+// 邀请码对应的邀请人昵称和头像标识，早期生成的邀请码头像标识可能为空
+func referrerByCode(db *sql.DB, code string) (string, string, error) {
+	var referrer, referrerAvatar string
+	err := db.QueryRow(`SELECT nick, user_id FROM referral_codes WHERE code = ?`, code).Scan(&referrer, &referrerAvatar)
+	if err == sql.ErrNoRows {
+		return "", "", fmt.Errorf("邀请码%s不存在", code)
+	}
+	return referrer, referrerAvatar, err
+}
+
+// 绑定邀请关系。只有从未充值、没有钱包流水的新用户可以绑定，同一昵称或头像只能绑定一次，
+// 不能互相邀请，邀请人每天绑定的人数有上限
+func bindReferral(db *sql.DB, referee, refereeAvatar, code, source, group string) (string, error) {
+	if refereeAvatar == "" {
+		return "", fmt.Errorf("暂时无法识别您的头像，请私聊机器人发送邀请码")
+	}
+	referrer, referrerAvatar, err := referrerByCode(db, code)
+	if err != nil {
+		return "", err
+	}
+	if referrer == referee || referrerAvatar == refereeAvatar {
+		return "", fmt.Errorf("不能使用自己的邀请码")
+	}
+	var existing string
+	err = db.QueryRow(`SELECT referrer FROM referrals WHERE referee = ? OR referee_id = ?`, referee, refereeAvatar).Scan(&existing)
+	if err == nil {
+		return "", fmt.Errorf("您已经绑定过邀请人%s", existing)
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+
+	var history int
+	if err := db.QueryRow(`SELECT (SELECT COUNT(*) FROM recharge_records WHERE payer = ? OR redeemed_by = ?)
+		+ (SELECT COUNT(*) FROM wallet_entries WHERE account = ?)`, referee, referee, referee).Scan(&history); err != nil {
+		return "", err
+	}
+	if history > 0 {
+		return "", fmt.Errorf("邀请码只限还没有充值过的新用户使用")
+	}
+	var reverse int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM referrals WHERE referee = ? AND referrer = ?`, referrer, referee).Scan(&reverse); err != nil {
+		return "", err
+	}
+	if reverse > 0 {
+		return "", fmt.Errorf("不能与自己邀请的人互相邀请")
+	}
+	if config.Referral.DailyLimit > 0 {
+		var recent int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM referrals WHERE referrer = ? AND created_at >= datetime('now', '-1 day')`,
+			referrer).Scan(&recent); err != nil {
+			return "", err
+		}
+		if recent >= config.Referral.DailyLimit {
+			log.Printf("邀请人 [%s] 24小时内绑定已达上限，拒绝 [%s]\n", referrer, referee)
+			return "", fmt.Errorf("该邀请码今天的邀请名额已用完，请明天再试")
+		}
+	}
+
+	if _, err := db.Exec(`INSERT INTO referrals (referee, referee_id, referrer, code, source, group_name) VALUES (?, ?, ?, ?, ?, ?)`,
+		referee, refereeAvatar, referrer, code, source, group); err != nil {
+		return "", err
+	}
+	return referrer, nil
+}
+
+// 绑定成功后给被邀请人的说明
+func referralWelcome(referrer string) string {
+	text := fmt.Sprintf("已绑定邀请人%s。", referrer)
+	if config.Referral.Reward > 0 {
+		text += fmt.Sprintf("首次充值满%.2f元时，邀请人将获得%.2f星卷奖励。", config.Referral.MinRecharge, config.Referral.Reward)
+	}
+	return text
+}
+
+// 处理 "邀请码XXXX"，私聊或群聊中绑定邀请人，group 为空表示私聊
+func handleBindReferral(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, user *openwechat.User, group string) {
+	referee := user.NickName
+	code := referralCodeFrom(msg.Content)
+	if code == "" {
+		msg.ReplyText("邀请码格式错误，请发送“邀请码”加8位邀请码，例如：邀请码1A2B3C4D。发送“我的邀请码”查看自己的邀请码。")
+		return
+	}
+	source := "私聊"
+	if group != "" {
+		source = "群聊"
+	}
+	referrer, err := bindReferral(db, referee, user.AvatarID(), code, source, group)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("绑定邀请人失败：%v", err))
+		return
+	}
+	msg.ReplyText(referee + referralWelcome(referrer))
+	notifyReferrer(self, referrer, referee)
+}
+
+func notifyReferrer(self *openwechat.Self, referrer, referee string) {
+	text := fmt.Sprintf("%s使用了您的邀请码。", referee)
+	if config.Referral.Reward > 0 {
+		text = fmt.Sprintf("%s使用了您的邀请码，对方首次充值满%.2f元时您将获得邀请奖励。", referee, config.Referral.MinRecharge)
+	}
+	if err := sendTextToNickName(self, referrer, text); err != nil {
+		log.Printf("通知邀请人 [%s] 失败: %v\n", referrer, err)
+	}
+}
+
+// 好友申请的验证消息里带有有效邀请码时自动通过并绑定邀请人，其他申请仍由人工处理
+func acceptReferralFriend(msg *openwechat.Message, db *sql.DB, self *openwechat.Self) {
+	code := referralCodeFrom(msg.RecommendInfo.Content)
+	if code == "" {
+		return
+	}
+	if _, _, err := referrerByCode(db, code); err != nil {
+		log.Printf("好友申请 [%s] 的邀请码无效: %v\n", msg.RecommendInfo.NickName, err)
+		return
+	}
+	friend, err := msg.Agree()
+	if err != nil {
+		log.Printf("通过好友申请 [%s] 失败: %v\n", msg.RecommendInfo.NickName, err)
+		return
+	}
+	referee := msg.RecommendInfo.NickName
+	referrer, err := bindReferral(db, referee, friend.AvatarID(), code, "加好友", "")
+	if err != nil {
+		log.Printf("绑定 [%s] 的邀请人失败: %v\n", referee, err)
+		return
+	}
+	if _, err := friend.SendText("欢迎！" + referralWelcome(referrer)); err != nil {
+		log.Printf("发送邀请欢迎消息失败: %v\n", err)
+	}
+	notifyReferrer(self, referrer, referee)
+}
+
+// 在兑换事务中给被邀请人的邀请人发放奖励。只看绑定后的第一次充值，
+// 不满 min_recharge 或奖励未开启时关闭这条邀请，之后的充值不再奖励
+func rewardReferral(tx *sql.Tx, referee string, amount float64, code string) error {
+	var id int
+	var referrer string
+	err := tx.QueryRow(`SELECT id, referrer FROM referrals WHERE referee = ? AND status = ?`, referee, referralPending).Scan(&id, &referrer)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if config.Referral.Reward <= 0 || amount < config.Referral.MinRecharge {
+		// 奖励未开启时不用通知邀请人
+		_, err := tx.Exec(`UPDATE referrals SET status = ?, recharge_code = ?, notified = ?, rewarded_at = datetime('now') WHERE id = ?`,
+			referralSkipped, code, config.Referral.Reward <= 0, id)
+		return err
+	}
+
+	if config.Referral.MaxRewards > 0 {
+		var rewarded int
+		if err := tx.QueryRow(`SELECT COUNT(*) FROM referrals WHERE referrer = ? AND status = ?`, referrer, referralRewarded).Scan(&rewarded); err != nil {
+			return err
+		}
+		if rewarded >= config.Referral.MaxRewards {
+			_, err := tx.Exec(`UPDATE referrals SET status = ?, recharge_code = ?, rewarded_at = datetime('now') WHERE id = ?`, referralCapped, code, id)
+			return err
+		}
+	}
+
+	reward := roundCents(config.Referral.Reward)
+	memo := fmt.Sprintf("邀请%s首次充值，兑换码%s", referee, code)
+	if _, err := postWalletEntry(tx, referrer, reward, "邀请奖励", "referral", id, memo); err != nil {
+		return err
+	}
+	if _, err := postWalletEntry(tx, platformAccount, -reward, "邀请奖励支出", "referral", id, referrer+" "+memo); err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE referrals SET status = ?, reward = ?, recharge_code = ?, rewarded_at = datetime('now') WHERE id = ?`,
+		referralRewarded, reward, code, id)
+	return err
+}
+
+// 兑换后通知邀请人奖励到账，与 checkTierChange 一样在事务提交后调用
+func notifyReferralReward(db *sql.DB, self *openwechat.Self, referee string) {
+	var id int
+	var referrer, status string
+	var reward float64
+	err := db.QueryRow(`SELECT id, referrer, status, reward FROM referrals WHERE referee = ? AND notified = 0 AND status != ?`,
+		referee, referralPending).Scan(&id, &referrer, &status, &reward)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("查询 [%s] 的邀请记录失败: %v\n", referee, err)
+		}
+		return
+	}
+	if _, err := db.Exec(`UPDATE referrals SET notified = 1 WHERE id = ?`, id); err != nil {
+		log.Printf("更新邀请记录失败: %v\n", err)
+		return
+	}
+	text := fmt.Sprintf("您邀请的%s已完成首次充值，邀请奖励%.2f星卷已存入钱包。", referee, reward)
+	switch status {
+	case referralCapped:
+		text = fmt.Sprintf("您邀请的%s已完成首次充值，您的邀请奖励次数已用完，本次不再发放奖励。", referee)
+	case referralSkipped:
+		text = fmt.Sprintf("您邀请的%s已完成首次充值，金额未满%.2f元，没有邀请奖励。", referee, config.Referral.MinRecharge)
+	}
+	if err := sendTextToNickName(self, referrer, text); err != nil {
+		log.Printf("通知邀请人 [%s] 失败: %v\n", referrer, err)
+	}
+}
+
+// 处理 "我的邀请码"，展示邀请码、邀请人数和累计奖励
+func handleMyReferral(msg *openwechat.Message, db *sql.DB, user *openwechat.User) {
+	nick := user.NickName
+	code, err := referralCodeFor(db, nick, user.AvatarID())
+	if err != nil {
+		log.Printf("生成 [%s] 的邀请码失败: %v\n", nick, err)
+		msg.ReplyText("获取邀请码时发生错误，请稍后重试。")
+		return
+	}
+	var invited, pending int
+	var rewards float64
+	if err := db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(status = ?), 0), IFNULL(SUM(reward), 0) FROM referrals WHERE referrer = ?`,
+		referralPending, nick).Scan(&invited, &pending, &rewards); err != nil {
+		msg.ReplyText("获取邀请记录时发生错误，请稍后重试。")
+		return
+	}
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("您的邀请码：%s\n已邀请%d人，其中%d人尚未充值，累计奖励%.2f星卷", code, invited, pending, rewards))
+	if config.Referral.Reward > 0 {
+		response.WriteString(fmt.Sprintf("\n好友添加机器人时在验证消息里填写“邀请码%s”，或进群后发送“邀请码%s”即可绑定；对方首次充值满%.2f元时您获得%.2f星卷。",
+			code, code, config.Referral.MinRecharge, config.Referral.Reward))
+	}
+	msg.ReplyText(response.String())
+}
+
+// 处理 "邀请列表" 管理员命令，查看最近的邀请记录，排查刷邀请
+func listReferrals(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT referee, referrer, source, group_name, status, reward, created_at FROM referrals ORDER BY id DESC LIMIT 20`)
+	if err != nil {
+		msg.ReplyText("获取邀请记录时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var referee, referrer, source, group, status, createdAt string
+		var reward float64
+		if err := rows.Scan(&referee, &referrer, &source, &group, &status, &reward, &createdAt); err != nil {
+			continue
+		}
+		if group != "" {
+			source += "：" + group
+		}
+		response.WriteString(fmt.Sprintf("%s %s 邀请 %s（%s），%s", createdAt, referrer, referee, source, status))
+		if reward > 0 {
+			response.WriteString(fmt.Sprintf(" %.2f星卷", reward))
+		}
+		response.WriteString("\n")
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("还没有邀请记录。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+// 在兑换事务里发放邀请奖励，模拟被邀请人充值
+func rechargeForReferral(t *testing.T, db *sql.DB, referee string, amount float64, code string) {
+	t.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		t.Fatalf("开启事务失败: %v", err)
+	}
+	defer tx.Rollback()
+	if err := rewardReferral(tx, referee, amount, code); err != nil {
+		t.Fatalf("发放邀请奖励失败: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatalf("提交失败: %v", err)
+	}
+}
+
+// 头像标识只能挡住改昵称不换头像的情况，换了头像就认不出来
+func TestReferralChecksAvatarID(t *testing.T) {
+	db := newTestDB(t)
+	code, err := referralCodeFor(db, "邀请人", "1001")
+	if err != nil {
+		t.Fatalf("生成邀请码失败: %v", err)
+	}
+	if _, err := bindReferral(db, "邀请人小号", "1001", code, "私聊", ""); err == nil {
+		t.Fatal("改名后不能使用自己的邀请码")
+	}
+	if _, err := bindReferral(db, "新人", "", code, "群聊", "上星群"); err == nil {
+		t.Fatal("识别不到头像时不能绑定")
+	}
+	if _, err := bindReferral(db, "新人", "2002", code, "私聊", ""); err != nil {
+		t.Fatalf("绑定邀请人失败: %v", err)
+	}
+	if _, err := bindReferral(db, "新人改名", "2002", code, "私聊", ""); err == nil {
+		t.Fatal("只改昵称后不能再次绑定")
+	}
+}
+
+func TestReferralPaysOnlyOnFirstRecharge(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Referral = ReferralConfig{Reward: 10, MinRecharge: 50}
+
+	db := newTestDB(t)
+	code, err := referralCodeFor(db, "邀请人", "1001")
+	if err != nil {
+		t.Fatalf("生成邀请码失败: %v", err)
+	}
+	for nick, id := range map[string]string{"小额": "2001", "达标": "2002"} {
+		if _, err := bindReferral(db, nick, id, code, "私聊", ""); err != nil {
+			t.Fatalf("绑定邀请人失败: %v", err)
+		}
+	}
+
+	// 首次充值不满门槛，之后再充大额也不奖励
+	rechargeForReferral(t, db, "小额", 10, "111111")
+	rechargeForReferral(t, db, "小额", 100, "222222")
+	if balance, _ := getWalletBalance(db, "邀请人"); balance != 0 {
+		t.Fatalf("首次充值不满门槛不应奖励，邀请人余额为%.2f", balance)
+	}
+
+	rechargeForReferral(t, db, "达标", 60, "333333")
+	rechargeForReferral(t, db, "达标", 60, "444444")
+	if balance, _ := getWalletBalance(db, "邀请人"); balance != 10 {
+		t.Fatalf("邀请人应只获得一次10星卷奖励，实际为%.2f", balance)
+	}
+	// 邀请奖励不计入可提现金额
+	if amount, _ := getWithdrawableAmount(db, "邀请人"); amount != 0 {
+		t.Fatalf("邀请奖励不能提现，可提现金额为%.2f", amount)
+	}
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 佣金规则：按比例收取，不低于最低佣金
+type CommissionRule struct {
+	Rate    float64 `json:"rate"`    // 佣金比例，例如 0.05 表示 5%
+	Minimum float64 `json:"minimum"` // 每单最低佣金
+}
+
+// 平台佣金配置，分类规则优先于默认规则
+type CommissionConfig struct {
+	CommissionRule
+	Categories map[string]CommissionRule `json:"categories"`
+}
+
+func initCommissionColumns(db *sql.DB) {
+	addColumnIfMissing(db, "trade_orders", "commission", "REAL NOT NULL DEFAULT 0")
+	addColumnIfMissing(db, "trade_orders", "seller_income", "REAL NOT NULL DEFAULT 0")
+}
+
+// 计算成交金额应收的佣金，佣金不超过成交金额
+func calculateCommission(amount float64, category string) float64 {
+	rule := config.Commission.CommissionRule
+	if r, ok := config.Commission.Categories[category]; ok && category != "" {
+		rule = r
+	}
+	commission := math.Max(amount*rule.Rate, rule.Minimum)
+	return roundCents(math.Min(commission, amount))
+}
+
+// 佣金说明，展示给卖家
+func commissionNotice(price float64, category string) string {
+	commission := calculateCommission(price, category)
+	return fmt.Sprintf("成交后平台收取佣金%.2f元，您实得%.2f元。", commission, roundCents(price-commission))
+}
+
+// 订单结算：扣除佣金后记入卖家钱包，佣金记入平台账户。
+// subsidy 是平台替买家补的优惠码金额，单独记为不能提现的优惠券补贴，
+// 否则买卖双方串通用优惠码下单就能把补贴提现出去
+func settleTradeOrder(tx *sql.Tx, order *TradeOrder, sellerGross, subsidy float64) (float64, error) {
+	var category string
+	if err := tx.QueryRow(`SELECT category FROM trade_items WHERE id = ?`, order.ItemID).Scan(&category); err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	commission := calculateCommission(sellerGross, category)
+	income := roundCents(sellerGross - commission)
+	memo := fmt.Sprintf("交易单%d号 %s", order.ID, order.ItemName)
+
+	subsidy = roundCents(math.Min(subsidy, income))
+	if _, err := postWalletEntry(tx, order.Seller, roundCents(income-subsidy), withdrawableEntryType, "trade_order", order.ID, memo); err != nil {
+		return 0, err
+	}
+	if subsidy > 0 {
+		if _, err := postWalletEntry(tx, order.Seller, subsidy, couponSubsidyEntryType, "trade_order", order.ID, memo+" 优惠码"+order.CouponCode); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := postWalletEntry(tx, platformAccount, commission, "平台佣金", "trade_order", order.ID, memo); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`UPDATE trade_orders SET commission = ?, seller_income = ? WHERE id = ?`, commission, income, order.ID); err != nil {
+		return 0, err
+	}
+	return commission, nil
+}
+
+var commissionPreviewRe = regexp.MustCompile(`^佣金(\d+(?:\.\d+)?)(?:，(.+))?$`)
+
+// 处理 "佣金[价格][，分类]" 命令，上架前预览佣金
+func handleCommissionPreview(msg *openwechat.Message) {
+	matches := commissionPreviewRe.FindStringSubmatch(msg.Content)
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请按照 '佣金[价格][，分类]' 的格式输入，例如：佣金100")
+		return
+	}
+	price, _ := strconv.ParseFloat(matches[1], 64)
+	msg.ReplyText(fmt.Sprintf("以%.2f元成交时，%s", price, commissionNotice(price, strings.TrimSpace(matches[2]))))
+}
+
+// 处理 "佣金报表[ YYYY-MM]" 管理员命令，默认统计本月
+func handleCommissionReport(msg *openwechat.Message, db *sql.DB) {
+	month := strings.TrimSpace(strings.TrimPrefix(msg.Content, "佣金报表"))
+	if month == "" {
+		month = time.Now().Format("2006-01")
+	}
+	if _, err := time.Parse("2006-01", month); err != nil {
+		msg.ReplyText("指令格式错误，请按照 '佣金报表 2024-06' 的格式输入。")
+		return
+	}
+
+	report, err := commissionReport(db, month)
+	if err != nil {
+		log.Printf("查询佣金报表失败: %v\n", err)
+		msg.ReplyText("获取佣金报表时发生错误，请稍后重试。")
+		return
+	}
+
+	var response strings.Builder
+	var totalOrders int
+	var totalAmount, totalCommission float64
+	for _, r := range report {
+		totalOrders += r.Orders
+		totalAmount += r.Amount
+		totalCommission += r.Commission
+		response.WriteString(fmt.Sprintf("%s：%d单，成交%.2f元，佣金%.2f元，卖家实得%.2f元\n", r.Category, r.Orders, r.Amount, r.Commission, r.Income))
+	}
+
+	balance, err := getWalletBalance(db, platformAccount)
+	if err != nil {
+		log.Printf("查询平台账户余额失败: %v\n", err)
+	}
+	msg.ReplyText(fmt.Sprintf("————%s佣金报表————\n%s合计：%d单，成交%.2f元，佣金%.2f元\n平台账户余额：%.2f元",
+		month, response.String(), totalOrders, totalAmount, totalCommission, balance))
+}
+
+// 佣金报表中一个分类的汇总
+type commissionReportRow struct {
+	Category   string
+	Orders     int
+	Amount     float64
+	Commission float64
+	Income     float64
+}
+
+// 按分类汇总某月成交的订单，month 是本地时间的 YYYY-MM，completed_at 存的是 UTC
+func commissionReport(db *sql.DB, month string) ([]commissionReportRow, error) {
+	rows, err := db.Query(`SELECT CASE WHEN i.category IS NULL OR i.category = '' THEN '未分类' ELSE i.category END AS c,
+		COUNT(*), SUM(o.price), SUM(o.commission), SUM(o.seller_income)
+	FROM trade_orders o LEFT JOIN trade_items i ON i.id = o.item_id
+	WHERE o.status IN (?, ?) AND strftime('%Y-%m', o.completed_at, 'localtime') = ?
+	GROUP BY c ORDER BY SUM(o.commission) DESC`, orderCompleted, orderSplit, month)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var report []commissionReportRow
+	for rows.Next() {
+		var r commissionReportRow
+		if err := rows.Scan(&r.Category, &r.Orders, &r.Amount, &r.Commission, &r.Income); err != nil {
+			return nil, err
+		}
+		report = append(report, r)
+	}
+	return report, rows.Err()
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCalculateCommission(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Commission = CommissionConfig{
+		CommissionRule: CommissionRule{Rate: 0.05, Minimum: 1},
+		Categories:     map[string]CommissionRule{"账号": {Rate: 0.1}},
+	}
+
+	for _, c := range []struct {
+		amount   float64
+		category string
+		want     float64
+	}{
+		{100, "", 5},
+		{10, "", 1},    // 不低于最低佣金
+		{0.5, "", 0.5}, // 不超过成交金额
+		{100, "账号", 10},
+	} {
+		if got := calculateCommission(c.amount, c.category); got != c.want {
+			t.Errorf("%.2f元（%s）的佣金应为%.2f，实际为%.2f", c.amount, c.category, c.want, got)
+		}
+	}
+}
+
+// completed_at 存 UTC，报表按本地时间的月份统计
+func TestCommissionReportUsesLocalMonth(t *testing.T) {
+	db := newTestDB(t)
+	item := addTestTradeItem(t, db, "卖家", 100, 10)
+
+	// 月初零点前后的订单，按本地时间应归入不同月份
+	boundary := time.Date(2024, 7, 1, 0, 0, 0, 0, time.Local)
+	times := []time.Time{boundary.Add(-time.Minute), boundary.Add(time.Minute), boundary.Add(time.Hour)}
+	for i, at := range times {
+		order, err := createTradeOrder(db, item, "买家", "", "", couponUse{})
+		if err != nil {
+			t.Fatalf("创建订单失败: %v", err)
+		}
+		if _, err := db.Exec(`UPDATE trade_orders SET status = ?, commission = 5, seller_income = 95, completed_at = ? WHERE id = ?`,
+			orderCompleted, at.UTC().Format("2006-01-02 15:04:05"), order.ID); err != nil {
+			t.Fatalf("设置订单%d失败: %v", i, err)
+		}
+	}
+	// 未成交的订单不计入
+	cancelled, _ := createTradeOrder(db, item, "买家", "", "", couponUse{})
+	db.Exec(`UPDATE trade_orders SET status = ?, completed_at = ? WHERE id = ?`, orderCancelled, boundary.UTC().Format("2006-01-02 15:04:05"), cancelled.ID)
+
+	for month, want := range map[string]int{"2024-06": 1, "2024-07": 2} {
+		report, err := commissionReport(db, month)
+		if err != nil {
+			t.Fatalf("查询佣金报表失败: %v", err)
+		}
+		if len(report) != 1 || report[0].Orders != want || report[0].Commission != float64(5*want) || report[0].Category != "未分类" {
+			t.Errorf("%s应有%d单，实际为%+v", month, want, report)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 优惠码状态和适用范围
+const (
+	couponActive   = "有效"
+	couponDisabled = "已停用"
+	couponVoided   = "已作废" // 订单取消后退回的使用记录，不再计入次数
+
+	couponTrade  = "交易"
+	couponBridge = "上星"
+)
+
+// 折扣码，与充值码不同，只在购买交易品或开上星订单时抵扣价格
+type Coupon struct {
+	Code         string
+	PercentOff   float64 // 按比例优惠，例如 0.1 表示打9折
+	AmountOff    float64 // 固定减免金额，与比例优惠二选一
+	MinSpend     float64 // 原价达到多少才能使用
+	PerUserLimit int     // 每人可用次数，0 表示不限
+	TotalLimit   int     // 总共可用次数，0 表示不限
+	AppliesTo    string  // 交易、上星，空表示都可用
+	Scope        string  // 交易品分类或上星类型，空表示不限
+	ExpiresAt    string  // UTC，空表示长期有效
+	Status       string
+	Used         int
+}
+
+// 下单时附带的优惠码和使用人的备注名。昵称可以随意修改，每人限用次数按机器人给的备注名计算
+type couponUse struct {
+	Code   string
+	Member string
+}
+
+// 使用记录按订单保存，ref_type 与钱包流水一致：trade_order 或 bridge
+func initCouponTables(db *sql.DB) {
+	createCouponsTableSQL := `
+	CREATE TABLE IF NOT EXISTS coupons (
+		code TEXT PRIMARY KEY,
+		percent_off REAL NOT NULL DEFAULT 0,
+		amount_off REAL NOT NULL DEFAULT 0,
+		min_spend REAL NOT NULL DEFAULT 0,
+		per_user_limit INTEGER NOT NULL DEFAULT 0,
+		total_limit INTEGER NOT NULL DEFAULT 0,
+		applies_to TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL DEFAULT '',
+		expires_at TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '有效',
+		created_by TEXT NOT NULL DEFAULT '',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createCouponsTableSQL); err != nil {
+		log.Fatalf("创建 coupons 表失败: %s\n", err)
+	}
+
+	createCouponRedemptionsTableSQL := `
+	CREATE TABLE IF NOT EXISTS coupon_redemptions (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		code TEXT NOT NULL,
+		account TEXT NOT NULL,
+		ref_type TEXT NOT NULL,
+		ref_id INTEGER NOT NULL,
+		original_amount REAL NOT NULL,
+		discount REAL NOT NULL,
+		status TEXT NOT NULL DEFAULT '有效',
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createCouponRedemptionsTableSQL); err != nil {
+		log.Fatalf("创建 coupon_redemptions 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_coupon_redemptions_code ON coupon_redemptions (code, account)`); err != nil {
+		log.Fatalf("创建 coupon_redemptions 索引失败: %s\n", err)
+	}
+	addColumnIfMissing(db, "coupon_redemptions", "member", "TEXT NOT NULL DEFAULT ''")
+
+	// 交易订单记录使用的优惠码，买家只需支付原价减去优惠，差额由平台补给卖家
+	addColumnIfMissing(db, "trade_orders", "coupon_code", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "trade_orders", "discount", "REAL NOT NULL DEFAULT 0")
+}
+
+// 订单或指令里附带的 “优惠码XXX”
+var couponCodeRe = regexp.MustCompile(`，优惠码([A-Za-z0-9]+)$`)
+
+func couponCodeFrom(content string) string {
+	if matches := couponCodeRe.FindStringSubmatch(content); len(matches) > 0 {
+		return strings.ToUpper(matches[1])
+	}
+	return ""
+}
+
+func getCoupon(db sqlQueryRower, code string) (*Coupon, error) {
+	var c Coupon
+	err := db.QueryRow(`SELECT code, percent_off, amount_off, min_spend, per_user_limit, total_limit, applies_to, scope, expires_at, status,
+		(SELECT COUNT(*) FROM coupon_redemptions WHERE code = coupons.code AND status = ?)
+	FROM coupons WHERE code = ?`, couponActive, code).Scan(&c.Code, &c.PercentOff, &c.AmountOff, &c.MinSpend, &c.PerUserLimit,
+		&c.TotalLimit, &c.AppliesTo, &c.Scope, &c.ExpiresAt, &c.Status, &c.Used)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("优惠码%s不存在", code)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// 检查优惠码能否用于这笔订单并计算优惠金额，amount 为原价。
+// 在建单的事务中再调用一次，避免并发下单时超出使用次数
+func checkCoupon(db sqlQueryRower, use couponUse, appliesTo, scope string, amount float64) (*Coupon, float64, error) {
+	code := use.Code
+	c, err := getCoupon(db, code)
+	if err != nil {
+		return nil, 0, err
+	}
+	if c.Status != couponActive {
+		return nil, 0, fmt.Errorf("优惠码%s已停用", code)
+	}
+	if c.ExpiresAt != "" && c.ExpiresAt <= time.Now().UTC().Format("2006-01-02 15:04:05") {
+		return nil, 0, fmt.Errorf("优惠码%s已过期", code)
+	}
+	if c.AppliesTo != "" && c.AppliesTo != appliesTo {
+		return nil, 0, fmt.Errorf("优惠码%s只能用于%s", code, c.AppliesTo)
+	}
+	if c.Scope != "" && c.Scope != scope {
+		return nil, 0, fmt.Errorf("优惠码%s只能用于%s", code, c.Scope)
+	}
+	if amount < c.MinSpend {
+		return nil, 0, fmt.Errorf("优惠码%s需满%s才能使用", code, formatPromotionNumber(c.MinSpend))
+	}
+	if c.TotalLimit > 0 && c.Used >= c.TotalLimit {
+		return nil, 0, fmt.Errorf("优惠码%s已被领完", code)
+	}
+	if c.PerUserLimit > 0 {
+		if use.Member == "" {
+			return nil, 0, fmt.Errorf("优惠码%s每人限用%d次，需要机器人给您设置备注名后才能使用，请联系管理员", code, c.PerUserLimit)
+		}
+		var used int
+		if err := db.QueryRow(`SELECT COUNT(*) FROM coupon_redemptions WHERE code = ? AND member = ? AND status = ?`,
+			code, use.Member, couponActive).Scan(&used); err != nil {
+			return nil, 0, err
+		}
+		if used >= c.PerUserLimit {
+			return nil, 0, fmt.Errorf("您已用过%d次优惠码%s", used, code)
+		}
+	}
+
+	discount := c.AmountOff
+	if c.PercentOff > 0 {
+		discount = amount * c.PercentOff
+	}
+	return c, roundCents(math.Min(discount, amount)), nil
+}
+
+func recordCouponRedemption(tx *sql.Tx, use couponUse, account, refType string, refID int, amount, discount float64) error {
+	_, err := tx.Exec(`INSERT INTO coupon_redemptions (code, account, member, ref_type, ref_id, original_amount, discount) VALUES (?, ?, ?, ?, ?, ?, ?)`,
+		use.Code, account, use.Member, refType, refID, amount, discount)
+	return err
+}
+
+// 订单取消或全额撤单后作废使用记录，用户可以再次使用
+func voidCouponRedemption(db sqlExecer, refType string, refID int) error {
+	_, err := db.Exec(`UPDATE coupon_redemptions SET status = ? WHERE ref_type = ? AND ref_id = ? AND status = ?`,
+		couponVoided, refType, refID, couponActive)
+	return err
+}
+
+// 交易订单完成时，平台承担优惠部分，卖家仍按原价结算，补贴部分由 settleTradeOrder 记为优惠券补贴
+func postCouponSubsidy(tx *sql.Tx, order *TradeOrder) error {
+	if order.Discount <= 0 {
+		return nil
+	}
+	memo := fmt.Sprintf("交易单%d号 优惠码%s", order.ID, order.CouponCode)
+	_, err := postWalletEntry(tx, platformAccount, -order.Discount, "优惠券支出", "trade_order", order.ID, memo)
+	return err
+}
+
+// 优惠规则的文字说明，例如 “满100减10，每人1次，限上星”
+func (c *Coupon) rule() string {
+	rule := fmt.Sprintf("减%s", formatPromotionNumber(c.AmountOff))
+	if c.PercentOff > 0 {
+		rule = fmt.Sprintf("%s折", formatPromotionNumber(roundCents((1-c.PercentOff)*10)))
+	}
+	if c.MinSpend > 0 {
+		rule = fmt.Sprintf("满%s%s", formatPromotionNumber(c.MinSpend), rule)
+	}
+	if c.PerUserLimit > 0 {
+		rule += fmt.Sprintf("，每人%d次", c.PerUserLimit)
+	}
+	if c.TotalLimit > 0 {
+		rule += fmt.Sprintf("，共%d次", c.TotalLimit)
+	}
+	if c.AppliesTo != "" {
+		rule += "，限" + c.AppliesTo
+		if c.Scope != "" {
+			rule += "：" + c.Scope
+		}
+	}
+	if c.ExpiresAt != "" {
+		expires, _ := time.ParseInLocation("2006-01-02 15:04:05", c.ExpiresAt, time.UTC)
+		rule += fmt.Sprintf("，%s前有效", expires.Local().Format("2006-01-02 15:04"))
+	}
+	return rule
+}
+
+var (
+	addCouponRe     = regexp.MustCompile(`^添加优惠码([A-Za-z0-9]+)，(?:打)?(\d+(?:\.\d+)?折|减\d+(?:\.\d+)?)((?:，.+)*)$`)
+	disableCouponRe = regexp.MustCompile(`^停用优惠码([A-Za-z0-9]+)$`)
+)
+
+func isCouponAdminCommand(content string) bool {
+	return content == "优惠码列表" || addCouponRe.MatchString(content) || disableCouponRe.MatchString(content)
+}
+
+// 管理员优惠码命令：
+// 添加优惠码[码]，[9折|减10][，满N][，至YYYY-MM-DD][，每人N次][，共N次][，交易[：分类]|上星[：类型]]
+// 停用优惠码[码]、优惠码列表
+func handleCouponAdmin(msg *openwechat.Message, db *sql.DB, admin string) {
+	switch {
+	case msg.Content == "优惠码列表":
+		listCoupons(msg, db)
+
+	case addCouponRe.MatchString(msg.Content):
+		c, err := parseCoupon(addCouponRe.FindStringSubmatch(msg.Content))
+		if err != nil {
+			msg.ReplyText(err.Error())
+			return
+		}
+		_, err = db.Exec(`INSERT INTO coupons (code, percent_off, amount_off, min_spend, per_user_limit, total_limit, applies_to, scope, expires_at, created_by)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`, c.Code, c.PercentOff, c.AmountOff, c.MinSpend, c.PerUserLimit, c.TotalLimit, c.AppliesTo, c.Scope, c.ExpiresAt, admin)
+		if err != nil {
+			log.Printf("保存优惠码失败: %v\n", err)
+			msg.ReplyText(fmt.Sprintf("保存优惠码失败，%s可能已存在。", c.Code))
+			return
+		}
+		writeAuditLog(db, admin, "添加优惠码", c.Code, "", c.rule(), "")
+		msg.ReplyText(fmt.Sprintf("已添加优惠码%s：%s", c.Code, c.rule()))
+
+	case disableCouponRe.MatchString(msg.Content):
+		code := strings.ToUpper(disableCouponRe.FindStringSubmatch(msg.Content)[1])
+		result, err := db.Exec(`UPDATE coupons SET status = ? WHERE code = ? AND status = ?`, couponDisabled, code, couponActive)
+		if err != nil {
+			log.Printf("停用优惠码失败: %v\n", err)
+			msg.ReplyText("停用优惠码失败，请稍后重试。")
+			return
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			msg.ReplyText(fmt.Sprintf("优惠码%s不存在或已停用。", code))
+			return
+		}
+		writeAuditLog(db, admin, "停用优惠码", code, couponActive, couponDisabled, "")
+		msg.ReplyText(fmt.Sprintf("优惠码%s已停用。", code))
+	}
+}
+
+func parseCoupon(matches []string) (*Coupon, error) {
+	c := &Coupon{Code: strings.ToUpper(matches[1]), Status: couponActive}
+	if strings.HasSuffix(matches[2], "折") {
+		rate, _ := strconv.ParseFloat(strings.TrimSuffix(matches[2], "折"), 64)
+		if rate <= 0 || rate >= 10 {
+			return nil, fmt.Errorf("折扣必须在0到10折之间，例如“9折”、“8.5折”。")
+		}
+		c.PercentOff = roundCents(1 - rate/10)
+	} else {
+		c.AmountOff, _ = strconv.ParseFloat(strings.TrimPrefix(matches[2], "减"), 64)
+		if c.AmountOff <= 0 {
+			return nil, fmt.Errorf("减免金额必须大于0。")
+		}
+	}
+
+	for _, option := range strings.Split(strings.TrimPrefix(matches[3], "，"), "，") {
+		option = strings.TrimSpace(option)
+		var n int
+		switch {
+		case option == "":
+		case strings.HasPrefix(option, "满"):
+			minSpend, err := strconv.ParseFloat(strings.TrimPrefix(option, "满"), 64)
+			if err != nil || minSpend <= 0 {
+				return nil, fmt.Errorf("最低消费格式错误：%s", option)
+			}
+			c.MinSpend = minSpend
+		case strings.HasPrefix(option, "至"):
+			day, err := time.ParseInLocation("2006-1-2", strings.TrimPrefix(option, "至"), time.Local)
+			if err != nil {
+				return nil, fmt.Errorf("有效期格式错误，请按照 '至2024-06-30' 的格式输入。")
+			}
+			// 有效期包含当天
+			expires := day.AddDate(0, 0, 1)
+			if expires.Before(time.Now()) {
+				return nil, fmt.Errorf("有效期已经过去。")
+			}
+			c.ExpiresAt = expires.UTC().Format("2006-01-02 15:04:05")
+		case strings.HasPrefix(option, "每人"):
+			if _, err := fmt.Sscanf(option, "每人%d次", &n); err != nil || n <= 0 {
+				return nil, fmt.Errorf("每人次数格式错误：%s", option)
+			}
+			c.PerUserLimit = n
+		case strings.HasPrefix(option, "共"):
+			if _, err := fmt.Sscanf(option, "共%d次", &n); err != nil || n <= 0 {
+				return nil, fmt.Errorf("总次数格式错误：%s", option)
+			}
+			c.TotalLimit = n
+		case strings.HasPrefix(option, couponTrade), strings.HasPrefix(option, couponBridge):
+			parts := strings.SplitN(option, "：", 2)
+			c.AppliesTo = parts[0]
+			if c.AppliesTo != couponTrade && c.AppliesTo != couponBridge {
+				return nil, fmt.Errorf("适用范围只能是“交易[：分类]”或“上星[：类型]”。")
+			}
+			if len(parts) == 2 {
+				c.Scope = strings.TrimSpace(parts[1])
+			}
+			if c.AppliesTo == couponBridge && c.Scope != "" {
+				if _, ok := config.BridgePrices[c.Scope]; !ok {
+					return nil, fmt.Errorf("没有“%s”这个上星类型，可选类型：%s", c.Scope, strings.Join(bridgeOrderTypes(), "、"))
+				}
+			}
+		default:
+			return nil, fmt.Errorf("无法识别的优惠码选项：%s，可选“满N”、“至YYYY-MM-DD”、“每人N次”、“共N次”、“交易：分类”或“上星：类型”。", option)
+		}
+	}
+	return c, nil
+}
+
+func listCoupons(msg *openwechat.Message, db *sql.DB) {
+	rows, err := db.Query(`SELECT c.code, c.percent_off, c.amount_off, c.min_spend, c.per_user_limit, c.total_limit, c.applies_to, c.scope, c.expires_at, c.status,
+		COUNT(r.id), IFNULL(SUM(r.discount), 0)
+	FROM coupons c LEFT JOIN coupon_redemptions r ON r.code = c.code AND r.status = ?
+	GROUP BY c.code ORDER BY c.created_at DESC LIMIT 20`, couponActive)
+	if err != nil {
+		msg.ReplyText("获取优惠码时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var c Coupon
+		var discounted float64
+		if err := rows.Scan(&c.Code, &c.PercentOff, &c.AmountOff, &c.MinSpend, &c.PerUserLimit, &c.TotalLimit, &c.AppliesTo, &c.Scope,
+			&c.ExpiresAt, &c.Status, &c.Used, &discounted); err != nil {
+			continue
+		}
+		response.WriteString(fmt.Sprintf("%s：%s，%s，已用%d次共优惠%.2f\n", c.Code, c.rule(), c.Status, c.Used, discounted))
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("还没有优惠码。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 每人限用次数按备注名计算，改名不能重新使用，没有备注名时不能用限次的优惠码
+func TestCouponPerUserLimitByRemark(t *testing.T) {
+	db := newTestDB(t)
+	if _, err := db.Exec(`INSERT INTO coupons (code, amount_off, per_user_limit) VALUES ('ONCE', 5, 1), ('ANY', 5, 0)`); err != nil {
+		t.Fatalf("添加优惠码失败: %v", err)
+	}
+	item := addTestTradeItem(t, db, "卖家", 50, 5)
+	if _, err := createTradeOrder(db, item, "买家", "", "", couponUse{Code: "ONCE", Member: "会员-买家"}); err != nil {
+		t.Fatalf("第一次使用应成功: %v", err)
+	}
+	if _, err := createTradeOrder(db, item, "买家改名", "", "", couponUse{Code: "ONCE", Member: "会员-买家"}); err == nil {
+		t.Fatal("改名后备注名不变，不应再次使用")
+	}
+	if _, _, err := checkCoupon(db, couponUse{Code: "ONCE", Member: "会员-别人"}, couponTrade, "", 50); err != nil {
+		t.Fatalf("别人应能使用: %v", err)
+	}
+	_, _, err := checkCoupon(db, couponUse{Code: "ONCE"}, couponTrade, "", 50)
+	if err == nil || !strings.Contains(err.Error(), "备注名") {
+		t.Fatalf("没有备注名时不能使用限次的优惠码: %v", err)
+	}
+	if _, _, err := checkCoupon(db, couponUse{Code: "ANY"}, couponTrade, "", 50); err != nil {
+		t.Fatalf("不限次的优惠码不需要备注名: %v", err)
+	}
+}
+
+// 平台补给卖家的优惠部分计入余额，但不能提现
+func TestCouponSubsidyNotWithdrawable(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Commission = CommissionConfig{CommissionRule: CommissionRule{Rate: 0.05}}
+
+	db := newTestDB(t)
+	if _, err := db.Exec(`INSERT INTO coupons (code, amount_off) VALUES ('OFF10', 10)`); err != nil {
+		t.Fatalf("添加优惠码失败: %v", err)
+	}
+	item := addTestTradeItem(t, db, "卖家", 100, 1)
+	order, err := createTradeOrder(db, item, "买家", "", "", couponUse{Code: "OFF10"})
+	if err != nil {
+		t.Fatalf("创建订单失败: %v", err)
+	}
+	addTestRechargeCode(t, db, "6001", 90)
+	if err := payTradeOrder(db, order, "6001", "买家"); err != nil {
+		t.Fatalf("付款失败: %v", err)
+	}
+	order, _ = getTradeOrderByID(db, order.ID)
+	if err := completeTradeOrder(db, order); err != nil {
+		t.Fatalf("完成订单失败: %v", err)
+	}
+
+	// 原价100，佣金5，卖家共得95，其中10是平台补贴
+	balance, _ := getWalletBalance(db, "卖家")
+	withdrawable, _ := getWithdrawableAmount(db, "卖家")
+	if balance != 95 || withdrawable != 85 {
+		t.Fatalf("卖家余额应为95、可提现85，实际为%.2f、%.2f", balance, withdrawable)
+	}
+	if platform, _ := getWalletBalance(db, platformAccount); platform != -5 {
+		t.Fatalf("平台应收佣金5、支出补贴10，实际余额%.2f", platform)
+	}
+}
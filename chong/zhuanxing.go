@@ -0,0 +1,341 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/eatmoreapple/openwechat"
+)
+
+// 会员之间转星卷的限制
+type TransferConfig struct {
+	MinAmount   float64 `json:"min_amount"`   // 单笔最少转多少星卷
+	DailyAmount float64 `json:"daily_amount"` // 每人 24 小时内最多转出多少星卷，0 表示不限
+	DailyCount  int     `json:"daily_count"`  // 每人 24 小时内最多转出几笔，0 表示不限
+}
+
+// 转星卷状态
+const (
+	transferPending   = "待确认"
+	transferCompleted = "已完成"
+	transferCancelled = "已取消"
+	transferExpired   = "已过期"
+
+	// 发起后多少分钟内需要确认
+	transferConfirmMinutes = 5
+)
+
+// 每笔转星卷一条记录，确认后双方各记一笔钱包流水，ref_type 为 star_transfer
+func initTransferTables(db *sql.DB) {
+	createStarTransfersTableSQL := `
+	CREATE TABLE IF NOT EXISTS star_transfers (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		sender TEXT NOT NULL,
+		receiver TEXT NOT NULL,
+		amount REAL NOT NULL,
+		group_name TEXT NOT NULL DEFAULT '',
+		status TEXT NOT NULL DEFAULT '待确认',
+		created_at TEXT NOT NULL DEFAULT (datetime('now')),
+		confirmed_at TEXT NOT NULL DEFAULT ''
+	);`
+	if _, err := db.Exec(createStarTransfersTableSQL); err != nil {
+		log.Fatalf("创建 star_transfers 表失败: %s\n", err)
+	}
+	if _, err := db.Exec(`CREATE INDEX IF NOT EXISTS idx_star_transfers_sender ON star_transfers (sender, status, created_at)`); err != nil {
+		log.Fatalf("创建 star_transfers 索引失败: %s\n", err)
+	}
+	addColumnIfMissing(db, "star_transfers", "sender_remark", "TEXT NOT NULL DEFAULT ''")
+
+	// 钱包按昵称记账，改成别人的昵称就能动别人的钱包。转出时按机器人给的备注名认人，
+	// 钱包第一次转出时绑定转出人的备注名，以后只有同一备注名才能从这个钱包转出
+	createWalletOwnersTableSQL := `
+	CREATE TABLE IF NOT EXISTS wallet_owners (
+		account TEXT PRIMARY KEY,
+		remark TEXT NOT NULL,
+		created_at TEXT NOT NULL DEFAULT (datetime('now'))
+	);`
+	if _, err := db.Exec(createWalletOwnersTableSQL); err != nil {
+		log.Fatalf("创建 wallet_owners 表失败: %s\n", err)
+	}
+}
+
+// 检查转出人能否动用这个钱包：必须有机器人设置的备注名，钱包已绑定时备注名要一致
+func checkWalletOwner(db sqlQueryRower, account, remark string) error {
+	if remark == "" {
+		return fmt.Errorf("转星卷需要先由机器人给您设置备注名，请联系管理员。")
+	}
+	var owner string
+	err := db.QueryRow(`SELECT remark FROM wallet_owners WHERE account = ?`, account).Scan(&owner)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("查询钱包信息失败，请稍后重试。")
+	}
+	if owner != remark {
+		log.Printf("[%s] 的钱包已绑定备注名 [%s]，拒绝备注名 [%s] 转出\n", account, owner, remark)
+		return fmt.Errorf("%s的钱包已绑定其他微信，不能转出。", account)
+	}
+	return nil
+}
+
+// 群聊里 @昵称 后面是微信插入的 U+2005 空格，私聊直接写昵称
+var starTransferRe = regexp.MustCompile(`^转星卷\s*@?(.+?)[\s\x{2005}]+(\d+(?:\.\d{1,2})?)$`)
+
+func isStarTransferCommand(content string) bool {
+	return strings.HasPrefix(content, "转星卷") || content == "确认转星卷" || content == "取消转星卷" || content == "转星卷记录"
+}
+
+// 处理转星卷相关命令，qun 为 nil 表示私聊。发起、确认和取消都核对机器人给发送者的备注名
+func handleStarTransferCommand(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, user *openwechat.User, qun *openwechat.User) {
+	sender := user.NickName
+	switch msg.Content {
+	case "确认转星卷":
+		confirmStarTransfer(msg, db, self, sender, friendRemark(self, user))
+	case "取消转星卷":
+		cancelStarTransfer(msg, db, sender, friendRemark(self, user))
+	case "转星卷记录":
+		listStarTransfers(msg, db, sender)
+	default:
+		requestStarTransfer(msg, db, self, sender, friendRemark(self, user), qun)
+	}
+}
+
+// 处理 "转星卷 @某人 N"（群聊）或 "转星卷 昵称 N"（私聊），先记一笔待确认的转账
+func requestStarTransfer(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, sender, remark string, qun *openwechat.User) {
+	if err := checkWalletOwner(db, sender, remark); err != nil {
+		msg.ReplyText(err.Error())
+		return
+	}
+	matches := starTransferRe.FindStringSubmatch(strings.TrimSpace(msg.Content))
+	if len(matches) == 0 {
+		msg.ReplyText("指令格式错误，请在群里发送 '转星卷 @某人 数量'，或私聊发送 '转星卷 昵称 数量'，例如：转星卷 @张三 10")
+		return
+	}
+	receiver := strings.TrimSpace(matches[1])
+	amount, _ := strconv.ParseFloat(matches[2], 64)
+	if receiver == sender {
+		msg.ReplyText("不能给自己转星卷。")
+		return
+	}
+	if amount < config.Transfer.MinAmount || amount <= 0 {
+		msg.ReplyText(fmt.Sprintf("单笔至少转%.2f星卷。", config.Transfer.MinAmount))
+		return
+	}
+	if isBanned(db, receiver) {
+		msg.ReplyText(fmt.Sprintf("%s的账户已被封禁，不能接收星卷。", receiver))
+		return
+	}
+
+	// 群里只能转给本群成员，私聊只能转给机器人的好友，避免昵称写错转给别人
+	groupName := ""
+	if qun != nil {
+		groupName = qun.NickName
+		group, ok := qun.AsGroup()
+		if !ok {
+			return
+		}
+		if members := groupMemberNicks(group); !members[receiver] {
+			msg.ReplyText(fmt.Sprintf("本群没有找到%s，请 @ 对方后重试。", receiver))
+			return
+		}
+	} else if _, err := findFriendByNickName(self, receiver); err != nil {
+		msg.ReplyText(fmt.Sprintf("没有找到好友%s，请确认昵称正确且对方已添加机器人为好友。", receiver))
+		return
+	}
+
+	if err := checkTransferLimits(db, sender, amount); err != nil {
+		msg.ReplyText(err.Error())
+		return
+	}
+	balance, err := getWalletBalance(db, sender)
+	if err != nil {
+		msg.ReplyText("获取钱包信息时发生错误，请稍后重试。")
+		return
+	}
+	if balance < amount {
+		msg.ReplyText(fmt.Sprintf("钱包余额%.2f星卷，不足以转出%.2f星卷。", balance, amount))
+		return
+	}
+
+	// 同一个人只保留最新一笔待确认的转账
+	if _, err := db.Exec(`UPDATE star_transfers SET status = ? WHERE sender = ? AND status = ?`, transferCancelled, sender, transferPending); err != nil {
+		log.Printf("取消旧的待确认转星卷失败: %v\n", err)
+	}
+	if _, err := db.Exec(`INSERT INTO star_transfers (sender, sender_remark, receiver, amount, group_name) VALUES (?, ?, ?, ?, ?)`,
+		sender, remark, receiver, amount, groupName); err != nil {
+		log.Printf("保存转星卷失败: %v\n", err)
+		msg.ReplyText("转星卷失败，请稍后重试。")
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("%s确认要向%s转%.2f星卷吗？请在%d分钟内发送“确认转星卷”完成转账，发送“取消转星卷”放弃。转出后无法撤回。",
+		sender, receiver, amount, transferConfirmMinutes))
+}
+
+// 24 小时内已完成的转出笔数和金额不能超过配置的上限
+func checkTransferLimits(db sqlQueryRower, sender string, amount float64) error {
+	if config.Transfer.DailyAmount <= 0 && config.Transfer.DailyCount <= 0 {
+		return nil
+	}
+	var count int
+	var total float64
+	if err := db.QueryRow(`SELECT COUNT(*), IFNULL(SUM(amount), 0) FROM star_transfers
+	WHERE sender = ? AND status = ? AND confirmed_at >= datetime('now', '-1 day')`, sender, transferCompleted).Scan(&count, &total); err != nil {
+		return fmt.Errorf("查询转星卷额度失败，请稍后重试。")
+	}
+	if config.Transfer.DailyCount > 0 && count >= config.Transfer.DailyCount {
+		return fmt.Errorf("24小时内最多转出%d笔星卷，请稍后再试。", config.Transfer.DailyCount)
+	}
+	if config.Transfer.DailyAmount > 0 && total+amount > config.Transfer.DailyAmount {
+		return fmt.Errorf("24小时内最多转出%.2f星卷，当前还可以转%.2f星卷。", config.Transfer.DailyAmount, roundCents(config.Transfer.DailyAmount-total))
+	}
+	return nil
+}
+
+type starTransfer struct {
+	ID           int
+	Sender       string
+	SenderRemark string
+	Receiver     string
+	Amount       float64
+	GroupName    string
+	Status       string
+	CreatedAt    string
+}
+
+// 发起人最新一笔未过期的待确认转账，过期的顺便标记为已过期
+func pendingStarTransfer(db *sql.DB, sender string) (*starTransfer, error) {
+	if _, err := db.Exec(`UPDATE star_transfers SET status = ? WHERE sender = ? AND status = ? AND created_at < datetime('now', ?)`,
+		transferExpired, sender, transferPending, fmt.Sprintf("-%d minutes", transferConfirmMinutes)); err != nil {
+		return nil, err
+	}
+	var t starTransfer
+	err := db.QueryRow(`SELECT id, sender, sender_remark, receiver, amount, group_name, status, created_at FROM star_transfers
+	WHERE sender = ? AND status = ? ORDER BY id DESC LIMIT 1`, sender, transferPending).Scan(
+		&t.ID, &t.Sender, &t.SenderRemark, &t.Receiver, &t.Amount, &t.GroupName, &t.Status, &t.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// 处理 "确认转星卷"，扣款、入账和状态更新在同一个事务里
+func confirmStarTransfer(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, sender, remark string) {
+	t, err := pendingStarTransfer(db, sender)
+	if err != nil {
+		log.Printf("查询待确认转星卷失败: %v\n", err)
+		msg.ReplyText("获取转星卷信息时发生错误，请稍后重试。")
+		return
+	}
+	if t == nil {
+		msg.ReplyText(fmt.Sprintf("没有待确认的转星卷，或已超过%d分钟，请重新发起。", transferConfirmMinutes))
+		return
+	}
+
+	balance, err := executeStarTransfer(db, t, remark)
+	if err != nil {
+		msg.ReplyText(fmt.Sprintf("转星卷失败：%v", err))
+		return
+	}
+	msg.ReplyText(fmt.Sprintf("%s已向%s转出%.2f星卷，钱包余额%.2f星卷。", t.Sender, t.Receiver, t.Amount, balance))
+	notice := fmt.Sprintf("%s向您转入%.2f星卷，发送“我的钱包”查看余额。", t.Sender, t.Amount)
+	if err := sendTextToNickName(self, t.Receiver, notice); err != nil {
+		log.Printf("通知 [%s] 收到星卷失败: %v\n", t.Receiver, err)
+	}
+}
+
+// 只有发起时的同一备注名可以确认，第一次转出时把钱包绑定到这个备注名
+func executeStarTransfer(db *sql.DB, t *starTransfer, remark string) (float64, error) {
+	if remark == "" || remark != t.SenderRemark {
+		return 0, fmt.Errorf("只能由发起人确认转星卷")
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	if err := checkWalletOwner(tx, t.Sender, remark); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO wallet_owners (account, remark) VALUES (?, ?) ON CONFLICT(account) DO NOTHING`, t.Sender, remark); err != nil {
+		return 0, err
+	}
+
+	// 确认前可能已经转出过其他笔，额度在事务里再检查一次
+	if err := checkTransferLimits(tx, t.Sender, t.Amount); err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(`UPDATE star_transfers SET status = ?, confirmed_at = datetime('now') WHERE id = ? AND status = ? AND created_at >= datetime('now', ?)`,
+		transferCompleted, t.ID, transferPending, fmt.Sprintf("-%d minutes", transferConfirmMinutes))
+	if err != nil {
+		return 0, err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return 0, fmt.Errorf("该笔转星卷已处理或已超过%d分钟", transferConfirmMinutes)
+	}
+	balance, err := postWalletEntry(tx, t.Sender, -t.Amount, "转出星卷", "star_transfer", t.ID, "转给"+t.Receiver)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := postWalletEntry(tx, t.Receiver, t.Amount, "转入星卷", "star_transfer", t.ID, "来自"+t.Sender); err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	return balance, nil
+}
+
+func cancelStarTransfer(msg *openwechat.Message, db *sql.DB, sender, remark string) {
+	result, err := db.Exec(`UPDATE star_transfers SET status = ? WHERE sender = ? AND sender_remark = ? AND status = ?`,
+		transferCancelled, sender, remark, transferPending)
+	if err != nil {
+		msg.ReplyText("取消转星卷失败，请稍后重试。")
+		return
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		msg.ReplyText("没有待确认的转星卷。")
+		return
+	}
+	msg.ReplyText("已取消转星卷。")
+}
+
+// 处理 "转星卷记录"，转出和转入都显示
+func listStarTransfers(msg *openwechat.Message, db *sql.DB, nick string) {
+	rows, err := db.Query(`SELECT id, sender, receiver, amount, group_name, status, created_at FROM star_transfers
+	WHERE (sender = ? OR receiver = ?) AND status = ? ORDER BY id DESC LIMIT 20`, nick, nick, transferCompleted)
+	if err != nil {
+		msg.ReplyText("获取转星卷记录时发生错误，请稍后重试。")
+		return
+	}
+	defer rows.Close()
+
+	var response strings.Builder
+	for rows.Next() {
+		var t starTransfer
+		if err := rows.Scan(&t.ID, &t.Sender, &t.Receiver, &t.Amount, &t.GroupName, &t.Status, &t.CreatedAt); err != nil {
+			continue
+		}
+		line := fmt.Sprintf("%s 转给%s -%.2f", t.CreatedAt, t.Receiver, t.Amount)
+		if t.Receiver == nick {
+			line = fmt.Sprintf("%s 来自%s +%.2f", t.CreatedAt, t.Sender, t.Amount)
+		}
+		if t.GroupName != "" {
+			line += "（" + t.GroupName + "）"
+		}
+		response.WriteString(line + "\n")
+	}
+	if response.Len() == 0 {
+		msg.ReplyText("还没有转星卷记录。")
+		return
+	}
+	msg.ReplyText(strings.TrimRight(response.String(), "\n"))
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"testing"
+)
+
+// 直接记一笔待确认的转星卷，minutesAgo 为发起距今的分钟数
+func addTestStarTransfer(t *testing.T, db *sql.DB, sender, remark, receiver string, amount float64, minutesAgo int) *starTransfer {
+	t.Helper()
+	result, err := db.Exec(`INSERT INTO star_transfers (sender, sender_remark, receiver, amount, created_at) VALUES (?, ?, ?, ?, datetime('now', ?))`,
+		sender, remark, receiver, amount, fmt.Sprintf("-%d minutes", minutesAgo))
+	if err != nil {
+		t.Fatalf("发起转星卷失败: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	return &starTransfer{ID: int(id), Sender: sender, SenderRemark: remark, Receiver: receiver, Amount: amount, Status: transferPending}
+}
+
+func transferStatus(t *testing.T, db *sql.DB, id int) string {
+	t.Helper()
+	var status string
+	if err := db.QueryRow(`SELECT status FROM star_transfers WHERE id = ?`, id).Scan(&status); err != nil {
+		t.Fatalf("查询转星卷失败: %v", err)
+	}
+	return status
+}
+
+func TestExecuteStarTransfer(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "小明", 100, "兑换码充值")
+	transfer := addTestStarTransfer(t, db, "小明", "会员-小明", "小红", 30, 0)
+
+	balance, err := executeStarTransfer(db, transfer, "会员-小明")
+	if err != nil {
+		t.Fatalf("转星卷失败: %v", err)
+	}
+	received, _ := getWalletBalance(db, "小红")
+	if balance != 70 || received != 30 || transferStatus(t, db, transfer.ID) != transferCompleted {
+		t.Fatalf("转出后余额应为70、对方30，实际为%.2f、%.2f", balance, received)
+	}
+	var entries int
+	db.QueryRow(`SELECT COUNT(*) FROM wallet_entries WHERE ref_type = 'star_transfer' AND ref_id = ?`, transfer.ID).Scan(&entries)
+	if entries != 2 {
+		t.Fatalf("双方应各有1笔流水，实际共%d笔", entries)
+	}
+
+	// 重复确认不能再扣一次
+	if _, err := executeStarTransfer(db, transfer, "会员-小明"); err == nil {
+		t.Fatal("同一笔转星卷不能确认两次")
+	}
+	if balance, _ := getWalletBalance(db, "小明"); balance != 70 {
+		t.Fatalf("重复确认后余额应仍为70，实际为%.2f", balance)
+	}
+}
+
+// 改成别人的昵称也动不了别人的钱包
+func TestStarTransferRequiresSameRemark(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "小明", 100, "兑换码充值")
+
+	if err := checkWalletOwner(db, "小明", ""); err == nil {
+		t.Fatal("没有备注名时不能转出")
+	}
+	first := addTestStarTransfer(t, db, "小明", "会员-小明", "小红", 10, 0)
+	if _, err := executeStarTransfer(db, first, "会员-冒充"); err == nil {
+		t.Fatal("只能由发起人确认")
+	}
+	if _, err := executeStarTransfer(db, first, "会员-小明"); err != nil {
+		t.Fatalf("转星卷失败: %v", err)
+	}
+
+	// 钱包已绑定会员-小明，改名成小明的人不能再发起
+	if err := checkWalletOwner(db, "小明", "会员-冒充"); err == nil {
+		t.Fatal("备注名不符不能从钱包转出")
+	}
+	forged := addTestStarTransfer(t, db, "小明", "会员-冒充", "冒充者", 50, 0)
+	if _, err := executeStarTransfer(db, forged, "会员-冒充"); err == nil {
+		t.Fatal("备注名不符的转星卷不能确认")
+	}
+	if balance, _ := getWalletBalance(db, "小明"); balance != 90 {
+		t.Fatalf("余额应为90，实际为%.2f", balance)
+	}
+}
+
+func TestStarTransferLimitsRecheckedOnConfirm(t *testing.T) {
+	saved := config
+	t.Cleanup(func() { config = saved })
+	config.Transfer = TransferConfig{DailyCount: 1}
+
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "小明", 100, "兑换码充值")
+	pending := addTestStarTransfer(t, db, "小明", "会员-小明", "小红", 10, 0)
+	if err := checkTransferLimits(db, "小明", 10); err != nil {
+		t.Fatalf("发起时还有额度: %v", err)
+	}
+	// 确认前另一笔已经完成，用掉了今天的额度
+	done := addTestStarTransfer(t, db, "小明", "会员-小明", "小刚", 10, 0)
+	if _, err := executeStarTransfer(db, done, "会员-小明"); err != nil {
+		t.Fatalf("转星卷失败: %v", err)
+	}
+	if _, err := executeStarTransfer(db, pending, "会员-小明"); err == nil {
+		t.Fatal("确认时应重新检查额度")
+	}
+	if transferStatus(t, db, pending.ID) != transferPending {
+		t.Fatal("超出额度的转星卷不应完成")
+	}
+}
+
+func TestStarTransferInsufficientBalance(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "小明", 10, "兑换码充值")
+	transfer := addTestStarTransfer(t, db, "小明", "会员-小明", "小红", 20, 0)
+
+	if _, err := executeStarTransfer(db, transfer, "会员-小明"); err == nil {
+		t.Fatal("余额不足时不能转出")
+	}
+	balance, _ := getWalletBalance(db, "小明")
+	received, _ := getWalletBalance(db, "小红")
+	if balance != 10 || received != 0 || transferStatus(t, db, transfer.ID) != transferPending {
+		t.Fatalf("失败的转星卷应整体回滚，余额%.2f、对方%.2f", balance, received)
+	}
+}
+
+func TestStarTransferExpires(t *testing.T) {
+	db := newTestDB(t)
+	postTestWalletEntry(t, db, "小明", 100, "兑换码充值")
+	stale := addTestStarTransfer(t, db, "小明", "会员-小明", "小红", 10, transferConfirmMinutes+1)
+
+	// 读到待确认之后才过期，确认时也要拒绝
+	if _, err := executeStarTransfer(db, stale, "会员-小明"); err == nil {
+		t.Fatal("过期的转星卷不能确认")
+	}
+	if pending, err := pendingStarTransfer(db, "小明"); err != nil || pending != nil {
+		t.Fatalf("过期后不应再有待确认的转星卷: %+v %v", pending, err)
+	}
+	if transferStatus(t, db, stale.ID) != transferExpired {
+		t.Fatal("过期的转星卷应标记为已过期")
+	}
+	if balance, _ := getWalletBalance(db, "小明"); balance != 100 {
+		t.Fatalf("余额应不变，实际为%.2f", balance)
+	}
+}
@@ -33,6 +33,13 @@ type TradeItem struct {
     Price          float64 `db:"price"`          // 交易品价格
     Quantity       int     `db:"quantity"`       // 交易品数量
     ImageFileName  string  `db:"image_file_name"`// 交易品图片文件名，可选
+    Category       string  `db:"category"`       // 交易品分类，可选
+    Tags           string  `db:"tags"`           // 交易品标签，顿号分隔
+    MarketGroup    string  `db:"market_group"`   // 发布交易品的群聊昵称，为空表示公共交易区
+    Status         string  `db:"status"`         // 在售、已下架、已过期
+    UpdatedAt      string  `db:"updated_at"`     // 最后修改或上架时间
+
+    SellerReputation Reputation `db:"-"`        // 卖家信誉，展示时查询
 }
 
 type appmsg struct {
@@ -59,18 +66,26 @@ func initDB() *sql.DB {
 	if err != nil {
 		log.Fatalf("打开数据库失败: %s\n", err)
 	}
+	initSchema(db)
+	return db
+}
 
+// 建表并补齐新增的列，测试里也用它初始化临时数据库
+func initSchema(db *sql.DB) {
 	// 创建充值记录表
 	createRechargeRecordsTable := `
 	CREATE TABLE IF NOT EXISTS recharge_records (
 		id INTEGER PRIMARY KEY AUTOINCREMENT,
 		amount REAL NOT NULL,
 		recharge_code TEXT NOT NULL UNIQUE,
-		used INTEGER NOT NULL DEFAULT 0  -- 0: 未使用, 1: 已使用
+		used INTEGER NOT NULL DEFAULT 0  -- 0: 未使用, 1: 已使用, 2: 已退款作废, 3: 退款审核中
 	);`
 	if _, err := db.Exec(createRechargeRecordsTable); err != nil {
 		log.Fatalf("创建充值记录表失败: %s\n", err)
 	}
+	addColumnIfMissing(db, "recharge_records", "payer", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "recharge_records", "transfer_id", "TEXT NOT NULL DEFAULT ''")
+	addColumnIfMissing(db, "recharge_records", "created_at", "TEXT NOT NULL DEFAULT ''")
     // 创建 trade_items 表
     createTradeItemsTableSQL := `
     CREATE TABLE IF NOT EXISTS trade_items (
@@ -94,12 +109,56 @@ func initDB() *sql.DB {
         StarsCount INTEGER,
         PRIMARY KEY (GroupID, UserName)
     );`
-    _, err = db.Exec(createMemberStarsTableSQL)
-    if err != nil {
+    if _, err := db.Exec(createMemberStarsTableSQL); err != nil {
         log.Fatalf("创建 member_stars 表失败: %s\n", err)
     }
+    initMarketTables(db)
+    initTradeItemStatus(db)
+    initTradeOrderTables(db)
+    initReviewTables(db)
+    initDisputeTables(db)
+    initWalletTables(db)
+    initCommissionColumns(db)
+    initPayoutTables(db)
+    initRefundTables(db)
+    initReconciliationTables(db)
+    initAdminTables(db)
+    initWebhookTables(db)
+    initPriceListTables(db)
+    initBridgeTables(db)
+    initBoosterTables(db)
+    initProgressTables(db)
+    initLeaderboardTables(db)
+    initTierTables(db)
+    initPromotionTables(db)
+    initCouponTables(db)
+    initReferralTables(db)
+    initTransferTables(db)
+}
 
-    return db
+// 为已存在的表补充新增的列
+func addColumnIfMissing(db *sql.DB, table, column, definition string) {
+    rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+    if err != nil {
+        log.Fatalf("读取 %s 表结构失败: %s\n", table, err)
+    }
+    defer rows.Close()
+    for rows.Next() {
+        var cid, notNull, pk int
+        var name, colType string
+        var defaultValue sql.NullString
+        if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+            log.Fatalf("读取 %s 表结构失败: %s\n", table, err)
+        }
+        if name == column {
+            return
+        }
+    }
+    rows.Close()
+
+    if _, err := db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition)); err != nil {
+        log.Fatalf("为 %s 表添加 %s 列失败: %s\n", table, column, err)
+    }
 }
 
 func generateRechargeCode() string {
@@ -133,6 +192,15 @@ func extractAmountFromXML(content string) float64 {
 	return amount
 }
 
+// 从 XML 消息中提取微信转账单号，退款时需要
+func extractTransferIDFromXML(content string) string {
+	var msg Msg
+	if err := xml.Unmarshal([]byte(content), &msg); err != nil {
+		return ""
+	}
+	return msg.AppMsg.WcpayInfo.TransferId
+}
+
 func main() {
 	bot := openwechat.DefaultBot(openwechat.Desktop) // 使用桌面模式
 	// 创建热存储容器对象，用于保存和加载登录会话信息
@@ -160,7 +228,8 @@ func main() {
         return
     }
 
-	// 初始化数据库
+	// 读取配置并初始化数据库
+	loadConfig("config.json")
 	db := initDB()
 	defer db.Close()
 	// 获取所有的好友
@@ -176,14 +245,37 @@ func main() {
 		fmt.Println(err)
 	}
 	fmt.Println("群组数量：", len(groups))
+	if err := bindGroupMarkets(db, groups); err != nil {
+		log.Printf("绑定群聊交易区失败: %v\n", err)
+	}
+	// 定时下架过期的交易品
+	go runPeriodically("交易品过期检查", time.Hour, func() { expireTradeItems(db, self) })
+	if config.SettlementIntervalHours > 0 {
+		go runPeriodically("结算批次", time.Duration(config.SettlementIntervalHours)*time.Hour, func() { runSettlementBatch(db, self) })
+	}
+	if config.DailyReconciliation {
+		go runPeriodically("每日对账", time.Hour, func() { runDailyReconciliation(db, self) })
+	}
+	// 后台网页看板
+	go startWebServer(db)
+	go runPeriodically("定时价格表", time.Minute, func() { applyScheduledPriceLists(db) })
+	if config.BridgeClaimTimeoutHours > 0 {
+		go runPeriodically("打手超时重新派单", 10*time.Minute, func() { requeueStaleBridges(db, self) })
+	}
+	if len(config.LeaderboardGroups) > 0 {
+		go runPeriodically("每周排行榜", time.Hour, func() { postWeeklyLeaderboards(db, self) })
+	}
+	if len(config.Webhooks) > 0 {
+		go runPeriodically("Webhook 投递", 5*time.Second, func() { deliverPendingWebhooks(db) })
+	}
 	// 注册消息处理函数
 	bot.MessageHandler = func(msg *openwechat.Message) {
 		if msg.IsSendByFriend() {
-			handlePrivateMessage(msg, db)
+			handlePrivateMessage(msg, db, self)
 		} else if msg.IsSendByGroup() {
             handleGroupMessage(msg, db, self) // 确保这里的self是*openwechat.Self类型的实例
 		} else {
-			handleOtherMessage(msg, db)
+			handleOtherMessage(msg, db, self)
 		}
 	}
 
@@ -192,24 +284,47 @@ func main() {
 }
 
 // 处理私聊消息
-func handlePrivateMessage(msg *openwechat.Message, db *sql.DB) {
+func handlePrivateMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Self) {
     // 获取消息发送者的信息
     sender, err := msg.Sender()
     if err != nil {
         log.Printf("获取群信息失败: %s\n", err)
         return
     }  
-    if msg.Content == "价格表" {
-        // 从数据库中获取当前的赛事信息
-        eventText := getCurrentEventFromDB(db)
-        fmt.Println("查询到的价格信息:", eventText) // 添加日志
-        msg.ReplyText(eventText)
+    if isBanned(db, sender.NickName) {
+        return
+    }
+    // 资金类管理命令除了昵称还要核对备注名，防止有人把昵称改成管理员的名字
+    if isAdmin(sender.NickName) && isMoneyAdminCommand(msg.Content) && !isTrustedAdmin(sender) {
+        msg.ReplyText("资金类管理命令需要机器人把您的备注名设置为 admin_remarks 中的名字后才能使用。")
+        return
+    }
+    // 管理员取证期间转发的消息记为申诉证据
+    if isAdmin(sender.NickName) && collectDisputeEvidence(msg, db, sender.NickName) {
+        return
+    }
+    // 管理后台命令优先于同名的用户命令，例如管理员可以下架任何人的交易品
+    if isAdmin(sender.NickName) && isAdminConsoleCommand(msg.Content) {
+        handleAdminConsole(msg, db, self, sender.NickName)
+        return
+    }
+    if isAdmin(sender.NickName) && isPriceListAdminCommand(msg.Content) {
+        handlePriceListAdmin(msg, db, "", sender.NickName)
+        return
+    }
+    if strings.HasPrefix(msg.Content, "价格表") {
+        // 私聊查看全局价格表
+        handlePriceList(msg, db, "")
         return
     }
-    if msg.Content == "我的历史" {
+    if strings.HasPrefix(msg.Content, "我的历史") {
         handleUserHistory(msg, db, sender.NickName)
         return
     }
+    // 打手更新进度后发来的截图
+    if msg.IsPicture() && attachProgressScreenshot(msg, db, self, sender.NickName) {
+        return
+    }
     if msg.IsPicture() {
         // 假设 getPendingTradeItem 函数可以获取用户未添加图片的交易品
         tradeItem, err := getPendingTradeItem(db, sender.NickName)
@@ -244,29 +359,58 @@ func handlePrivateMessage(msg *openwechat.Message, db *sql.DB) {
 		fmt.Printf(msg.Content)
         amount := extractAmountFromXML(msg.Content)
         fmt.Printf("收到转账，金额：%.2f\n", amount)
+        var rechargeCode string
         if amount != 0{
 			// 生成唯一的充值码
-			rechargeCode := generateRechargeCode()
+			rechargeCode = generateRechargeCode()
 			
 			// 将转账金额和充值码记录到数据库中
-			insertRechargeRecord(db, amount, rechargeCode)
+			transferID := extractTransferIDFromXML(msg.Content)
+			if err := insertRechargeRecord(db, amount, rechargeCode, sender.NickName, transferID); err != nil {
+				log.Printf("记录兑换码失败: %v\n", err)
+			}
 			
 			// 向用户发送确认消息和兑换码
 			msg.ReplyText(fmt.Sprintf("兑换码：%s", rechargeCode))
-			msg.ReplyText(fmt.Sprintf("请复制上面这句话发送到微信群中获取星卷。"))
+			msg.ReplyText(fmt.Sprintf("请复制上面这句话发送到交易群中完成付款；要存入钱包开单，请发送“钱包充值：%s”。", rechargeCode))
 		}
+		// 所有转账消息都记录下来，供每日对账
+		recordTransferLog(db, msg.Content, sender.NickName, "", rechargeCode)
     }
     
     if msg.Content == "帮助" {
         helpMessage := `命令指南:
     - "帮助": 显示此帮助信息。
+    - "价格表" / "价格表[名称]": 查看价格表；"价格表列表": 查看所有价格表。
     - "创建交易品，名称，价格，数量[，描述]": 创建一个新的交易品。描述为可选项。
     - "我的交易品": 查询你创建的交易品列表。
+    - "修改交易品[交易ID]号，价格：[价格]，数量：[数量]，描述：[描述]": 修改自己的交易品，字段可任选。
+    - "下架[交易ID]号" / "上架[交易ID]号": 下架或重新上架自己的交易品，过期的交易品可重新上架。
     - "交易区": 浏览当前可用的交易品列表。
-    - "交易区：[]": 浏览当前[指定名字]可用的交易品列表。
-    - "交易[交易ID]号": 交易[指定ID]号的交易品
+    - "交易区：[]": 浏览当前[指定名字或标签]可用的交易品列表。
+    - "分类": 查看交易品分类；"分类：[类别]": 浏览指定分类的交易品。
+    - "设置分类[交易ID]号，类别[，标签1、标签2]": 为自己的交易品设置分类和标签。
+    - "交易[交易ID]号[，优惠码XXX]": 交易[指定ID]号的交易品，机器人会自动创建交易群，可附带优惠码抵扣价格。
     - "开始交易[交易ID]号，名称：[名称]，价格：[价格]，描述：[描述]": 在群聊中启动一个交易。请确保交易ID正确。
     - "兑换码：[充值码]": 使用兑换码完成充值交易支付。
+    - "钱包充值：[充值码]": 把兑换码存入钱包，用于开单和转星卷，可参加充值活动。
+    - "确认收货" / "取消交易": 在交易群中完成或取消订单。
+    - "评价[交易单号]号，[1-5分]，[评价内容]": 交易完成后为对方评分，评价内容可选。
+    - "信誉" / "信誉：[昵称]": 查看自己或指定用户的评分和成交数。
+    - "佣金[价格][，分类]": 上架前查看成交后平台收取的佣金和实得金额。
+    - "我的钱包": 查看钱包余额和最近的收支记录。
+    - "转星卷 [昵称] [数量]": 把钱包星卷转给好友，在群里发送“转星卷 @某人 数量”转给群成员；发起后发送“确认转星卷”完成，“转星卷记录”查看转入转出记录。转出需要机器人给您设置过备注名。
+    - "提现[金额]": 申请把交易收入提现到微信，不填金额则提现全部可提现金额；充值、赠送和转入的星卷不能提现。
+    - "退款[兑换码]，[理由]": 申请退还未使用的兑换码，审核通过后原路退款。
+    - "开单[类型]，[游戏ID]，[星数][，优惠码XXX]": 用钱包星卷下上星订单，可附带优惠码；"上星订单": 查看进行中的订单进度。
+    - "进度[订单号]号": 查看上星订单的进度记录和最新截图。
+    - "我的等级": 查看会员等级、累计兑换金额和等级权益。
+    - "充值活动": 查看正在进行的充值赠送活动，在群里发送只显示本群可参加的活动。
+    - "我的邀请码": 查看自己的邀请码和邀请奖励；新用户加好友时在验证消息里填写，或发送“邀请码[邀请码]”绑定邀请人。
+    - "排行榜[ 本周/本月/总榜]": 查看摘星榜、星卷榜和卖家榜，在群里发送只统计本群。
+    - "我的历史 [本月/上月/2024-05/2024-05-01~2024-05-31] [类型] [第N页]": 分页查看上星历史和合计；末尾加“导出”或“图片”获取全部记录。
+    - "撤单[订单号]号": 撤销还没有开始上星的订单，星卷全额退回钱包。
+    - "申诉[交易单号]号，[理由]": 付款后卖家未交付时申诉，订单会被冻结并交由管理员处理；在交易群中直接发送“申诉，[理由]”。
     
     请根据指令格式发送消息，确保信息的正确性。`
     
@@ -274,6 +418,11 @@ func handlePrivateMessage(msg *openwechat.Message, db *sql.DB) {
     }
     
 
+    if matches := walletRechargeRe.FindStringSubmatch(msg.Content); len(matches) > 0 {
+        handleWalletRecharge(msg, db, self, sender, "", matches[1])
+        return
+    }
+
     if strings.HasPrefix(msg.Content, "充值") {
         // 提取金额文本
         rechargeAmountMatch := regexp.MustCompile(`充值(\d+(\.\d+)?)`).FindStringSubmatch(msg.Content)
@@ -286,16 +435,20 @@ func handlePrivateMessage(msg *openwechat.Message, db *sql.DB) {
                 return
             }
             // 根据金额查询对应的充值码
-            rechargeCode, err := getRechargeCodeByAmount(db, amount)
+            rechargeCode, err := getRechargeCodeByAmount(db, amount, sender.NickName)
             if err != nil {
-                msg.ReplyText("未找到对应金额的充值码，或已被使用。")
+                msg.ReplyText("未找到您转账的该金额充值码，或已被使用。")
                 return
             }
             msg.ReplyText(fmt.Sprintf("兑换码：%s，请复制上面这句话发送到微信群中获取星卷。", rechargeCode))
         }
     }
+    booster := ""
+    if isBoosterCommand(msg.Content) {
+        booster = verifiedBooster(db, self, sender)
+    }
     switch {
-    case strings.HasPrefix(msg.Content, "交易"):
+    case strings.HasPrefix(msg.Content, "交易，"):
         parts := strings.Split(msg.Content, "，")
         if len(parts) >= 4 && len(parts) <= 6 { // 允许4个到6个部分
             sellerName := parts[1]
@@ -319,13 +472,13 @@ func handlePrivateMessage(msg *openwechat.Message, db *sql.DB) {
             }
     
             // 插入新的交易品到数据库
-            err = insertTradeItem(db, sellerName, itemName, description, price, quantity)
+            err = insertTradeItem(db, sellerName, itemName, description, price, quantity, "")
             if err != nil {
                 msg.ReplyText(fmt.Sprintf("创建交易品失败：%v", err))
                 return
             }
     
-            msg.ReplyText(fmt.Sprintf("交易品%s创建完成！请创建新群聊并且将二维码发到此微信以便于进行交易", itemName))
+            msg.ReplyText(fmt.Sprintf("交易品%s创建完成！有买家下单时机器人会自动拉交易群。%s", itemName, commissionNotice(price, "")))
         } else {
             msg.ReplyText("交易品信息不完整，请按照格式输入：'交易，卖家名称，名称，价格[，数量][，描述]'")
         }
@@ -337,11 +490,113 @@ func handlePrivateMessage(msg *openwechat.Message, db *sql.DB) {
         return
 	case strings.HasPrefix(msg.Content, "交易区"):
 		// 处理 “交易区” 命令
-		handleTradeZone(msg, db)
+		handleTradeZone(msg, db, "")
         return
 	case regexp.MustCompile(`^交易\d+`).MatchString(msg.Content):
 		// 以 "交易" 开头且紧跟数字的特殊命令
-		handleSpecificTradeItem(msg, db)
+		handleSpecificTradeItem(msg, db, self, sender, "")
+        return
+	case strings.HasPrefix(msg.Content, "设置分类"):
+		handleSetCategory(msg, db, sender.NickName)
+        return
+	case strings.HasPrefix(msg.Content, "修改交易品"):
+		handleEditTradeItem(msg, db, sender.NickName)
+        return
+	case regexp.MustCompile(`^[上下]架\d+号$`).MatchString(msg.Content):
+		handleListTradeItem(msg, db, sender.NickName)
+        return
+	case strings.HasPrefix(msg.Content, "分类"):
+		handleCategories(msg, db, "")
+        return
+	case strings.HasPrefix(msg.Content, "评价"):
+		handleReview(msg, db, sender.NickName)
+        return
+	case strings.HasPrefix(msg.Content, "信誉"):
+		handleReputation(msg, db, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && (msg.Content == "申诉列表" || msg.Content == "结束取证" ||
+		strings.HasPrefix(msg.Content, "取证") || strings.HasPrefix(msg.Content, "裁决")):
+		handleDisputeAdmin(msg, db, self, sender.NickName)
+        return
+	case strings.HasPrefix(msg.Content, "申诉"):
+		handleDispute(msg, db, self, nil, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && strings.HasPrefix(msg.Content, "佣金报表"):
+		handleCommissionReport(msg, db)
+        return
+	case strings.HasPrefix(msg.Content, "佣金"):
+		handleCommissionPreview(msg)
+        return
+	case isAdmin(sender.NickName) && (msg.Content == "提现列表" || msg.Content == "生成结算批次" ||
+		strings.HasPrefix(msg.Content, "批准提现") || strings.HasPrefix(msg.Content, "拒绝提现") || strings.HasPrefix(msg.Content, "已支付")):
+		handlePayoutAdmin(msg, db, self, sender.NickName)
+        return
+	case msg.Content == "我的钱包":
+		handleMyWallet(msg, db, sender.NickName)
+        return
+	case strings.HasPrefix(msg.Content, "提现"):
+		handlePayoutRequest(msg, db, self, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && (msg.Content == "退款列表" || strings.HasPrefix(msg.Content, "批准退款") ||
+		strings.HasPrefix(msg.Content, "拒绝退款") || strings.HasPrefix(msg.Content, "已退款")):
+		handleRefundAdmin(msg, db, self, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && (msg.Content == "Webhook失败列表" || msg.Content == "测试Webhook" || strings.HasPrefix(msg.Content, "重放Webhook")):
+		handleWebhookAdmin(msg, db)
+        return
+	case isAdmin(sender.NickName) && strings.HasPrefix(msg.Content, "对账"):
+		handleReconciliation(msg, db)
+        return
+	case strings.HasPrefix(msg.Content, "退款"):
+		handleRefundRequest(msg, db, self, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && isBridgeAdminCommand(msg.Content):
+		handleBridgeAdmin(msg, db, self, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && isBoosterAdminCommand(msg.Content):
+		handleBoosterAdmin(msg, db, self, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && isPromotionAdminCommand(msg.Content):
+		handlePromotionAdmin(msg, db, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && isCouponAdminCommand(msg.Content):
+		handleCouponAdmin(msg, db, sender.NickName)
+        return
+	case isAdmin(sender.NickName) && msg.Content == "邀请列表":
+		listReferrals(msg, db)
+        return
+	case booster != "":
+		handleBoosterCommand(msg, db, self, booster)
+        return
+	case strings.HasPrefix(msg.Content, "开单"):
+		handleOpenBridge(msg, db, self, sender)
+        return
+	case msg.Content == "上星订单":
+		listBridges(msg, db, sender.NickName)
+        return
+	case bridgeTimelineRe.MatchString(msg.Content):
+		handleBridgeTimeline(msg, db, sender.NickName)
+        return
+	case strings.HasPrefix(msg.Content, "排行榜"):
+		handleLeaderboard(msg, db, nil)
+        return
+	case msg.Content == "我的等级":
+		handleMyTier(msg, db, sender.NickName)
+        return
+	case msg.Content == "充值活动":
+		listPromotions(msg, db, "", false)
+        return
+	case msg.Content == "我的邀请码":
+		handleMyReferral(msg, db, sender)
+        return
+	case isStarTransferCommand(msg.Content):
+		handleStarTransferCommand(msg, db, self, sender, nil)
+        return
+	case strings.HasPrefix(msg.Content, "邀请码"):
+		handleBindReferral(msg, db, self, sender, "")
+        return
+	case strings.HasPrefix(msg.Content, "撤单"):
+		handleCancelOwnBridge(msg, db, sender.NickName)
         return
 	}
 }
@@ -358,7 +613,45 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
         log.Printf("获取群内消息发送者信息失败: %s\n", err)
         return
     }
+    if isBanned(db, sender.NickName) {
+        return
+    }
 
+    // 机器人创建的交易群，处理付款、确认收货、取消交易和申诉
+    order, err := getTradeOrderByGroup(db, qun)
+    if err != nil {
+        log.Printf("查询交易群订单失败: %s\n", err)
+    }
+    if order != nil {
+        // 交易群中的消息都留档，申诉时提供给管理员
+        logTradeOrderMessage(db, order, sender.NickName, msg)
+        if msg.IsPicture() {
+            return
+        }
+        if matches := regexp.MustCompile(`^兑换码：(\d+)$`).FindStringSubmatch(msg.Content); len(matches) > 0 {
+            if err := payTradeOrder(db, order, matches[1], sender.NickName); err != nil {
+                msg.ReplyText(fmt.Sprintf("付款失败: %v", err))
+                return
+            }
+            msg.ReplyText(fmt.Sprintf("买家已付款 %.2f 元，请卖家%s交付交易品，买家收到后发送“确认收货”。", order.amountDue(), order.Seller))
+            checkTierChange(db, self, sender.NickName)
+            notifyReferralReward(db, self, sender.NickName)
+            return
+        }
+        if msg.Content == "确认收货" || msg.Content == "取消交易" {
+            handleTradeGroupCommand(msg, db, self, qun, sender, order)
+            return
+        }
+        if strings.HasPrefix(msg.Content, "申诉") {
+            handleDispute(msg, db, self, order, sender.NickName)
+            return
+        }
+    }
+
+    // 打手更新进度后发来的截图
+    if msg.IsPicture() && attachProgressScreenshot(msg, db, self, sender.NickName) {
+        return
+    }
     if msg.IsPicture() {
         // 假设 getPendingTradeItem 函数可以获取用户未添加图片的交易品
         tradeItem, err := getPendingTradeItem(db, sender.NickName)
@@ -389,7 +682,7 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
     
         msg.ReplyText(fmt.Sprintf("交易品%s的图片已更新，请耐心等待用户购买，输入”我的交易品“可以查看", tradeItem.ItemName))
     }
-    
+
     // 处理 "开始交易" 指令
     tradeStartRegexpStr := `^开始交易(\d+)号，名称：(.+)，价格：(\d+(\.\d+)?)，描述：\s*(.*)$`
     tradeStartRe := regexp.MustCompile(tradeStartRegexpStr)
@@ -406,6 +699,11 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
             msg.ReplyText("交易绑定失败，请重试。")
             return
         }
+        // 手动建群的交易同样记录订单，但不绑定这个普通群，群里的消息不按订单处理。
+        // 带优惠码的交易不会退回手动流程，这里的订单不使用优惠码
+        if tradeItem, err := getTradeItemByID(db, tradeID); err == nil && tradeItem != nil {
+            createTradeOrder(db, tradeItem, sender.NickName, "", "", couponUse{})
+        }
 
         // 回复提示信息
         msg.ReplyText("现在开始交易，请买家扫描下方二维码联系微信转账，进行下一步指示")
@@ -428,6 +726,11 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
         return // 结束函数，防止执行后续的代码
     }
 
+    if matches := walletRechargeRe.FindStringSubmatch(msg.Content); len(matches) > 0 {
+        handleWalletRecharge(msg, db, self, sender, qun.NickName, matches[1])
+        return
+    }
+
         // 处理 "兑换码" 指令
     rechargeCodeRegexpStr := `^兑换码：(\d+)$`
     rechargeCodeRe := regexp.MustCompile(rechargeCodeRegexpStr)
@@ -455,14 +758,16 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
             return
         }
 
-        // 兑换充值码
-        amount, err := redeemRechargeCode(db, rechargeCode)
+        // 普通群里的兑换码只用于确认交易付款，不进钱包
+        amount, err := confirmTradeTransfer(db, rechargeCode, sender.NickName, qun.NickName)
         if err != nil {
             msg.ReplyText(fmt.Sprintf("处理兑换码出错: %v", err))
             return
         }
 
         msg.ReplyText(fmt.Sprintf("用户已转账 %.2f 元，请进行下一步交易。", amount))
+        checkTierChange(db, self, sender.NickName)
+        notifyReferralReward(db, self, sender.NickName)
         return // 结束函数，防止执行后续的代码
     }
 
@@ -470,6 +775,7 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
         fmt.Printf(msg.Content)
         amount := extractAmountFromXML(msg.Content)
         fmt.Printf("收到群内转账，金额：%.2f\n", amount)
+        recordTransferLog(db, msg.Content, sender.NickName, qun.NickName, "")
         
         // 查找消息发送者是否在群组中
         groups, err := self.Groups()
@@ -490,8 +796,12 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
         }
         msg.ReplyText(fmt.Sprintf("用户已转账 %.2f 元，请进行下一步交易。", amount))
     }
+    booster := ""
+    if isBoosterCommand(msg.Content) {
+        booster = verifiedBooster(db, self, sender)
+    }
     switch {
-    case strings.HasPrefix(msg.Content, "交易"):
+    case strings.HasPrefix(msg.Content, "交易，"):
         parts := strings.Split(msg.Content, "，")
         if len(parts) >= 3 && len(parts) <= 5 { // 允许3个到5个部分
             itemName := parts[1]
@@ -513,14 +823,18 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
                 description = parts[4]
             }
     
+            marketGroup, ok := marketGroupOrReply(msg, db, qun)
+            if !ok {
+                return
+            }
             // 插入新的交易品到数据库
-            err = insertTradeItem(db, sender.NickName, itemName, description, price, quantity)
+            err = insertTradeItem(db, sender.NickName, itemName, description, price, quantity, marketGroup)
             if err != nil {
                 msg.ReplyText(fmt.Sprintf("创建交易品失败：%v", err))
                 return
             }
     
-            msg.ReplyText(fmt.Sprintf("交易品%s创建完成！请创建新群聊并且将二维码发到此微信以便于进行交易", itemName))
+            msg.ReplyText(fmt.Sprintf("交易品%s创建完成！有买家下单时机器人会自动拉交易群。%s", itemName, commissionNotice(price, "")))
         } else {
             msg.ReplyText("交易品信息不完整，请按照格式输入：'交易，名称，价格[，数量][，描述]'")
         }
@@ -530,32 +844,107 @@ func handleGroupMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Se
 		// 处理 “我的交易品” 命令
 		handleMyTradeItems(msg, db, sender.NickName)
 	
-	case strings.HasPrefix(msg.Content, "交易区"):
-		// 处理 “交易区” 命令
-		handleTradeZone(msg, db)
+	case isAdmin(sender.NickName) && isPriceListAdminCommand(msg.Content):
+		// 群里设置的价格表只在本群生效
+		handlePriceListAdmin(msg, db, qun.NickName, sender.NickName)
+	case strings.HasPrefix(msg.Content, "价格表"):
+		handlePriceList(msg, db, qun.NickName)
+	case strings.HasPrefix(msg.Content, "交易区"), msg.Content == "全部交易区":
+		// 处理 “交易区” 命令，默认展示本群交易区
+		if marketGroup, ok := marketGroupOrReply(msg, db, qun); ok {
+			handleTradeZone(msg, db, marketGroup)
+		}
 	
 	case regexp.MustCompile(`^交易\d+`).MatchString(msg.Content):
 		// 以 "交易" 开头且紧跟数字的特殊命令
-		handleSpecificTradeItem(msg, db)
+		if marketGroup, ok := marketGroupOrReply(msg, db, qun); ok {
+			handleSpecificTradeItem(msg, db, self, sender, marketGroup)
+		}
+
+	case strings.HasPrefix(msg.Content, "设置分类"):
+		handleSetCategory(msg, db, sender.NickName)
+
+	case strings.HasPrefix(msg.Content, "修改交易品"):
+		handleEditTradeItem(msg, db, sender.NickName)
+
+	case regexp.MustCompile(`^[上下]架\d+号$`).MatchString(msg.Content):
+		handleListTradeItem(msg, db, sender.NickName)
+
+	case strings.HasPrefix(msg.Content, "分类"):
+		if marketGroup, ok := marketGroupOrReply(msg, db, qun); ok {
+			handleCategories(msg, db, marketGroup)
+		}
+
+	case strings.HasPrefix(msg.Content, "评价"):
+		handleReview(msg, db, sender.NickName)
+
+	case strings.HasPrefix(msg.Content, "信誉"):
+		handleReputation(msg, db, sender.NickName)
+
+	case regexp.MustCompile(`^佣金\d`).MatchString(msg.Content):
+		handleCommissionPreview(msg)
+
+	case msg.Content == "市场设为私有", msg.Content == "市场设为公开":
+		handleMarketPrivacy(msg, db, qun, sender.NickName)
+
+	case booster != "":
+		// 打手群里接单和更新进度，按备注名认人，改成打手的昵称没有用
+		handleBoosterCommand(msg, db, self, booster)
+
+	case bridgeTimelineRe.MatchString(msg.Content):
+		handleBridgeTimeline(msg, db, sender.NickName)
+
+	case strings.HasPrefix(msg.Content, "排行榜"):
+		handleLeaderboard(msg, db, qun)
+
+	case msg.Content == "充值活动":
+		listPromotions(msg, db, qun.NickName, false)
+
+	case strings.HasPrefix(msg.Content, "邀请码"):
+		// 新成员进群后发送邀请码绑定邀请人
+		handleBindReferral(msg, db, self, sender, qun.NickName)
+
+	case isStarTransferCommand(msg.Content):
+		handleStarTransferCommand(msg, db, self, sender, qun)
     }	
 }
 
-// 处理其他消息，例如转账和红包消息
-func handleOtherMessage(msg *openwechat.Message, db *sql.DB) {
-   return
+// 处理其他消息，例如转账、红包和好友申请
+func handleOtherMessage(msg *openwechat.Message, db *sql.DB, self *openwechat.Self) {
+   if msg.IsFriendAdd() {
+       acceptReferralFriend(msg, db, self)
+   }
 }
 
 // 将转账金额和兑换码记录到数据库中
-func insertRechargeRecord(db *sql.DB, amount float64, rechargeCode string) error {
-    // 向数据库的充值记录表插入一条记录
-    _, err := db.Exec("INSERT INTO recharge_records (amount, recharge_code, used) VALUES (?, ?, 0)", amount, rechargeCode)
-    return err
+func insertRechargeRecord(db *sql.DB, amount float64, rechargeCode, payer, transferID string) error {
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
+
+    // 向数据库的充值记录表插入一条记录，付款人和转账单号用于退款
+    if _, err := tx.Exec("INSERT INTO recharge_records (amount, recharge_code, used, payer, transfer_id, created_at) VALUES (?, ?, 0, ?, ?, datetime('now'))",
+        amount, rechargeCode, payer, transferID); err != nil {
+        return err
+    }
+    if err := emitEvent(tx, eventCodeIssued, map[string]interface{}{
+        "code": rechargeCode, "amount": amount, "payer": payer, "transfer_id": transferID,
+    }); err != nil {
+        return err
+    }
+    return tx.Commit()
 }
 
-func getRechargeCodeByAmount(db *sql.DB, amount float64) (string, error) {
+// 补发自己转账得到的兑换码，只查付款人是本人的记录，没有付款人的兑换码不补发
+func getRechargeCodeByAmount(db *sql.DB, amount float64, payer string) (string, error) {
+    if payer == "" {
+        return "", sql.ErrNoRows
+    }
     var rechargeCode string
     // 根据金额查询对应的充值码
-    err := db.QueryRow("SELECT recharge_code FROM recharge_records WHERE amount = ? AND used = 0 LIMIT 1", amount).Scan(&rechargeCode)
+    err := db.QueryRow("SELECT recharge_code FROM recharge_records WHERE amount = ? AND used = 0 AND payer = ? ORDER BY id LIMIT 1", amount, payer).Scan(&rechargeCode)
     if err != nil {
         // 如果没有找到记录或查询出错，返回错误
         return "", err
@@ -616,8 +1005,8 @@ func processRechargeCode(db *sql.DB, groupID string, rechargeCode int, buyerNick
     }
 
     // 最后，更新兑换码为已使用，更新交易项的买家信息
-    updateCodeSQL := `UPDATE recharge_records SET used = 1 WHERE recharge_code = ?`
-    _, err = db.Exec(updateCodeSQL, rechargeCode)
+    updateCodeSQL := `UPDATE recharge_records SET used = 1, used_at = datetime('now'), redeemed_by = ? WHERE recharge_code = ?`
+    _, err = db.Exec(updateCodeSQL, buyerNickname, rechargeCode)
     if err != nil {
         log.Printf("更新兑换码为已使用时出错: %v", err)
         return err  
@@ -657,8 +1046,8 @@ func handleMyTradeItems(msg *openwechat.Message, db *sql.DB, seller string) {
         }
 
         // 根据需要调整消息格式
-        replyMsg := fmt.Sprintf("交易品ID：%d，名称：%s，价格：%.2f，描述：%s，数量：%d，已售出：%d",
-            item.ID, item.ItemName, item.Price, item.Description, item.Quantity, soldOut)
+        replyMsg := fmt.Sprintf("交易品ID：%d，名称：%s，价格：%.2f，描述：%s，数量：%d，已售出：%d，状态：%s",
+            item.ID, item.ItemName, item.Price, item.Description, item.Quantity, soldOut, item.Status)
         msg.ReplyText(replyMsg)
         // 如果有图片，也发送图片
         if item.ImageFileName != "" {
@@ -668,36 +1057,59 @@ func handleMyTradeItems(msg *openwechat.Message, db *sql.DB, seller string) {
     }
 }
 
-func handleTradeZone(msg *openwechat.Message, db *sql.DB) {
-    var content string
+// marketGroup 为空表示在私聊中浏览，展示所有公开的交易品
+func handleTradeZone(msg *openwechat.Message, db *sql.DB, marketGroup string) {
+    filter := tradeItemFilter{MarketGroup: marketGroup, AllMarkets: marketGroup == ""}
 
     // 检查命令是否以 "交易区：" 开头
     if strings.HasPrefix(msg.Content, "交易区：") {
-        content = strings.TrimPrefix(msg.Content, "交易区：")
+        filter.Keyword = strings.TrimPrefix(msg.Content, "交易区：")
+    } else if msg.Content == "全部交易区" {
+        filter.AllMarkets = true
     } else if strings.HasPrefix(msg.Content, "交易区") { // 或者只是 "交易区"
-        content = ""
+        filter.Keyword = ""
     } else {
         // 如果既不是 "交易区：" 也不是 "交易区"，则可能是其他命令或消息
         return
     }
 
-    tradeItems, err := getAvailableTradeItems(db, content) // content 可能是空字符串，表示不过滤名称
+    tradeItems, err := getAvailableTradeItems(db, filter)
     if err != nil {
         msg.ReplyText("获取交易区信息时发生错误，请稍后重试。")
         return
     }
+    replyTradeItems(msg, db, tradeItems)
+}
 
+// 以目录图片（失败时以文字）回复交易品列表
+func replyTradeItems(msg *openwechat.Message, db *sql.DB, tradeItems []TradeItem) {
     if len(tradeItems) == 0 {
         msg.ReplyText("当前没有可用的交易品。")
         return
     }
+    attachSellerReputation(db, tradeItems)
+
+    // 优先以目录图片的形式展示交易品
+    pages, err := renderTradeCatalog(tradeItems)
+    if err == nil {
+        for _, page := range pages {
+            if _, err = msg.ReplyImage(page); err != nil {
+                break
+            }
+        }
+    }
+    if err == nil {
+        msg.ReplyText("发送“交易[交易ID]号”购买对应的交易品")
+        return
+    }
+    log.Printf("发送交易区目录图片失败，改为文字展示: %v\n", err)
 
     // 在消息开始处添加分隔符
     msg.ReplyText("————交易区————")
 
     for _, item := range tradeItems {
         // 使用指定格式构建回复消息
-        replyMsg := fmt.Sprintf("%d号---%s（%s），价：%.2f", item.ID, item.ItemName, item.Description, item.Price)
+        replyMsg := fmt.Sprintf("%d号---%s（%s），价：%.2f，卖家：%s %s", item.ID, item.ItemName, item.Description, item.Price, item.Seller, item.SellerReputation)
         msg.ReplyText(replyMsg)
     }
 
@@ -705,7 +1117,8 @@ func handleTradeZone(msg *openwechat.Message, db *sql.DB) {
     msg.ReplyText("————交易区————")
 }
 
-func handleSpecificTradeItem(msg *openwechat.Message, db *sql.DB) {
+// 买家下单：创建订单并自动拉卖家和买家进交易群
+func handleSpecificTradeItem(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, buyer *openwechat.User, marketGroup string) {
     var tradeID int
     _, err := fmt.Sscanf(msg.Content, "交易%d号", &tradeID)
     if err != nil {
@@ -719,15 +1132,45 @@ func handleSpecificTradeItem(msg *openwechat.Message, db *sql.DB) {
         return
     }
 
-    if tradeItem == nil {
+    if tradeItem == nil || tradeItem.Status != tradeItemOnSale || !canAccessTradeItem(db, tradeItem, marketGroup) {
         msg.ReplyText("未找到指定的交易品。")
         return
     }
 
+    // 优惠码不可用时直接提示，不进入手动交易流程
+    coupon := couponUse{Code: couponCodeFrom(msg.Content), Member: friendRemark(self, buyer)}
+    if coupon.Code != "" {
+        if _, _, err := checkCoupon(db, coupon, couponTrade, tradeItem.Category, tradeItem.Price); err != nil {
+            msg.ReplyText(fmt.Sprintf("无法使用优惠码：%v", err))
+            return
+        }
+    }
+
+    items := []TradeItem{*tradeItem}
+    attachSellerReputation(db, items)
+    tradeItem = &items[0]
+    order, err := openTradeOrder(db, self, tradeItem, buyer.NickName, coupon)
+    if err == nil {
+        msg.ReplyText(fmt.Sprintf("已创建交易单%d号并拉您和卖家进入交易群“%s”，请在群内完成交易。", order.ID, order.GroupName))
+        return
+    }
+    log.Printf("自动创建交易群失败: %v\n", err)
+    // 手动交易的订单不绑定交易群，优惠码无法抵扣，带优惠码时不退回手动交易
+    if coupon.Code != "" {
+        msg.ReplyText(fmt.Sprintf("自动创建交易群失败：%v。优惠码只能在机器人创建的交易群中使用，请稍后重试，或不带优惠码发送“交易%d号”手动交易。", err, tradeItem.ID))
+        return
+    }
+    msg.ReplyText(fmt.Sprintf("自动创建交易群失败：%v，请按下面的提示手动交易。", err))
+
     replyMsg := fmt.Sprintf("开始交易%d号，名称：%s，价格：%.2f，描述：%s", tradeItem.ID, tradeItem.ItemName, tradeItem.Price, tradeItem.Description)
     msg.ReplyText(replyMsg)
-    // 如果有图片，也发送图片
-    if tradeItem.ImageFileName != "" {
+    // 发送交易品卡片，渲染失败时退回发送原图
+    if card, err := renderTradeItemCard(*tradeItem); err == nil {
+        if _, err := msg.ReplyImage(card); err != nil {
+            log.Printf("发送交易品卡片失败: %v\n", err)
+        }
+    } else if tradeItem.ImageFileName != "" {
+        log.Printf("渲染交易品卡片失败: %v\n", err)
         sendPicture(msg, tradeItem.ImageFileName)
     }
     msg.ReplyText("扫描上面二维码进群，复制上面的话到群中进行下一步交易")
@@ -736,7 +1179,7 @@ func handleSpecificTradeItem(msg *openwechat.Message, db *sql.DB) {
 func getUserTradeItems(db *sql.DB, seller string) ([]TradeItem, error) {
     var tradeItems []TradeItem
 
-    query := `SELECT id, item_name, description, price, quantity, image_file_name FROM trade_items WHERE seller = ? AND quantity > 0`
+    query := `SELECT id, buyers, item_name, description, price, quantity, image_file_name, status FROM trade_items WHERE seller = ? AND quantity > 0`
     rows, err := db.Query(query, seller)
     if err != nil {
         return nil, err
@@ -745,7 +1188,7 @@ func getUserTradeItems(db *sql.DB, seller string) ([]TradeItem, error) {
 
     for rows.Next() {
         var item TradeItem
-        if err := rows.Scan(&item.ID, &item.ItemName, &item.Description, &item.Price, &item.Quantity, &item.ImageFileName); err != nil {
+        if err := rows.Scan(&item.ID, &item.Buyers, &item.ItemName, &item.Description, &item.Price, &item.Quantity, &item.ImageFileName, &item.Status); err != nil {
             return nil, err
         }
         tradeItems = append(tradeItems, item)
@@ -758,20 +1201,12 @@ func getUserTradeItems(db *sql.DB, seller string) ([]TradeItem, error) {
     return tradeItems, nil
 }
 
-func getAvailableTradeItems(db *sql.DB, filter string) ([]TradeItem, error) {
+func getAvailableTradeItems(db *sql.DB, filter tradeItemFilter) ([]TradeItem, error) {
     var tradeItems []TradeItem
-    var query string
-    var rows *sql.Rows
-    var err error
-
-    if filter == "" {
-        query = `SELECT id, item_name, description, price, quantity, image_file_name FROM trade_items WHERE quantity > 0`
-        rows, err = db.Query(query)
-    } else {
-        query = `SELECT id, item_name, description, price, quantity, image_file_name FROM trade_items WHERE quantity > 0 AND item_name LIKE ?`
-        rows, err = db.Query(query, "%"+filter+"%")
-    }
 
+    where, args := tradeItemFilterSQL(filter)
+    query := `SELECT id, seller, item_name, description, price, quantity, image_file_name, category, tags, market_group FROM trade_items WHERE ` + where + ` ORDER BY id`
+    rows, err := db.Query(query, args...)
     if err != nil {
         return nil, err
     }
@@ -779,7 +1214,7 @@ func getAvailableTradeItems(db *sql.DB, filter string) ([]TradeItem, error) {
 
     for rows.Next() {
         var item TradeItem
-        if err := rows.Scan(&item.ID, &item.ItemName, &item.Description, &item.Price, &item.Quantity, &item.ImageFileName); err != nil {
+        if err := rows.Scan(&item.ID, &item.Seller, &item.ItemName, &item.Description, &item.Price, &item.Quantity, &item.ImageFileName, &item.Category, &item.Tags, &item.MarketGroup); err != nil {
             return nil, err
         }
         tradeItems = append(tradeItems, item)
@@ -795,9 +1230,9 @@ func getAvailableTradeItems(db *sql.DB, filter string) ([]TradeItem, error) {
 func getTradeItemByID(db *sql.DB, tradeItemID int) (*TradeItem, error) {
     var item TradeItem
 
-    query := `SELECT id, seller, item_name, description, price, quantity, image_file_name FROM trade_items WHERE id = ?`
+    query := `SELECT id, seller, item_name, description, price, quantity, image_file_name, category, tags, market_group, status, updated_at FROM trade_items WHERE id = ?`
     row := db.QueryRow(query, tradeItemID)
-    if err := row.Scan(&item.ID, &item.Seller, &item.ItemName, &item.Description, &item.Price, &item.Quantity, &item.ImageFileName); err != nil {
+    if err := row.Scan(&item.ID, &item.Seller, &item.ItemName, &item.Description, &item.Price, &item.Quantity, &item.ImageFileName, &item.Category, &item.Tags, &item.MarketGroup, &item.Status, &item.UpdatedAt); err != nil {
         if err == sql.ErrNoRows {
             return nil, nil // 没有找到指定的交易品
         }
@@ -820,18 +1255,32 @@ func sendPicture(msg *openwechat.Message, imageFileName string) error {
     return err
 }
 
-func insertTradeItem(db *sql.DB, seller, itemName, description string, price float64, quantity int) error {
+func insertTradeItem(db *sql.DB, seller, itemName, description string, price float64, quantity int, marketGroup string) error {
     // 定义插入SQL语句
-    insertStmt := `INSERT INTO trade_items (seller, buyers, group_id, item_name, description, price, quantity, image_file_name) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`
+    insertStmt := `INSERT INTO trade_items (seller, buyers, group_id, item_name, description, price, quantity, image_file_name, market_group, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, datetime('now'))`
+
+    tx, err := db.Begin()
+    if err != nil {
+        return err
+    }
+    defer tx.Rollback()
 
     // 执行插入操作
-    _, err := db.Exec(insertStmt, seller, "", "", itemName, description, price, quantity, "")
+    result, err := tx.Exec(insertStmt, seller, "", "", itemName, description, price, quantity, "", marketGroup)
     if err != nil {
         log.Printf("插入交易品失败: %v\n", err)
         return err // 返回错误信息
     }
-
-    return nil // 操作成功，返回nil
+    id, err := result.LastInsertId()
+    if err != nil {
+        return err
+    }
+    if err := emitEvent(tx, eventItemListed, map[string]interface{}{
+        "item_id": id, "seller": seller, "item_name": itemName, "price": price, "quantity": quantity, "market_group": marketGroup,
+    }); err != nil {
+        return err
+    }
+    return tx.Commit()
 }
 
 func savePicture(directory string, resp *http.Response) (string, error) {
@@ -867,7 +1316,7 @@ func getPendingTradeItem(db *sql.DB, seller string) (*TradeItem, error) {
     var tradeItem TradeItem
 
     // 假设您的数据库表中 "image_file_name" 为空表示未添加图片
-    query := `SELECT id, item_name FROM trade_items WHERE seller = ? AND image_file_name = '' LIMIT 1`
+    query := `SELECT id, item_name FROM trade_items WHERE seller = ? AND image_file_name = '' AND status = '在售' LIMIT 1`
     row := db.QueryRow(query, seller)
 
     if err := row.Scan(&tradeItem.ID, &tradeItem.ItemName); err != nil {
@@ -924,67 +1373,35 @@ func replyToUser(self *openwechat.Self, weChatUserName, content string) {
     }
 }
 
-func handleUserHistory(msg *openwechat.Message, db *sql.DB, weChatUser string) {
-    query := `
-    SELECT CreatedAt, StarCost, GameID, Stars, FinalRank, IsActive, OrderType
-    FROM Bridges
-    WHERE GroupUserNickName = ?
-    ORDER BY OrderType, CreatedAt DESC`
-    rows, err := db.Query(query, weChatUser)
+// 按昵称给好友发送私聊消息，数据库中的用户都以昵称记录
+func sendTextToNickName(self *openwechat.Self, nickName, content string) error {
+    friend, err := findFriendByNickName(self, nickName)
     if err != nil {
-        msg.ReplyText(fmt.Sprintf("获取历史记录时出错: %v", err))
-        return
-    }
-    defer rows.Close()
-    type OrderTypeStats struct {
-        TotalStarCost int
-        TotalStars    int
+        return err
     }
-    orderTypeStats := make(map[string]OrderTypeStats)
-    historyMessages := make(map[string][]string)
-    for rows.Next() {
-        var createdAt time.Time
-        var starCost, stars int
-        var gameID, finalRank, orderType string
-        var isActive bool
+    _, err = friend.SendText(content)
+    return err
+}
 
-        err := rows.Scan(&createdAt, &starCost, &gameID, &stars, &finalRank, &isActive, &orderType)
-        if err != nil {
-            log.Printf("读取历史记录时出错: %v\n", err)
-            continue
+// 私聊通知所有管理员
+func notifyAdmins(self *openwechat.Self, content string) {
+    for _, admin := range config.Admins {
+        if err := sendTextToNickName(self, admin, content); err != nil {
+            log.Printf("通知管理员 [%s] 失败: %v\n", admin, err)
         }
-        // 累计星卷和星数
-        stats := orderTypeStats[orderType]
-        stats.TotalStarCost += starCost
-        stats.TotalStars += stars
-        orderTypeStats[orderType] = stats
-        status := "已结束"
-        if isActive {
-            status = "正在进行中"
-        }
-
-        historyMessage := fmt.Sprintf("%s(使用%d星卷)\n%s--%d星[%s]$%s", createdAt.Format("2006-01-02 15:04:05"), starCost, gameID, stars, finalRank, status)
-        historyMessages[orderType] = append(historyMessages[orderType], historyMessage)
     }
+}
 
-    if len(historyMessages) == 0 {
-        msg.ReplyText("没有找到历史记录。")
-        return
+func findFriendByNickName(self *openwechat.Self, nickName string) (*openwechat.Friend, error) {
+    friends, err := self.Friends()
+    if err != nil {
+        return nil, fmt.Errorf("获取好友列表失败: %v", err)
     }
-    underline := strings.Repeat("—", 12)  // 设置下划线长度为80字符
-    var response strings.Builder
-    for orderType, messages := range historyMessages {
-        stats := orderTypeStats[orderType]
-        // 在每个订单类型的消息上方添加总计统计
-        response.WriteString(fmt.Sprintf("%s:\n♥♥总使用星卷: %d♥♥\n🚗🚗总摘星: %d🚗🚗\n", 
-                                         orderType, stats.TotalStarCost, stats.TotalStars))
-        for _, message := range messages {
-            response.WriteString(message + "\n")
-            response.WriteString(underline + "\n")  // 每条记录后添加设定长度的下划线
-        }
-        response.WriteString("\n") // 在每个订单类型之间添加额外的空行
+    friend := friends.SearchByNickName(1, nickName).First()
+    if friend == nil {
+        return nil, fmt.Errorf("未找到好友 [%s]", nickName)
     }
-    msg.ReplyText(response.String())
+    return friend, nil
 }
 
 func getCurrentEventFromDB(db *sql.DB) string {
@@ -997,29 +1414,145 @@ func getCurrentEventFromDB(db *sql.DB) string {
     return eventText
 }
 
-// 兑换充值码
-func redeemRechargeCode(db *sql.DB, code string) (float64, error) {
+var walletRechargeRe = regexp.MustCompile(`^钱包充值：(\d+)$`)
+
+// 处理 "钱包充值：[兑换码]"，群里发送时可参加本群的充值活动。首充和限额活动按机器人给的备注名认人
+func handleWalletRecharge(msg *openwechat.Message, db *sql.DB, self *openwechat.Self, sender *openwechat.User, group, code string) {
+    account := sender.NickName
+    amount, bonuses, balance, err := redeemRechargeCode(db, code, account, friendRemark(self, sender), group)
+    if err != nil {
+        msg.ReplyText(fmt.Sprintf("处理兑换码出错: %v", err))
+        return
+    }
+
+    bonusText := ""
+    for _, bonus := range bonuses {
+        bonusText += fmt.Sprintf("，%s %.2f 星卷", bonus.Name, bonus.Amount)
+    }
+    if bonusText != "" {
+        bonusText = "（另得" + strings.TrimPrefix(bonusText, "，") + "）"
+    }
+    msg.ReplyText(fmt.Sprintf("%s已充值 %.2f 星卷%s，钱包余额 %.2f 星卷，私聊机器人“开单”即可下上星订单。", account, amount, bonusText, balance))
+    checkTierChange(db, self, account)
+    notifyReferralReward(db, self, account)
+}
+
+// 普通群里用兑换码确认交易付款，只把兑换码标记为已使用，金额由买卖双方自行交易
+func confirmTradeTransfer(db *sql.DB, code, buyer, group string) (float64, error) {
+    tx, err := db.Begin()
+    if err != nil {
+        return 0, err
+    }
+    defer tx.Rollback()
+
     var amount float64
     var used int
-
-    // 查询充值码对应的金额和使用状态
-    err := db.QueryRow("SELECT amount, used FROM recharge_records WHERE recharge_code = ?", code).Scan(&amount, &used)
+    err = tx.QueryRow("SELECT amount, used FROM recharge_records WHERE recharge_code = ?", code).Scan(&amount, &used)
     if err != nil {
         if err == sql.ErrNoRows {
             return 0, fmt.Errorf("充值码不存在")
         }
         return 0, fmt.Errorf("查询充值码出错: %s", err)
     }
+    if err := rechargeCodeStatusError(used); err != nil {
+        return 0, err
+    }
 
-    if used != 0 {
+    result, err := tx.Exec("UPDATE recharge_records SET used = 1, used_at = datetime('now'), redeemed_by = ? WHERE recharge_code = ? AND used = 0", buyer, code)
+    if err != nil {
+        return 0, fmt.Errorf("更新充值码状态失败: %s", err)
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
         return 0, fmt.Errorf("充值码已被使用")
     }
+    if err := rewardReferral(tx, buyer, amount, code); err != nil {
+        return 0, fmt.Errorf("发放邀请奖励失败: %s", err)
+    }
+    if err := emitEvent(tx, eventCodeRedeemed, map[string]interface{}{
+        "code": code, "amount": amount, "redeemer": buyer, "group": group,
+    }); err != nil {
+        return 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, err
+    }
+    return amount, nil
+}
 
-    // 将充值码标记为已使用
-    _, err = db.Exec("UPDATE recharge_records SET used = 1 WHERE recharge_code = ?", code)
+// 兑换充值码，金额按 1 元 1 星卷记入兑换人的钱包，会员等级奖励和充值活动赠送一并到账。
+// member 是机器人给兑换人的备注名，没有时为空，首充和有每人上限的活动不赠送
+func redeemRechargeCode(db *sql.DB, code, account, member, group string) (float64, []rechargeBonus, float64, error) {
+    var amount float64
+    var used int
+
+    tx, err := db.Begin()
     if err != nil {
-        return 0, fmt.Errorf("更新充值码状态失败: %s", err)
+        return 0, nil, 0, err
     }
+    defer tx.Rollback()
 
-    return amount, nil
+    // 查询充值码对应的金额和使用状态
+    err = tx.QueryRow("SELECT amount, used FROM recharge_records WHERE recharge_code = ?", code).Scan(&amount, &used)
+    if err != nil {
+        if err == sql.ErrNoRows {
+            return 0, nil, 0, fmt.Errorf("充值码不存在")
+        }
+        return 0, nil, 0, fmt.Errorf("查询充值码出错: %s", err)
+    }
+
+    if err := rechargeCodeStatusError(used); err != nil {
+        return 0, nil, 0, err
+    }
+    // 奖励按兑换前的等级计算
+    spent, err := memberSpent(tx, account)
+    if err != nil {
+        return 0, nil, 0, err
+    }
+
+    // 将充值码标记为已使用，退款申请可能同时冻结了该兑换码
+    firstRecharge, err := isFirstRecharge(tx, spent, member)
+    if err != nil {
+        return 0, nil, 0, err
+    }
+    result, err := tx.Exec("UPDATE recharge_records SET used = 1, used_at = datetime('now'), redeemed_by = ?, redeemer_remark = ? WHERE recharge_code = ? AND used = 0", account, member, code)
+    if err != nil {
+        return 0, nil, 0, fmt.Errorf("更新充值码状态失败: %s", err)
+    }
+    if n, _ := result.RowsAffected(); n == 0 {
+        return 0, nil, 0, fmt.Errorf("充值码已被使用")
+    }
+    balance, err := postWalletEntry(tx, account, amount, "兑换码充值", "recharge_code", 0, "兑换码"+code)
+    if err != nil {
+        return 0, nil, 0, fmt.Errorf("充值到钱包失败: %s", err)
+    }
+    var bonuses []rechargeBonus
+    tierBonus, err := postTierBonus(tx, account, amount, spent, code)
+    if err != nil {
+        return 0, nil, 0, fmt.Errorf("发放等级奖励失败: %s", err)
+    }
+    if tierBonus > 0 {
+        bonuses = append(bonuses, rechargeBonus{Name: tierForSpent(spent).Name + "奖励", Amount: tierBonus})
+    }
+    promotionBonuses, err := applyPromotions(tx, account, member, group, amount, code, firstRecharge)
+    if err != nil {
+        return 0, nil, 0, fmt.Errorf("发放活动赠送失败: %s", err)
+    }
+    bonuses = append(bonuses, promotionBonuses...)
+    // 邀请奖励发给邀请人，不计入兑换人的余额
+    if err := rewardReferral(tx, account, amount, code); err != nil {
+        return 0, nil, 0, fmt.Errorf("发放邀请奖励失败: %s", err)
+    }
+    if err := emitEvent(tx, eventCodeRedeemed, map[string]interface{}{
+        "code": code, "amount": amount, "redeemer": account, "group": group,
+    }); err != nil {
+        return 0, nil, 0, err
+    }
+    if err := tx.Commit(); err != nil {
+        return 0, nil, 0, err
+    }
+
+    for _, bonus := range bonuses {
+        balance += bonus.Amount
+    }
+    return amount, bonuses, roundCents(balance), nil
 }
\ No newline at end of file
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+)
+
+// 每个测试用一个临时数据库文件，表结构和线上一致
+func newTestDB(t *testing.T) *sql.DB {
+	t.Helper()
+	db, err := sql.Open("sqlite3", filepath.Join(t.TempDir(), "star_journal.db"))
+	if err != nil {
+		t.Fatalf("打开测试数据库失败: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	initSchema(db)
+	return db
+}
+
+// 上架一个交易品，返回带ID的交易品
+func addTestTradeItem(t *testing.T, db *sql.DB, seller string, price float64, quantity int) *TradeItem {
+	t.Helper()
+	result, err := db.Exec(`INSERT INTO trade_items (seller, buyers, group_id, item_name, description, price, quantity, image_file_name, updated_at) VALUES (?, '', '', '测试交易品', '', ?, ?, '', datetime('now'))`,
+		seller, price, quantity)
+	if err != nil {
+		t.Fatalf("上架交易品失败: %v", err)
+	}
+	id, _ := result.LastInsertId()
+	item, err := getTradeItemByID(db, int(id))
+	if err != nil || item == nil {
+		t.Fatalf("读取交易品失败: %v", err)
+	}
+	return item
+}
+
+// 生成一个未使用的兑换码
+func addTestRechargeCode(t *testing.T, db *sql.DB, code string, amount float64) {
+	t.Helper()
+	if _, err := db.Exec(`INSERT INTO recharge_records (amount, recharge_code) VALUES (?, ?)`, amount, code); err != nil {
+		t.Fatalf("生成兑换码失败: %v", err)
+	}
+}
+
+func TestTradeTransferDoesNotCreditWallet(t *testing.T) {
+	db := newTestDB(t)
+	addTestRechargeCode(t, db, "111111", 30)
+
+	amount, err := confirmTradeTransfer(db, "111111", "买家", "交易群")
+	if err != nil || amount != 30 {
+		t.Fatalf("确认付款失败: %.2f %v", amount, err)
+	}
+	if balance, _ := getWalletBalance(db, "买家"); balance != 0 {
+		t.Fatalf("交易付款不应进钱包，余额为%.2f", balance)
+	}
+	if _, _, _, err := redeemRechargeCode(db, "111111", "买家", "", ""); err == nil {
+		t.Fatal("已用于付款的兑换码不能再存入钱包")
+	}
+
+	addTestRechargeCode(t, db, "222222", 50)
+	if _, _, balance, err := redeemRechargeCode(db, "222222", "买家", "", ""); err != nil || balance < 50 {
+		t.Fatalf("钱包充值失败: %.2f %v", balance, err)
+	}
+}
+
+// “充值N”只补发本人转账得到的兑换码
+func TestRechargeCodeByAmountOnlyForPayer(t *testing.T) {
+	db := newTestDB(t)
+	addTestRechargeCode(t, db, "4001", 50)
+	addTestRechargeCode(t, db, "4002", 50)
+	db.Exec(`UPDATE recharge_records SET payer = '付款人' WHERE recharge_code = '4002'`)
+
+	if code, err := getRechargeCodeByAmount(db, 50, "付款人"); err != nil || code != "4002" {
+		t.Fatalf("应补发付款人自己的兑换码: %s %v", code, err)
+	}
+	if code, err := getRechargeCodeByAmount(db, 50, "路人"); err == nil {
+		t.Fatalf("不应把别人的或没有付款人的兑换码发给路人，得到%s", code)
+	}
+	if _, err := getRechargeCodeByAmount(db, 50, ""); err == nil {
+		t.Fatal("没有昵称时不应补发")
+	}
+}